@@ -0,0 +1,87 @@
+package main
+
+import (
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/salt"
+	"diploma/analytics-exporter/internal/sites"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// reportDryRun initializes the components which don't start background work,
+// binds the listeners and prints what would run.
+func (c *cli) reportDryRun(db database.Database) error {
+	if problems := c.validate(); len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	if db == nil {
+		return errors.New("no database backend is configured")
+	}
+	if _, err := salt.New(c.salt); err != nil {
+		return fmt.Errorf("cannot create salt: %w", err)
+	}
+	statsCache, err := prometheus.NewStatsCache(db, time.Duration(c.metricsTimeout)*time.Second, sites.NewRegistry(c.sites))
+	if err != nil {
+		return fmt.Errorf("cannot create the stats cache: %w", err)
+	}
+	if _, err := prometheus.NewPrometheus(statsCache, c.listenAddr(c.cfg.mAddr, c.cfg.mPort), c.sites.Keys(), sites.NewRegistry(c.sites), c.autoDomains); err != nil {
+		return fmt.Errorf("cannot create the prometheus instance: %w", err)
+	}
+	for _, lis := range c.listeners() {
+		l, err := net.Listen("tcp", lis.addr)
+		if err != nil {
+			return fmt.Errorf("cannot listen on the %s address: %w", lis.name, err)
+		}
+		_ = l.Close()
+	}
+
+	w := os.Stdout
+	backend := "memdb"
+	if !c.useMemDB {
+		backend = fmt.Sprintf("%T", db)
+	}
+	fmt.Fprintln(w, "backend:", backend)
+	fmt.Fprintln(w, "domains:", strings.Join(c.domains, ", "))
+	for _, lis := range c.listeners() {
+		fmt.Fprintf(w, "%s: %s\n", lis.name, lis.addr)
+	}
+	if c.cfg.singlePort {
+		fmt.Fprintln(w, "single port: gRPC and metrics are served by the gateway")
+	}
+	fmt.Fprintln(w, "gateway TLS:", c.cfg.gwTLS.Enabled())
+	if c.ingestAsync {
+		fmt.Fprintf(w, "ingest: async, %d workers, queue of %d\n", c.ingest.Workers, c.ingest.QueueSize)
+	} else {
+		fmt.Fprintln(w, "ingest: sync")
+	}
+	if c.rollupInterval > 0 {
+		fmt.Fprintln(w, "rollups: every", c.rollupInterval)
+	}
+	if c.archiveURL != "" {
+		fmt.Fprintf(w, "archive: %s after %s, every %s\n", c.archiveURL, c.archiveAfter, c.archiveInterval)
+	}
+	if len(c.peers) > 0 {
+		fmt.Fprintln(w, "replication peers:", strings.Join(c.peers, ", "))
+	}
+	if len(c.kafkaBrokers) > 0 {
+		fmt.Fprintf(w, "kafka: %s to topic %s\n", strings.Join(c.kafkaBrokers, ", "), c.kafkaTopic)
+	}
+	if c.webhooksConfig != "" {
+		fmt.Fprintln(w, "webhooks:", c.webhooksConfig)
+	}
+	if c.amqpURL != "" {
+		fmt.Fprintln(w, "amqp queue:", c.amqpQueue)
+	}
+	if c.mqtt.Broker != "" {
+		fmt.Fprintln(w, "mqtt:", c.mqtt.Broker)
+	}
+	if c.mockData {
+		fmt.Fprintln(w, "mock data: enabled")
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"diploma/analytics-exporter/internal/grpcwrap"
+	analyticsApi "diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// exporter holds the export settings.
+type exporter struct {
+	target string
+	tls    bool
+	apiKey string
+	direct bool
+	domain string
+	from   string
+	to     string
+	format string
+	output string
+}
+
+// newExportCmd returns the command dumping the events of a running instance or of the database.
+func newExportCmd(c *cli) *cobra.Command {
+	ex := exporter{}
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Dump events of a domain from a running instance to JSONL or CSV",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if ex.direct {
+				if err := c.setupConfig(cmd, args); err != nil {
+					return err
+				}
+			}
+			return ex.run(cmd, c)
+		},
+	}
+
+	cmd.Flags().StringVar(&ex.target, "target", "localhost:9090", "gRPC address of the source instance")
+	cmd.Flags().BoolVar(&ex.tls, "tls", false, "Connect to the source instance over TLS")
+	cmd.Flags().StringVar(&ex.apiKey, "api-key", "", "Token of the site granting the owner role, required by the multi-tenant instances")
+	cmd.Flags().BoolVar(&ex.direct, "direct", false, "Export directly from the configured database instead of a running instance")
+	cmd.Flags().StringVar(&ex.domain, "domain", "", "Domain to export the events of")
+	cmd.Flags().StringVar(&ex.from, "from", "", "Start of the time range, RFC 3339 timestamp or date (unbounded if empty)")
+	cmd.Flags().StringVar(&ex.to, "to", "", "Exclusive end of the time range, RFC 3339 timestamp or date (unbounded if empty)")
+	cmd.Flags().StringVar(&ex.format, "format", "jsonl", "Output format: jsonl or csv")
+	cmd.Flags().StringVarP(&ex.output, "output", "o", "-", "Output file (- for stdout)")
+
+	return cmd
+}
+
+func (ex *exporter) run(cmd *cobra.Command, c *cli) error {
+	if ex.domain == "" {
+		return errors.New("the domain is missing")
+	}
+	if ex.format != "jsonl" && ex.format != "csv" {
+		return fmt.Errorf("unsupported format %q", ex.format)
+	}
+
+	req := &analyticsApi.ExportEventsRequest{Domain: ex.domain}
+	if ex.from != "" {
+		from, err := parseTimeFlag(ex.from)
+		if err != nil {
+			return fmt.Errorf("invalid from: %w", err)
+		}
+		req.From = timestamppb.New(from)
+	}
+	if ex.to != "" {
+		to, err := parseTimeFlag(ex.to)
+		if err != nil {
+			return fmt.Errorf("invalid to: %w", err)
+		}
+		req.To = timestamppb.New(to)
+	}
+
+	forEach, closeSource, err := ex.openSource(cmd.Context(), c, req)
+	if err != nil {
+		return err
+	}
+	defer closeSource()
+
+	out := os.Stdout
+	if ex.output != "-" {
+		if out, err = os.Create(ex.output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	write := ex.newWriter(w)
+
+	count := 0
+	err = forEach(func(e *analyticsApi.Event) error {
+		count++
+		return write(e)
+	})
+	if err != nil {
+		return err
+	}
+	if err = write(nil); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d events\n", count)
+	return nil
+}
+
+// openSource returns the function iterating over the requested events of the running instance
+// or of the database, and the function closing the source.
+func (ex *exporter) openSource(ctx context.Context, c *cli, req *analyticsApi.ExportEventsRequest) (func(fn func(e *analyticsApi.Event) error) error, func(), error) {
+	if ex.direct {
+		db, err := openDirectDatabase(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		site, err := directSiteKey(ctx, c, db, req.GetDomain())
+		if err != nil {
+			return nil, nil, err
+		}
+		var from, to time.Time
+		if req.GetFrom() != nil {
+			from = req.GetFrom().AsTime()
+		}
+		if req.GetTo() != nil {
+			to = req.GetTo().AsTime()
+		}
+		return func(fn func(e *analyticsApi.Event) error) error {
+			return db.ForEach(ctx, site, from, to, fn)
+		}, func() {}, nil
+	}
+
+	conn, err := grpcwrap.NewClientConn(ex.target, ex.tls, grpcwrap.WithAPIKey(ex.apiKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	stream, err := analyticsApi.NewAnalyticsClient(conn).ExportEvents(ctx, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return func(fn func(e *analyticsApi.Event) error) error {
+		for {
+			e, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = fn(e); err != nil {
+				return err
+			}
+		}
+	}, func() { _ = conn.Close() }, nil
+}
+
+// csvColumns are the columns of the CSV export.
+var csvColumns = []string{"id", "timestamp", "type", "domain", "url", "referrer", "browser", "os", "device", "hashed_visit", "props", "trace_id"}
+
+// newWriter returns the function writing an event in the configured format, a nil event flushes the output.
+func (ex *exporter) newWriter(w io.Writer) func(e *analyticsApi.Event) error {
+	if ex.format == "jsonl" {
+		return func(e *analyticsApi.Event) error {
+			if e == nil {
+				return nil
+			}
+			b, err := protojson.Marshal(e)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(append(b, '\n'))
+			return err
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	header := false
+	return func(e *analyticsApi.Event) error {
+		if !header {
+			if err := cw.Write(csvColumns); err != nil {
+				return err
+			}
+			header = true
+		}
+		if e == nil {
+			cw.Flush()
+			return cw.Error()
+		}
+
+		props := make([]string, 0, len(e.GetProps()))
+		for k, v := range e.GetProps() {
+			props = append(props, k+"="+v)
+		}
+		return cw.Write([]string{
+			e.GetID(),
+			e.GetTimestamp().AsTime().Format(time.RFC3339Nano),
+			e.GetType(),
+			e.GetDomain(),
+			e.GetURL(),
+			e.GetReferrer(),
+			e.GetBrowser(),
+			e.GetOS(),
+			deviceName(e.GetDevice()),
+			e.GetHashedVisit(),
+			strings.Join(props, ";"),
+			e.GetTraceID(),
+		})
+	}
+}
+
+// deviceName returns the name of the device type.
+func deviceName(d *analyticsApi.Device) string {
+	switch {
+	case d.GetDesktop():
+		return "Desktop"
+	case d.GetMobile():
+		return "Mobile"
+	case d.GetTablet():
+		return "Tablet"
+	case d.GetBot():
+		return "Bot"
+	default:
+		return "Unknown"
+	}
+}
+
+// parseTimeFlag parses the RFC 3339 timestamp or the date in UTC.
+func parseTimeFlag(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
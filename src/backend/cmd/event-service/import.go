@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/grpcwrap"
+	"diploma/analytics-exporter/internal/importer"
+	"diploma/analytics-exporter/internal/sites"
+	analyticsApi "diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// importChunkSize is an approximate size of the file part imported at once, below the gRPC message limit.
+const importChunkSize = 1 << 20
+
+// importRunner holds the import settings.
+type importRunner struct {
+	target string
+	tls    bool
+	apiKey string
+	direct bool
+	domain string
+	source string
+
+	// site is the key the data is stored under by the direct import
+	site sites.Key
+	// location is the timezone of the site the days of the direct import are rolled up in
+	location *time.Location
+	// settings are the stats settings of the site the rollups of the direct import are calculated with
+	settings sites.StatsSettings
+
+	// importChunk imports a part of the file with the whole rows
+	importChunk func(ctx context.Context, name string, content []byte) (events int64, rollups int64, err error)
+}
+
+// newImportCmd returns the command importing the data exported from other analytics
+// or from the export command into a running instance or directly into the database.
+func newImportCmd(c *cli) *cobra.Command {
+	im := importRunner{}
+	cmd := &cobra.Command{
+		Use:   "import [flags] file...",
+		Short: "Import Plausible, Google Analytics or Matomo exports or JSONL dumps",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, files []string) error {
+			if im.direct {
+				if err := c.setupConfig(cmd, files); err != nil {
+					return err
+				}
+				db, err := openDirectDatabase(c)
+				if err != nil {
+					return err
+				}
+				registry, err := directSites(cmd.Context(), c, db)
+				if err != nil {
+					return err
+				}
+				im.site, im.location = registry.Key(im.domain), registry.Location(im.domain)
+				im.settings = registry.StatsSettings(im.domain)
+				im.importChunk = im.storeChunk(db)
+			} else {
+				conn, err := grpcwrap.NewClientConn(im.target, im.tls, grpcwrap.WithAPIKey(im.apiKey))
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				im.importChunk = im.sendChunk(analyticsApi.NewAnalyticsClient(conn))
+			}
+			return im.run(cmd.Context(), files)
+		},
+	}
+
+	cmd.Flags().StringVar(&im.target, "target", "localhost:9090", "gRPC address of the target instance")
+	cmd.Flags().BoolVar(&im.tls, "tls", false, "Connect to the target instance over TLS")
+	cmd.Flags().StringVar(&im.apiKey, "api-key", "", "Token of the site granting the owner role, required by the multi-tenant instances")
+	cmd.Flags().BoolVar(&im.direct, "direct", false, "Import directly into the configured database instead of a running instance")
+	cmd.Flags().StringVar(&im.domain, "domain", "", "Domain to import the data for")
+	cmd.Flags().StringVar(&im.source, "source", "plausible", "Format of the files: plausible or ga CSV exports, matomo visits or database dumps, or jsonl dumps of the export command")
+
+	return cmd
+}
+
+// openDirectDatabase returns the configured database for the direct import and export.
+//
+// The in-memory database lives only in the serving process, so it cannot be accessed directly.
+func openDirectDatabase(c *cli) (database.Database, error) {
+	if c.useMemDB {
+		return nil, errors.New("the in-memory database is local to the serving process, import and export it through a running instance")
+	}
+	db, err := database.NewDatabase(c.useMemDB)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create db client: %w", err)
+	}
+	if db == nil {
+		return nil, errors.New("no database backend is configured")
+	}
+	return db, nil
+}
+
+// directSiteKey returns the key the data of the domain is stored under in the database,
+// resolving its tenant by the configured and the managed sites.
+func directSiteKey(ctx context.Context, c *cli, db database.Database, domain string) (sites.Key, error) {
+	registry, err := directSites(ctx, c, db)
+	if err != nil {
+		return sites.Key{}, err
+	}
+	return registry.Key(domain), nil
+}
+
+// directSites returns the registry of the configured and the managed sites for the direct import and export.
+func directSites(ctx context.Context, c *cli, db database.Database) (*sites.Registry, error) {
+	base := sites.FromDomains(nil)
+	if c.sitesConfig != "" {
+		cfg, err := sites.LoadConfig(c.sitesConfig)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load sites config: %w", err)
+		}
+		base = cfg
+	}
+	managed, err := db.ListSites(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list sites: %w", err)
+	}
+	return sites.NewRegistry(sites.Merge(base, managed)), nil
+}
+
+// sendChunk returns the function importing the chunks into the running instance.
+func (im *importRunner) sendChunk(client analyticsApi.AnalyticsClient) func(ctx context.Context, name string, content []byte) (int64, int64, error) {
+	return func(ctx context.Context, name string, content []byte) (int64, int64, error) {
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+		resp, err := client.Import(ctx, &analyticsApi.ImportRequest{
+			Domain:  im.domain,
+			Source:  im.source,
+			Name:    name,
+			Content: content,
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+		return resp.GetEvents(), resp.GetRollups(), nil
+	}
+}
+
+// storeChunk returns the function importing the chunks directly into the database.
+func (im *importRunner) storeChunk(db database.Database) func(ctx context.Context, name string, content []byte) (int64, int64, error) {
+	return func(ctx context.Context, name string, content []byte) (int64, int64, error) {
+		res, err := importer.Parse(importer.Source(im.source), im.domain, name, bytes.NewReader(content))
+		if err != nil {
+			return 0, 0, err
+		}
+		rollups, err := importer.Store(ctx, db, im.site, im.location, im.settings, res)
+		if err != nil {
+			return 0, 0, err
+		}
+		return int64(len(res.Events)), int64(rollups), nil
+	}
+}
+
+func (im *importRunner) run(ctx context.Context, files []string) error {
+	if im.domain == "" {
+		return errors.New("the domain is missing")
+	}
+
+	for _, file := range files {
+		importFile := im.importCSV
+		switch importer.Source(im.source) {
+		case importer.SourceJSONL:
+			importFile = im.importJSONL
+		case importer.SourceMatomo:
+			importFile = im.importMatomo
+		}
+		events, rollups, err := importFile(ctx, file)
+		if err != nil {
+			return fmt.Errorf("cannot import %s: %w", file, err)
+		}
+		fmt.Printf("%s: %d events, %d rollups\n", file, events, rollups)
+	}
+	return nil
+}
+
+// importMatomo imports the Matomo file, which is a JSON array or JSONL of the visits or a CSV dump.
+//
+// The visits of the array are split into chunks of whole visits as JSONL.
+func (im *importRunner) importMatomo(ctx context.Context, file string) (events int64, rollups int64, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch first[0] {
+	case '{':
+		return im.importJSONL(ctx, file)
+	case '[':
+	default:
+		return im.importCSV(ctx, file)
+	}
+
+	var buf bytes.Buffer
+	flush := func() error {
+		chunkEvents, chunkRollups, err := im.importChunk(ctx, filepath.Base(file), buf.Bytes())
+		if err != nil {
+			return err
+		}
+		events += chunkEvents
+		rollups += chunkRollups
+		buf.Reset()
+		return nil
+	}
+
+	dec := json.NewDecoder(reader)
+	if _, err = dec.Token(); err != nil {
+		return 0, 0, err
+	}
+	for dec.More() {
+		var visit json.RawMessage
+		if err = dec.Decode(&visit); err != nil {
+			return 0, 0, err
+		}
+		if err = json.Compact(&buf, visit); err != nil {
+			return 0, 0, err
+		}
+		buf.WriteByte('\n')
+		if buf.Len() >= importChunkSize {
+			if err = flush(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if buf.Len() > 0 {
+		if err = flush(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return events, rollups, nil
+}
+
+// importJSONL imports the file split into chunks of whole lines.
+func (im *importRunner) importJSONL(ctx context.Context, file string) (events int64, rollups int64, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	flush := func() error {
+		chunkEvents, chunkRollups, err := im.importChunk(ctx, filepath.Base(file), buf.Bytes())
+		if err != nil {
+			return err
+		}
+		events += chunkEvents
+		rollups += chunkRollups
+		buf.Reset()
+		return nil
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		buf.Write(line)
+		if buf.Len() >= importChunkSize || (errors.Is(err, io.EOF) && buf.Len() > 0) {
+			if err := flush(); err != nil {
+				return 0, 0, err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return events, rollups, nil
+}
+
+// importCSV imports the file split into chunks of whole rows, each with the header.
+func (im *importRunner) importCSV(ctx context.Context, file string) (events int64, rollups int64, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	flush := func() error {
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+		chunkEvents, chunkRollups, err := im.importChunk(ctx, filepath.Base(file), buf.Bytes())
+		if err != nil {
+			return err
+		}
+		events += chunkEvents
+		rollups += chunkRollups
+		buf.Reset()
+		return nil
+	}
+
+	rows := 0
+	for {
+		if rows == 0 {
+			if err = writer.Write(header); err != nil {
+				return 0, 0, err
+			}
+		}
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if err = writer.Write(row); err != nil {
+			return 0, 0, err
+		}
+		rows++
+
+		if buf.Len() >= importChunkSize {
+			if err = flush(); err != nil {
+				return 0, 0, err
+			}
+			rows = 0
+		}
+	}
+	if rows > 0 {
+		if err = flush(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return events, rollups, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"diploma/analytics-exporter/internal/grpcwrap"
+	"diploma/analytics-exporter/internal/mock"
+	analyticsApi "diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/metadata"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// loadgen holds the load generator settings.
+type loadgen struct {
+	target      string
+	protocol    string
+	rate        int
+	duration    time.Duration
+	concurrency int
+	domains     []string
+	visitors    int
+	pages       int
+}
+
+// newLoadgenCmd returns the command firing generated events at a running instance.
+func newLoadgenCmd() *cobra.Command {
+	lg := loadgen{}
+	cmd := &cobra.Command{
+		Use:   "loadgen",
+		Short: "Send generated events to a running instance at a fixed rate",
+		RunE:  lg.run,
+	}
+
+	cmd.Flags().StringVar(&lg.target, "target", "localhost:9090", "Address of the target instance (host:port for grpc, base URL for http)")
+	cmd.Flags().StringVar(&lg.protocol, "protocol", "grpc", "Protocol to send events with: grpc or http")
+	cmd.Flags().IntVar(&lg.rate, "rate", 100, "Events per second")
+	cmd.Flags().DurationVar(&lg.duration, "duration", time.Minute, "Duration of the load (0 to run until interrupted)")
+	cmd.Flags().IntVar(&lg.concurrency, "concurrency", 16, "Number of concurrent senders")
+	cmd.Flags().StringSliceVar(&lg.domains, "domains", []string{"loadgen.example.com"}, "Domains to send events for")
+	cmd.Flags().IntVar(&lg.visitors, "visitors", 1000, "Number of distinct generated visitors")
+	cmd.Flags().IntVar(&lg.pages, "pages", 50, "Number of distinct pages per domain")
+
+	return cmd
+}
+
+// sender sends a single event on behalf of the visitor.
+type sender func(ctx context.Context, e *analyticsApi.Event, ip string, userAgent string) error
+
+func (lg *loadgen) run(_ *cobra.Command, _ []string) error {
+	if lg.rate <= 0 || lg.concurrency <= 0 || lg.visitors <= 0 || lg.pages <= 0 {
+		return errors.New("rate, concurrency, visitors and pages must be positive")
+	}
+	if len(lg.domains) == 0 {
+		return errors.New("the domain list is empty")
+	}
+
+	send, err := lg.newSender()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if lg.duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, lg.duration)
+		defer cancel()
+	}
+
+	var sent, failed atomic.Int64
+	var latencyMutex sync.Mutex
+	latencies := make([]time.Duration, 0)
+
+	// Senders pick up the events produced at the configured rate
+	events := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < lg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+			pageZipf := rand.NewZipf(rnd, 1.2, 1, uint64(lg.pages-1))
+			visitorZipf := rand.NewZipf(rnd, 1.1, 1, uint64(lg.visitors-1))
+			uaZipf := rand.NewZipf(rnd, 1.5, 1, uint64(len(mock.UserAgents)-1))
+			for range events {
+				visitor := visitorZipf.Uint64()
+				domain := lg.domains[visitor%uint64(len(lg.domains))]
+				e := &analyticsApi.Event{
+					Type:     "pageview",
+					Domain:   domain,
+					URL:      "https://" + domain + "/page/" + strconv.FormatUint(pageZipf.Uint64(), 10),
+					Referrer: mock.Referrers[rnd.Intn(len(mock.Referrers))],
+				}
+				ip := fmt.Sprintf("10.%d.%d.%d", visitor>>16&0xff, visitor>>8&0xff, visitor&0xff)
+				userAgent := mock.UserAgents[(visitor+uaZipf.Uint64())%uint64(len(mock.UserAgents))]
+
+				start := time.Now()
+				if err := send(ctx, e, ip, userAgent); err != nil {
+					failed.Add(1)
+					continue
+				}
+				sent.Add(1)
+				latencyMutex.Lock()
+				latencies = append(latencies, time.Since(start))
+				latencyMutex.Unlock()
+			}
+		}()
+	}
+
+	fmt.Fprintf(os.Stderr, "Sending %d events/s to %s over %s\n", lg.rate, lg.target, lg.protocol)
+	ticker := time.NewTicker(time.Second / time.Duration(lg.rate))
+	defer ticker.Stop()
+	progress := time.NewTicker(time.Second)
+	defer progress.Stop()
+	started := time.Now()
+produce:
+	for {
+		select {
+		case <-ctx.Done():
+			break produce
+		case <-progress.C:
+			fmt.Fprintf(os.Stderr, "sent: %d, failed: %d\n", sent.Load(), failed.Load())
+		case <-ticker.C:
+			select {
+			case events <- 0:
+			case <-ctx.Done():
+				break produce
+			}
+		}
+	}
+	close(events)
+	wg.Wait()
+
+	// Report the results
+	elapsed := time.Since(started)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(float64(len(latencies)-1)*p)]
+	}
+	fmt.Printf("duration: %s\nsent: %d\nfailed: %d\nthroughput: %.1f events/s\nlatency p50: %s\nlatency p90: %s\nlatency p99: %s\n",
+		elapsed.Round(time.Millisecond), sent.Load(), failed.Load(), float64(sent.Load())/elapsed.Seconds(),
+		percentile(0.5), percentile(0.9), percentile(0.99))
+
+	return nil
+}
+
+// newSender returns sender of the configured protocol.
+func (lg *loadgen) newSender() (sender, error) {
+	switch lg.protocol {
+	case "grpc":
+		conn, err := grpcwrap.NewClientConn(lg.target, false)
+		if err != nil {
+			return nil, err
+		}
+		client := analyticsApi.NewAnalyticsClient(conn)
+		return func(ctx context.Context, e *analyticsApi.Event, ip string, userAgent string) error {
+			// Mimic the metadata set by the gateway
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", ip, "grpcgateway-user-agent", userAgent)
+			_, err := client.CreateEvent(ctx, e)
+			return err
+		}, nil
+	case "http":
+		client := &http.Client{Timeout: 10 * time.Second}
+		return func(ctx context.Context, e *analyticsApi.Event, ip string, userAgent string) error {
+			body, err := json.Marshal(map[string]string{
+				"type":     e.GetType(),
+				"url":      e.GetURL(),
+				"domain":   e.GetDomain(),
+				"referrer": e.GetReferrer(),
+			})
+			if err != nil {
+				return err
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, lg.target+"/api/event", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("User-Agent", userAgent)
+			req.Header.Set("X-Forwarded-For", ip)
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected status %s", resp.Status)
+			}
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", lg.protocol)
+	}
+}
@@ -2,40 +2,157 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
+	cryptoRand "crypto/rand"
+	"diploma/analytics-exporter/internal/admin"
+	"diploma/analytics-exporter/internal/alert"
+	"diploma/analytics-exporter/internal/amqp"
 	"diploma/analytics-exporter/internal/analytics"
+	"diploma/analytics-exporter/internal/archive"
+	"diploma/analytics-exporter/internal/arrow"
 	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/features"
+	"diploma/analytics-exporter/internal/graphql"
 	"diploma/analytics-exporter/internal/grpcwrap"
+	"diploma/analytics-exporter/internal/handoff"
+	"diploma/analytics-exporter/internal/ingest"
+	"diploma/analytics-exporter/internal/kafka"
+	"diploma/analytics-exporter/internal/leader"
+	"diploma/analytics-exporter/internal/live"
+	"diploma/analytics-exporter/internal/logging"
+	"diploma/analytics-exporter/internal/mock"
+	"diploma/analytics-exporter/internal/mqtt"
+	"diploma/analytics-exporter/internal/oidc"
+	"diploma/analytics-exporter/internal/plausible"
 	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/pubsub"
+	"diploma/analytics-exporter/internal/readiness"
+	"diploma/analytics-exporter/internal/replication"
+	"diploma/analytics-exporter/internal/report"
+	"diploma/analytics-exporter/internal/retention"
+	"diploma/analytics-exporter/internal/rollup"
+	"diploma/analytics-exporter/internal/salt"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/internal/usage"
+	"diploma/analytics-exporter/internal/version"
+	"diploma/analytics-exporter/internal/webhook"
+	"diploma/analytics-exporter/internal/widget"
 	analyticsApi "diploma/analytics-exporter/pkg/api/analytics"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
-	"google.golang.org/protobuf/types/known/timestamppb"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// envPrefix is a prefix of the environment variables overriding the configuration,
+// e.g. ANALYTICS_RPC_PORT sets rpc-port.
+const envPrefix = "ANALYTICS"
+
+// leaderElectionKubernetes is the lock of the leader election by the Lease object of the pod namespace.
+const leaderElectionKubernetes = "kubernetes"
+
 // Configuration keys as constants
 const (
+	configKeyConfig         string = "config"
 	configKeyBindAddr       string = "bind-addr"
 	configKeyDebug          string = "debug"
+	configKeyLogLevel       string = "log-level"
+	configKeyLogFormat      string = "log-format"
+	configKeyLogFile        string = "log-file"
+	configKeyLogMaxSize     string = "log-max-size"
+	configKeyLogMaxAge      string = "log-max-age"
+	configKeyLogMaxBackups  string = "log-max-backups"
+	configKeyLogComponents  string = "log-levels"
 	configKeyMock           string = "mock"
+	configKeyMockSeed       string = "mock-seed"
+	configKeyDryRun         string = "dry-run"
+	configKeyFeatures       string = "features"
 	configKeyGRPCPort       string = "rpc-port"
+	configKeyGRPCAddr       string = "grpc-addr"
+	configKeyGWAddr         string = "gw-addr"
+	configKeyMAddr          string = "metrics-addr"
 	configKeyGWPort         string = "gw-port"
 	configKeyMPort          string = "metric-port"
 	configKeyUseMemDB       string = "use-memdb"
 	configKeyMetricsTimeout string = "metric-timeout"
 	configKeyDomains        string = "domains"
+	configKeyAutoDomains    string = "auto-domains"
+	configKeySites          string = "sites-config"
+	configKeyAdminToken     string = "admin-token"
+	configKeyLinkSecret     string = "shared-link-secret"
+	configKeySaltLifetime   string = "salt-lifetime"
+	configKeySaltSize       string = "salt-size"
+	configKeySaltPath       string = "salt-path"
+	configKeySaltShared     string = "salt-shared"
+	configKeySaltGrace      string = "salt-grace"
+	configKeyGWInProcess    string = "gw-in-process"
+	configKeySinglePort     string = "single-port"
+	configKeyGWTLSCert      string = "gw-tls-cert"
+	configKeyGWTLSKey       string = "gw-tls-key"
+	configKeyGWACMEHosts    string = "gw-acme-hosts"
+	configKeyGWACMECacheDir string = "gw-acme-cache-dir"
+	configKeyGWACMEEmail    string = "gw-acme-email"
+	configKeyLiveInterval   string = "live-interval"
+	configKeyIngestAsync    string = "ingest-async"
+	configKeyIngestQueue    string = "ingest-queue-size"
+	configKeyIngestBatch    string = "ingest-batch-size"
+	configKeyIngestFlush    string = "ingest-flush-interval"
+	configKeyIngestWorkers  string = "ingest-workers"
+	configKeyIngestOverflow string = "ingest-overflow"
+	configKeyIngestWAL      string = "ingest-wal"
+	configKeyRollupInterval string = "rollup-interval"
+	configKeyKafkaBrokers   string = "kafka-brokers"
+	configKeyKafkaTopic     string = "kafka-topic"
+	configKeyWebhooks       string = "webhooks-config"
+	configKeyAMQPURL        string = "amqp-url"
+	configKeyAMQPQueue      string = "amqp-queue"
+	configKeyAMQPPrefetch   string = "amqp-prefetch"
+	configKeyMQTTBroker     string = "mqtt-broker"
+	configKeyMQTTTopic      string = "mqtt-topic"
+	configKeyMQTTQoS        string = "mqtt-qos"
+	configKeyMQTTClientID   string = "mqtt-client-id"
+	configKeyArchiveURL     string = "archive-url"
+	configKeyArchiveAfter   string = "archive-after"
+	configKeyArchiveEvery   string = "archive-interval"
+	configKeyRetentionEvery string = "retention-interval"
+	configKeyLeaderElection string = "leader-election"
+	configKeyLeaderLease    string = "leader-lease"
+	configKeyLeaderTTL      string = "leader-lease-ttl"
+	configKeyPeers          string = "peers"
+	configKeyReplicationKey string = "replication-key"
+	configKeySMTPAddr       string = "smtp-addr"
+	configKeySMTPUsername   string = "smtp-username"
+	configKeySMTPPassword   string = "smtp-password"
+	configKeySMTPFrom       string = "smtp-from"
+	configKeyAlertInterval  string = "alert-interval"
+	configKeyOIDCIssuer     string = "oidc-issuer"
+	configKeyOIDCClientID   string = "oidc-client-id"
+	configKeyOIDCAdminGroup string = "oidc-admin-group"
+	configKeySessionSecret  string = "session-secret"
+	configKeySessionTTL     string = "session-ttl"
+	configKeyPrivacy        string = "privacy-signals"
+	configKeyGeoBlocklist   string = "geo-blocklist"
+	configKeyHashInputs     string = "visitor-hash-inputs"
+	configKeyTrustedProxies string = "trusted-proxies"
+	configKeyTimestampSkew  string = "timestamp-max-skew"
+	configKeyTimestampAge   string = "timestamp-max-age"
+	configKeyScrubQuery     string = "scrub-url-query"
+	configKeyQueryAllowlist string = "url-query-allowlist"
 )
 
 type cli struct {
@@ -45,265 +162,945 @@ type cli struct {
 		grpcPort uint16
 		gwPort   uint16
 		mPort    uint16
+		grpcAddr string
+		gwAddr   string
+		mAddr    string
+
+		gwInProcess bool
+		gwTLS       grpcwrap.TLSConfig
+		singlePort  bool
 	}
 	metricsTimeout int64
+	liveInterval   int64
 	useMemDB       bool
 	domains        []string
 	mockData       bool
+	mockSeed       int64
+	dryRun         bool
+	features       features.Set
+	// autoDomains are the patterns of the domains the collectors are registered for on their first events
+	autoDomains []string
+
+	ingestAsync bool
+	ingest      ingest.Config
+	privacy     analytics.PrivacyPolicy
+	// geoBlocklist are the country and region codes the events aren't stored from
+	geoBlocklist []string
+	// hashInputs are the components of the visitor hash
+	hashInputs []string
+	// trustedProxies are the addresses and the CIDRs of the proxies skipped in X-Forwarded-For
+	trustedProxies []string
+	// timestamps is the validation of the timestamps sent by the clients
+	timestamps analytics.TimestampPolicy
+	// scrubQuery removes the query parameters of the URLs which aren't in queryAllowlist
+	scrubQuery     bool
+	queryAllowlist []string
+
+	rollupInterval time.Duration
+
+	kafkaBrokers []string
+	kafkaTopic   string
+
+	webhooksConfig string
+
+	amqpURL      string
+	amqpQueue    string
+	amqpPrefetch int
+
+	mqtt mqtt.Config
+
+	archiveURL      string
+	archiveAfter    time.Duration
+	archiveInterval time.Duration
+	// retentionInterval is the time between purges of the events past the retention of their sites, disabled if 0
+	retentionInterval time.Duration
+
+	// leaderElection is the lock of the lease electing the replica running the background jobs,
+	// they run on every replica if it's empty
+	leaderElection string
+	leaderLease    string
+	leaderTTL      time.Duration
+
+	// peers are the base URLs of the gateways of the replicas the events are replicated to, disabled if empty
+	peers          []string
+	replicationKey string
+
+	smtp          report.SMTPConfig
+	alertInterval time.Duration
+
+	sitesConfig string
+	sites       *sites.Config
+	adminToken  string
+	linkSecret  string
+
+	oidcIssuer     string
+	oidcClientID   string
+	oidcAdminGroup string
+	sessionSecret  string
+	sessionTTL     time.Duration
+
+	log logging.Config
+
+	salt salt.Config
 }
 
 // run is the actual work function that configures and starts all components.
-func (c *cli) run(_ *cobra.Command, _ []string) error {
+func (c *cli) run(cmd *cobra.Command, _ []string) error {
 	// TODO: add auto cleaning of the records that are stored longer then 24h
-	// Setup logger
-	loggerConfig := zap.NewProductionConfig()
-	if c.cfg.debug {
-		loggerConfig = zap.NewDevelopmentConfig()
-	}
-	l, err := loggerConfig.Build()
+	// The flags are valid at this point, so the usage doesn't help with the errors
+	cmd.SilenceUsage = true
+
+	// Setup logger, its level is changed on reload, while the rest stays as configured at startup
+	l, logLevel, err := logging.New(c.log)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("cannot create logger: %w", err)
 	}
+	defer func() {
+		_ = l.Sync()
+	}()
 	zap.ReplaceGlobals(l)
 
 	// Log build info and command line arguments
-	l.Info("Runtime info", zap.Int("pid", os.Getpid()), zap.Strings("args", os.Args))
+	l.Info("Runtime info", zap.Int("pid", os.Getpid()), zap.Strings("args", os.Args), zap.Any("build", version.Labels()))
 	l.Info("Configuration info", zap.Any("config", c.cfg))
 
+	// Load the sites configuration
+	if err = c.loadSites(); err != nil {
+		return err
+	}
+	sitesRegistry := sites.NewRegistry(c.sites)
+	if c.linkSecret == "" {
+		l.Warn("Shared link secret isn't set, the shared links are valid until restart")
+		if c.linkSecret, err = randomSecret(); err != nil {
+			return fmt.Errorf("cannot generate shared link secret: %w", err)
+		}
+	}
+	linkSigner, err := sites.NewLinkSigner(c.linkSecret)
+	if err != nil {
+		return err
+	}
+	sitesRegistry.SetLinkSigner(linkSigner)
+
+	// Sign-on with the OpenID Connect provider, the sessions are accepted only if it's configured
+	var oidcProvider *oidc.Provider
+	var sessionSigner *sites.SessionSigner
+	if c.oidcIssuer != "" {
+		if oidcProvider, err = oidc.NewProvider(c.oidcIssuer, c.oidcClientID); err != nil {
+			return fmt.Errorf("cannot create OIDC provider: %w", err)
+		}
+		if c.sessionSecret == "" {
+			l.Warn("Session secret isn't set, the sessions are valid until restart")
+			if c.sessionSecret, err = randomSecret(); err != nil {
+				return fmt.Errorf("cannot generate session secret: %w", err)
+			}
+		}
+		if sessionSigner, err = sites.NewSessionSigner(c.sessionSecret); err != nil {
+			return err
+		}
+		sitesRegistry.SetSessionSigner(sessionSigner)
+	}
+
+	// Listeners passed by the previous process on restart
+	listeners, err := handoff.New()
+	if err != nil {
+		return fmt.Errorf("cannot inherit listeners: %w", err)
+	}
+	if listeners.Inherited() {
+		l.Info("Taking over the listeners of the previous process")
+	}
+
+	// The service is ready once all the conditions are done
+	ready := readiness.New("database", "wal", "collectors")
+
+	// Expose the feature flags, so the deployments are compared by them
+	c.features.RegisterMetrics()
+	l.Info("Feature flags", zap.Any("enabled", c.features.List()))
+
 	// Initialise database
 	db, err := database.NewDatabase(c.useMemDB)
 	if err != nil {
-		l.Fatal("cannot create db client", zap.Error(err))
+		return fmt.Errorf("cannot create db client: %w", err)
+	}
+	ready.Done("database")
+
+	// Report what would run instead of running it
+	if c.dryRun {
+		return c.reportDryRun(db)
+	}
+	// The stats are cached until the events within their ranges are inserted or deleted,
+	// so every writer goes through the cache
+	statsCache, err := prometheus.NewStatsCache(db, time.Duration(c.metricsTimeout)*time.Second, sitesRegistry)
+	if err != nil {
+		return fmt.Errorf("cannot create the stats cache: %w", err)
+	}
+	db = statsCache
+
+	// The servers and the background jobs run in the group, its context is cancelled
+	// on shutdown or once any of them fails, stopping the rest
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	group, ctx := errgroup.WithContext(ctx)
+
+	// Replicate the events to the peers, restoring the ones stored before the start from them first
+	var replicator *replication.Replicator
+	if len(c.peers) > 0 {
+		if replicator, err = replication.NewReplicator(db, c.peers, c.replicationKey); err != nil {
+			return fmt.Errorf("cannot create the replicator: %w", err)
+		}
+		replicator.Restore(ctx)
+		group.Go(func() error {
+			replicator.Run(ctx)
+			return nil
+		})
+		db = replicator
 	}
 
 	// Mock the data
 	if c.mockData {
-		go func() {
+		seed := c.mockSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		generator, err := mock.NewGenerator(mock.DefaultConfig(c.domains, 10, seed))
+		if err != nil {
+			return fmt.Errorf("cannot create mock generator: %w", err)
+		}
+		group.Go(func() error {
 			initialTime := time.Now()
 			for {
-				for _, md := range GetMockData(initialTime) {
-					time.Sleep(time.Duration(rand.Intn(15)) * time.Second)
-					if err = db.Insert(context.Background(), md); err != nil {
-						l.Fatal("failed to mock the data", zap.Error(err))
+				for _, visit := range generator.Visits(initialTime) {
+					for _, md := range visit.Events {
+						if !sleepContext(ctx, time.Duration(rand.Intn(15))*time.Second) {
+							return nil
+						}
+						md.Tenant = sitesRegistry.Key(md.GetDomain()).Tenant
+						if err := db.Insert(ctx, md); err != nil {
+							return fmt.Errorf("failed to mock the data: %w", err)
+						}
 					}
 				}
 				initialTime = initialTime.Add(time.Duration(3)*time.Hour + time.Duration(20)*time.Minute)
 				l.Info("data is mocked")
-				time.Sleep(time.Duration(rand.Intn(5)) * time.Minute)
+				if !sleepContext(ctx, time.Duration(rand.Intn(5))*time.Minute) {
+					return nil
+				}
 			}
-		}()
+		})
 	}
 
-	// Initialise gRPC server wrapper
-	g, err := grpcwrap.NewServer()
+	// The background jobs run on the elected leader of the replicas, or on every replica without the election
+	var jobs []func(ctx context.Context)
+
+	// The shared salt is rotated by the leader, the salt of every replica is rotated on use without the election
+	saltConfig := c.salt
+	saltConfig.Elected = c.leaderElection != ""
+	visitSalt, err := salt.New(saltConfig)
 	if err != nil {
-		return fmt.Errorf("cannot create grpcwrap instance: %w", err)
+		return fmt.Errorf("cannot create salt: %w", err)
+	}
+	if saltConfig.Elected {
+		jobs = append(jobs, visitSalt.Run)
+	}
+
+	// Start rollups scheduler
+	var scheduler *rollup.Scheduler
+	if c.rollupInterval > 0 {
+		scheduler, err = rollup.NewScheduler(db, c.sites, c.rollupInterval)
+		if err != nil {
+			return fmt.Errorf("cannot create rollup scheduler: %w", err)
+		}
+		jobs = append(jobs, scheduler.Run)
+	}
+
+	// Start archival of the old events
+	var archiver *archive.Archiver
+	if c.archiveURL != "" {
+		store, err := archive.NewStore(c.archiveURL)
+		if err != nil {
+			return fmt.Errorf("cannot create archive store: %w", err)
+		}
+		archiver, err = archive.NewArchiver(db, store, c.sites.Keys(), c.archiveAfter, c.archiveInterval)
+		if err != nil {
+			return fmt.Errorf("cannot create archiver: %w", err)
+		}
+		if err = archiver.Reconfigure(c.sites.Keys(), c.archiveAfter, c.sites.Retention()); err != nil {
+			return fmt.Errorf("cannot configure archiver: %w", err)
+		}
+		jobs = append(jobs, archiver.Run)
+	}
+
+	// Start purging the events past the retention of their sites, the archiver enforces it itself
+	if archiver == nil && c.retentionInterval > 0 {
+		purger, err := retention.NewPurger(db, sitesRegistry, c.retentionInterval)
+		if err != nil {
+			return fmt.Errorf("cannot create retention purger: %w", err)
+		}
+		jobs = append(jobs, purger.Run)
+	}
+
+	// Start reports of the sites, the due reports are checked every 15 minutes.
+	// The email reports require the SMTP server, the chat ones are posted to the channel webhooks.
+	var mailer alert.Mailer
+	var reportSender report.Sender
+	if c.smtp.Addr != "" {
+		sender, err := report.NewSMTPSender(c.smtp)
+		if err != nil {
+			return fmt.Errorf("cannot create SMTP sender: %w", err)
+		}
+		mailer, reportSender = sender, sender
+	}
+	reporter, err := report.NewScheduler(db, sitesRegistry, reportSender, 15*time.Minute)
+	if err != nil {
+		return fmt.Errorf("cannot create report scheduler: %w", err)
+	}
+	jobs = append(jobs, reporter.Run)
+
+	// Start evaluation of the alert rules of the sites, the email notifications use the SMTP server of the reports
+	if c.alertInterval > 0 {
+		evaluator, err := alert.NewEvaluator(db, sitesRegistry, mailer, c.alertInterval)
+		if err != nil {
+			return fmt.Errorf("cannot create alert evaluator: %w", err)
+		}
+		jobs = append(jobs, evaluator.Run)
+	}
+	if err = c.runJobs(ctx, group, jobs); err != nil {
+		return err
+	}
+
+	// Initialize prometheus server with its metrics, the collectors of the new allowlisted domains
+	// are registered by the sink of the accepted events
+	bindMAddr := c.listenAddr(c.cfg.mAddr, c.cfg.mPort)
+	prom, err := prometheus.NewPrometheus(statsCache, bindMAddr, sitesRegistry.Config().Keys(), sitesRegistry, c.autoDomains)
+	if err != nil {
+		return fmt.Errorf("cannot create the prometheus instance: %w", err)
+	}
+	ready.Done("collectors")
+
+	// Initialise sinks of the accepted events before the gRPC server, so they are closed after it stops
+	bus := pubsub.NewBus()
+	sinks := make([]analytics.EventSink, 0)
+	if len(c.kafkaBrokers) > 0 {
+		producer, err := kafka.NewProducer(c.kafkaBrokers, c.kafkaTopic)
+		if err != nil {
+			return fmt.Errorf("cannot create kafka producer: %w", err)
+		}
+		defer func() {
+			if err := producer.Close(); err != nil {
+				l.Error("Cannot close the kafka producer", zap.Error(err))
+			}
+		}()
+		sinks = append(sinks, producer)
+	}
+	// The dispatcher always runs for the webhooks of the site goals, which may be added on reload
+	webhooksCfg := &webhook.Config{}
+	if c.webhooksConfig != "" {
+		webhooksCfg, err = webhook.LoadConfig(c.webhooksConfig)
+		if err != nil {
+			return fmt.Errorf("cannot load webhooks config: %w", err)
+		}
+	}
+	dispatcher, err := webhook.NewDispatcher(webhooksCfg, sitesRegistry)
+	if err != nil {
+		return fmt.Errorf("cannot create webhook dispatcher: %w", err)
 	}
 	defer func() {
-		g.Shutdown()
+		if err := dispatcher.Shutdown(context.Background()); err != nil {
+			l.Error("Cannot shutdown the webhook dispatcher", zap.Error(err))
+		}
 	}()
+	sinks = append(sinks, dispatcher)
+	if len(c.autoDomains) > 0 {
+		sinks = append(sinks, prom)
+	}
+
+	// Initialise asynchronous ingestion pipeline
+	analyticsDB := db
+	if c.ingestAsync {
+		pipeline, err := ingest.NewPipeline(db, c.ingest)
+		if err != nil {
+			return fmt.Errorf("cannot create ingestion pipeline: %w", err)
+		}
+		defer func() {
+			if err := pipeline.Shutdown(context.Background()); err != nil {
+				l.Error("Cannot shutdown the ingestion pipeline", zap.Error(err))
+			}
+		}()
+		analyticsDB = pipeline
+	}
+	// The write-ahead log is replayed by the pipeline constructor
+	ready.Done("wal")
+
+	// Initialise gRPC server wrapper, checking the roles of the API keys before the Analytics methods
+	authorizer := analytics.NewAuthorizer(sitesRegistry)
+	g, err := grpcwrap.NewServer(
+		grpc.ChainUnaryInterceptor(authorizer.UnaryInterceptor()),
+		grpc.ChainStreamInterceptor(authorizer.StreamInterceptor()),
+	)
+	if err != nil {
+		return fmt.Errorf("cannot create grpcwrap instance: %w", err)
+	}
+	ready.OnReady(func() {
+		g.SetServing()
+		state := "READY=1"
+		if listeners.Inherited() {
+			// Let systemd track the new process instead of the previous one
+			state = fmt.Sprintf("MAINPID=%d\n%s", os.Getpid(), state)
+		}
+		if err := readiness.Notify(state); err != nil {
+			l.Error("Cannot notify systemd", zap.Error(err))
+		}
+		if err := listeners.Ready(); err != nil {
+			l.Error("Cannot stop the previous process", zap.Error(err))
+		}
+		l.Info("Service is ready")
+	})
 
 	// Initialise analytics
-	if err = analytics.New(g.GRPCServer, db); err != nil {
+	// The usage is counted in the database directly, the quotas must be checked before the events are queued
+	meter, err := usage.NewMeter(db, sitesRegistry)
+	if err != nil {
+		return fmt.Errorf("cannot create usage meter: %w", err)
+	}
+	geoBlocklist, err := analytics.ParseGeoBlocklist(c.geoBlocklist)
+	if err != nil {
+		return fmt.Errorf("cannot parse geo blocklist: %w", err)
+	}
+	hashInputs, err := analytics.ParseHashInputs(c.hashInputs)
+	if err != nil {
+		return fmt.Errorf("cannot parse visitor hash inputs: %w", err)
+	}
+	trustedProxies, err := analytics.ParseTrustedProxies(c.trustedProxies)
+	if err != nil {
+		return fmt.Errorf("cannot parse trusted proxies: %w", err)
+	}
+	var scrubber *analytics.QueryScrubber
+	if c.scrubQuery {
+		scrubber = analytics.NewQueryScrubber(c.queryAllowlist)
+	}
+	analyticsSrv, err := analytics.New(g.GRPCServer, analytics.Options{
+		DB:             analyticsDB,
+		Bus:            bus,
+		Sites:          sitesRegistry,
+		Salt:           visitSalt,
+		HashInputs:     hashInputs,
+		Meter:          meter,
+		Privacy:        c.privacy,
+		GeoBlocklist:   geoBlocklist,
+		TrustedProxies: trustedProxies,
+		Timestamps:     c.timestamps,
+		Scrubber:       scrubber,
+		StatsCache:     statsCache,
+		Sinks:          sinks,
+	})
+	if err != nil {
 		return fmt.Errorf("cannot create catalog instance: %w", err)
 	}
-	// Start gRPC server
-	var lis net.Listener
-	bindGRPCAddr := c.cfg.bindAddr + ":" + strconv.Itoa(int(c.cfg.grpcPort))
-	lis, err = net.Listen("tcp", bindGRPCAddr)
+
+	// Initialise admin service, the sites it manages are merged with the configured ones
+	// and applied to the ingestion and the exporter immediately
+	applySites := func(cfg *sites.Config) {
+		keys := cfg.Keys()
+		prom.SetSites(keys)
+		if scheduler != nil {
+			scheduler.SetSites(cfg)
+		}
+		if archiver != nil {
+			if err := archiver.Reconfigure(keys, c.archiveAfter, cfg.Retention()); err != nil {
+				l.Error("Cannot apply archival configuration", zap.Error(err))
+			}
+		}
+	}
+	adminSrv, err := admin.New(g.GRPCServer, db, sitesRegistry, c.sites, c.adminToken, applySites)
 	if err != nil {
-		return fmt.Errorf("cannot create grpc network listener: %w", err)
+		return fmt.Errorf("cannot create admin service: %w", err)
 	}
-	go func() {
-		if err = g.GRPCServer.Serve(lis); err != nil {
-			l.Fatal("Cannot serve incoming connections on the listener", zap.Error(err))
+	var adminGW analyticsApi.AdminServer
+	if c.adminToken != "" {
+		adminGW = adminSrv
+	}
+	// Start AMQP consumer
+	if c.amqpURL != "" {
+		consumer, err := amqp.NewConsumer(c.amqpURL, c.amqpQueue, c.amqpPrefetch, analyticsSrv)
+		if err != nil {
+			return fmt.Errorf("cannot create AMQP consumer: %w", err)
 		}
-	}()
-	l.Info("gRPC server started", zap.String("address", bindGRPCAddr))
+		group.Go(func() error {
+			consumer.Run(ctx)
+			return nil
+		})
+	}
+
+	// Start MQTT subscriber
+	if c.mqtt.Broker != "" {
+		subscriber, err := mqtt.NewSubscriber(c.mqtt, analyticsSrv)
+		if err != nil {
+			return fmt.Errorf("cannot create MQTT subscriber: %w", err)
+		}
+		subscriber.Connect()
+		defer subscriber.Close()
+	}
+
+	// Start gRPC server, in single port mode it's served by the gateway server
+	bindGRPCAddr := c.listenAddr(c.cfg.grpcAddr, c.cfg.grpcPort)
+	if !c.cfg.singlePort {
+		var lis net.Listener
+		lis, err = listeners.Listen("grpc", bindGRPCAddr)
+		if err != nil {
+			return fmt.Errorf("cannot create grpc network listener: %w", err)
+		}
+		group.Go(func() error {
+			if err := g.GRPCServer.Serve(lis); err != nil {
+				return fmt.Errorf("cannot serve incoming connections on the listener: %w", err)
+			}
+			return nil
+		})
+		l.Info("gRPC server started", zap.String("address", bindGRPCAddr))
+	}
+	group.Go(func() error {
+		<-ctx.Done()
+		g.Shutdown()
+		return nil
+	})
+
+	// Initialize Plausible Stats API compatibility layer
+	plausibleAPI, err := plausible.NewAPI(db, sitesRegistry)
+	if err != nil {
+		return fmt.Errorf("cannot create the plausible stats api: %w", err)
+	}
+	widgets, err := widget.NewHandler(db, sitesRegistry)
+	if err != nil {
+		return fmt.Errorf("cannot create the widgets handler: %w", err)
+	}
+	arrowAPI, err := arrow.NewHandler(db, sitesRegistry)
+	if err != nil {
+		return fmt.Errorf("cannot create the arrow handler: %w", err)
+	}
 
 	// Initialize gRPC HTTP Gateway server
-	bindGWAddr := c.cfg.bindAddr + ":" + strconv.Itoa(int(c.cfg.gwPort))
-	gwServer, err := grpcwrap.NewGatewayServer(bindGWAddr, bindGRPCAddr, false)
+	bindGWAddr := c.listenAddr(c.cfg.gwAddr, c.cfg.gwPort)
+	gwPaths := []grpcwrap.GatewayPath{
+		{
+			Method:  "GET",
+			Pattern: live.Path,
+			Handler: live.NewHandler(db, bus, sitesRegistry, time.Duration(c.liveInterval)*time.Second),
+		},
+		{
+			Method:  "GET",
+			Pattern: readiness.ReadyPath,
+			Handler: ready.ReadyHandler,
+		},
+		{
+			Method:  "GET",
+			Pattern: readiness.LivePath,
+			Handler: readiness.LiveHandler,
+		},
+		{
+			Method:  "GET",
+			Pattern: plausible.AggregatePath,
+			Handler: plausibleAPI.Aggregate,
+		},
+		{
+			Method:  "GET",
+			Pattern: plausible.TimeseriesPath,
+			Handler: plausibleAPI.Timeseries,
+		},
+		{
+			Method:  "GET",
+			Pattern: plausible.BreakdownPath,
+			Handler: plausibleAPI.Breakdown,
+		},
+		{
+			Method:  "GET",
+			Pattern: plausible.RealtimePath,
+			Handler: plausibleAPI.Realtime,
+		},
+		{
+			Method:  "GET",
+			Pattern: widget.Path,
+			Handler: widgets.JSON,
+		},
+		{
+			Method:  "GET",
+			Pattern: widget.BadgePath,
+			Handler: widgets.Badge,
+		},
+		{
+			Method:  "GET",
+			Pattern: arrow.EventsPath,
+			Handler: arrowAPI.Events,
+		},
+		{
+			Method:  "GET",
+			Pattern: arrow.RollupsPath,
+			Handler: arrowAPI.Rollups,
+		},
+	}
+	if oidcProvider != nil {
+		gwPaths = append(gwPaths, grpcwrap.GatewayPath{
+			Method:  "POST",
+			Pattern: oidc.Path,
+			Handler: oidc.NewHandler(oidcProvider, sitesRegistry, sessionSigner, c.sessionTTL, c.oidcAdminGroup),
+		})
+	}
+	if replicator != nil {
+		gwPaths = append(gwPaths, grpcwrap.GatewayPath{
+			Method:  "POST",
+			Pattern: replication.EventsPath,
+			Handler: replicator.Events,
+		}, grpcwrap.GatewayPath{
+			Method:  "POST",
+			Pattern: replication.DeletePath,
+			Handler: replicator.Delete,
+		}, grpcwrap.GatewayPath{
+			Method:  "GET",
+			Pattern: replication.SnapshotPath,
+			Handler: replicator.Snapshot,
+		})
+	}
+	if c.features.Enabled(features.GraphQL) {
+		gql, err := graphql.NewHandler(db, sitesRegistry)
+		if err != nil {
+			return fmt.Errorf("cannot create the graphql handler: %w", err)
+		}
+		gwPaths = append(gwPaths, grpcwrap.GatewayPath{
+			Method:  "POST",
+			Pattern: graphql.Path,
+			Handler: gql.Serve,
+		}, grpcwrap.GatewayPath{
+			Method:  "GET",
+			Pattern: graphql.Path,
+			Handler: gql.Serve,
+		})
+	}
+	if c.cfg.singlePort {
+		gwPaths = append(gwPaths, grpcwrap.GatewayPath{
+			Method:  "GET",
+			Pattern: prometheus.Path,
+			Handler: prometheus.Handler,
+		}, grpcwrap.GatewayPath{
+			Method:  "GET",
+			Pattern: prometheus.TenantPath,
+			Handler: prom.TenantHandler,
+		})
+	}
+	var gwServer *http.Server
+	if c.cfg.gwInProcess || c.cfg.singlePort {
+		gwServer, err = grpcwrap.NewInProcessGatewayServer(bindGWAddr, analyticsSrv, adminGW, gwPaths...)
+	} else {
+		gwServer, err = grpcwrap.NewGatewayServer(bindGWAddr, bindGRPCAddr, false, gwPaths...)
+	}
 	if err != nil {
-		l.Fatal("Cannot create the gateway server", zap.Error(err))
+		return fmt.Errorf("cannot create the gateway server: %w", err)
 	}
-	defer func() {
-		if err = gwServer.Shutdown(context.Background()); err != nil {
-			l.Fatal("Cannot shutdown the http server", zap.Error(err))
+	if c.cfg.singlePort {
+		gwServer.Handler, err = grpcwrap.NewSinglePortHandler(g.GRPCServer, gwServer.Handler)
+		if err != nil {
+			return fmt.Errorf("cannot create the single port handler: %w", err)
 		}
-	}()
+	}
 
-	// Start gRPC HTTP Gateway server
-	go func() {
-		if err = gwServer.ListenAndServe(); err != nil {
-			l.Fatal("Cannot serve incoming traffic to the gateway", zap.Error(err))
+	// Configure HTTPS for the gateway server
+	var gwCertFile, gwKeyFile string
+	if c.cfg.gwTLS.Enabled() {
+		gwCertFile, gwKeyFile, err = grpcwrap.EnableTLS(gwServer, c.cfg.gwTLS)
+		if err != nil {
+			return fmt.Errorf("cannot configure TLS for the gateway server: %w", err)
 		}
-	}()
-	l.Info("Gateway server started", zap.String("address", bindGWAddr))
+	}
 
-	// Initialize prometheus server with its metrics
-	bindMAddr := c.cfg.bindAddr + ":" + strconv.Itoa(int(c.cfg.mPort))
-	prom, err := prometheus.NewPrometheus(db, bindMAddr, c.domains)
+	// Start gRPC HTTP Gateway server
+	gwLis, err := listeners.Listen("gateway", bindGWAddr)
 	if err != nil {
-		l.Fatal("Cannot create the prometheus instance", zap.Error(err))
+		return fmt.Errorf("cannot create gateway network listener: %w", err)
 	}
-	defer func() {
-		if err = prom.HTTPServer.Shutdown(context.Background()); err != nil {
-			l.Fatal("Cannot shutdown the http server", zap.Error(err))
+	group.Go(func() error {
+		var err error
+		if c.cfg.gwTLS.Enabled() {
+			err = gwServer.ServeTLS(gwLis, gwCertFile, gwKeyFile)
+		} else {
+			err = gwServer.Serve(gwLis)
 		}
-	}()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("cannot serve incoming traffic to the gateway: %w", err)
+		}
+		return nil
+	})
+	group.Go(func() error {
+		<-ctx.Done()
+		if err := gwServer.Shutdown(context.Background()); err != nil {
+			return fmt.Errorf("cannot shutdown the gateway server: %w", err)
+		}
+		return nil
+	})
+	l.Info("Gateway server started", zap.String("address", bindGWAddr), zap.Bool("tls", c.cfg.gwTLS.Enabled()))
 
-	// Run prometheus metrics HTTP server
-	go func() {
-		if err = prom.HTTPServer.ListenAndServe(); err != nil {
-			l.Fatal("Cannot serve metrics endpoint", zap.Error(err))
+	// Run prometheus metrics HTTP server, in single port mode the metrics are served by the gateway server
+	if !c.cfg.singlePort {
+		mLis, err := listeners.Listen("metrics", bindMAddr)
+		if err != nil {
+			return fmt.Errorf("cannot create metrics network listener: %w", err)
 		}
-	}()
-	l.Info("Metrics server started", zap.String("address", bindMAddr))
+		group.Go(func() error {
+			if err := prom.HTTPServer.Serve(mLis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return fmt.Errorf("cannot serve metrics endpoint: %w", err)
+			}
+			return nil
+		})
+		group.Go(func() error {
+			<-ctx.Done()
+			if err := prom.Shutdown(); err != nil {
+				return fmt.Errorf("cannot shutdown the metrics server: %w", err)
+			}
+			return nil
+		})
+		l.Info("Metrics server started", zap.String("address", bindMAddr))
+	}
 
-	// Wait for the shutdown signal
+	// Apply the reloadable settings on SIGHUP and on config file change,
+	// the rest of the settings require a restart
+	reload := func() {
+		if err := c.reloadConfig(); err != nil {
+			l.Error("Cannot reload configuration", zap.Error(err))
+			return
+		}
+		if err := logLevel.UnmarshalText([]byte(c.log.Level)); err != nil {
+			l.Error("Cannot reload log level", zap.Error(err))
+		}
+		if err := adminSrv.SetBase(ctx, c.sites); err != nil {
+			l.Error("Cannot reload sites configuration", zap.Error(err))
+		}
+		l.Info("Configuration reloaded", zap.Strings("domains", sitesRegistry.Config().Domains()), zap.String("log-level", c.log.Level))
+	}
+	configChanged := make(chan struct{}, 1)
+	if viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(func(_ fsnotify.Event) {
+			select {
+			case configChanged <- struct{}{}:
+			default:
+			}
+		})
+		viper.WatchConfig()
+	}
+
+	// Wait for the shutdown signal or a failure of the group
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	var sig os.Signal
+	for sig == nil && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-configChanged:
+			reload()
+		case s := <-sigChan:
+			if s == syscall.SIGUSR2 {
+				// The new process stops this one once it's ready
+				proc, err := listeners.Restart()
+				if err != nil {
+					l.Error("Cannot restart", zap.Error(err))
+					continue
+				}
+				l.Info("Started new process, handing off the listeners", zap.Int("pid", proc.Pid))
+				continue
+			}
+			if s != syscall.SIGHUP {
+				sig = s
+				continue
+			}
+			if viper.ConfigFileUsed() != "" {
+				if err := viper.ReadInConfig(); err != nil {
+					l.Error("Cannot read config file", zap.Error(err))
+					continue
+				}
+			}
+			reload()
+		}
+	}
+
+	// Shutdown, the sinks and the pipeline are closed by the deferred calls once the group stops
+	if sig != nil {
+		l.Info("Shutting down: "+sig.String(), zap.Int("signal", int(sig.(syscall.Signal))))
+	} else {
+		l.Error("Shutting down after a failure")
+	}
+	if err = readiness.Notify("STOPPING=1"); err != nil {
+		l.Error("Cannot notify systemd", zap.Error(err))
+	}
+	cancel()
 
-	// Shutdown
-	l.Info("Shutting down: "+sig.String(), zap.Int("signal", int(sig.(syscall.Signal))))
+	return group.Wait()
+}
+
+// sleepContext pauses for d, returning false if ctx is done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
 
+// randomSecret returns a random hex encoded secret.
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := cryptoRand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// reloadConfig re-reads the reloadable settings.
+func (c *cli) reloadConfig() error {
+	c.cfg.debug = viper.GetBool(configKeyDebug)
+	c.setupLogConfig()
+	c.archiveAfter = viper.GetDuration(configKeyArchiveAfter)
+	c.domains = viper.GetStringSlice(configKeyDomains)
+	c.sitesConfig = viper.GetString(configKeySites)
+	return c.loadSites()
+}
+
+// loadSites loads the sites configuration file, or the sites of the domains with the default settings
+// if it's not set, and replaces the domains with the ones of the sites.
+func (c *cli) loadSites() error {
+	cfg := sites.FromDomains(c.domains)
+	if c.sitesConfig != "" {
+		var err error
+		if cfg, err = sites.LoadConfig(c.sitesConfig); err != nil {
+			return fmt.Errorf("cannot load sites config: %w", err)
+		}
+	}
+	c.sites = cfg
+	c.domains = cfg.Domains()
 	return nil
 }
 
-func (c *cli) setupConfig(_ *cobra.Command, _ []string) {
+// listenAddr returns addr if it's set, otherwise the bind address with the port.
+func (c *cli) listenAddr(addr string, port uint16) string {
+	if addr != "" {
+		return addr
+	}
+	return net.JoinHostPort(c.cfg.bindAddr, strconv.Itoa(int(port)))
+}
+
+func (c *cli) setupConfig(_ *cobra.Command, _ []string) error {
+	// Read the configuration file, its keys are the flag names
+	if path := viper.GetString(configKeyConfig); path != "" {
+		viper.SetConfigFile(path)
+		if err := viper.ReadInConfig(); err != nil {
+			return fmt.Errorf("cannot read config file: %w", err)
+		}
+	}
+
 	c.cfg.bindAddr = viper.GetString(configKeyBindAddr)
 	c.cfg.debug = viper.GetBool(configKeyDebug)
 	c.cfg.grpcPort = viper.GetUint16(configKeyGRPCPort)
 	c.cfg.gwPort = viper.GetUint16(configKeyGWPort)
 	c.cfg.mPort = viper.GetUint16(configKeyMPort)
+	c.cfg.grpcAddr = viper.GetString(configKeyGRPCAddr)
+	c.cfg.gwAddr = viper.GetString(configKeyGWAddr)
+	c.cfg.mAddr = viper.GetString(configKeyMAddr)
+	c.cfg.gwInProcess = viper.GetBool(configKeyGWInProcess)
+	c.cfg.singlePort = viper.GetBool(configKeySinglePort)
+	c.cfg.gwTLS.CertFile = viper.GetString(configKeyGWTLSCert)
+	c.cfg.gwTLS.KeyFile = viper.GetString(configKeyGWTLSKey)
+	c.cfg.gwTLS.ACMEHosts = viper.GetStringSlice(configKeyGWACMEHosts)
+	c.cfg.gwTLS.ACMECacheDir = viper.GetString(configKeyGWACMECacheDir)
+	c.cfg.gwTLS.ACMEEmail = viper.GetString(configKeyGWACMEEmail)
 	c.useMemDB = viper.GetBool(configKeyUseMemDB)
 	c.mockData = viper.GetBool(configKeyMock)
+	c.mockSeed = viper.GetInt64(configKeyMockSeed)
+	c.dryRun = viper.GetBool(configKeyDryRun)
 	c.metricsTimeout = viper.GetInt64(configKeyMetricsTimeout)
+	c.liveInterval = viper.GetInt64(configKeyLiveInterval)
+	c.ingestAsync = viper.GetBool(configKeyIngestAsync)
+	c.ingest.QueueSize = viper.GetInt(configKeyIngestQueue)
+	c.ingest.BatchSize = viper.GetInt(configKeyIngestBatch)
+	c.ingest.FlushInterval = viper.GetDuration(configKeyIngestFlush)
+	c.ingest.Workers = viper.GetInt(configKeyIngestWorkers)
+	c.ingest.Overflow = ingest.OverflowPolicy(viper.GetString(configKeyIngestOverflow))
+	c.privacy = analytics.PrivacyPolicy(viper.GetString(configKeyPrivacy))
+	c.geoBlocklist = viper.GetStringSlice(configKeyGeoBlocklist)
+	c.hashInputs = viper.GetStringSlice(configKeyHashInputs)
+	c.trustedProxies = viper.GetStringSlice(configKeyTrustedProxies)
+	c.timestamps.MaxSkew = viper.GetDuration(configKeyTimestampSkew)
+	c.timestamps.MaxAge = viper.GetDuration(configKeyTimestampAge)
+	c.scrubQuery = viper.GetBool(configKeyScrubQuery)
+	c.queryAllowlist = viper.GetStringSlice(configKeyQueryAllowlist)
+	c.ingest.WALPath = viper.GetString(configKeyIngestWAL)
+	c.rollupInterval = viper.GetDuration(configKeyRollupInterval)
+	c.kafkaBrokers = viper.GetStringSlice(configKeyKafkaBrokers)
+	c.kafkaTopic = viper.GetString(configKeyKafkaTopic)
+	c.webhooksConfig = viper.GetString(configKeyWebhooks)
+	c.amqpURL = viper.GetString(configKeyAMQPURL)
+	c.amqpQueue = viper.GetString(configKeyAMQPQueue)
+	c.amqpPrefetch = viper.GetInt(configKeyAMQPPrefetch)
+	c.mqtt.Broker = viper.GetString(configKeyMQTTBroker)
+	c.mqtt.Topic = viper.GetString(configKeyMQTTTopic)
+	c.mqtt.QoS = byte(viper.GetUint(configKeyMQTTQoS))
+	c.mqtt.ClientID = viper.GetString(configKeyMQTTClientID)
+	c.archiveURL = viper.GetString(configKeyArchiveURL)
+	c.archiveAfter = viper.GetDuration(configKeyArchiveAfter)
+	c.archiveInterval = viper.GetDuration(configKeyArchiveEvery)
+	c.retentionInterval = viper.GetDuration(configKeyRetentionEvery)
+	c.leaderElection = viper.GetString(configKeyLeaderElection)
+	c.leaderLease = viper.GetString(configKeyLeaderLease)
+	c.leaderTTL = viper.GetDuration(configKeyLeaderTTL)
+	c.peers = viper.GetStringSlice(configKeyPeers)
+	c.replicationKey = viper.GetString(configKeyReplicationKey)
+	c.smtp.Addr = viper.GetString(configKeySMTPAddr)
+	c.smtp.Username = viper.GetString(configKeySMTPUsername)
+	c.smtp.Password = viper.GetString(configKeySMTPPassword)
+	c.smtp.From = viper.GetString(configKeySMTPFrom)
+	c.alertInterval = viper.GetDuration(configKeyAlertInterval)
 	c.domains = viper.GetStringSlice(configKeyDomains)
-}
+	c.autoDomains = viper.GetStringSlice(configKeyAutoDomains)
+	c.sitesConfig = viper.GetString(configKeySites)
+	c.adminToken = viper.GetString(configKeyAdminToken)
+	c.linkSecret = viper.GetString(configKeyLinkSecret)
+	c.oidcIssuer = viper.GetString(configKeyOIDCIssuer)
+	c.oidcClientID = viper.GetString(configKeyOIDCClientID)
+	c.oidcAdminGroup = viper.GetString(configKeyOIDCAdminGroup)
+	c.sessionSecret = viper.GetString(configKeySessionSecret)
+	c.sessionTTL = viper.GetDuration(configKeySessionTTL)
+	c.salt.Lifetime = viper.GetDuration(configKeySaltLifetime)
+	c.salt.Size = viper.GetInt(configKeySaltSize)
+	c.salt.Path = viper.GetString(configKeySaltPath)
+	c.salt.Shared = viper.GetBool(configKeySaltShared)
+	c.salt.Grace = viper.GetDuration(configKeySaltGrace)
+	c.setupLogConfig()
 
-var (
-	Domain    = "web"
-	EventType = "pageview"
-	URL       = "mockData.example.com"
-	OSs       = []string{
-		"Windows",
-		"Windows Phone",
-		"Android",
-		"macOS",
-		"iOS",
-		"Linux",
-		"FreeBSD",
-		"ChromeOS",
-		"BlackBerry",
-	}
-	Browsers = []string{
-		"Opera",
-		"Opera Mini",
-		"Opera Touch",
-		"Chrome",
-		"Headless Chrome",
-		"Firefox",
-		"Internet Explorer",
-		"Safari",
-		"Edge",
-		"Vivaldi",
-	}
-	Referrers = []string{
-		"",
-		"https://www.google.com",
-		"https://ua.linkedin.com",
-		"https://www.bing.com",
-		"https://yahoo.com",
-	}
-	Paths = []string{
-		"/",
-		"/foo",
-		"/bar",
-		"/foo/bar",
-		"/bar/foo",
-	}
-	Devices = []*analyticsApi.Device{
-		{
-			Device: &analyticsApi.Device_Mobile{
-				Mobile: true,
-			},
-		},
-		{
-			Device: &analyticsApi.Device_Tablet{
-				Tablet: true,
-			},
-		},
-		{
-			Device: &analyticsApi.Device_Desktop{
-				Desktop: true,
-			},
-		},
-		{
-			Device: &analyticsApi.Device_Bot{
-				Bot: true,
-			},
-		},
+	// The feature flags enable the experimental subsystems on top of their own settings
+	var err error
+	if c.features, err = features.Parse(viper.GetStringMapString(configKeyFeatures)); err != nil {
+		return err
+	}
+	if c.features.Enabled(features.AsyncPipeline) {
+		c.ingestAsync = true
 	}
-	H = sha256.New()
-)
-
-func GetMockData(initialTime time.Time) []*analyticsApi.Event {
-	mockData := make([]*analyticsApi.Event, 0)
-
-	type visitor struct {
-		IP      string
-		Browser string
-		OS      string
-		Device  *analyticsApi.Device
-	}
-	ipCidr := "132.14.53."
-	// generate from 1 to 10 visitors
-	totalVisitors := rand.Intn(10) + 1
-	visitors := make([]visitor, totalVisitors)
-	for i := 0; i < totalVisitors; i++ {
-		visitors[i] = visitor{
-			IP:      ipCidr + strconv.Itoa(rand.Intn(255)+1),
-			Browser: Browsers[rand.Intn(len(Browsers))],
-			OS:      OSs[rand.Intn(len(OSs))],
-			Device:  Devices[rand.Intn(len(Devices))],
-		}
-
-		pageViewsAmount := rand.Intn(5) + 1
-
-		timeShift := 0
-		for j := 0; j < pageViewsAmount; j++ {
-			H.Write([]byte(visitors[i].IP + visitors[i].Browser + visitors[i].Device.String()))
-			visitHashValue := H.Sum(nil)
-
-			var referrer string
-			if rand.Intn(2) == 1 {
-				referrer = URL
-			} else {
-				referrer = Referrers[rand.Intn(len(Referrers))]
-			}
 
-			mockData = append(mockData, &analyticsApi.Event{
-				ID:          uuid.New().String(),
-				Type:        EventType,
-				URL:         URL + Paths[rand.Intn(len(Paths))],
-				Domain:      Domain,
-				Referrer:    referrer,
-				Browser:     visitors[i].Browser,
-				OS:          visitors[i].OS,
-				Device:      visitors[i].Device,
-				HashedVisit: hex.EncodeToString(visitHashValue),
-				Timestamp:   timestamppb.New(initialTime.Add(time.Minute * time.Duration(timeShift))),
-			})
+	return nil
+}
 
-			timeShift += rand.Intn(40)
-			H.Reset()
+// setupLogConfig reads the logging settings, debugging defaults to the debug level and the console format.
+func (c *cli) setupLogConfig() {
+	c.log.Level = viper.GetString(configKeyLogLevel)
+	c.log.Format = viper.GetString(configKeyLogFormat)
+	c.log.File = viper.GetString(configKeyLogFile)
+	c.log.MaxSizeMB = viper.GetInt(configKeyLogMaxSize)
+	c.log.MaxAgeDays = viper.GetInt(configKeyLogMaxAge)
+	c.log.MaxBackups = viper.GetInt(configKeyLogMaxBackups)
+	c.log.Components = viper.GetStringMapString(configKeyLogComponents)
+	c.log.Development = c.cfg.debug
+	if c.cfg.debug {
+		if !viper.IsSet(configKeyLogLevel) {
+			c.log.Level = "debug"
+		}
+		if !viper.IsSet(configKeyLogFormat) {
+			c.log.Format = "console"
 		}
 	}
-
-	return mockData
 }
 
 func main() {
@@ -322,12 +1119,37 @@ func main() {
 	// Set variables and start the server
 	c := cli{}
 	rootCmd := &cobra.Command{
-		Use:    filepath.Base(cmdFull),
-		PreRun: c.setupConfig,
-		RunE:   c.run,
+		Use: filepath.Base(cmdFull),
+		Long: `Analytics events service.
+
+Every flag can also be set in the YAML or TOML config file passed with --config,
+using the flag name as the key, and with the ` + envPrefix + `_ prefixed environment variable,
+using the upper-cased flag name with dashes replaced by underscores, e.g. ` + envPrefix + `_RPC_PORT.
+List values are separated by spaces in the environment variables.
+
+The precedence is: flags > environment variables > config file > defaults.
+
+SIGHUP reloads the domains, the archival settings and the log level.
+SIGUSR2 starts a new process of the binary which takes over the listeners
+and stops this one once ready, so the binary is upgraded without refusing connections.
+The in-memory database isn't handed over.`,
+		Version: version.Version,
+		PreRunE: c.setupConfig,
+		RunE:    c.run,
 	}
+	rootCmd.SetVersionTemplate(version.String())
+
+	// Bind the environment variables
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
 
 	// Setup persistent flags
+	rootCmd.PersistentFlags().String(configKeyConfig, "", "Path to the YAML or TOML config file")
+	if err := viper.BindPFlag(configKeyConfig, rootCmd.PersistentFlags().Lookup(configKeyConfig)); err != nil {
+		panic(err)
+	}
+
 	rootCmd.PersistentFlags().StringVar(&c.cfg.bindAddr, configKeyBindAddr, "", "Address to bind.")
 	if err := viper.BindPFlag(configKeyBindAddr, rootCmd.PersistentFlags().Lookup(configKeyBindAddr)); err != nil {
 		panic(err)
@@ -338,6 +1160,46 @@ func main() {
 		panic(err)
 	}
 
+	rootCmd.PersistentFlags().StringVar(&c.log.Level, configKeyLogLevel, "info", "Log level: debug, info, warn or error (debug if debugging)")
+	if err := viper.BindPFlag(configKeyLogLevel, rootCmd.PersistentFlags().Lookup(configKeyLogLevel)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.log.Format, configKeyLogFormat, "json", "Log format: json or console (console if debugging)")
+	if err := viper.BindPFlag(configKeyLogFormat, rootCmd.PersistentFlags().Lookup(configKeyLogFormat)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.log.File, configKeyLogFile, "", "Path to the log file (stderr if empty)")
+	if err := viper.BindPFlag(configKeyLogFile, rootCmd.PersistentFlags().Lookup(configKeyLogFile)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().IntVar(&c.log.MaxSizeMB, configKeyLogMaxSize, 100, "Size (in megabytes) of the log file at which it's rotated")
+	if err := viper.BindPFlag(configKeyLogMaxSize, rootCmd.PersistentFlags().Lookup(configKeyLogMaxSize)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().IntVar(&c.log.MaxAgeDays, configKeyLogMaxAge, 0, "Age (in days) after which the rotated log files are removed (kept if 0)")
+	if err := viper.BindPFlag(configKeyLogMaxAge, rootCmd.PersistentFlags().Lookup(configKeyLogMaxAge)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().IntVar(&c.log.MaxBackups, configKeyLogMaxBackups, 0, "Maximum number of the kept rotated log files (all if 0)")
+	if err := viper.BindPFlag(configKeyLogMaxBackups, rootCmd.PersistentFlags().Lookup(configKeyLogMaxBackups)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringToString(configKeyFeatures, nil, "Feature flags of the experimental behavior, e.g. async-pipeline=true")
+	if err := viper.BindPFlag(configKeyFeatures, rootCmd.PersistentFlags().Lookup(configKeyFeatures)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringToStringVar(&c.log.Components, configKeyLogComponents, nil, "Log levels of the components overriding the log level, e.g. ingest=debug,memdb=warn")
+	if err := viper.BindPFlag(configKeyLogComponents, rootCmd.PersistentFlags().Lookup(configKeyLogComponents)); err != nil {
+		panic(err)
+	}
+
 	rootCmd.PersistentFlags().Uint16Var(&c.cfg.grpcPort, configKeyGRPCPort, 9090, "Port for gRPC client connections.")
 	if err := viper.BindPFlag(configKeyGRPCPort, rootCmd.PersistentFlags().Lookup(configKeyGRPCPort)); err != nil {
 		panic(err)
@@ -353,6 +1215,56 @@ func main() {
 		panic(err)
 	}
 
+	rootCmd.PersistentFlags().StringVar(&c.cfg.grpcAddr, configKeyGRPCAddr, "", "Full listen address for gRPC, overrides bind-addr and rpc-port")
+	if err := viper.BindPFlag(configKeyGRPCAddr, rootCmd.PersistentFlags().Lookup(configKeyGRPCAddr)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.cfg.gwAddr, configKeyGWAddr, "", "Full listen address for the gateway, overrides bind-addr and gw-port")
+	if err := viper.BindPFlag(configKeyGWAddr, rootCmd.PersistentFlags().Lookup(configKeyGWAddr)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.cfg.mAddr, configKeyMAddr, "", "Full listen address for metrics, overrides bind-addr and metric-port")
+	if err := viper.BindPFlag(configKeyMAddr, rootCmd.PersistentFlags().Lookup(configKeyMAddr)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().BoolVar(&c.cfg.gwInProcess, configKeyGWInProcess, false, "Call the gRPC handlers in-process from the gateway instead of dialing the gRPC server")
+	if err := viper.BindPFlag(configKeyGWInProcess, rootCmd.PersistentFlags().Lookup(configKeyGWInProcess)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().BoolVar(&c.cfg.singlePort, configKeySinglePort, false, "Serve gRPC, the gateway and the metrics on the gateway port, routing by path and content type")
+	if err := viper.BindPFlag(configKeySinglePort, rootCmd.PersistentFlags().Lookup(configKeySinglePort)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.cfg.gwTLS.CertFile, configKeyGWTLSCert, "", "Path to the gateway TLS certificate file")
+	if err := viper.BindPFlag(configKeyGWTLSCert, rootCmd.PersistentFlags().Lookup(configKeyGWTLSCert)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.cfg.gwTLS.KeyFile, configKeyGWTLSKey, "", "Path to the gateway TLS key file")
+	if err := viper.BindPFlag(configKeyGWTLSKey, rootCmd.PersistentFlags().Lookup(configKeyGWTLSKey)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringSliceVar(&c.cfg.gwTLS.ACMEHosts, configKeyGWACMEHosts, nil, "Public hostnames to obtain Let's Encrypt certificates for (gateway must listen on 443)")
+	if err := viper.BindPFlag(configKeyGWACMEHosts, rootCmd.PersistentFlags().Lookup(configKeyGWACMEHosts)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.cfg.gwTLS.ACMECacheDir, configKeyGWACMECacheDir, "acme-cache", "Directory to store ACME certificates in")
+	if err := viper.BindPFlag(configKeyGWACMECacheDir, rootCmd.PersistentFlags().Lookup(configKeyGWACMECacheDir)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.cfg.gwTLS.ACMEEmail, configKeyGWACMEEmail, "", "Contact email for the ACME account")
+	if err := viper.BindPFlag(configKeyGWACMEEmail, rootCmd.PersistentFlags().Lookup(configKeyGWACMEEmail)); err != nil {
+		panic(err)
+	}
+
 	rootCmd.PersistentFlags().BoolVar(&c.useMemDB, configKeyUseMemDB, true, "Use MemDB (not for production use)")
 	if err := viper.BindPFlag(configKeyUseMemDB, rootCmd.PersistentFlags().Lookup(configKeyUseMemDB)); err != nil {
 		panic(err)
@@ -363,20 +1275,366 @@ func main() {
 		panic(err)
 	}
 
-	rootCmd.PersistentFlags().Int64Var(&c.metricsTimeout, configKeyMetricsTimeout, 5, "Time (in seconds) to wait before metrics recalculation")
+	rootCmd.PersistentFlags().BoolVar(&c.dryRun, configKeyDryRun, false, "Initialize the components and bind the listeners, report what would run and exit")
+	if err := viper.BindPFlag(configKeyDryRun, rootCmd.PersistentFlags().Lookup(configKeyDryRun)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().Int64Var(&c.mockSeed, configKeyMockSeed, 0, "Seed of the mocked data (time based if 0)")
+	if err := viper.BindPFlag(configKeyMockSeed, rootCmd.PersistentFlags().Lookup(configKeyMockSeed)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().Int64Var(&c.metricsTimeout, configKeyMetricsTimeout, 5, "Maximal age (in seconds) of the cached stats, which are also recalculated after their events are inserted")
 	if err := viper.BindPFlag(configKeyMetricsTimeout, rootCmd.PersistentFlags().Lookup(configKeyMetricsTimeout)); err != nil {
 		panic(err)
 	}
 
-	rootCmd.PersistentFlags().StringSliceVar(&c.domains, configKeyDomains, nil, "List of domains to get the analytic from")
+	rootCmd.PersistentFlags().Int64Var(&c.liveInterval, configKeyLiveInterval, 5, "Time (in seconds) between current visitors updates of the live stream")
+	if err := viper.BindPFlag(configKeyLiveInterval, rootCmd.PersistentFlags().Lookup(configKeyLiveInterval)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().BoolVar(&c.ingestAsync, configKeyIngestAsync, false, "Queue incoming events and insert them in batches in the background")
+	if err := viper.BindPFlag(configKeyIngestAsync, rootCmd.PersistentFlags().Lookup(configKeyIngestAsync)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().IntVar(&c.ingest.QueueSize, configKeyIngestQueue, 10000, "Maximum number of events waiting in the ingestion queue")
+	if err := viper.BindPFlag(configKeyIngestQueue, rootCmd.PersistentFlags().Lookup(configKeyIngestQueue)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().IntVar(&c.ingest.BatchSize, configKeyIngestBatch, 100, "Maximum number of events inserted in one batch")
+	if err := viper.BindPFlag(configKeyIngestBatch, rootCmd.PersistentFlags().Lookup(configKeyIngestBatch)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.ingest.FlushInterval, configKeyIngestFlush, time.Second, "Maximum time an event waits in the ingestion queue before being inserted")
+	if err := viper.BindPFlag(configKeyIngestFlush, rootCmd.PersistentFlags().Lookup(configKeyIngestFlush)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().IntVar(&c.ingest.Workers, configKeyIngestWorkers, 2, "Number of ingestion pipeline workers")
+	if err := viper.BindPFlag(configKeyIngestWorkers, rootCmd.PersistentFlags().Lookup(configKeyIngestWorkers)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().String(configKeyIngestOverflow, string(ingest.OverflowBlock), "Policy for a full ingestion queue: block, drop-oldest or reject")
+	if err := viper.BindPFlag(configKeyIngestOverflow, rootCmd.PersistentFlags().Lookup(configKeyIngestOverflow)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().String(configKeyPrivacy, string(analytics.PrivacyIgnore), "Policy for the events sent with the DNT: 1 or Sec-GPC: 1 header: ignore, anonymize (record without the visitor hash) or drop")
+	if err := viper.BindPFlag(configKeyPrivacy, rootCmd.PersistentFlags().Lookup(configKeyPrivacy)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringSliceVar(&c.geoBlocklist, configKeyGeoBlocklist, nil, "Country (e.g. DE) and region (e.g. US-CA) codes of the visitors whose events are only counted and not stored, located by the CF-IPCountry, CloudFront-Viewer-Country or X-Country-Code header")
+	if err := viper.BindPFlag(configKeyGeoBlocklist, rootCmd.PersistentFlags().Lookup(configKeyGeoBlocklist)); err != nil {
+		panic(err)
+	}
+
+	defaultHashInputs := make([]string, len(analytics.DefaultHashInputs))
+	for i, input := range analytics.DefaultHashInputs {
+		defaultHashInputs[i] = string(input)
+	}
+	rootCmd.PersistentFlags().StringSliceVar(&c.hashInputs, configKeyHashInputs, defaultHashInputs, "Components of the salted visitor hash: domain, ip, user-agent and screen (omit ip to hash no IP-derived input)")
+	if err := viper.BindPFlag(configKeyHashInputs, rootCmd.PersistentFlags().Lookup(configKeyHashInputs)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringSliceVar(&c.trustedProxies, configKeyTrustedProxies, analytics.DefaultTrustedProxies, "Addresses and CIDRs of the proxies skipped in X-Forwarded-For to get the client address, the rightmost untrusted one")
+	if err := viper.BindPFlag(configKeyTrustedProxies, rootCmd.PersistentFlags().Lookup(configKeyTrustedProxies)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.timestamps.MaxSkew, configKeyTimestampSkew, time.Minute, "Maximum time the timestamps sent by the clients may be ahead of the server time by")
+	if err := viper.BindPFlag(configKeyTimestampSkew, rootCmd.PersistentFlags().Lookup(configKeyTimestampSkew)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.timestamps.MaxAge, configKeyTimestampAge, 24*time.Hour, "Maximum age of the timestamps sent by the clients, e.g. by the offline trackers (the server time is always used if 0)")
+	if err := viper.BindPFlag(configKeyTimestampAge, rootCmd.PersistentFlags().Lookup(configKeyTimestampAge)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().BoolVar(&c.scrubQuery, configKeyScrubQuery, false, "Remove the query parameters which aren't allowlisted from the stored URLs and referrers")
+	if err := viper.BindPFlag(configKeyScrubQuery, rootCmd.PersistentFlags().Lookup(configKeyScrubQuery)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringSliceVar(&c.queryAllowlist, configKeyQueryAllowlist, analytics.DefaultQueryAllowlist, "Query parameters kept by the URL scrubbing, the names ending with * match by the prefix")
+	if err := viper.BindPFlag(configKeyQueryAllowlist, rootCmd.PersistentFlags().Lookup(configKeyQueryAllowlist)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.ingest.WALPath, configKeyIngestWAL, "", "Path to the write-ahead log of the queued events (disabled if empty), the events which couldn't be inserted are appended to its .dead file as JSONL")
+	if err := viper.BindPFlag(configKeyIngestWAL, rootCmd.PersistentFlags().Lookup(configKeyIngestWAL)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.rollupInterval, configKeyRollupInterval, 5*time.Minute, "Time between hourly and daily rollups recalculation (disabled if 0)")
+	if err := viper.BindPFlag(configKeyRollupInterval, rootCmd.PersistentFlags().Lookup(configKeyRollupInterval)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringSliceVar(&c.kafkaBrokers, configKeyKafkaBrokers, nil, "Kafka brokers to publish accepted events to (disabled if empty)")
+	if err := viper.BindPFlag(configKeyKafkaBrokers, rootCmd.PersistentFlags().Lookup(configKeyKafkaBrokers)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.kafkaTopic, configKeyKafkaTopic, "analytics-events", "Kafka topic to publish accepted events to")
+	if err := viper.BindPFlag(configKeyKafkaTopic, rootCmd.PersistentFlags().Lookup(configKeyKafkaTopic)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.webhooksConfig, configKeyWebhooks, "", "Path to the webhooks configuration file (disabled if empty)")
+	if err := viper.BindPFlag(configKeyWebhooks, rootCmd.PersistentFlags().Lookup(configKeyWebhooks)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.amqpURL, configKeyAMQPURL, "", "AMQP URL to consume events from (disabled if empty)")
+	if err := viper.BindPFlag(configKeyAMQPURL, rootCmd.PersistentFlags().Lookup(configKeyAMQPURL)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.amqpQueue, configKeyAMQPQueue, "analytics-events", "AMQP queue to consume events from")
+	if err := viper.BindPFlag(configKeyAMQPQueue, rootCmd.PersistentFlags().Lookup(configKeyAMQPQueue)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().IntVar(&c.amqpPrefetch, configKeyAMQPPrefetch, 100, "Maximum number of unacknowledged AMQP messages")
+	if err := viper.BindPFlag(configKeyAMQPPrefetch, rootCmd.PersistentFlags().Lookup(configKeyAMQPPrefetch)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.mqtt.Broker, configKeyMQTTBroker, "", "MQTT broker URL to receive events from, e.g. tcp://localhost:1883 (disabled if empty)")
+	if err := viper.BindPFlag(configKeyMQTTBroker, rootCmd.PersistentFlags().Lookup(configKeyMQTTBroker)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.mqtt.Topic, configKeyMQTTTopic, "analytics/events", "MQTT topic to receive events from")
+	if err := viper.BindPFlag(configKeyMQTTTopic, rootCmd.PersistentFlags().Lookup(configKeyMQTTTopic)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().Uint8Var(&c.mqtt.QoS, configKeyMQTTQoS, 1, "MQTT subscription QoS level (0, 1 or 2)")
+	if err := viper.BindPFlag(configKeyMQTTQoS, rootCmd.PersistentFlags().Lookup(configKeyMQTTQoS)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.mqtt.ClientID, configKeyMQTTClientID, "analytics-exporter", "MQTT client identifier")
+	if err := viper.BindPFlag(configKeyMQTTClientID, rootCmd.PersistentFlags().Lookup(configKeyMQTTClientID)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.archiveURL, configKeyArchiveURL, "", "Storage to archive old events to: file:///dir or s3://bucket/prefix (disabled if empty)")
+	if err := viper.BindPFlag(configKeyArchiveURL, rootCmd.PersistentFlags().Lookup(configKeyArchiveURL)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.archiveAfter, configKeyArchiveAfter, 30*24*time.Hour, "Age after which events are archived and deleted")
+	if err := viper.BindPFlag(configKeyArchiveAfter, rootCmd.PersistentFlags().Lookup(configKeyArchiveAfter)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.archiveInterval, configKeyArchiveEvery, time.Hour, "Time between archival runs")
+	if err := viper.BindPFlag(configKeyArchiveEvery, rootCmd.PersistentFlags().Lookup(configKeyArchiveEvery)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.retentionInterval, configKeyRetentionEvery, time.Hour, "Time between purges of the events older than the retention of their sites, when they aren't archived (disabled if 0)")
+	if err := viper.BindPFlag(configKeyRetentionEvery, rootCmd.PersistentFlags().Lookup(configKeyRetentionEvery)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.leaderElection, configKeyLeaderElection, "", "Lock of the lease electing the replica running the rollups, the archival, the retention, the salt rotation, the reports and the alerts: kubernetes (they run on every replica if empty)")
+	if err := viper.BindPFlag(configKeyLeaderElection, rootCmd.PersistentFlags().Lookup(configKeyLeaderElection)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.leaderLease, configKeyLeaderLease, "analytics-exporter", "Name of the lease of the leader election, the Lease object of the pod namespace with kubernetes")
+	if err := viper.BindPFlag(configKeyLeaderLease, rootCmd.PersistentFlags().Lookup(configKeyLeaderLease)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.leaderTTL, configKeyLeaderTTL, 15*time.Second, "Time the lease of the leader is held for without the renewal, which is attempted every third of it")
+	if err := viper.BindPFlag(configKeyLeaderTTL, rootCmd.PersistentFlags().Lookup(configKeyLeaderTTL)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringSliceVar(&c.peers, configKeyPeers, nil, "Base URLs of the gateways of the replicas the inserted and the deleted events are replicated to and restored from on start, e.g. http://analytics-1:8080 (disabled if empty)")
+	if err := viper.BindPFlag(configKeyPeers, rootCmd.PersistentFlags().Lookup(configKeyPeers)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.replicationKey, configKeyReplicationKey, "", "Key shared by the peers authenticating the replication requests")
+	if err := viper.BindPFlag(configKeyReplicationKey, rootCmd.PersistentFlags().Lookup(configKeyReplicationKey)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.smtp.Addr, configKeySMTPAddr, "", "SMTP server host:port the email reports of the sites are sent through (disabled if empty)")
+	if err := viper.BindPFlag(configKeySMTPAddr, rootCmd.PersistentFlags().Lookup(configKeySMTPAddr)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.smtp.Username, configKeySMTPUsername, "", "SMTP username, the server is used without authentication if empty")
+	if err := viper.BindPFlag(configKeySMTPUsername, rootCmd.PersistentFlags().Lookup(configKeySMTPUsername)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.smtp.Password, configKeySMTPPassword, "", "SMTP password")
+	if err := viper.BindPFlag(configKeySMTPPassword, rootCmd.PersistentFlags().Lookup(configKeySMTPPassword)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.smtp.From, configKeySMTPFrom, "", "Sender address of the email reports")
+	if err := viper.BindPFlag(configKeySMTPFrom, rootCmd.PersistentFlags().Lookup(configKeySMTPFrom)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.alertInterval, configKeyAlertInterval, time.Minute, "Interval of the evaluation of the alert rules of the sites (disabled if 0)")
+	if err := viper.BindPFlag(configKeyAlertInterval, rootCmd.PersistentFlags().Lookup(configKeyAlertInterval)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringSliceVar(&c.domains, configKeyDomains, nil, "List of domains to get the analytic from (ignored if the sites config is set)")
 	if err := viper.BindPFlag(configKeyDomains, rootCmd.PersistentFlags().Lookup(configKeyDomains)); err != nil {
 		panic(err)
 	}
 
+	rootCmd.PersistentFlags().StringSliceVar(&c.autoDomains, configKeyAutoDomains, nil, "Patterns of the domains the metrics are exposed for from their first events, when they aren't configured, e.g. *.example.com")
+	if err := viper.BindPFlag(configKeyAutoDomains, rootCmd.PersistentFlags().Lookup(configKeyAutoDomains)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.salt.Lifetime, configKeySaltLifetime, salt.DefaultLifetime, "Time after which the salt of the visitor hashes is rotated")
+	if err := viper.BindPFlag(configKeySaltLifetime, rootCmd.PersistentFlags().Lookup(configKeySaltLifetime)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().IntVar(&c.salt.Size, configKeySaltSize, salt.DefaultSize, "Number of random bytes of the salt of the visitor hashes")
+	if err := viper.BindPFlag(configKeySaltSize, rootCmd.PersistentFlags().Lookup(configKeySaltSize)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.salt.Path, configKeySaltPath, "", "Path to persist the salt of the visitor hashes to, so visitors are recognized after restarts (kept in memory if empty)")
+	if err := viper.BindPFlag(configKeySaltPath, rootCmd.PersistentFlags().Lookup(configKeySaltPath)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().BoolVar(&c.salt.Shared, configKeySaltShared, false, "Share the salt persisted to the salt path, e.g. on a shared volume, with the other replicas, so they hash the visitors identically")
+	if err := viper.BindPFlag(configKeySaltShared, rootCmd.PersistentFlags().Lookup(configKeySaltShared)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.salt.Grace, configKeySaltGrace, 0, "Time after the salt rotation the visitors seen within it before keep their hashes of the previous salt (disabled if 0)")
+	if err := viper.BindPFlag(configKeySaltGrace, rootCmd.PersistentFlags().Lookup(configKeySaltGrace)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.sitesConfig, configKeySites, "", "Path to the sites configuration file defining the domains and their settings")
+	if err := viper.BindPFlag(configKeySites, rootCmd.PersistentFlags().Lookup(configKeySites)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.adminToken, configKeyAdminToken, "", "Token of the admin service managing the sites and their API keys (disabled if empty)")
+	if err := viper.BindPFlag(configKeyAdminToken, rootCmd.PersistentFlags().Lookup(configKeyAdminToken)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.linkSecret, configKeyLinkSecret, "", "Secret the shared links to the stats are signed with, at least 16 characters (random if empty)")
+	if err := viper.BindPFlag(configKeyLinkSecret, rootCmd.PersistentFlags().Lookup(configKeyLinkSecret)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.oidcIssuer, configKeyOIDCIssuer, "", "Issuer URL of the OpenID Connect provider the users sign in with, e.g. https://accounts.google.com (disabled if empty)")
+	if err := viper.BindPFlag(configKeyOIDCIssuer, rootCmd.PersistentFlags().Lookup(configKeyOIDCIssuer)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.oidcClientID, configKeyOIDCClientID, "", "Client ID the ID tokens of the OpenID Connect provider must be issued for")
+	if err := viper.BindPFlag(configKeyOIDCClientID, rootCmd.PersistentFlags().Lookup(configKeyOIDCClientID)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.oidcAdminGroup, configKeyOIDCAdminGroup, "", "Group of the \"groups\" claim of the ID tokens granting the admin access to the sessions (none if empty)")
+	if err := viper.BindPFlag(configKeyOIDCAdminGroup, rootCmd.PersistentFlags().Lookup(configKeyOIDCAdminGroup)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&c.sessionSecret, configKeySessionSecret, "", "Secret the sessions of the users are signed with, at least 16 characters (random if empty)")
+	if err := viper.BindPFlag(configKeySessionSecret, rootCmd.PersistentFlags().Lookup(configKeySessionSecret)); err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&c.sessionTTL, configKeySessionTTL, sites.DefaultSessionTTL, "Lifetime of the sessions of the users signed in with the OpenID Connect provider")
+	if err := viper.BindPFlag(configKeySessionTTL, rootCmd.PersistentFlags().Lookup(configKeySessionTTL)); err != nil {
+		panic(err)
+	}
+
 	if err := viper.BindPFlags(rootCmd.Flags()); err != nil {
 		panic(err)
 	}
 
+	// Setup subcommands
+	rootCmd.AddCommand(newLoadgenCmd())
+	rootCmd.AddCommand(newImportCmd(&c))
+	rootCmd.AddCommand(newExportCmd(&c))
+	rootCmd.AddCommand(newSeedCmd())
+	rootCmd.AddCommand(newValidateCmd(&c))
+	rootCmd.AddCommand(newStatsCmd())
+	rootCmd.AddCommand(newTailLogsCmd())
+	rootCmd.AddCommand(newSendEventCmd())
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "version",
+		Short: "Print the build metadata",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, _ []string) {
+			fmt.Print(version.String())
+		},
+	})
+
 	// Start the ball
 	cobra.CheckErr(rootCmd.Execute())
 }
+
+// runJobs runs the background jobs in the group until ctx is done, on the leader of the replicas
+// elected by the lease of the configured lock, or right away without the election.
+func (c *cli) runJobs(ctx context.Context, group *errgroup.Group, jobs []func(ctx context.Context)) error {
+	var lock leader.Lock
+	var err error
+	switch c.leaderElection {
+	case "":
+		for _, job := range jobs {
+			group.Go(func() error {
+				job(ctx)
+				return nil
+			})
+		}
+		return nil
+	case leaderElectionKubernetes:
+		lock, err = leader.NewKubernetesLock(c.leaderLease)
+	default:
+		err = fmt.Errorf("unknown lock %q", c.leaderElection)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot create the leader election lock: %w", err)
+	}
+
+	// The replicas of the same host, e.g. during the zero downtime restart, campaign separately
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("cannot get the hostname: %w", err)
+	}
+	elector, err := leader.NewElector(lock, hostname+"_"+uuid.NewString(), c.leaderTTL)
+	if err != nil {
+		return fmt.Errorf("cannot create the leader elector: %w", err)
+	}
+	group.Go(func() error {
+		elector.Run(ctx, jobs...)
+		return nil
+	})
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/analytics"
+	"diploma/analytics-exporter/internal/grpcwrap"
+	"diploma/analytics-exporter/internal/mock"
+	analyticsApi "diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/metadata"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// seedTimeScale is how many times faster than in the generated visits the page views are sent.
+const seedTimeScale = 60
+
+// seeder holds the seed settings.
+type seeder struct {
+	target   string
+	tls      bool
+	apiKey   string
+	domains  []string
+	visitors int
+	interval time.Duration
+	duration time.Duration
+	seed     int64
+
+	customEventRate float64
+	diurnal         bool
+}
+
+// newSeedCmd returns the command sending mocked visits to a running instance over the public API.
+func newSeedCmd() *cobra.Command {
+	sd := seeder{}
+	cmd := &cobra.Command{
+		Use:   "seed",
+		Short: "Send mocked visits to a running instance over the public API",
+		Long: `Send mocked visits to a running instance over the public API.
+
+A batch of visits is started every interval, the page views of a visit are sent
+` + fmt.Sprint(seedTimeScale) + ` times faster than generated, so a visit of half an hour takes half a minute.`,
+		Args: cobra.NoArgs,
+		RunE: sd.run,
+	}
+
+	cmd.Flags().StringVar(&sd.target, "target", "localhost:9090", "gRPC address of the target instance")
+	cmd.Flags().BoolVar(&sd.tls, "tls", false, "Connect to the target instance over TLS")
+	cmd.Flags().StringVar(&sd.apiKey, "api-key", "", "API key of the site, required by the multi-tenant instances")
+	cmd.Flags().StringSliceVar(&sd.domains, "domains", []string{"web"}, "Domains to send visits for")
+	cmd.Flags().IntVar(&sd.visitors, "visitors", 10, "Maximum number of visitors in a batch")
+	cmd.Flags().DurationVar(&sd.interval, "interval", 10*time.Second, "Time between the batches of visits")
+	cmd.Flags().DurationVar(&sd.duration, "duration", time.Minute, "Time to start new batches for (0 to run until interrupted)")
+	cmd.Flags().Int64Var(&sd.seed, "seed", 0, "Seed of the generated data (time based if 0)")
+	cmd.Flags().Float64Var(&sd.customEventRate, "custom-event-rate", 0.1, "Probability of a custom event following a page view")
+	cmd.Flags().BoolVar(&sd.diurnal, "diurnal", true, "Scale the number of visitors by the hour of the day")
+
+	return cmd
+}
+
+func (sd *seeder) run(_ *cobra.Command, _ []string) error {
+	if sd.interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	seed := sd.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	cfg := mock.DefaultConfig(sd.domains, sd.visitors, seed)
+	cfg.CustomEventRate = sd.customEventRate
+	if !sd.diurnal {
+		cfg.Diurnal = nil
+	}
+	generator, err := mock.NewGenerator(cfg)
+	if err != nil {
+		return err
+	}
+
+	conn, err := grpcwrap.NewClientConn(sd.target, sd.tls, grpcwrap.WithAPIKey(sd.apiKey))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := analyticsApi.NewAnalyticsClient(conn)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	batchesCtx := ctx
+	if sd.duration > 0 {
+		var cancelBatches context.CancelFunc
+		batchesCtx, cancelBatches = context.WithTimeout(ctx, sd.duration)
+		defer cancelBatches()
+	}
+
+	fmt.Fprintf(os.Stderr, "Seeding %v at %s with seed %d\n", sd.domains, sd.target, seed)
+	var sent, failed atomic.Int64
+	var wg sync.WaitGroup
+	ticker := time.NewTicker(sd.interval)
+	defer ticker.Stop()
+	for {
+		started := time.Now()
+		for _, visit := range generator.Visits(started) {
+			wg.Add(1)
+			go func(visit *mock.Visit) {
+				defer wg.Done()
+				visitCtx := metadata.NewOutgoingContext(ctx, metadata.Pairs(
+					analytics.MetadataClientAddress, visit.IP,
+					analytics.MetadataUserAgent, visit.UserAgent,
+				))
+				for _, e := range visit.Events {
+					// Keep the pace of the visit, so the page views are counted as a single visit
+					delay := e.GetTimestamp().AsTime().Sub(started) / seedTimeScale
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(time.Until(started.Add(delay))):
+					}
+					_, err := client.CreateEvent(visitCtx, &analyticsApi.Event{
+						Type:     e.GetType(),
+						URL:      e.GetURL(),
+						Domain:   e.GetDomain(),
+						Referrer: e.GetReferrer(),
+						Props:    e.GetProps(),
+					})
+					if err != nil {
+						failed.Add(1)
+						continue
+					}
+					sent.Add(1)
+				}
+			}(visit)
+		}
+
+		select {
+		case <-batchesCtx.Done():
+			// Let the started visits finish unless interrupted
+			wg.Wait()
+			fmt.Printf("sent: %d\nfailed: %d\n", sent.Load(), failed.Load())
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"diploma/analytics-exporter/internal/grpcwrap"
+	"diploma/analytics-exporter/internal/tracker"
+	analyticsApi "diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultSendEventUserAgent is the user agent of the test events, a desktop browser so the event is stored as is.
+const defaultSendEventUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+
+// eventSender holds the send-event settings.
+type eventSender struct {
+	target    string
+	protocol  string
+	tls       bool
+	apiKey    string
+	timeout   time.Duration
+	domain    string
+	eventType string
+	path      string
+	url       string
+	referrer  string
+	userAgent string
+	ip        string
+	origin    string
+	props     map[string]string
+}
+
+// newSendEventCmd returns the command sending a single test event to a running instance.
+func newSendEventCmd() *cobra.Command {
+	es := eventSender{}
+	cmd := &cobra.Command{
+		Use:   "send-event",
+		Short: "Send a single test event to a running instance",
+		Long: "Send a single test event over gRPC or HTTP and print the result, e.g. to check the ingestion,\n" +
+			"the API keys and the allowed origins of a deployment.",
+		Args: cobra.NoArgs,
+		RunE: es.run,
+	}
+
+	cmd.Flags().StringVar(&es.target, "target", "localhost:9090", "Address of the target instance (host:port for grpc, base URL for http, http://localhost:8080 by default)")
+	cmd.Flags().StringVar(&es.protocol, "protocol", "grpc", "Protocol to send the event with: grpc or http")
+	cmd.Flags().BoolVar(&es.tls, "tls", false, "Connect to the gRPC instance over TLS")
+	cmd.Flags().StringVar(&es.apiKey, "api-key", "", "API key of the site, required by the keyed sites")
+	cmd.Flags().DurationVar(&es.timeout, "timeout", 10*time.Second, "Timeout of the request")
+	cmd.Flags().StringVar(&es.domain, "domain", "", "Domain of the event")
+	cmd.Flags().StringVar(&es.eventType, "type", "pageview", "Type of the event")
+	cmd.Flags().StringVar(&es.path, "path", "/", "Path of the page of the event")
+	cmd.Flags().StringVar(&es.url, "url", "", "URL of the page of the event (overrides path)")
+	cmd.Flags().StringVar(&es.referrer, "referrer", "", "Referrer of the event")
+	cmd.Flags().StringVar(&es.userAgent, "user-agent", defaultSendEventUserAgent, "User agent of the visitor")
+	cmd.Flags().StringVar(&es.ip, "ip", "", "Client address of the visitor (127.0.0.1 over grpc, the own one over http if empty)")
+	cmd.Flags().StringVar(&es.origin, "origin", "", "Origin the event is sent from, checked against the allowed origins of the site")
+	cmd.Flags().StringToStringVar(&es.props, "props", nil, "Props of the event, e.g. plan=pro,seats=3")
+
+	return cmd
+}
+
+func (es *eventSender) run(cmd *cobra.Command, _ []string) error {
+	if es.domain == "" {
+		return errors.New("the domain is missing")
+	}
+	if es.protocol != "grpc" && es.protocol != "http" {
+		return fmt.Errorf("unsupported protocol %q", es.protocol)
+	}
+	if es.protocol == "http" && !cmd.Flags().Changed("target") {
+		es.target = "http://localhost:8080"
+	}
+	e := &analyticsApi.Event{
+		Type:     es.eventType,
+		Domain:   es.domain,
+		URL:      es.url,
+		Referrer: es.referrer,
+		Props:    es.props,
+	}
+	if e.URL == "" {
+		e.URL = "https://" + es.domain + "/" + strings.TrimPrefix(es.path, "/")
+	}
+	// The flags are valid at this point, so the usage doesn't help with the errors of the instance
+	cmd.SilenceUsage = true
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), es.timeout)
+	defer cancel()
+	var err error
+	switch es.protocol {
+	case "grpc":
+		err = es.sendGRPC(ctx, e)
+	case "http":
+		err = es.sendHTTP(ctx, e)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot send event: %w", err)
+	}
+	fmt.Printf("Sent %s event of %s to %s over %s\n", e.GetType(), e.GetURL(), es.target, es.protocol)
+	return nil
+}
+
+// sendGRPC sends the event with the metadata set the way the gateway does.
+func (es *eventSender) sendGRPC(ctx context.Context, e *analyticsApi.Event) error {
+	conn, err := grpcwrap.NewClientConn(es.target, es.tls, grpcwrap.WithAPIKey(es.apiKey))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ip := es.ip
+	if ip == "" {
+		ip = "127.0.0.1"
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", ip, "grpcgateway-user-agent", es.userAgent)
+	if es.origin != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "grpcgateway-origin", es.origin)
+	}
+	if _, err = analyticsApi.NewAnalyticsClient(conn).CreateEvent(ctx, e); err != nil {
+		s := status.Convert(err)
+		return fmt.Errorf("%s: %s", s.Code(), s.Message())
+	}
+	return nil
+}
+
+// sendHTTP posts the event to the ingestion endpoint the way the tracker script does.
+func (es *eventSender) sendHTTP(ctx context.Context, e *analyticsApi.Event) error {
+	body, err := json.Marshal(map[string]any{
+		"type":     e.GetType(),
+		"url":      e.GetURL(),
+		"domain":   e.GetDomain(),
+		"referrer": e.GetReferrer(),
+		"props":    e.GetProps(),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(es.target, "/")+tracker.EventPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", es.userAgent)
+	if es.ip != "" {
+		req.Header.Set("X-Forwarded-For", es.ip)
+	}
+	if es.origin != "" {
+		req.Header.Set("Origin", es.origin)
+	}
+	if es.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+es.apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
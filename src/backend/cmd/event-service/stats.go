@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cmp"
+	"diploma/analytics-exporter/internal/grpcwrap"
+	"diploma/analytics-exporter/internal/sites"
+	analyticsApi "diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// statsBarWidth is the width of the bar of the most frequent entry in the report.
+const statsBarWidth = 30
+
+// statsReporter holds the stats settings.
+type statsReporter struct {
+	target string
+	tls    bool
+	apiKey string
+	domain string
+	period string
+	from   string
+	to     string
+	top    int
+}
+
+// newStatsCmd returns the command printing the stats of a running instance.
+func newStatsCmd() *cobra.Command {
+	sr := statsReporter{}
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Print a report of the stats of a domain from a running instance",
+		Args:  cobra.NoArgs,
+		RunE:  sr.run,
+	}
+
+	cmd.Flags().StringVar(&sr.target, "target", "localhost:9090", "gRPC address of the instance")
+	cmd.Flags().BoolVar(&sr.tls, "tls", false, "Connect to the instance over TLS")
+	cmd.Flags().StringVar(&sr.apiKey, "api-key", "", "Token of the site granting the viewer or the owner role, required by the multi-tenant instances")
+	cmd.Flags().StringVar(&sr.domain, "domain", "", "Domain to report the stats of")
+	cmd.Flags().StringVar(&sr.period, "period", "24h", "Period to report, a duration or a number of days like 7d before now, all, or today, yesterday, month, last_month or year in the site timezone")
+	cmd.Flags().StringVar(&sr.from, "from", "", "Start of the time range, RFC 3339 timestamp or date (overrides period)")
+	cmd.Flags().StringVar(&sr.to, "to", "", "Exclusive end of the time range, RFC 3339 timestamp or date (now if empty)")
+	cmd.Flags().IntVar(&sr.top, "top", 10, "Number of the entries shown in each top list")
+
+	return cmd
+}
+
+func (sr *statsReporter) run(cmd *cobra.Command, _ []string) error {
+	if sr.domain == "" {
+		return errors.New("the domain is missing")
+	}
+	if sr.top <= 0 {
+		return errors.New("top must be positive")
+	}
+
+	req := &analyticsApi.GetStatsRequest{Domain: sr.domain}
+	to := time.Now()
+	if sr.to != "" {
+		t, err := parseTimeFlag(sr.to)
+		if err != nil {
+			return fmt.Errorf("invalid to: %w", err)
+		}
+		to = t
+		req.To = timestamppb.New(to)
+	}
+	switch {
+	case sr.from != "":
+		from, err := parseTimeFlag(sr.from)
+		if err != nil {
+			return fmt.Errorf("invalid from: %w", err)
+		}
+		req.From = timestamppb.New(from)
+	case slices.Contains(calendarPeriods, sr.period):
+		if req.To != nil {
+			return errors.New("calendar periods cannot be combined with to")
+		}
+		req.Period = sr.period
+	case sr.period != "all":
+		period, err := parsePeriod(sr.period)
+		if err != nil {
+			return fmt.Errorf("invalid period: %w", err)
+		}
+		req.From = timestamppb.New(to.Add(-period))
+	}
+
+	conn, err := grpcwrap.NewClientConn(sr.target, sr.tls, grpcwrap.WithAPIKey(sr.apiKey))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stats, err := analyticsApi.NewAnalyticsClient(conn).GetStats(cmd.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	return sr.print(os.Stdout, req, stats)
+}
+
+// calendarPeriods are the periods resolved by the instance in the site timezone.
+var calendarPeriods = []string{sites.PeriodToday, sites.PeriodYesterday, sites.PeriodMonth, sites.PeriodLastMonth, sites.PeriodYear}
+
+// print writes the report of the stats to w, the time range is shown in the site timezone.
+func (sr *statsReporter) print(w io.Writer, req *analyticsApi.GetStatsRequest, stats *analyticsApi.Stats) error {
+	loc, err := time.LoadLocation(stats.GetTimezone())
+	if err != nil || stats.GetTimezone() == "" {
+		loc = time.Local
+	}
+	from, to := "beginning", "now"
+	if t := cmp.Or(stats.GetFrom(), req.GetFrom()); t != nil {
+		from = t.AsTime().In(loc).Format(time.DateTime)
+	}
+	if t := cmp.Or(stats.GetTo(), req.GetTo()); t != nil {
+		to = t.AsTime().In(loc).Format(time.DateTime)
+	}
+	var zone string
+	if stats.GetTimezone() != "" {
+		zone = " (" + stats.GetTimezone() + ")"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s, %s to %s%s\n\n", sr.domain, from, to, zone)
+	fmt.Fprintf(tw, "Unique visitors\t%d\n", stats.GetUniqueVisitors())
+	fmt.Fprintf(tw, "Visits\t%d\n", stats.GetTotalVisits())
+	fmt.Fprintf(tw, "Page views\t%d\n", stats.GetTotalPageViews())
+	fmt.Fprintf(tw, "Bounce rate\t%.1f%%\n", stats.GetBounceRate()*100)
+	fmt.Fprintf(tw, "Current visitors\t%d\n", stats.GetCurrentVisitors())
+
+	sections := []struct {
+		title  string
+		counts map[string]int64
+	}{
+		{"Top pages", stats.GetPages()},
+		{"Entry pages", stats.GetEntryPages()},
+		{"Exit pages", stats.GetExitPages()},
+		{"Sources", stats.GetSources()},
+		{"Devices", stats.GetDevices()},
+		{"Browsers", stats.GetBrowsers()},
+		{"Operating systems", stats.GetOSs()},
+	}
+	for _, s := range sections {
+		fmt.Fprintf(tw, "\n%s\n", s.title)
+		writeTop(tw, s.counts, sr.top)
+	}
+
+	return tw.Flush()
+}
+
+// writeTop writes the n most frequent entries of the counts with the bars proportional to the counts.
+func writeTop(w io.Writer, counts map[string]int64, n int) {
+	if len(counts) == 0 {
+		fmt.Fprintln(w, "  (none)")
+		return
+	}
+
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if c := cmp.Compare(counts[b], counts[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	maxCount := counts[keys[0]]
+	for _, k := range keys {
+		name := k
+		if name == "" {
+			name = "(direct)"
+		}
+		bar := strings.Repeat("█", max(int(counts[k]*statsBarWidth/max(maxCount, 1)), 1))
+		fmt.Fprintf(w, "  %s\t%d\t%s\n", name, counts[k], bar)
+	}
+}
+
+// parsePeriod parses a duration, also accepting a number of days like 7d.
+func parsePeriod(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(v)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/accesslog"
+	analyticsApi "diploma/analytics-exporter/pkg/api/analytics"
+	"diploma/analytics-exporter/pkg/client"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// logTailer holds the tail-logs settings.
+type logTailer struct {
+	target        string
+	tls           bool
+	apiKey        string
+	domain        string
+	format        string
+	scheme        string
+	fromStart     bool
+	pollInterval  time.Duration
+	excludePaths  []string
+	excludeExts   []string
+	otherHosts    bool
+	flushInterval time.Duration
+}
+
+// newTailLogsCmd returns the command following the access logs and sending their pageviews to a running instance.
+func newTailLogsCmd() *cobra.Command {
+	lt := logTailer{}
+	cmd := &cobra.Command{
+		Use:   "tail-logs <file>...",
+		Short: "Follow the access logs of a web server and send their pageviews to a running instance",
+		Long: "Follow the Nginx, Apache or Caddy access logs and send the successful GET requests of the pages\n" +
+			"as the pageviews, the visitors are identified by the client addresses and the user agents of the requests.\n" +
+			"The format is combined, common, caddy or an Nginx log_format definition.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: lt.run,
+	}
+
+	cmd.Flags().StringVar(&lt.target, "target", "localhost:9090", "gRPC address of the instance")
+	cmd.Flags().BoolVar(&lt.tls, "tls", false, "Connect to the instance over TLS")
+	cmd.Flags().StringVar(&lt.apiKey, "api-key", "", "API key of the site, required by the keyed sites")
+	cmd.Flags().StringVar(&lt.domain, "domain", "", "Domain the pageviews are sent for")
+	cmd.Flags().StringVar(&lt.format, "format", accesslog.FormatCombined, "Format of the logs: combined, common, caddy or an Nginx log_format definition")
+	cmd.Flags().StringVar(&lt.scheme, "scheme", "https", "Scheme of the page URLs")
+	cmd.Flags().BoolVar(&lt.fromStart, "from-start", false, "Send the requests already in the files too")
+	cmd.Flags().DurationVar(&lt.pollInterval, "poll-interval", time.Second, "Interval of checking the files for the new lines")
+	cmd.Flags().StringSliceVar(&lt.excludePaths, "exclude-paths", nil, "Path prefixes which aren't sent, e.g. /api/,/healthz")
+	cmd.Flags().StringSliceVar(&lt.excludeExts, "exclude-extensions", []string{".css", ".js", ".map", ".png", ".jpg", ".jpeg", ".gif", ".svg", ".ico", ".webp", ".avif", ".woff", ".woff2", ".ttf", ".xml", ".txt", ".json"}, "Extensions of the assets which aren't sent")
+	cmd.Flags().BoolVar(&lt.otherHosts, "other-hosts", false, "Send the requests of the hosts other than the domain and its subdomains")
+	cmd.Flags().DurationVar(&lt.flushInterval, "flush-interval", client.DefaultFlushInterval, "Interval of sending the queued pageviews")
+
+	return cmd
+}
+
+func (lt *logTailer) run(_ *cobra.Command, files []string) error {
+	if lt.domain == "" {
+		return errors.New("the domain is missing")
+	}
+	if lt.pollInterval <= 0 {
+		return errors.New("poll interval must be positive")
+	}
+	parser, err := accesslog.NewParser(lt.format)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			return err
+		}
+	}
+
+	var sent, skipped, dropped, failed atomic.Int64
+	c, err := client.New(lt.target, client.Options{
+		TLS:           lt.tls,
+		APIKey:        lt.apiKey,
+		FlushInterval: lt.flushInterval,
+		OnError: func(e *analyticsApi.Event, err error) {
+			failed.Add(1)
+			fmt.Fprintf(os.Stderr, "cannot send pageview of %s: %v\n", e.GetURL(), err)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	lines := make(chan string)
+	errs := make(chan error, len(files))
+	var wg sync.WaitGroup
+	for _, file := range files {
+		wg.Add(1)
+		go func(file string) {
+			defer wg.Done()
+			if err := accesslog.Follow(ctx, file, lt.fromStart, lt.pollInterval, lines); err != nil {
+				errs <- fmt.Errorf("cannot follow %s: %w", file, err)
+				cancel()
+			}
+		}(file)
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Following %d files, sending pageviews of %s to %s\n", len(files), lt.domain, lt.target)
+	for line := range lines {
+		entry, err := parser.Parse(line)
+		if err != nil || !lt.pageview(entry) {
+			skipped.Add(1)
+			continue
+		}
+		host := entry.Host
+		if host == "" {
+			host = lt.domain
+		}
+		e := &analyticsApi.Event{
+			Type:     "pageview",
+			Domain:   lt.domain,
+			URL:      lt.scheme + "://" + host + entry.URI,
+			Referrer: entry.Referrer,
+		}
+		if err := c.Enqueue(e, client.Visitor{IP: entry.RemoteAddr, UserAgent: entry.UserAgent}); err != nil {
+			dropped.Add(1)
+			continue
+		}
+		sent.Add(1)
+	}
+
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer closeCancel()
+	closeErr := c.Close(closeCtx)
+	fmt.Fprintf(os.Stderr, "Sent: %d, skipped: %d, dropped: %d, failed: %d\n",
+		sent.Load()-failed.Load(), skipped.Load(), dropped.Load(), failed.Load())
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return closeErr
+	}
+}
+
+// pageview reports whether the entry is a pageview of the domain.
+func (lt *logTailer) pageview(e *accesslog.Entry) bool {
+	if e.Method != "" && e.Method != "GET" {
+		return false
+	}
+	if e.Status != 0 && (e.Status < 200 || e.Status >= 400) {
+		return false
+	}
+	if !strings.HasPrefix(e.URI, "/") {
+		return false
+	}
+	p, _, _ := strings.Cut(e.URI, "?")
+	for _, prefix := range lt.excludePaths {
+		if strings.HasPrefix(p, prefix) {
+			return false
+		}
+	}
+	if ext := strings.ToLower(path.Ext(p)); ext != "" && slices.Contains(lt.excludeExts, ext) {
+		return false
+	}
+	if host, _, _ := strings.Cut(strings.ToLower(e.Host), ":"); !lt.otherHosts && host != "" && host != lt.domain && !strings.HasSuffix(host, "."+lt.domain) {
+		return false
+	}
+	return true
+}
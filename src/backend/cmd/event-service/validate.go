@@ -0,0 +1,279 @@
+package main
+
+import (
+	"diploma/analytics-exporter/internal/analytics"
+	"diploma/analytics-exporter/internal/archive"
+	"diploma/analytics-exporter/internal/oidc"
+	"diploma/analytics-exporter/internal/report"
+	"diploma/analytics-exporter/internal/salt"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/internal/webhook"
+	"fmt"
+	"github.com/spf13/cobra"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// domainRegexp matches a host name of one or more dot separated labels.
+var domainRegexp = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// newValidateCmd returns the command checking the configuration without starting the service.
+func newValidateCmd(c *cli) *cobra.Command {
+	var checkConnectivity bool
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Check the flags, the config file and the sites file without starting the service",
+		Args:  cobra.NoArgs,
+		// Errors are reported by the command itself
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := c.setupConfig(cmd, args); err != nil {
+				fmt.Fprintln(os.Stderr, "✗", err)
+				return err
+			}
+
+			problems := c.validate()
+			if checkConnectivity {
+				problems = append(problems, c.checkConnectivity()...)
+			}
+			if len(problems) > 0 {
+				for _, p := range problems {
+					fmt.Fprintln(os.Stderr, "✗", p)
+				}
+				return fmt.Errorf("found %d configuration problems", len(problems))
+			}
+
+			fmt.Println("✓ configuration is valid")
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&checkConnectivity, "check-connectivity", false, "Also check that the configured brokers and storages are reachable")
+
+	return cmd
+}
+
+// validate returns the problems of the configuration.
+func (c *cli) validate() []string {
+	problems := make([]string, 0)
+
+	if err := c.loadSites(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, d := range c.domains {
+		if !domainRegexp.MatchString(d) {
+			problems = append(problems, fmt.Sprintf("invalid domain %q", d))
+		}
+	}
+
+	listeners := c.listeners()
+	for i, lis := range listeners {
+		host, port, err := net.SplitHostPort(lis.addr)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s address: %v", lis.name, err))
+			continue
+		}
+		if port == "" || port == "0" {
+			problems = append(problems, fmt.Sprintf("%s port is not set", lis.name))
+			continue
+		}
+		for _, other := range listeners[:i] {
+			otherHost, otherPort, err := net.SplitHostPort(other.addr)
+			if err != nil {
+				continue
+			}
+			if port == otherPort && (host == otherHost || isWildcardHost(host) || isWildcardHost(otherHost)) {
+				problems = append(problems, fmt.Sprintf("%s and %s addresses %s and %s overlap", other.name, lis.name, other.addr, lis.addr))
+			}
+		}
+	}
+
+	if (c.cfg.gwTLS.CertFile == "") != (c.cfg.gwTLS.KeyFile == "") {
+		problems = append(problems, fmt.Sprintf("%s and %s must be set together", configKeyGWTLSCert, configKeyGWTLSKey))
+	}
+	for _, f := range []string{c.cfg.gwTLS.CertFile, c.cfg.gwTLS.KeyFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(c.cfg.gwTLS.ACMEHosts) > 0 && c.cfg.gwTLS.CertFile != "" {
+		problems = append(problems, fmt.Sprintf("%s cannot be used with %s", configKeyGWACMEHosts, configKeyGWTLSCert))
+	}
+
+	if _, err := salt.New(c.salt); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.ingestAsync {
+		if err := c.ingest.Validate(); err != nil {
+			problems = append(problems, "ingest: "+err.Error())
+		}
+	}
+	if err := c.privacy.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := analytics.ParseHashInputs(c.hashInputs); err != nil {
+		problems = append(problems, configKeyHashInputs+": "+err.Error())
+	}
+	if _, err := analytics.ParseGeoBlocklist(c.geoBlocklist); err != nil {
+		problems = append(problems, configKeyGeoBlocklist+": "+err.Error())
+	}
+	if len(c.kafkaBrokers) > 0 && c.kafkaTopic == "" {
+		problems = append(problems, configKeyKafkaTopic+" is empty")
+	}
+	if c.webhooksConfig != "" {
+		if _, err := webhook.LoadConfig(c.webhooksConfig); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if c.amqpURL != "" {
+		if _, err := url.Parse(c.amqpURL); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s: %v", configKeyAMQPURL, err))
+		}
+		if c.amqpQueue == "" {
+			problems = append(problems, configKeyAMQPQueue+" is empty")
+		}
+	}
+	if c.mqtt.Broker != "" {
+		if err := c.mqtt.Validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if c.smtp.Addr != "" {
+		if _, err := report.NewSMTPSender(c.smtp); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if c.oidcIssuer != "" {
+		if _, err := oidc.NewProvider(c.oidcIssuer, c.oidcClientID); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid OIDC configuration: %v", err))
+		}
+		if c.sessionSecret != "" {
+			if _, err := sites.NewSessionSigner(c.sessionSecret); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if c.sessionTTL <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive", configKeySessionTTL))
+		}
+	}
+	if c.archiveURL != "" {
+		if _, err := archive.NewStore(c.archiveURL); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if c.archiveAfter <= 0 || c.archiveInterval <= 0 {
+			problems = append(problems, fmt.Sprintf("%s and %s must be positive", configKeyArchiveAfter, configKeyArchiveEvery))
+		}
+	}
+	if c.retentionInterval < 0 {
+		problems = append(problems, fmt.Sprintf("%s must not be negative", configKeyRetentionEvery))
+	}
+	switch c.leaderElection {
+	case "":
+	case leaderElectionKubernetes:
+		if c.leaderLease == "" {
+			problems = append(problems, configKeyLeaderLease+" is empty")
+		}
+		if c.leaderTTL < 3*time.Second {
+			problems = append(problems, fmt.Sprintf("%s must be at least 3s", configKeyLeaderTTL))
+		}
+		// The replicas hash the visitors of the same salt only if it's shared
+		if !c.salt.Shared {
+			problems = append(problems, fmt.Sprintf("%s requires %s", configKeyLeaderElection, configKeySaltShared))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown %s %q", configKeyLeaderElection, c.leaderElection))
+	}
+	if len(c.peers) > 0 {
+		for _, peer := range c.peers {
+			if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("%s %q must be an http or https URL", configKeyPeers, peer))
+			}
+		}
+		if c.replicationKey == "" {
+			problems = append(problems, fmt.Sprintf("%s requires %s", configKeyPeers, configKeyReplicationKey))
+		}
+		if !c.useMemDB {
+			problems = append(problems, fmt.Sprintf("%s replicates the in-memory database, it requires %s", configKeyPeers, configKeyUseMemDB))
+		}
+		// Only the events are replicated, every replica rolls them up itself
+		if c.leaderElection != "" {
+			problems = append(problems, fmt.Sprintf("%s can't be combined with %s, the rollups aren't replicated", configKeyPeers, configKeyLeaderElection))
+		}
+	}
+
+	return problems
+}
+
+// checkConnectivity returns the problems of connecting to the configured brokers and storages.
+func (c *cli) checkConnectivity() []string {
+	addrs := make([]string, 0)
+	addrs = append(addrs, c.kafkaBrokers...)
+	if u, err := url.Parse(c.amqpURL); err == nil && c.amqpURL != "" {
+		addrs = append(addrs, hostPort(u, "5672"))
+	}
+	if u, err := url.Parse(c.mqtt.Broker); err == nil && c.mqtt.Broker != "" {
+		addrs = append(addrs, hostPort(u, "1883"))
+	}
+	if strings.HasPrefix(c.archiveURL, "s3://") {
+		endpoint := os.Getenv("S3_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "https://s3.amazonaws.com"
+		}
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		if u, err := url.Parse(endpoint); err == nil {
+			addrs = append(addrs, hostPort(u, "443"))
+		}
+	}
+
+	problems := make([]string, 0)
+	for _, addr := range addrs {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("cannot connect to %s: %v", addr, err))
+			continue
+		}
+		_ = conn.Close()
+	}
+	return problems
+}
+
+// listener is a named listen address of the service.
+type listener struct {
+	name string
+	addr string
+}
+
+// listeners returns the addresses the service listens on.
+func (c *cli) listeners() []listener {
+	if c.cfg.singlePort {
+		return []listener{{"gateway", c.listenAddr(c.cfg.gwAddr, c.cfg.gwPort)}}
+	}
+	return []listener{
+		{"gRPC", c.listenAddr(c.cfg.grpcAddr, c.cfg.grpcPort)},
+		{"gateway", c.listenAddr(c.cfg.gwAddr, c.cfg.gwPort)},
+		{"metrics", c.listenAddr(c.cfg.mAddr, c.cfg.mPort)},
+	}
+}
+
+// isWildcardHost reports whether listening on host accepts connections on all addresses.
+func isWildcardHost(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
+// hostPort returns the host and port of the URL, using defaultPort if it has none.
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
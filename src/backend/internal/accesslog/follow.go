@@ -0,0 +1,116 @@
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Follow sends the lines appended to the file at path to lines until ctx is done, polling it every interval.
+// The lines already in the file are sent first if fromStart is set.
+//
+// The file is reopened from the start when it's rotated, i.e. replaced by a new file, after the rest of
+// the rotated one is read, and read from the start again when it's truncated.
+func Follow(ctx context.Context, path string, fromStart bool, interval time.Duration, lines chan<- string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if !fromStart {
+		if _, err = f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+
+	r := bufio.NewReader(f)
+	var partial strings.Builder
+	// readLines sends all the complete lines available, it returns false once ctx is done
+	readLines := func() (bool, error) {
+		for {
+			chunk, err := r.ReadString('\n')
+			partial.WriteString(chunk)
+			if errors.Is(err, io.EOF) {
+				return true, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			line := strings.TrimRight(partial.String(), "\r\n")
+			partial.Reset()
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return false, nil
+			}
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if ok, err := readLines(); !ok || err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		next, err := reopen(f, path)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			continue
+		}
+		if next != f {
+			// The rest of the rotated file is read before switching to the new one
+			if ok, err := readLines(); !ok || err != nil {
+				_ = next.Close()
+				return err
+			}
+			_ = f.Close()
+			f = next
+		}
+		r.Reset(f)
+		partial.Reset()
+	}
+}
+
+// reopen returns the new file at path if the file f was rotated, or f set to its start if it was truncated,
+// nil if it's unchanged.
+func reopen(f *os.File, path string) (*os.File, error) {
+	current, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	latest, err := os.Stat(path)
+	if err != nil {
+		// The new file isn't created yet after the rotation
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !os.SameFile(current, latest) {
+		return os.Open(path)
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if latest.Size() >= offset {
+		return nil, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,196 @@
+// Package accesslog parses and follows the access logs of the web servers, so their requests are reported
+// as the events without the tracker script.
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The names of the predefined formats.
+const (
+	// FormatCombined is the combined log format of Nginx and Apache.
+	FormatCombined = "combined"
+	// FormatCommon is the common log format of Nginx and Apache, without the referrer and the user agent.
+	FormatCommon = "common"
+	// FormatCaddy is the JSON access log of Caddy.
+	FormatCaddy = "caddy"
+)
+
+// predefinedFormats are the Nginx style definitions of the predefined text formats.
+var predefinedFormats = map[string]string{
+	FormatCombined: `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+	FormatCommon:   `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`,
+}
+
+// ErrNoMatch is returned for the lines not matching the format.
+var ErrNoMatch = errors.New("line doesn't match the format")
+
+// Entry is a request of the access log.
+type Entry struct {
+	RemoteAddr string
+	// Host is the requested host, empty if the format doesn't log it
+	Host      string
+	Method    string
+	URI       string
+	Status    int
+	Referrer  string
+	UserAgent string
+}
+
+// Parser parses the lines of the access log.
+type Parser interface {
+	Parse(line string) (*Entry, error)
+}
+
+// NewParser returns the Parser of the predefined format, or of the format defined the way of the Nginx
+// log_format directive, e.g. `$remote_addr [$time_local] "$request" $status "$http_user_agent"`.
+//
+// The variables used are $remote_addr, $http_x_forwarded_for, $host, $http_host, $request, $request_method,
+// $request_uri, $status, $http_referer and $http_user_agent, the other ones are matched and skipped.
+func NewParser(format string) (Parser, error) {
+	if format == FormatCaddy {
+		return caddyParser{}, nil
+	}
+	if predefined, ok := predefinedFormats[format]; ok {
+		format = predefined
+	}
+	return newTextParser(format)
+}
+
+// variablePattern matches the variables of the format.
+var variablePattern = regexp.MustCompile(`\$[a-z_]+`)
+
+// textParser parses the lines of the Nginx style format with the regular expression compiled from it.
+type textParser struct {
+	re *regexp.Regexp
+}
+
+// newTextParser compiles the format into textParser.
+func newTextParser(format string) (*textParser, error) {
+	if !strings.Contains(format, "$") {
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	seen := make(map[string]bool)
+	last := 0
+	for _, loc := range variablePattern.FindAllStringIndex(format, -1) {
+		expr.WriteString(regexp.QuoteMeta(format[last:loc[0]]))
+		name := format[loc[0]+1 : loc[1]]
+
+		// The value lasts until the literal following the variable
+		value := ".*"
+		if loc[1] < len(format) && format[loc[1]] != '$' {
+			value = "[^" + regexp.QuoteMeta(format[loc[1]:loc[1]+1]) + "]*"
+		}
+		if seen[name] {
+			expr.WriteString(value)
+		} else {
+			expr.WriteString("(?P<" + name + ">" + value + ")")
+			seen[name] = true
+		}
+		last = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(format[last:]))
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid log format %q: %w", format, err)
+	}
+	if re.SubexpIndex("request") < 0 && re.SubexpIndex("request_uri") < 0 {
+		return nil, errors.New("log format has neither $request nor $request_uri")
+	}
+	return &textParser{re: re}, nil
+}
+
+// Parse implements Parser.
+func (p *textParser) Parse(line string) (*Entry, error) {
+	match := p.re.FindStringSubmatch(line)
+	if match == nil {
+		return nil, ErrNoMatch
+	}
+	value := func(name string) string {
+		if i := p.re.SubexpIndex(name); i >= 0 && match[i] != "-" {
+			return match[i]
+		}
+		return ""
+	}
+
+	e := &Entry{
+		RemoteAddr: value("remote_addr"),
+		Host:       value("host"),
+		Method:     value("request_method"),
+		URI:        value("request_uri"),
+		Referrer:   value("http_referer"),
+		UserAgent:  value("http_user_agent"),
+	}
+	if forwarded := value("http_x_forwarded_for"); forwarded != "" {
+		ip, _, _ := strings.Cut(forwarded, ",")
+		e.RemoteAddr = strings.TrimSpace(ip)
+	}
+	if e.Host == "" {
+		e.Host = value("http_host")
+	}
+	if request := strings.Fields(value("request")); len(request) >= 2 {
+		e.Method, e.URI = request[0], request[1]
+	}
+	if s := value("status"); s != "" {
+		status, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", s)
+		}
+		e.Status = status
+	}
+	return e, nil
+}
+
+// caddyParser parses the JSON access log of Caddy.
+type caddyParser struct{}
+
+// caddyEntry is the part of the Caddy access log entry mapped into Entry.
+type caddyEntry struct {
+	Request *struct {
+		RemoteIP string              `json:"remote_ip"`
+		ClientIP string              `json:"client_ip"`
+		Host     string              `json:"host"`
+		Method   string              `json:"method"`
+		URI      string              `json:"uri"`
+		Headers  map[string][]string `json:"headers"`
+	} `json:"request"`
+	Status int `json:"status"`
+}
+
+// Parse implements Parser.
+func (caddyParser) Parse(line string) (*Entry, error) {
+	var ce caddyEntry
+	if err := json.Unmarshal([]byte(line), &ce); err != nil || ce.Request == nil {
+		return nil, ErrNoMatch
+	}
+	header := func(name string) string {
+		if v := ce.Request.Headers[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	e := &Entry{
+		RemoteAddr: ce.Request.ClientIP,
+		Host:       ce.Request.Host,
+		Method:     ce.Request.Method,
+		URI:        ce.Request.URI,
+		Status:     ce.Status,
+		Referrer:   header("Referer"),
+		UserAgent:  header("User-Agent"),
+	}
+	if e.RemoteAddr == "" {
+		e.RemoteAddr = ce.Request.RemoteIP
+	}
+	return e, nil
+}
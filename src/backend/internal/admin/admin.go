@@ -0,0 +1,360 @@
+// Package admin implements analytics.AdminServer managing the sites at runtime.
+//
+// The managed sites are stored in the database and merged with the sites of the sites file,
+// which stay read-only.
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/hex"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"slices"
+	"sync"
+)
+
+// apiKeyBytes is the amount of random bytes of the generated API keys.
+const apiKeyBytes = 24
+
+// Server is analytics.AdminServer.
+type Server struct {
+	analytics.UnimplementedAdminServer
+
+	db       database.Database
+	registry *sites.Registry
+	token    string
+	onChange func(cfg *sites.Config)
+
+	// mutex serializes the changes, so they are applied to the registry in order
+	mutex sync.Mutex
+	base  *sites.Config
+}
+
+// New returns new Server instance, storing the sites of base merged with the managed ones into registry.
+//
+// onChange is called with the merged Config on every change. The service is registered on g
+// only if the admin token is set, the managed sites, the personal access tokens, the users
+// and the teams are loaded either way.
+func New(g *grpc.Server, db database.Database, registry *sites.Registry, base *sites.Config, token string, onChange func(cfg *sites.Config)) (*Server, error) {
+	if g == nil {
+		return nil, errors.New("grpc.Server instance is nil")
+	}
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if registry == nil {
+		return nil, errors.New("sites.Registry instance is nil")
+	}
+	if onChange == nil {
+		onChange = func(*sites.Config) {}
+	}
+	s := &Server{
+		db:       db,
+		registry: registry,
+		token:    token,
+		onChange: onChange,
+		base:     base,
+	}
+	if err := s.apply(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := s.applyTokens(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := s.applyUsers(context.Background()); err != nil {
+		return nil, err
+	}
+	if token != "" {
+		analytics.RegisterAdminServer(g, s)
+	}
+	return s, nil
+}
+
+// SetBase replaces the sites of the sites file, e.g. on reload.
+func (s *Server) SetBase(ctx context.Context, base *sites.Config) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.base = base
+	return s.apply(ctx)
+}
+
+// apply stores the merged sites into the registry. The mutex must be held, except on construction.
+func (s *Server) apply(ctx context.Context) error {
+	managed, err := s.db.ListSites(ctx)
+	if err != nil {
+		return err
+	}
+	cfg := sites.Merge(s.base, managed)
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+	s.registry.Store(cfg)
+	s.onChange(cfg)
+	return nil
+}
+
+// authorize checks the admin token of the request, a personal access token with the admin scope
+// and the key of an admin user are accepted too.
+func (s *Server) authorize(ctx context.Context) error {
+	token := bearerToken(ctx)
+	if token == "" {
+		return status.Error(codes.Unauthenticated, "admin token is required")
+	}
+	if _, ok := s.registry.AdminAccessToken(token); ok {
+		return nil
+	}
+	if _, ok := s.registry.AdminUser(token); ok {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		return status.Error(codes.PermissionDenied, "invalid admin token")
+	}
+	return nil
+}
+
+// bearerToken returns the token of the authorization metadata of the request.
+func bearerToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("authorization"); len(v) > 0 {
+		return sites.BearerKey(v[0])
+	}
+	return ""
+}
+
+// ListSites returns all the sites, including the ones of the sites file.
+func (s *Server) ListSites(ctx context.Context, _ *emptypb.Empty) (*analytics.Sites, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	base := s.base
+	s.mutex.Unlock()
+
+	cfg := s.registry.Config()
+	res := &analytics.Sites{Sites: make([]*analytics.Site, 0, len(cfg.Sites))}
+	for i := range cfg.Sites {
+		_, fromFile := base.Get(cfg.Sites[i].Domain)
+		res.Sites = append(res.Sites, toProto(&cfg.Sites[i], !fromFile))
+	}
+	return res, nil
+}
+
+// CreateSite creates a managed site, the API keys are added with RotateAPIKey.
+func (s *Server) CreateSite(ctx context.Context, r *analytics.Site) (*analytics.Site, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.registry.Get(r.GetDomain()); ok {
+		return nil, status.Errorf(codes.AlreadyExists, "site %s already exists", r.GetDomain())
+	}
+	site := fromProto(r)
+	res, err := s.store(ctx, site)
+	if err != nil {
+		return nil, err
+	}
+	s.audit(ctx, database.AuditSiteCreate, site.Domain, nil, site)
+	return res, nil
+}
+
+// UpdateSite replaces the settings of a managed site, keeping its API keys and tokens.
+func (s *Server) UpdateSite(ctx context.Context, r *analytics.Site) (*analytics.Site, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, err := s.managed(r.GetDomain())
+	if err != nil {
+		return nil, err
+	}
+	site := fromProto(r)
+	site.APIKeys = slices.Clone(current.APIKeys)
+	site.Tokens = slices.Clone(current.Tokens)
+	res, err := s.store(ctx, site)
+	if err != nil {
+		return nil, err
+	}
+	s.audit(ctx, database.AuditSiteUpdate, site.Domain, current, site)
+	return res, nil
+}
+
+// DeleteSite deletes a managed site, its events are kept.
+func (s *Server) DeleteSite(ctx context.Context, r *analytics.DeleteSiteRequest) (*emptypb.Empty, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, err := s.managed(r.GetDomain())
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.db.DeleteSite(ctx, r.GetDomain()); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot delete site %s: %v", r.GetDomain(), err)
+	}
+	if err = s.apply(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot apply sites: %v", err)
+	}
+	s.audit(ctx, database.AuditSiteDelete, current.Domain, current, nil)
+	return &emptypb.Empty{}, nil
+}
+
+// RotateAPIKey adds a new API key to a managed site, revoking the existing ones unless requested otherwise.
+func (s *Server) RotateAPIKey(ctx context.Context, r *analytics.RotateAPIKeyRequest) (*analytics.RotateAPIKeyResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, err := s.managed(r.GetDomain())
+	if err != nil {
+		return nil, err
+	}
+	key, err := newAPIKey()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate API key: %v", err)
+	}
+	site := current.Clone()
+	if !r.GetKeepExisting() {
+		site.APIKeys = nil
+	}
+	site.APIKeys = append(site.APIKeys, key)
+	if _, err = s.store(ctx, &site); err != nil {
+		return nil, err
+	}
+	s.audit(ctx, database.AuditKeyRotate, site.Domain, current, &site)
+	return &analytics.RotateAPIKeyResponse{Key: key}, nil
+}
+
+// managed returns the managed site of the domain.
+func (s *Server) managed(domain string) (*sites.Site, error) {
+	if _, ok := s.base.Get(domain); ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "site %s is defined in the sites file", domain)
+	}
+	site, ok := s.registry.Get(domain)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "site %s is not found", domain)
+	}
+	return site, nil
+}
+
+// store validates and stores the managed site, applying the change.
+func (s *Server) store(ctx context.Context, site *sites.Site) (*analytics.Site, error) {
+	if err := site.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.db.UpsertSite(ctx, site); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot store site %s: %v", site.Domain, err)
+	}
+	if err := s.apply(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot apply sites: %v", err)
+	}
+	return toProto(site, true), nil
+}
+
+// newAPIKey returns a random API key.
+func newAPIKey() (string, error) {
+	b := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// toProto converts the site to analytics.Site, omitting the API keys.
+func toProto(s *sites.Site, managed bool) *analytics.Site {
+	res := &analytics.Site{
+		Domain:         s.Domain,
+		Timezone:       s.Timezone,
+		AllowedOrigins: s.AllowedOrigins,
+		Owner:          s.Owner,
+		APIKeys:        int32(len(s.APIKeys) + len(s.Tokens)),
+		Managed:        managed,
+		Exclusions: &analytics.SiteExclusions{
+			IPs:        s.Exclusions.IPs,
+			UserAgents: s.Exclusions.UserAgents,
+			Visitors:   s.Exclusions.Visitors,
+		},
+		URLRules: &analytics.SiteURLRules{
+			CollapseTrailingSlash: s.URLRules.CollapseTrailingSlash,
+			Lowercase:             s.URLRules.Lowercase,
+			FoldIndex:             s.URLRules.FoldIndex,
+			StripQuery:            s.URLRules.StripQuery,
+		},
+	}
+	if s.SessionTimeout > 0 {
+		res.SessionTimeout = durationpb.New(s.SessionTimeout)
+	}
+	if s.Retention > 0 {
+		res.Retention = durationpb.New(s.Retention)
+	}
+	if s.DedupWindow > 0 {
+		res.DedupWindow = durationpb.New(s.DedupWindow)
+	}
+	if s.CurrentVisitorsWindow > 0 {
+		res.CurrentVisitorsWindow = durationpb.New(s.CurrentVisitorsWindow)
+	}
+	for _, g := range s.Goals {
+		res.Goals = append(res.Goals, &analytics.Goal{Name: g.Name, Event: g.Event, Path: g.Path})
+	}
+	return res
+}
+
+// fromProto converts analytics.Site to the site without API keys.
+func fromProto(r *analytics.Site) *sites.Site {
+	site := &sites.Site{
+		Domain:         r.GetDomain(),
+		Timezone:       r.GetTimezone(),
+		AllowedOrigins: slices.Clone(r.GetAllowedOrigins()),
+		Owner:          r.GetOwner(),
+		Exclusions: sites.Exclusions{
+			IPs:        slices.Clone(r.GetExclusions().GetIPs()),
+			UserAgents: slices.Clone(r.GetExclusions().GetUserAgents()),
+			Visitors:   slices.Clone(r.GetExclusions().GetVisitors()),
+		},
+		URLRules: sites.URLRules{
+			CollapseTrailingSlash: r.GetURLRules().GetCollapseTrailingSlash(),
+			Lowercase:             r.GetURLRules().GetLowercase(),
+			FoldIndex:             r.GetURLRules().GetFoldIndex(),
+			StripQuery:            slices.Clone(r.GetURLRules().GetStripQuery()),
+		},
+	}
+	if r.GetSessionTimeout() != nil {
+		site.SessionTimeout = r.GetSessionTimeout().AsDuration()
+	}
+	if r.GetRetention() != nil {
+		site.Retention = r.GetRetention().AsDuration()
+	}
+	if r.GetDedupWindow() != nil {
+		site.DedupWindow = r.GetDedupWindow().AsDuration()
+	}
+	if r.GetCurrentVisitorsWindow() != nil {
+		site.CurrentVisitorsWindow = r.GetCurrentVisitorsWindow().AsDuration()
+	}
+	for _, g := range r.GetGoals() {
+		site.Goals = append(site.Goals, sites.Goal{Name: g.GetName(), Event: g.GetEvent(), Path: g.GetPath()})
+	}
+	return site
+}
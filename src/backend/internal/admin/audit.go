@@ -0,0 +1,112 @@
+package admin
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// metadataActor is the metadata key naming the operator behind the admin token in the audit log.
+const metadataActor = "x-audit-actor"
+
+// ListAuditLog returns the audit log entries, optionally of a single site and in a time range.
+func (s *Server) ListAuditLog(ctx context.Context, r *analytics.ListAuditLogRequest) (*analytics.AuditLog, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	var from, to time.Time
+	if r.GetFrom() != nil {
+		from = r.GetFrom().AsTime()
+	}
+	if r.GetTo() != nil {
+		to = r.GetTo().AsTime()
+	}
+	entries, err := s.db.ListAudit(ctx, r.GetDomain(), from, to)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list audit log: %v", err)
+	}
+
+	res := &analytics.AuditLog{Entries: make([]*analytics.AuditEntry, 0, len(entries))}
+	for _, e := range entries {
+		res.Entries = append(res.Entries, &analytics.AuditEntry{
+			Seq:       e.Seq,
+			Timestamp: timestamppb.New(e.Time),
+			Actor:     e.Actor,
+			Action:    e.Action,
+			Domain:    e.Domain,
+			Before:    e.Before,
+			After:     e.After,
+		})
+	}
+	return res, nil
+}
+
+// audit appends the action changing the site from before to after to the audit log, either may be nil.
+//
+// The action is already applied, so a failure is logged rather than returned.
+func (s *Server) audit(ctx context.Context, action string, domain string, before, after *sites.Site) {
+	s.appendAudit(ctx, action, domain, siteJSON(before), siteJSON(after))
+}
+
+// appendAudit appends the action with the JSON encoded states to the audit log, logging a failure.
+func (s *Server) appendAudit(ctx context.Context, action string, domain string, before, after string) {
+	entry := &database.AuditEntry{
+		Time:   time.Now(),
+		Actor:  s.actor(ctx),
+		Action: action,
+		Domain: domain,
+		Before: before,
+		After:  after,
+	}
+	if err := s.db.AppendAudit(ctx, entry); err != nil {
+		zap.L().Named("admin").Error("Cannot append audit log entry",
+			zap.String("action", action), zap.String("domain", domain), zap.Error(err))
+	}
+}
+
+// actor returns the actor of the request for the audit log, "admin", "token:<id>" for the access tokens
+// or "user:<email>" for the users.
+func (s *Server) actor(ctx context.Context) string {
+	name := "admin"
+	if id, ok := s.registry.AdminAccessToken(bearerToken(ctx)); ok {
+		name = "token:" + id
+	} else if email, ok := s.registry.AdminUser(bearerToken(ctx)); ok {
+		name = "user:" + email
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(metadataActor); len(v) > 0 && v[0] != "" {
+		return name + ":" + v[0]
+	}
+	return name
+}
+
+// siteJSON returns the site encoded as analytics.Site without the API keys, or an empty string if it's nil.
+func siteJSON(site *sites.Site) string {
+	if site == nil {
+		return ""
+	}
+	b, err := protojson.Marshal(toProto(site, true))
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// messageJSON returns the message encoded for the audit log.
+func messageJSON(m proto.Message) string {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,157 @@
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// CreateAccessToken creates a personal access token of the tenant, its key is returned only once.
+func (s *Server) CreateAccessToken(ctx context.Context, r *analytics.CreateAccessTokenRequest) (*analytics.CreateAccessTokenResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if r.GetTenant() == "" {
+		return nil, status.Error(codes.InvalidArgument, "tenant is required")
+	}
+	if r.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	if len(r.GetScopes()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one scope is required")
+	}
+	scopes := make([]sites.Scope, 0, len(r.GetScopes()))
+	for _, v := range r.GetScopes() {
+		scope := sites.Scope(v)
+		if err := scope.Validate(); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		scopes = append(scopes, scope)
+	}
+	var ttl time.Duration
+	if r.GetTTL() != nil {
+		ttl = r.GetTTL().AsDuration()
+	}
+	if ttl < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl must not be negative")
+	}
+
+	b := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate access token: %v", err)
+	}
+	key := sites.NewAccessTokenKey(b)
+	now := time.Now()
+	token := &sites.AccessToken{
+		ID:      uuid.New().String(),
+		Name:    r.GetName(),
+		Tenant:  r.GetTenant(),
+		Scopes:  scopes,
+		Hash:    sites.HashAccessToken(key),
+		Created: now,
+	}
+	if ttl > 0 {
+		token.Expires = now.Add(ttl)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.db.InsertAccessToken(ctx, token); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot store access token: %v", err)
+	}
+	if err := s.applyTokens(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot apply access tokens: %v", err)
+	}
+	res := tokenToProto(token)
+	s.appendAudit(ctx, database.AuditTokenCreate, "", "", messageJSON(res))
+	return &analytics.CreateAccessTokenResponse{Token: res, Key: key}, nil
+}
+
+// ListAccessTokens returns the personal access tokens, optionally of a single tenant.
+func (s *Server) ListAccessTokens(ctx context.Context, r *analytics.ListAccessTokensRequest) (*analytics.AccessTokens, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.db.ListAccessTokens(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list access tokens: %v", err)
+	}
+	res := &analytics.AccessTokens{Tokens: make([]*analytics.AccessToken, 0, len(tokens))}
+	for _, t := range tokens {
+		if r.GetTenant() != "" && t.Tenant != r.GetTenant() {
+			continue
+		}
+		res.Tokens = append(res.Tokens, tokenToProto(t))
+	}
+	return res, nil
+}
+
+// RevokeAccessToken deletes the personal access token, it's rejected immediately.
+func (s *Server) RevokeAccessToken(ctx context.Context, r *analytics.RevokeAccessTokenRequest) (*emptypb.Empty, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tokens, err := s.db.ListAccessTokens(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list access tokens: %v", err)
+	}
+	var token *sites.AccessToken
+	for _, t := range tokens {
+		if t.ID == r.GetID() {
+			token = t
+			break
+		}
+	}
+	if token == nil {
+		return nil, status.Errorf(codes.NotFound, "access token %s is not found", r.GetID())
+	}
+	if _, err = s.db.DeleteAccessToken(ctx, token.ID); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot delete access token %s: %v", token.ID, err)
+	}
+	if err = s.applyTokens(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot apply access tokens: %v", err)
+	}
+	s.appendAudit(ctx, database.AuditTokenRevoke, "", messageJSON(tokenToProto(token)), "")
+	return &emptypb.Empty{}, nil
+}
+
+// applyTokens stores the personal access tokens into the registry.
+func (s *Server) applyTokens(ctx context.Context) error {
+	tokens, err := s.db.ListAccessTokens(ctx)
+	if err != nil {
+		return err
+	}
+	s.registry.SetAccessTokens(tokens)
+	return nil
+}
+
+// tokenToProto converts the personal access token to analytics.AccessToken, omitting its hash.
+func tokenToProto(t *sites.AccessToken) *analytics.AccessToken {
+	res := &analytics.AccessToken{
+		ID:      t.ID,
+		Name:    t.Name,
+		Tenant:  t.Tenant,
+		Created: timestamppb.New(t.Created),
+	}
+	for _, scope := range t.Scopes {
+		res.Scopes = append(res.Scopes, string(scope))
+	}
+	if !t.Expires.IsZero() {
+		res.Expires = timestamppb.New(t.Expires)
+	}
+	return res
+}
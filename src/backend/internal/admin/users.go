@@ -0,0 +1,285 @@
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"slices"
+	"time"
+)
+
+// CreateUser creates a user, their API key is returned only once.
+func (s *Server) CreateUser(ctx context.Context, r *analytics.CreateUserRequest) (*analytics.CreateUserResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate user key: %v", err)
+	}
+	key := sites.NewUserKey(b)
+	user := &sites.User{
+		ID:      uuid.New().String(),
+		Email:   r.GetEmail(),
+		Name:    r.GetName(),
+		Admin:   r.GetAdmin(),
+		Hash:    sites.HashAccessToken(key),
+		Created: time.Now(),
+	}
+	if err := user.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.db.InsertUser(ctx, user); err != nil {
+		if errors.Is(err, database.ErrUserExists) {
+			return nil, status.Errorf(codes.AlreadyExists, "user %s already exists", user.Email)
+		}
+		return nil, status.Errorf(codes.Internal, "cannot store user: %v", err)
+	}
+	if err := s.applyUsers(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot apply users: %v", err)
+	}
+	res := userToProto(user)
+	s.appendAudit(ctx, database.AuditUserCreate, "", "", messageJSON(res))
+	return &analytics.CreateUserResponse{User: res, Key: key}, nil
+}
+
+// ListUsers returns all the users.
+func (s *Server) ListUsers(ctx context.Context, _ *emptypb.Empty) (*analytics.Users, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	users, err := s.db.ListUsers(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list users: %v", err)
+	}
+	res := &analytics.Users{Users: make([]*analytics.User, 0, len(users))}
+	for _, u := range users {
+		res.Users = append(res.Users, userToProto(u))
+	}
+	return res, nil
+}
+
+// DeleteUser deletes the user and their memberships, their key is rejected immediately.
+func (s *Server) DeleteUser(ctx context.Context, r *analytics.DeleteUserRequest) (*emptypb.Empty, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.user(ctx, r.GetID())
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.db.DeleteUser(ctx, user.ID); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot delete user %s: %v", user.ID, err)
+	}
+	if err = s.applyUsers(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot apply users: %v", err)
+	}
+	s.appendAudit(ctx, database.AuditUserDelete, "", messageJSON(userToProto(user)), "")
+	return &emptypb.Empty{}, nil
+}
+
+// CreateTeam creates a team, assigning its ID.
+func (s *Server) CreateTeam(ctx context.Context, r *analytics.Team) (*analytics.Team, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	team := teamFromProto(r)
+	team.ID = uuid.New().String()
+	team.Created = time.Now()
+	res, err := s.storeTeam(ctx, team)
+	if err != nil {
+		return nil, err
+	}
+	s.appendAudit(ctx, database.AuditTeamCreate, "", "", messageJSON(res))
+	return res, nil
+}
+
+// ListTeams returns all the teams.
+func (s *Server) ListTeams(ctx context.Context, _ *emptypb.Empty) (*analytics.Teams, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	teams, err := s.db.ListTeams(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list teams: %v", err)
+	}
+	res := &analytics.Teams{Teams: make([]*analytics.Team, 0, len(teams))}
+	for _, t := range teams {
+		res.Teams = append(res.Teams, teamToProto(t))
+	}
+	return res, nil
+}
+
+// UpdateTeam replaces the name, the sites and the members of the team.
+func (s *Server) UpdateTeam(ctx context.Context, r *analytics.Team) (*analytics.Team, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, err := s.team(ctx, r.GetID())
+	if err != nil {
+		return nil, err
+	}
+	team := teamFromProto(r)
+	team.Created = current.Created
+	res, err := s.storeTeam(ctx, team)
+	if err != nil {
+		return nil, err
+	}
+	s.appendAudit(ctx, database.AuditTeamUpdate, "", messageJSON(teamToProto(current)), messageJSON(res))
+	return res, nil
+}
+
+// DeleteTeam deletes the team, its members lose the access to its sites.
+func (s *Server) DeleteTeam(ctx context.Context, r *analytics.DeleteTeamRequest) (*emptypb.Empty, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, err := s.team(ctx, r.GetID())
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.db.DeleteTeam(ctx, current.ID); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot delete team %s: %v", current.ID, err)
+	}
+	if err = s.applyUsers(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot apply users: %v", err)
+	}
+	s.appendAudit(ctx, database.AuditTeamDelete, "", messageJSON(teamToProto(current)), "")
+	return &emptypb.Empty{}, nil
+}
+
+// user returns the user of the ID.
+func (s *Server) user(ctx context.Context, id string) (*sites.User, error) {
+	users, err := s.db.ListUsers(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list users: %v", err)
+	}
+	i := slices.IndexFunc(users, func(u *sites.User) bool { return u.ID == id })
+	if i < 0 {
+		return nil, status.Errorf(codes.NotFound, "user %s is not found", id)
+	}
+	return users[i], nil
+}
+
+// team returns the team of the ID.
+func (s *Server) team(ctx context.Context, id string) (*sites.Team, error) {
+	teams, err := s.db.ListTeams(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list teams: %v", err)
+	}
+	i := slices.IndexFunc(teams, func(t *sites.Team) bool { return t.ID == id })
+	if i < 0 {
+		return nil, status.Errorf(codes.NotFound, "team %s is not found", id)
+	}
+	return teams[i], nil
+}
+
+// storeTeam validates and stores the team, applying the change. Its sites and members must exist.
+func (s *Server) storeTeam(ctx context.Context, team *sites.Team) (*analytics.Team, error) {
+	if err := team.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	for _, domain := range team.Sites {
+		if _, ok := s.registry.Get(domain); !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "site %s is not found", domain)
+		}
+	}
+	for _, m := range team.Members {
+		if _, err := s.user(ctx, m.UserID); err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil, status.Errorf(codes.InvalidArgument, "user %s is not found", m.UserID)
+			}
+			return nil, err
+		}
+	}
+	if err := s.db.UpsertTeam(ctx, team); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot store team %s: %v", team.Name, err)
+	}
+	if err := s.applyUsers(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot apply users: %v", err)
+	}
+	return teamToProto(team), nil
+}
+
+// applyUsers stores the users and the teams into the registry.
+func (s *Server) applyUsers(ctx context.Context) error {
+	users, err := s.db.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	teams, err := s.db.ListTeams(ctx)
+	if err != nil {
+		return err
+	}
+	s.registry.SetUsers(users, teams)
+	return nil
+}
+
+// userToProto converts the user to analytics.User, omitting the hash of their key.
+func userToProto(u *sites.User) *analytics.User {
+	return &analytics.User{
+		ID:      u.ID,
+		Email:   u.Email,
+		Name:    u.Name,
+		Admin:   u.Admin,
+		Created: timestamppb.New(u.Created),
+	}
+}
+
+// teamToProto converts the team to analytics.Team.
+func teamToProto(t *sites.Team) *analytics.Team {
+	res := &analytics.Team{
+		ID:      t.ID,
+		Name:    t.Name,
+		Sites:   slices.Clone(t.Sites),
+		Created: timestamppb.New(t.Created),
+	}
+	for _, m := range t.Members {
+		res.Members = append(res.Members, &analytics.TeamMember{UserID: m.UserID, Role: string(m.Role)})
+	}
+	return res
+}
+
+// teamFromProto converts analytics.Team to the team, the creation time isn't taken from the request.
+func teamFromProto(r *analytics.Team) *sites.Team {
+	team := &sites.Team{
+		ID:    r.GetID(),
+		Name:  r.GetName(),
+		Sites: slices.Clone(r.GetSites()),
+	}
+	for _, m := range r.GetMembers() {
+		team.Members = append(team.Members, sites.Member{UserID: m.GetUserID(), Role: sites.Role(m.GetRole())})
+	}
+	return team
+}
@@ -0,0 +1,190 @@
+// Package alert implements the evaluation of the traffic alert rules of the sites and their notifications.
+package alert
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/anomaly"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/notify"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/sites"
+	"errors"
+	"fmt"
+	promClient "github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Mailer sends the email notifications, report.SMTPSender implements it.
+type Mailer interface {
+	Send(ctx context.Context, to []string, subject string, body string) error
+}
+
+// Evaluator evaluates the alert rules of the sites every interval,
+// notifying the targets of the rules when they start firing and when they are resolved.
+//
+// The state of the rules is kept in memory, the rules firing at the start notify as new.
+type Evaluator struct {
+	db       database.Database
+	sites    *sites.Registry
+	mailer   Mailer
+	notifier *notify.Notifier
+	client   *http.Client
+	interval time.Duration
+	logger   *zap.Logger
+
+	mutex sync.Mutex
+	// firing are the states of the rules by the site and the rule name
+	firing map[ruleKey]bool
+
+	firingGauge        *promClient.GaugeVec
+	valueGauge         *promClient.GaugeVec
+	notificationsTotal *promClient.CounterVec
+}
+
+// ruleKey identifies a rule of a site.
+type ruleKey struct {
+	domain string
+	name   string
+}
+
+// NewEvaluator returns new Evaluator instance evaluating the rules of the sites of sitesRegistry.
+//
+// mailer may be nil, the email notifications fail then.
+func NewEvaluator(db database.Database, sitesRegistry *sites.Registry, mailer Mailer, interval time.Duration) (*Evaluator, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if sitesRegistry == nil {
+		return nil, errors.New("sites.Registry instance is nil")
+	}
+	if interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+
+	e := &Evaluator{
+		db:       db,
+		sites:    sitesRegistry,
+		mailer:   mailer,
+		notifier: notify.NewNotifier(10 * time.Second),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		interval: interval,
+		logger:   zap.L().Named("alert"),
+		firing:   make(map[ruleKey]bool),
+		firingGauge: promClient.NewGaugeVec(promClient.GaugeOpts{
+			Name: "alert_firing",
+			Help: "Whether the alert rule of the site is firing, 1 or 0",
+		}, []string{"domain", "alert"}),
+		valueGauge: promClient.NewGaugeVec(promClient.GaugeOpts{
+			Name: "alert_value",
+			Help: "Last evaluated value of the metric of the alert rule of the site",
+		}, []string{"domain", "alert"}),
+		notificationsTotal: promClient.NewCounterVec(promClient.CounterOpts{
+			Name: "alert_notifications_total",
+			Help: "Total number of the alert notifications by the channel and the result",
+		}, []string{"domain", "alert", "channel", "result"}),
+	}
+	promClient.MustRegister(e.firingGauge, e.valueGauge, e.notificationsTotal)
+
+	return e, nil
+}
+
+// Run evaluates the rules every interval until ctx is done.
+func (e *Evaluator) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		e.Evaluate(ctx, time.Now())
+	}
+}
+
+// Evaluate evaluates the rules of all the sites at now, notifying about the changed states.
+//
+// The states of the removed rules are forgotten without notifications.
+func (e *Evaluator) Evaluate(ctx context.Context, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	seen := make(map[ruleKey]bool, len(e.firing))
+	cfg := e.sites.Config()
+	for i := range cfg.Sites {
+		site := &cfg.Sites[i]
+		for j := range site.Alerts {
+			rule := &site.Alerts[j]
+			key := ruleKey{domain: site.Domain, name: rule.Name}
+			seen[key] = true
+
+			value, err := e.value(ctx, site, rule, now)
+			if err != nil {
+				e.logger.Error("Cannot evaluate alert rule", zap.String("domain", site.Domain),
+					zap.String("alert", rule.Name), zap.Error(err))
+				continue
+			}
+			firing := rule.Firing(value)
+			e.valueGauge.WithLabelValues(site.Domain, rule.Name).Set(value)
+			e.firingGauge.WithLabelValues(site.Domain, rule.Name).Set(boolValue(firing))
+
+			if firing == e.firing[key] {
+				continue
+			}
+			e.firing[key] = firing
+			e.notify(ctx, &Notification{
+				Domain:    site.Domain,
+				Alert:     rule.Name,
+				Metric:    rule.Metric,
+				Operator:  rule.Operator,
+				Threshold: rule.Threshold,
+				Value:     value,
+				Firing:    firing,
+				Timestamp: now,
+			}, site, rule)
+		}
+	}
+
+	for key := range e.firing {
+		if !seen[key] {
+			delete(e.firing, key)
+			e.firingGauge.DeleteLabelValues(key.domain, key.name)
+			e.valueGauge.DeleteLabelValues(key.domain, key.name)
+		}
+	}
+}
+
+// value returns the metric of the rule of the site at now.
+func (e *Evaluator) value(ctx context.Context, site *sites.Site, rule *sites.AlertRule, now time.Time) (float64, error) {
+	window := rule.EvaluationWindow()
+	switch rule.Metric {
+	case sites.AlertVisitorsAnomaly:
+		return anomaly.ZScore(ctx, e.db, site.Key(), now)
+	case sites.AlertCurrentVisitors:
+		visitors, err := prometheus.GetCurrentVisitors(ctx, e.db, site.Key(), site.StatsSettings(), now)
+		return float64(visitors), err
+	}
+	stats, err := prometheus.GetAnalyticsStatsRange(ctx, e.db, site.Key(), site.StatsSettings(), now.Add(-window), now)
+	if err != nil {
+		return 0, err
+	}
+	switch rule.Metric {
+	case sites.AlertVisitors:
+		return float64(stats.UniqueVisitors), nil
+	case sites.AlertPageViews:
+		return float64(stats.TotalPageViews), nil
+	default:
+		return 0, fmt.Errorf("unknown metric %q", rule.Metric)
+	}
+}
+
+// boolValue returns 1 for true and 0 for false.
+func boolValue(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
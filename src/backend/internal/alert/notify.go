@@ -0,0 +1,140 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"diploma/analytics-exporter/internal/notify"
+	"diploma/analytics-exporter/internal/sites"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// messageTemplate is the text of the chat messages of the notifications.
+var messageTemplate = template.Must(template.New("alert").Parse(
+	`{{if .Firing}}*{{.Alert}}* is firing on {{.Domain}}: {{.Metric}} is {{printf "%g" .Value}}, ` +
+		`{{.Operator}} {{printf "%g" .Threshold}}{{else}}*{{.Alert}}* is resolved on {{.Domain}}: ` +
+		`{{.Metric}} is {{printf "%g" .Value}}, no longer {{.Operator}} {{printf "%g" .Threshold}}{{end}}`))
+
+// Notification is the JSON payload of the webhook notifications.
+type Notification struct {
+	Domain    string            `json:"domain"`
+	Alert     string            `json:"alert"`
+	Metric    sites.AlertMetric `json:"metric"`
+	Operator  string            `json:"operator"`
+	Threshold float64           `json:"threshold"`
+	Value     float64           `json:"value"`
+	// Firing is false when the alert is resolved
+	Firing    bool      `json:"firing"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Text returns the human readable notification.
+func (n *Notification) Text() string {
+	state := "FIRING"
+	if !n.Firing {
+		state = "RESOLVED"
+	}
+	return fmt.Sprintf("[%s] %s on %s: %s is %g (%s %g) at %s", state, n.Alert, n.Domain,
+		n.Metric, n.Value, n.Operator, n.Threshold, n.Timestamp.UTC().Format(time.RFC3339))
+}
+
+// Message returns the chat message of the notification of the rule.
+func (n *Notification) Message(rule *sites.AlertRule) (*notify.Message, error) {
+	text := &strings.Builder{}
+	if err := messageTemplate.Execute(text, n); err != nil {
+		return nil, err
+	}
+	m := &notify.Message{
+		Title: fmt.Sprintf("[FIRING] %s on %s", n.Alert, n.Domain),
+		Text:  text.String(),
+		Color: notify.ColorFiring,
+		Fields: []notify.Field{
+			{Name: "Metric", Value: string(n.Metric)},
+			{Name: "Value", Value: fmt.Sprintf("%g", n.Value)},
+			{Name: "Threshold", Value: fmt.Sprintf("%s %g", n.Operator, n.Threshold)},
+		},
+		Timestamp: n.Timestamp,
+	}
+	if !n.Firing {
+		m.Title = fmt.Sprintf("[RESOLVED] %s on %s", n.Alert, n.Domain)
+		m.Color = notify.ColorResolved
+	}
+	if rule.Metric != sites.AlertCurrentVisitors && rule.Metric != sites.AlertVisitorsAnomaly {
+		m.Fields = append(m.Fields, notify.Field{Name: "Window", Value: rule.EvaluationWindow().String()})
+	}
+	return m, nil
+}
+
+// notify sends the notification to the targets of the rule of the site, the failures are logged.
+func (e *Evaluator) notify(ctx context.Context, n *Notification, site *sites.Site, rule *sites.AlertRule) {
+	send := func(channel string, fn func() error) {
+		result := "sent"
+		if err := fn(); err != nil {
+			result = "error"
+			e.logger.Error("Cannot send alert notification", zap.String("domain", n.Domain),
+				zap.String("alert", n.Alert), zap.String("channel", channel), zap.Error(err))
+		}
+		e.notificationsTotal.WithLabelValues(n.Domain, n.Alert, channel, result).Inc()
+	}
+
+	if rule.Webhook != "" {
+		send("webhook", func() error { return e.post(ctx, rule.Webhook, n) })
+	}
+	var channels []*sites.Channel
+	if rule.Slack != "" {
+		channels = append(channels, &sites.Channel{Name: "slack", Type: sites.ChannelSlack, URL: rule.Slack})
+	}
+	for _, name := range rule.Channels {
+		if ch, ok := site.Channel(name); ok {
+			channels = append(channels, ch)
+		}
+	}
+	if len(channels) > 0 {
+		m, err := n.Message(rule)
+		for _, ch := range channels {
+			send(string(ch.Type), func() error {
+				if err != nil {
+					return err
+				}
+				return e.notifier.Send(ctx, ch, m)
+			})
+		}
+	}
+	if len(rule.Email) > 0 {
+		send("email", func() error {
+			if e.mailer == nil {
+				return errors.New("SMTP server isn't configured")
+			}
+			return e.mailer.Send(ctx, rule.Email, n.Text(), n.Text()+"\n")
+		})
+	}
+}
+
+// post posts the JSON encoded payload to the URL.
+func (e *Evaluator) post(ctx context.Context, url string, payload any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Package amqp implements ingestion of the events consumed from an AMQP queue.
+package amqp
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/analytics"
+	analyticsApi "diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	amqpGo "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"time"
+)
+
+// Message headers holding the visitor details and the API key, the message body is the protojson encoded event.
+const (
+	HeaderClientAddress = "x-forwarded-for"
+	HeaderUserAgent     = "user-agent"
+	HeaderAPIKey        = "api-key"
+)
+
+// reconnectDelay is the delay before reconnecting after the connection is lost.
+const reconnectDelay = 5 * time.Second
+
+// Consumer creates events from the messages of an AMQP queue.
+//
+// Messages are acknowledged once the event is created. Invalid messages are rejected
+// without requeueing, the ones failed for other reasons are requeued.
+type Consumer struct {
+	url      string
+	queue    string
+	prefetch int
+	srv      analyticsApi.AnalyticsServer
+	logger   *zap.Logger
+}
+
+// NewConsumer returns new Consumer instance.
+func NewConsumer(url string, queue string, prefetch int, srv analyticsApi.AnalyticsServer) (*Consumer, error) {
+	if url == "" {
+		return nil, errors.New("AMQP URL is empty")
+	}
+	if queue == "" {
+		return nil, errors.New("AMQP queue is empty")
+	}
+	if prefetch <= 0 {
+		return nil, errors.New("prefetch must be positive")
+	}
+	if srv == nil {
+		return nil, errors.New("analytics.AnalyticsServer instance is nil")
+	}
+	return &Consumer{
+		url:      url,
+		queue:    queue,
+		prefetch: prefetch,
+		srv:      srv,
+		logger:   zap.L().Named("amqp"),
+	}, nil
+}
+
+// Run consumes the queue until ctx is done, reconnecting whenever the connection is lost.
+func (c *Consumer) Run(ctx context.Context) {
+	for {
+		if err := c.consume(ctx); err != nil {
+			c.logger.Error("AMQP consumer failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// consume processes the deliveries of a single connection.
+func (c *Consumer) consume(ctx context.Context) error {
+	conn, err := amqpGo.Dial(c.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err = ch.Qos(c.prefetch, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := ch.ConsumeWithContext(ctx, c.queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	c.logger.Info("AMQP consumer started", zap.String("queue", c.queue))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("AMQP deliveries channel is closed")
+			}
+			if err = c.handle(ctx, d); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle creates the event of the delivery and acknowledges it.
+func (c *Consumer) handle(ctx context.Context, d amqpGo.Delivery) error {
+	e := &analyticsApi.Event{}
+	if err := protojson.Unmarshal(d.Body, e); err != nil {
+		c.logger.Debug("rejecting malformed message", zap.Error(err))
+		return d.Reject(false)
+	}
+
+	// Pass the visitor details the same way the gateway does
+	clientAddress, _ := d.Headers[HeaderClientAddress].(string)
+	userAgent, _ := d.Headers[HeaderUserAgent].(string)
+	apiKey, _ := d.Headers[HeaderAPIKey].(string)
+	eventCtx := analytics.WithAPIKey(analytics.WithVisitor(ctx, clientAddress, userAgent), apiKey)
+
+	if _, err := c.srv.CreateEvent(eventCtx, e); err != nil {
+		// Retrying doesn't help with invalid or unauthorized events, or the ones over the quota
+		code := status.Code(err)
+		requeue := code != codes.InvalidArgument && code != codes.Unauthenticated && code != codes.PermissionDenied &&
+			!analytics.IsQuotaExceeded(err)
+		c.logger.Debug("cannot create event", zap.Bool("requeue", requeue), zap.Error(err))
+		return d.Nack(false, requeue)
+	}
+	return d.Ack(false)
+}
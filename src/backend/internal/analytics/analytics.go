@@ -2,32 +2,172 @@
 package analytics
 
 import (
-	"crypto/sha256"
 	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/pubsub"
+	"diploma/analytics-exporter/internal/salt"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/internal/usage"
 	"diploma/analytics-exporter/pkg/api/analytics"
 	"errors"
+	promClient "github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
-	"hash"
 )
 
 type analyticsServer struct {
 	analytics.UnimplementedAnalyticsServer
-	h  hash.Hash
-	db database.Database
+	db    database.Database
+	bus   *pubsub.Bus
+	sites *sites.Registry
+	salt  *salt.Salt
+	meter *usage.Meter
+	sinks []EventSink
+
+	hashInputs []HashInput
+	recent     *recentVisitors
+	proxies    TrustedProxies
+
+	timestamps      TimestampPolicy
+	timestampsTotal *promClient.CounterVec
+
+	privacy      PrivacyPolicy
+	privacyTotal *promClient.CounterVec
+
+	scrubber *QueryScrubber
+
+	// statsCache calculates the stats shared with the exporter, nil if they're calculated on every request
+	statsCache *prometheus.StatsCache
+
+	geoBlocklist    GeoBlocklist
+	geoBlockedTotal *promClient.CounterVec
+
+	excludedTotal *promClient.CounterVec
+
+	duplicates      *recentEvents
+	duplicatesTotal *promClient.CounterVec
+
+	logger *zap.Logger
+}
+
+// EventSink receives every accepted event after it has been stored.
+//
+// Publish must not block the request.
+type EventSink interface {
+	Publish(e *analytics.Event)
 }
 
-// New registers provisioner.ProvisionerServer instance
-func New(g *grpc.Server, db database.Database) error {
+// Options are the dependencies and the policies of the analytics server.
+type Options struct {
+	// DB stores the events, it's required.
+	DB database.Database
+	// Bus publishes the stored events to the subscriptions, it's required.
+	Bus *pubsub.Bus
+	// Sites are the domains the events are checked against the settings of, e.g. the allowed origins,
+	// the exclusions and the dedup windows. The events are accepted as is if it's nil.
+	Sites *sites.Registry
+	// Salt hashes the visitors, the ones seen before its rotation keep their hashes during its grace period.
+	// It's required.
+	Salt *salt.Salt
+	// HashInputs are the components of the visitor hash, at least one is required.
+	HashInputs []HashInput
+	// Meter counts the accepted events and enforces the quotas of the tenants, they aren't counted if it's nil.
+	Meter *usage.Meter
+	// Privacy is the handling of the events sent with the privacy signals, PrivacyIgnore if empty.
+	Privacy PrivacyPolicy
+	// GeoBlocklist are the countries and the regions the events of the visitors from aren't stored, only counted.
+	GeoBlocklist GeoBlocklist
+	// TrustedProxies are the proxies the client addresses are forwarded by, the client address is the forwarded one
+	// of the first proxy which isn't trusted.
+	TrustedProxies TrustedProxies
+	// Timestamps is the policy the timestamps sent by the clients are accepted by,
+	// otherwise the events are stored at the server time.
+	Timestamps TimestampPolicy
+	// Scrubber removes the query parameters of the URLs and the referrers, they're stored as is if it's nil.
+	Scrubber *QueryScrubber
+	// StatsCache calculates the stats shared with the exporter, they're calculated on every request if it's nil.
+	StatsCache *prometheus.StatsCache
+	// Sinks receive every stored event after Bus.
+	Sinks []EventSink
+}
+
+// New registers analytics.AnalyticsServer instance of the options and returns it,
+// so it can be reused by the in-process gateway.
+//
+// The registered server relies on the interceptors of Authorizer installed on g, while the returned one,
+// called in process, authorizes the calls itself.
+func New(g *grpc.Server, opts Options) (analytics.AnalyticsServer, error) {
 	if g == nil {
-		return errors.New("grpc.Server instance is nil")
+		return nil, errors.New("grpc.Server instance is nil")
+	}
+	if opts.DB == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if opts.Bus == nil {
+		return nil, errors.New("pubsub.Bus instance is nil")
+	}
+	if opts.Salt == nil {
+		return nil, errors.New("salt.Salt instance is nil")
+	}
+	if len(opts.HashInputs) == 0 {
+		return nil, errors.New("visitor hash inputs are empty")
+	}
+	if opts.Privacy == "" {
+		opts.Privacy = PrivacyIgnore
+	}
+	if err := opts.Privacy.Validate(); err != nil {
+		return nil, err
+	}
+	if err := opts.Timestamps.Validate(); err != nil {
+		return nil, err
+	}
+	srv := &analyticsServer{
+		db:    opts.DB,
+		bus:   opts.Bus,
+		sites: opts.Sites,
+		salt:  opts.Salt,
+		meter: opts.Meter,
+		sinks: append([]EventSink{opts.Bus}, opts.Sinks...),
+
+		hashInputs: opts.HashInputs,
+		proxies:    opts.TrustedProxies,
+		scrubber:   opts.Scrubber,
+		statsCache: opts.StatsCache,
+		logger:     zap.L().Named("analytics"),
+
+		timestamps: opts.Timestamps,
+		timestampsTotal: promClient.NewCounterVec(promClient.CounterOpts{
+			Name: "event_timestamps_total",
+			Help: "Total number of the stored events by the source of their timestamps, the server or the client",
+		}, []string{"domain", "source"}),
+
+		privacy: opts.Privacy,
+		privacyTotal: promClient.NewCounterVec(promClient.CounterOpts{
+			Name: "privacy_signal_events_total",
+			Help: "Total number of the events sent with the privacy signal or without the consent by the policy applied to them",
+		}, []string{"signal", "policy"}),
+
+		geoBlocklist: opts.GeoBlocklist,
+		geoBlockedTotal: promClient.NewCounterVec(promClient.CounterOpts{
+			Name: "geo_blocked_events_total",
+			Help: "Total number of the events not stored as sent from the blocked countries and regions",
+		}, []string{"domain"}),
+
+		excludedTotal: promClient.NewCounterVec(promClient.CounterOpts{
+			Name: "excluded_events_total",
+			Help: "Total number of the events not stored as matching the exclusions of the site",
+		}, []string{"domain"}),
+
+		duplicates: newRecentEvents(),
+		duplicatesTotal: promClient.NewCounterVec(promClient.CounterOpts{
+			Name: "duplicate_events_total",
+			Help: "Total number of the events not stored as identical to the recent ones of the same visitor or as the retries of the stored ones",
+		}, []string{"domain"}),
 	}
-	if db == nil {
-		return errors.New("database.Database instance is nil")
+	if opts.Salt.Grace() > 0 {
+		srv.recent = newRecentVisitors(opts.Salt.Grace())
 	}
-	h := sha256.New()
-	analytics.RegisterAnalyticsServer(g, &analyticsServer{
-		db: db,
-		h:  h,
-	})
-	return nil
+	promClient.MustRegister(srv.timestampsTotal, srv.privacyTotal, srv.geoBlockedTotal, srv.excludedTotal, srv.duplicatesTotal)
+	analytics.RegisterAnalyticsServer(g, srv)
+	return &authorizedServer{srv: srv, authorizer: NewAuthorizer(opts.Sites)}, nil
 }
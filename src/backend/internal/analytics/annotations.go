@@ -0,0 +1,106 @@
+package analytics
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// maxAnnotationLength is the maximal length of the annotation descriptions.
+const maxAnnotationLength = 1024
+
+// CreateAnnotation stores the annotation of the domain, assigning its ID.
+func (s *analyticsServer) CreateAnnotation(ctx context.Context, r *analytics.Annotation) (*analytics.Annotation, error) {
+	if r.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is missing")
+	}
+	if r.GetDescription() == "" {
+		return nil, status.Error(codes.InvalidArgument, "description is missing")
+	}
+	if len(r.GetDescription()) > maxAnnotationLength || len(r.GetKind()) > maxAnnotationLength {
+		return nil, status.Errorf(codes.InvalidArgument, "kind and description must be at most %d bytes long", maxAnnotationLength)
+	}
+
+	site := s.sites.Key(r.GetDomain())
+	a := &database.Annotation{
+		ID:          uuid.New().String(),
+		Tenant:      site.Tenant,
+		Domain:      site.Domain,
+		Timestamp:   time.Now(),
+		Kind:        r.GetKind(),
+		Description: r.GetDescription(),
+	}
+	if r.GetTimestamp() != nil {
+		a.Timestamp = r.GetTimestamp().AsTime()
+	}
+	if err := s.db.InsertAnnotation(ctx, a); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot store annotation: %v", err)
+	}
+	return toAnnotation(a), nil
+}
+
+// ListAnnotations returns the annotations of the domain in the time range.
+func (s *analyticsServer) ListAnnotations(ctx context.Context, r *analytics.ListAnnotationsRequest) (*analytics.Annotations, error) {
+	if r.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is missing")
+	}
+
+	var from, to time.Time
+	if r.GetFrom() != nil {
+		from = r.GetFrom().AsTime()
+	}
+	if r.GetTo() != nil {
+		to = r.GetTo().AsTime()
+	}
+	annotations, err := s.annotations(ctx, r.GetDomain(), from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &analytics.Annotations{Annotations: annotations}, nil
+}
+
+// DeleteAnnotation deletes the annotation of the domain.
+func (s *analyticsServer) DeleteAnnotation(ctx context.Context, r *analytics.DeleteAnnotationRequest) (*emptypb.Empty, error) {
+	if r.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is missing")
+	}
+
+	deleted, err := s.db.DeleteAnnotation(ctx, s.sites.Key(r.GetDomain()), r.GetID())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot delete annotation %s: %v", r.GetID(), err)
+	}
+	if !deleted {
+		return nil, status.Errorf(codes.NotFound, "annotation %s is not found", r.GetID())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// annotations returns the annotations of the domain in the [from, to) range.
+func (s *analyticsServer) annotations(ctx context.Context, domain string, from, to time.Time) ([]*analytics.Annotation, error) {
+	annotations, err := s.db.ListAnnotations(ctx, s.sites.Key(domain), from, to)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list annotations of %s: %v", domain, err)
+	}
+	res := make([]*analytics.Annotation, 0, len(annotations))
+	for _, a := range annotations {
+		res = append(res, toAnnotation(a))
+	}
+	return res, nil
+}
+
+// toAnnotation converts the stored annotation to analytics.Annotation.
+func toAnnotation(a *database.Annotation) *analytics.Annotation {
+	return &analytics.Annotation{
+		ID:          a.ID,
+		Domain:      a.Domain,
+		Timestamp:   timestamppb.New(a.Timestamp),
+		Kind:        a.Kind,
+		Description: a.Description,
+	}
+}
@@ -0,0 +1,269 @@
+package analytics
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// MetadataAuthorization is the metadata key of the API key sent as "Bearer <key>",
+// the gateway passes the Authorization header under it.
+const MetadataAuthorization = "authorization"
+
+// methodPermissions are the permissions required by the Analytics methods.
+var methodPermissions = map[string]sites.Permission{
+	analytics.Analytics_CreateEvent_FullMethodName:      sites.PermissionIngest,
+	analytics.Analytics_ListEvents_FullMethodName:       sites.PermissionEvents,
+	analytics.Analytics_SubscribeEvents_FullMethodName:  sites.PermissionEvents,
+	analytics.Analytics_ExportEvents_FullMethodName:     sites.PermissionEvents,
+	analytics.Analytics_Import_FullMethodName:           sites.PermissionWrite,
+	analytics.Analytics_GetStats_FullMethodName:         sites.PermissionStats,
+	analytics.Analytics_SubscribeStats_FullMethodName:   sites.PermissionStats,
+	analytics.Analytics_GetUsage_FullMethodName:         sites.PermissionUsage,
+	analytics.Analytics_CreateSharedLink_FullMethodName: sites.PermissionShare,
+	analytics.Analytics_CreateAnnotation_FullMethodName: sites.PermissionWrite,
+	analytics.Analytics_ListAnnotations_FullMethodName:  sites.PermissionStats,
+	analytics.Analytics_DeleteAnnotation_FullMethodName: sites.PermissionWrite,
+	analytics.Analytics_ExportVisitor_FullMethodName:    sites.PermissionEvents,
+	analytics.Analytics_DeleteVisitor_FullMethodName:    sites.PermissionWrite,
+}
+
+// WithAPIKey returns a copy of ctx carrying the API key in the incoming metadata,
+// the way the gateway passes the Authorization header. An empty key is omitted.
+func WithAPIKey(ctx context.Context, key string) context.Context {
+	if key == "" {
+		return ctx
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	md = md.Copy()
+	md.Set(MetadataAuthorization, "Bearer "+key)
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+// apiKey returns the API key of the incoming request.
+func apiKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(MetadataAuthorization); len(v) > 0 {
+		return sites.BearerKey(v[0])
+	}
+	return ""
+}
+
+// requestDomain returns the domain the request refers to.
+func requestDomain(req any) string {
+	switch r := req.(type) {
+	case interface{ GetDomain() string }:
+		return r.GetDomain()
+	case *wrapperspb.StringValue:
+		return r.GetValue()
+	default:
+		return ""
+	}
+}
+
+// Authorizer checks that the API keys of the Analytics requests grant the roles required by the methods.
+type Authorizer struct {
+	sites *sites.Registry
+}
+
+// NewAuthorizer returns new Authorizer instance checking the keys against sitesRegistry,
+// everything is allowed if it's nil.
+func NewAuthorizer(sitesRegistry *sites.Registry) *Authorizer {
+	return &Authorizer{sites: sitesRegistry}
+}
+
+// Authorize checks that the request of the method is allowed, the other services' methods are passed as is.
+func (a *Authorizer) Authorize(ctx context.Context, method string, req any) error {
+	permission, ok := methodPermissions[method]
+	if !ok || a.sites == nil {
+		return nil
+	}
+	domain := requestDomain(req)
+	if permission == sites.PermissionIngest {
+		return authStatus(a.sites.AuthorizeEvent(apiKey(ctx), domain), domain)
+	}
+	return authStatus(a.sites.Authorize(apiKey(ctx), domain, permission), domain)
+}
+
+// UnaryInterceptor returns grpc.UnaryServerInterceptor authorizing the requests.
+func (a *Authorizer) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := a.Authorize(ctx, info.FullMethod, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor returns grpc.StreamServerInterceptor authorizing the first request of the streams.
+func (a *Authorizer) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if _, ok := methodPermissions[info.FullMethod]; !ok {
+			return handler(srv, ss)
+		}
+		return handler(srv, &authorizedStream{ServerStream: ss, authorizer: a, method: info.FullMethod})
+	}
+}
+
+// authorizedStream authorizes the first message received from the client.
+type authorizedStream struct {
+	grpc.ServerStream
+	authorizer *Authorizer
+	method     string
+	authorized bool
+}
+
+// RecvMsg implements grpc.ServerStream.
+func (s *authorizedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if !s.authorized {
+		if err := s.authorizer.Authorize(s.Context(), s.method, m); err != nil {
+			return err
+		}
+		s.authorized = true
+	}
+	return nil
+}
+
+// authorizedServer authorizes the calls of analytics.AnalyticsServer made in process, e.g. by the gateway,
+// which aren't passed through the gRPC interceptors.
+type authorizedServer struct {
+	analytics.UnimplementedAnalyticsServer
+	srv        analytics.AnalyticsServer
+	authorizer *Authorizer
+}
+
+// CreateEvent implements analytics.AnalyticsServer.
+func (s *authorizedServer) CreateEvent(ctx context.Context, r *analytics.Event) (*emptypb.Empty, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_CreateEvent_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.CreateEvent(ctx, r)
+}
+
+// ListEvents implements analytics.AnalyticsServer.
+func (s *authorizedServer) ListEvents(ctx context.Context, r *wrapperspb.StringValue) (*analytics.Events, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_ListEvents_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.ListEvents(ctx, r)
+}
+
+// SubscribeEvents implements analytics.AnalyticsServer.
+func (s *authorizedServer) SubscribeEvents(r *analytics.SubscribeEventsRequest, stream analytics.Analytics_SubscribeEventsServer) error {
+	if err := s.authorizer.Authorize(stream.Context(), analytics.Analytics_SubscribeEvents_FullMethodName, r); err != nil {
+		return err
+	}
+	return s.srv.SubscribeEvents(r, stream)
+}
+
+// ExportEvents implements analytics.AnalyticsServer.
+func (s *authorizedServer) ExportEvents(r *analytics.ExportEventsRequest, stream analytics.Analytics_ExportEventsServer) error {
+	if err := s.authorizer.Authorize(stream.Context(), analytics.Analytics_ExportEvents_FullMethodName, r); err != nil {
+		return err
+	}
+	return s.srv.ExportEvents(r, stream)
+}
+
+// Import implements analytics.AnalyticsServer.
+func (s *authorizedServer) Import(ctx context.Context, r *analytics.ImportRequest) (*analytics.ImportResponse, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_Import_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.Import(ctx, r)
+}
+
+// SubscribeStats implements analytics.AnalyticsServer.
+func (s *authorizedServer) SubscribeStats(r *analytics.SubscribeStatsRequest, stream analytics.Analytics_SubscribeStatsServer) error {
+	if err := s.authorizer.Authorize(stream.Context(), analytics.Analytics_SubscribeStats_FullMethodName, r); err != nil {
+		return err
+	}
+	return s.srv.SubscribeStats(r, stream)
+}
+
+// GetStats implements analytics.AnalyticsServer.
+func (s *authorizedServer) GetStats(ctx context.Context, r *analytics.GetStatsRequest) (*analytics.Stats, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_GetStats_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.GetStats(ctx, r)
+}
+
+// GetUsage implements analytics.AnalyticsServer.
+func (s *authorizedServer) GetUsage(ctx context.Context, r *analytics.GetUsageRequest) (*analytics.Usage, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_GetUsage_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.GetUsage(ctx, r)
+}
+
+// CreateSharedLink implements analytics.AnalyticsServer.
+func (s *authorizedServer) CreateSharedLink(ctx context.Context, r *analytics.CreateSharedLinkRequest) (*analytics.SharedLink, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_CreateSharedLink_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.CreateSharedLink(ctx, r)
+}
+
+// CreateAnnotation implements analytics.AnalyticsServer.
+func (s *authorizedServer) CreateAnnotation(ctx context.Context, r *analytics.Annotation) (*analytics.Annotation, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_CreateAnnotation_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.CreateAnnotation(ctx, r)
+}
+
+// ListAnnotations implements analytics.AnalyticsServer.
+func (s *authorizedServer) ListAnnotations(ctx context.Context, r *analytics.ListAnnotationsRequest) (*analytics.Annotations, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_ListAnnotations_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.ListAnnotations(ctx, r)
+}
+
+// DeleteAnnotation implements analytics.AnalyticsServer.
+func (s *authorizedServer) DeleteAnnotation(ctx context.Context, r *analytics.DeleteAnnotationRequest) (*emptypb.Empty, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_DeleteAnnotation_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.DeleteAnnotation(ctx, r)
+}
+
+// authStatus converts the authorization error to the gRPC status.
+func authStatus(err error, domain string) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sites.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, sites.ErrForbidden):
+		return status.Errorf(codes.PermissionDenied, "access to %s is denied", domain)
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// ExportVisitor implements analytics.AnalyticsServer.
+func (s *authorizedServer) ExportVisitor(ctx context.Context, r *analytics.ExportVisitorRequest) (*analytics.Events, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_ExportVisitor_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.ExportVisitor(ctx, r)
+}
+
+// DeleteVisitor implements analytics.AnalyticsServer.
+func (s *authorizedServer) DeleteVisitor(ctx context.Context, r *analytics.DeleteVisitorRequest) (*analytics.DeleteVisitorResponse, error) {
+	if err := s.authorizer.Authorize(ctx, analytics.Analytics_DeleteVisitor_FullMethodName, r); err != nil {
+		return nil, err
+	}
+	return s.srv.DeleteVisitor(ctx, r)
+}
@@ -0,0 +1,99 @@
+package analytics
+
+import (
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"sync"
+	"time"
+)
+
+// pruneInterval is the period the expired events are removed from recentEvents after.
+const pruneInterval = time.Minute
+
+// idWindow is the period the events with the client IDs are remembered for, so their retries aren't stored again.
+const idWindow = time.Hour
+
+// eventKey identifies the identical events of a visitor, or the event with the client ID if id is set.
+type eventKey struct {
+	domain  string
+	id      string
+	visitor string
+	typ     string
+	url     string
+}
+
+// recentEvents are the events stored within the dedup windows of their sites, so the identical ones
+// of the same visitor, e.g. of the page refreshes or of the double fired tracker calls, are detected.
+//
+// It's safe for concurrent use.
+type recentEvents struct {
+	mutex sync.Mutex
+	// expires are the ends of the windows of the stored events
+	expires map[eventKey]time.Time
+	pruned  time.Time
+}
+
+// newRecentEvents returns new recentEvents instance.
+func newRecentEvents() *recentEvents {
+	return &recentEvents{
+		expires: make(map[eventKey]time.Time),
+		pruned:  time.Now(),
+	}
+}
+
+// seen reports whether the identical event of the same visitor is stored within the window before now,
+// otherwise the event is recorded as stored at now. The events without the visitor hash are never duplicates,
+// as the visitors of the anonymized events are unknown.
+//
+// The window starts at the stored event, so the refreshes of a page are counted once per window.
+func (r *recentEvents) seen(e *analytics.Event, window time.Duration, now time.Time) bool {
+	if e.GetHashedVisit() == "" {
+		return false
+	}
+	return r.record(visitorEventKey(e), window, now)
+}
+
+// forget removes the event recorded by seen, so the identical event is accepted once the event isn't stored.
+func (r *recentEvents) forget(e *analytics.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.expires, visitorEventKey(e))
+}
+
+// visitorEventKey returns the key of the identical events of the visitor of the event.
+func visitorEventKey(e *analytics.Event) eventKey {
+	return eventKey{domain: e.GetDomain(), visitor: e.GetHashedVisit(), typ: e.GetType(), url: e.GetURL()}
+}
+
+// seenID reports whether the event with the same client ID of the domain is stored within idWindow before now,
+// otherwise the ID is recorded as stored at now.
+func (r *recentEvents) seenID(domain string, id string, now time.Time) bool {
+	return r.record(eventKey{domain: domain, id: id}, idWindow, now)
+}
+
+// forgetID removes the client ID of the domain, so the retry of the event which isn't stored is accepted.
+func (r *recentEvents) forgetID(domain string, id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.expires, eventKey{domain: domain, id: id})
+}
+
+// record reports whether the key is recorded within its window before now, otherwise it's recorded at now.
+func (r *recentEvents) record(key eventKey, window time.Duration, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if now.Sub(r.pruned) > pruneInterval {
+		for k, expires := range r.expires {
+			if !now.Before(expires) {
+				delete(r.expires, k)
+			}
+		}
+		r.pruned = now
+	}
+
+	if expires, ok := r.expires[key]; ok && now.Before(expires) {
+		return true
+	}
+	r.expires[key] = now.Add(window)
+	return false
+}
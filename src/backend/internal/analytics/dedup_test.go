@@ -0,0 +1,143 @@
+package analytics
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/salt"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	promClient "github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestRecentEvents(t *testing.T) {
+	// The pruning is measured from the creation of recentEvents
+	start := time.Now()
+	event := &analytics.Event{Domain: "example.com", Type: "pageview", URL: "https://example.com/", HashedVisit: "visitor"}
+	other := &analytics.Event{Domain: "example.com", Type: "pageview", URL: "https://example.com/other", HashedVisit: "visitor"}
+	anonymous := &analytics.Event{Domain: "example.com", Type: "pageview", URL: "https://example.com/"}
+
+	r := newRecentEvents()
+	steps := []struct {
+		name  string
+		seen  func() bool
+		want  bool
+		after func()
+	}{
+		{name: "first event", seen: func() bool { return r.seen(event, time.Minute, start) }, want: false},
+		{name: "refresh", seen: func() bool { return r.seen(event, time.Minute, start.Add(30*time.Second)) }, want: true},
+		{name: "other page", seen: func() bool { return r.seen(other, time.Minute, start.Add(30*time.Second)) }, want: false},
+		{name: "anonymous event", seen: func() bool { return r.seen(anonymous, time.Minute, start) }, want: false},
+		{name: "anonymous repeated", seen: func() bool { return r.seen(anonymous, time.Minute, start) }, want: false},
+		// The window starts at the first event, not at the refreshes
+		{
+			name:  "after window",
+			seen:  func() bool { return r.seen(event, time.Minute, start.Add(time.Minute)) },
+			want:  false,
+			after: func() { r.forget(event) },
+		},
+		{name: "after forget", seen: func() bool { return r.seen(event, time.Minute, start.Add(90*time.Second)) }, want: false},
+		{name: "first ID", seen: func() bool { return r.seenID("example.com", "id", start) }, want: false},
+		{name: "retried ID", seen: func() bool { return r.seenID("example.com", "id", start.Add(idWindow-time.Second)) }, want: true},
+		{name: "ID of other domain", seen: func() bool { return r.seenID("example.org", "id", start) }, want: false},
+		{
+			name:  "expired ID",
+			seen:  func() bool { return r.seenID("example.com", "id", start.Add(idWindow)) },
+			want:  false,
+			after: func() { r.forgetID("example.com", "id") },
+		},
+		{name: "after forget ID", seen: func() bool { return r.seenID("example.com", "id", start.Add(idWindow)) }, want: false},
+	}
+	for _, step := range steps {
+		if got := step.seen(); got != step.want {
+			t.Errorf("%s: seen = %v, want %v", step.name, got, step.want)
+		}
+		if step.after != nil {
+			step.after()
+		}
+	}
+
+	// The expired events are pruned once pruneInterval passes
+	r.seen(other, time.Minute, start.Add(2*idWindow))
+	if len(r.expires) != 1 {
+		t.Errorf("recorded events after pruning = %d, want 1", len(r.expires))
+	}
+}
+
+// failingDatabase is database.Database failing the inserts while failures are left.
+type failingDatabase struct {
+	database.Database
+	failures int
+}
+
+func (d *failingDatabase) Insert(ctx context.Context, msg *analytics.Event) error {
+	if d.failures > 0 {
+		d.failures--
+		return errors.New("database is unavailable")
+	}
+	return d.Database.Insert(ctx, msg)
+}
+
+// TestCreateEventDuplicates checks the failed events aren't taken for the stored ones by their retries and by the identical events.
+func TestCreateEventDuplicates(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{name: "identical events"},
+		{name: "client IDs", id: "6f1c1a52-8d2b-4f5e-9a3c-2f6d8e1b7c40"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inmem, err := database.NewDatabase(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db := &failingDatabase{Database: inmem, failures: 1}
+			visitSalt, err := salt.New(salt.Config{Lifetime: time.Hour, Size: 16})
+			if err != nil {
+				t.Fatal(err)
+			}
+			counter := func(labels ...string) *promClient.CounterVec {
+				return promClient.NewCounterVec(promClient.CounterOpts{Name: "test_total"}, labels)
+			}
+			s := &analyticsServer{
+				db:              db,
+				sites:           sites.NewRegistry(&sites.Config{Sites: []sites.Site{{Domain: "example.com", DedupWindow: time.Minute}}}),
+				salt:            visitSalt,
+				hashInputs:      DefaultHashInputs,
+				timestampsTotal: counter("domain", "source"),
+				duplicates:      newRecentEvents(),
+				duplicatesTotal: counter("domain"),
+				logger:          zap.NewNop(),
+			}
+			ctx := WithVisitor(context.Background(), "203.0.113.1", "Mozilla/5.0 Firefox/125.0")
+			create := func() error {
+				_, err := s.CreateEvent(ctx, &analytics.Event{ID: tt.id, Domain: "example.com", Type: "pageview", URL: "https://example.com/"})
+				return err
+			}
+
+			if err = create(); status.Code(err) != codes.Internal {
+				t.Fatalf("CreateEvent() of the failing database error = %v, want Internal", err)
+			}
+			if err = create(); err != nil {
+				t.Fatalf("CreateEvent() after the failure error = %v", err)
+			}
+			if err = create(); err != nil {
+				t.Fatalf("CreateEvent() of the duplicate error = %v", err)
+			}
+			events, err := inmem.List(context.Background(), sites.Key{Tenant: "example.com", Domain: "example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events.GetEvents()) != 1 {
+				t.Errorf("stored events = %d, want 1", len(events.GetEvents()))
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package analytics
+
+import (
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"github.com/mileusna/useragent"
+	"google.golang.org/grpc/metadata"
+	"strings"
+)
+
+// Metadata keys of the low entropy client hints of the device, which the Chromium browsers send by default.
+const (
+	MetadataMobileHint   = "sec-ch-ua-mobile"
+	MetadataPlatformHint = "sec-ch-ua-platform"
+)
+
+// platformOSs are the operating systems of the Sec-CH-UA-Platform values, named the way the user agents are parsed.
+var platformOSs = map[string]string{
+	"Android":     useragent.Android,
+	"Chrome OS":   useragent.ChromeOS,
+	"Chromium OS": useragent.ChromeOS,
+	"iOS":         useragent.IOS,
+	"Linux":       useragent.Linux,
+	"macOS":       useragent.MacOS,
+	"Windows":     useragent.Windows,
+}
+
+// mobileOSs and desktopOSs are the operating systems the devices of the unclassified user agents are guessed by.
+var (
+	mobileOSs  = []string{useragent.Android, useragent.IOS, useragent.WindowsPhone, useragent.BlackBerry}
+	desktopOSs = []string{useragent.Windows, useragent.MacOS, useragent.Linux, useragent.FreeBSD, useragent.ChromeOS}
+)
+
+// classifyDevice returns the device of the parsed user agent ua sent with md.
+//
+// The user agent is used first, then the Sec-CH-UA-Mobile client hint and then the operating system
+// of the user agent or of the Sec-CH-UA-Platform hint. The device is Unknown if none of them tells it.
+func classifyDevice(ua useragent.UserAgent, md metadata.MD) *analytics.Device {
+	switch {
+	case ua.Mobile:
+		return &analytics.Device{Device: &analytics.Device_Mobile{Mobile: true}}
+	case ua.Tablet:
+		return &analytics.Device{Device: &analytics.Device_Tablet{Tablet: true}}
+	case ua.Desktop:
+		return &analytics.Device{Device: &analytics.Device_Desktop{Desktop: true}}
+	case ua.Bot:
+		return &analytics.Device{Device: &analytics.Device_Bot{Bot: true}}
+	}
+
+	// The hint is a structured header boolean, ?1 or ?0
+	switch hint(md, MetadataMobileHint) {
+	case "?1":
+		return &analytics.Device{Device: &analytics.Device_Mobile{Mobile: true}}
+	case "?0":
+		return &analytics.Device{Device: &analytics.Device_Desktop{Desktop: true}}
+	}
+
+	os := clientOS(ua, md)
+	for _, mobile := range mobileOSs {
+		if os == mobile {
+			return &analytics.Device{Device: &analytics.Device_Mobile{Mobile: true}}
+		}
+	}
+	for _, desktop := range desktopOSs {
+		if os == desktop {
+			return &analytics.Device{Device: &analytics.Device_Desktop{Desktop: true}}
+		}
+	}
+	return &analytics.Device{Device: &analytics.Device_Unknown{Unknown: true}}
+}
+
+// clientOS returns the operating system of the parsed user agent ua, or of the Sec-CH-UA-Platform hint sent with md
+// if the user agent doesn't tell it.
+func clientOS(ua useragent.UserAgent, md metadata.MD) string {
+	if ua.OS != "" {
+		return ua.OS
+	}
+	return platformOSs[hint(md, MetadataPlatformHint)]
+}
+
+// hint returns the value of the client hint, without the quotes of the structured header strings.
+func hint(md metadata.MD, key string) string {
+	v := md.Get(key)
+	if len(v) == 0 {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(v[0]), `"`)
+}
@@ -0,0 +1,111 @@
+package analytics
+
+import (
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"github.com/mileusna/useragent"
+	"google.golang.org/grpc/metadata"
+	"testing"
+)
+
+// deviceName returns the name of the device of the event.
+func deviceName(d *analytics.Device) string {
+	switch d.GetDevice().(type) {
+	case *analytics.Device_Mobile:
+		return "mobile"
+	case *analytics.Device_Tablet:
+		return "tablet"
+	case *analytics.Device_Desktop:
+		return "desktop"
+	case *analytics.Device_Bot:
+		return "bot"
+	case *analytics.Device_Unknown:
+		return "unknown"
+	}
+	return "none"
+}
+
+func TestClassifyDevice(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		hints     []string
+		want      string
+	}{
+		{
+			name:      "iPhone",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+			want:      "mobile",
+		},
+		{
+			name:      "Android phone",
+			userAgent: "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+			want:      "mobile",
+		},
+		{
+			name:      "iPad",
+			userAgent: "Mozilla/5.0 (iPad; CPU OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+			want:      "tablet",
+		},
+		{
+			name:      "Windows desktop",
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			want:      "desktop",
+		},
+		{
+			name:      "macOS desktop",
+			userAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+			want:      "desktop",
+		},
+		{
+			name:      "crawler",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want:      "bot",
+		},
+		{
+			name:      "mobile hint",
+			userAgent: "Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			hints:     []string{MetadataMobileHint, "?1"},
+			want:      "mobile",
+		},
+		{
+			name:      "desktop hint",
+			userAgent: "Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			hints:     []string{MetadataMobileHint, " ?0 "},
+			want:      "desktop",
+		},
+		{
+			name:      "mobile platform hint",
+			userAgent: "Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			hints:     []string{MetadataPlatformHint, `"Android"`},
+			want:      "mobile",
+		},
+		{
+			name:      "desktop platform hint",
+			userAgent: "Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			hints:     []string{MetadataPlatformHint, `"Chrome OS"`},
+			want:      "desktop",
+		},
+		{
+			name:      "unknown platform hint",
+			userAgent: "Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			hints:     []string{MetadataPlatformHint, `"Fuchsia"`},
+			want:      "unknown",
+		},
+		{
+			name:      "invalid mobile hint",
+			userAgent: "Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			hints:     []string{MetadataMobileHint, "yes"},
+			want:      "unknown",
+		},
+		{name: "HTTP client", userAgent: "curl/8.5.0", want: "unknown"},
+		{name: "empty user agent", userAgent: "", want: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyDevice(useragent.Parse(tt.userAgent), metadata.Pairs(tt.hints...))
+			if name := deviceName(got); name != tt.want {
+				t.Errorf("classifyDevice(%q, %q) = %s, want %s", tt.userAgent, tt.hints, name, tt.want)
+			}
+		})
+	}
+}
@@ -2,29 +2,52 @@ package analytics
 
 import (
 	"context"
-	"crypto/rand"
+	"diploma/analytics-exporter/internal/database"
 	"diploma/analytics-exporter/pkg/api/analytics"
-	"encoding/hex"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/mileusna/useragent"
+	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
-	"io"
+	"slices"
 	"time"
 )
 
-var (
-	DailySalt          []byte
-	DailySaltTimestamp time.Time
+// Metadata keys of the visitor details, as set by the gateway.
+const (
+	MetadataClientAddress = "x-forwarded-for"
+	MetadataUserAgent     = "grpcgateway-user-agent"
+	MetadataOrigin        = "grpcgateway-origin"
 )
 
-const DailySaltLifetime = time.Hour * 24
-const DailySaltBytesAmount = 32
+// WithVisitor returns a copy of ctx carrying the visitor details in the incoming metadata,
+// the way the gateway passes them to CreateEvent. Empty values are omitted.
+func WithVisitor(ctx context.Context, clientAddress string, userAgent string) context.Context {
+	md := metadata.MD{}
+	if clientAddress != "" {
+		md.Set(MetadataClientAddress, clientAddress)
+	}
+	if userAgent != "" {
+		md.Set(MetadataUserAgent, userAgent)
+	}
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+// loggedMetadata returns the metadata of the request without the client address,
+// unless it's hashed, so it isn't kept in the logs of the deployments hashing no IP-derived input.
+func (s *analyticsServer) loggedMetadata(md metadata.MD) metadata.MD {
+	if slices.Contains(s.hashInputs, HashIP) {
+		return md
+	}
+	logged := md.Copy()
+	delete(logged, MetadataClientAddress)
+	return logged
+}
 
 // CreateEvent creates event in the database as *catalog.Customer
 func (s *analyticsServer) CreateEvent(ctx context.Context, r *analytics.Event) (*emptypb.Empty, error) {
@@ -35,99 +58,296 @@ func (s *analyticsServer) CreateEvent(ctx context.Context, r *analytics.Event) (
 		return nil, status.Error(codes.InvalidArgument, "domain is missing")
 	}
 	md, _ := metadata.FromIncomingContext(ctx)
-	for key, val := range md {
-		fmt.Printf("Key: %s, value: %s\n", key, val)
+	if ce := s.logger.Check(zap.DebugLevel, "Received event"); ce != nil {
+		ce.Write(zap.String("domain", r.GetDomain()), zap.Any("metadata", s.loggedMetadata(md)))
 	}
-
-	fmt.Println(DailySaltTimestamp)
-	fmt.Println(time.Now())
-	if DailySalt == nil || time.Since(DailySaltTimestamp) > DailySaltLifetime {
-		DailySalt = make([]byte, DailySaltBytesAmount)
-		_, err := io.ReadFull(rand.Reader, DailySalt)
-		if err != nil {
-			return nil, fmt.Errorf("error while creating the daily salt: %w", err)
+	if len(md[MetadataClientAddress]) == 0 && slices.Contains(s.hashInputs, HashIP) {
+		return nil, status.Error(codes.InvalidArgument, "client address is missing")
+	}
+	if len(md[MetadataUserAgent]) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "user agent is missing")
+	}
+	if s.sites != nil {
+		var origin string
+		if len(md[MetadataOrigin]) > 0 {
+			origin = md[MetadataOrigin][0]
+		}
+		if site, ok := s.sites.Get(r.GetDomain()); ok && !site.AllowsOrigin(origin) {
+			return nil, status.Errorf(codes.PermissionDenied, "origin %s is not allowed for %s", origin, r.GetDomain())
 		}
-		DailySaltTimestamp = time.Now()
-		fmt.Println("Generated a new daily salt")
 	}
 
-	// Generate new ID
-	id := uuid.New().String()
-
-	// Get the hash of the visit by formula: hash(daily_salt + website_domain + ip_address + user_agent)
-	s.h.Write(DailySalt)
-	s.h.Write([]byte(r.GetDomain()))
-	s.h.Write([]byte(md["x-forwarded-for"][0]))
-	s.h.Write([]byte(md["grpcgateway-user-agent"][0]))
-	visitHashValue := s.h.Sum(nil)
-	visitEncodedHashString := hex.EncodeToString(visitHashValue)
+	// The offline and the batching trackers send the time the event happened at
+	now := time.Now()
+	timestamp, timestampSource, err := s.timestamps.timestamp(r.GetTimestamp(), now)
+	if err != nil {
+		return nil, err
+	}
 
-	defer func() {
-		s.h.Reset()
-	}()
+	if s.geoBlocklist.blocked(md) {
+		s.geoBlockedTotal.WithLabelValues(r.GetDomain()).Inc()
+		return &emptypb.Empty{}, nil
+	}
 
-	// Construct a new Protobuf wrapped timestamp from the current time.
-	timePbNow := timestamppb.Now()
+	policy := PrivacyIgnore
+	if signals := privacySignals(md); len(signals) > 0 {
+		policy = s.privacy
+		for _, signal := range signals {
+			s.privacyTotal.WithLabelValues(signal, string(policy)).Inc()
+		}
+	}
+	if policy == PrivacyDrop {
+		return &emptypb.Empty{}, nil
+	}
+	// The events without the consent are counted in the aggregates only, same as the anonymized ones without the props
+	props := r.GetProps()
+	if r.GetConsent() != nil && !r.GetConsent().GetValue() {
+		if policy == PrivacyIgnore {
+			policy = PrivacyAnonymize
+		}
+		props = nil
+		s.privacyTotal.WithLabelValues("no-consent", string(policy)).Inc()
+	}
 
-	// Parse the user agent header
-	ua := useragent.Parse(md["grpcgateway-user-agent"][0])
+	salt, err := s.salt.Get()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot get salt: %v", err)
+	}
 
-	var device analytics.Device
-	switch {
-	case ua.Mobile:
-		device = analytics.Device{
-			Device: &analytics.Device_Mobile{
-				Mobile: true,
-			},
+	// The clients send their own IDs, so the retries of the events are stored once, otherwise a new one is generated
+	id := uuid.New().String()
+	clientID := r.GetID() != ""
+	if clientID {
+		parsed, err := uuid.Parse(r.GetID())
+		if err != nil || parsed == uuid.Nil {
+			return nil, status.Errorf(codes.InvalidArgument, "event ID %q is not a UUID", r.GetID())
 		}
-	case ua.Tablet:
-		device = analytics.Device{
-			Device: &analytics.Device_Tablet{
-				Tablet: true,
-			},
+		id = parsed.String()
+	}
+
+	// Get the hash of the visit by formula: hash(salt + inputs), the inputs are website_domain + ip_address + user_agent
+	// unless configured otherwise, the anonymized events have none
+	var visitEncodedHashString string
+	if policy != PrivacyAnonymize {
+		visitEncodedHashString = s.visitorHash(salt, r, md)
+		// The visitors seen before the salt rotation keep the hashes of the previous salt during its grace period
+		if s.recent != nil {
+			var previousHash string
+			if previous := s.salt.Previous(); previous != nil {
+				previousHash = s.visitorHash(previous, r, md)
+			}
+			visitEncodedHashString = s.recent.match(visitEncodedHashString, previousHash, now)
 		}
-	case ua.Desktop:
-		device = analytics.Device{
-			Device: &analytics.Device_Desktop{
-				Desktop: true,
-			},
+	}
+
+	// The excluded traffic of the site, e.g. of the office or of the monitoring bots, isn't stored
+	if s.sites != nil {
+		if site, ok := s.sites.Get(r.GetDomain()); ok && site.Excludes(s.proxies.clientIP(md), md[MetadataUserAgent][0], visitEncodedHashString) {
+			s.excludedTotal.WithLabelValues(r.GetDomain()).Inc()
+			return &emptypb.Empty{}, nil
 		}
-	case ua.Bot:
-		device = analytics.Device{
-			Device: &analytics.Device_Bot{
-				Bot: true,
-			},
+	}
+
+	// The variants of a page, e.g. with and without the trailing slash, are stored as one by the rules of the site
+	pageURL := s.scrubber.Scrub(r.GetURL())
+	if s.sites != nil {
+		if site, ok := s.sites.Get(r.GetDomain()); ok {
+			pageURL = site.URLRules.Normalize(pageURL)
 		}
 	}
 
+	// Parse the user agent header
+	ua := useragent.Parse(md[MetadataUserAgent][0])
+
 	e := &analytics.Event{
 		ID:          id,
+		Tenant:      s.sites.Key(r.GetDomain()).Tenant,
 		Type:        r.GetType(),
-		URL:         r.GetURL(),
+		URL:         pageURL,
 		Domain:      r.GetDomain(),
-		Referrer:    r.GetReferrer(),
+		Referrer:    s.scrubber.Scrub(r.GetReferrer()),
 		Browser:     ua.Name,
-		OS:          ua.OS,
-		Device:      &device,
+		OS:          clientOS(ua, md),
+		Device:      classifyDevice(ua, md),
 		HashedVisit: visitEncodedHashString,
 		Meta:        r.GetMeta(),
-		Props:       r.GetProps(),
-		Timestamp:   timePbNow,
+		Props:       props,
+		Timestamp:   timestamppb.New(timestamp),
+		Consent:     r.GetConsent(),
+		TraceID:     traceID(md),
+
+		ClientTimestamp: timestampSource == TimestampClient,
 	}
 
-	fmt.Println(e)
+	s.logger.Debug("Created event", zap.Stringer("event", e))
+
+	// The retried events are stored once, the storage skips the stored IDs as well,
+	// but the retries within the window aren't metered and published again
+	if clientID && s.duplicates.seenID(e.GetDomain(), id, now) {
+		s.duplicatesTotal.WithLabelValues(r.GetDomain()).Inc()
+		return &emptypb.Empty{}, nil
+	}
+
+	// The page refreshes and the double fired tracker calls are stored once within the dedup window of the site
+	deduplicated := false
+	if s.sites != nil {
+		if site, ok := s.sites.Get(r.GetDomain()); ok && site.DedupWindow > 0 {
+			if s.duplicates.seen(e, site.DedupWindow, now) {
+				s.duplicatesTotal.WithLabelValues(r.GetDomain()).Inc()
+				return &emptypb.Empty{}, nil
+			}
+			deduplicated = true
+		}
+	}
+
+	// The retries and the identical events of the events which aren't stored are accepted,
+	// so they're recorded as stored before and forgotten on the failures, while the concurrent ones are skipped
+	failed := func(err error) (*emptypb.Empty, error) {
+		if clientID {
+			s.duplicates.forgetID(e.GetDomain(), id)
+		}
+		if deduplicated {
+			s.duplicates.forget(e)
+		}
+		return nil, err
+	}
+
+	if s.meter != nil {
+		accepted, err := s.meter.Admit(ctx, e.GetTenant(), now)
+		if err != nil {
+			return failed(usageStatus(err, e.GetTenant()))
+		}
+		if !accepted {
+			// Dropped by the sampling over the quota, which isn't an error for the client
+			return &emptypb.Empty{}, nil
+		}
+	}
 
 	if err := s.db.Insert(ctx, e); err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot create event %s: %v", r.GetDomain(), e)
+		// Pass through errors which already define the status, e.g. an overloaded ingestion queue
+		if _, ok := status.FromError(err); ok {
+			return failed(err)
+		}
+		return failed(status.Errorf(codes.Internal, "cannot create event %s: %v", r.GetDomain(), e))
+	}
+	s.timestampsTotal.WithLabelValues(r.GetDomain(), timestampSource).Inc()
+	for _, sink := range s.sinks {
+		sink.Publish(e)
 	}
 	return &emptypb.Empty{}, nil
 }
 
 // ListEvents returns events slice from the database as *analytics.Events
 func (s *analyticsServer) ListEvents(ctx context.Context, r *wrapperspb.StringValue) (*analytics.Events, error) {
-	entries, err := s.db.List(ctx, r.String())
+	entries, err := s.db.List(ctx, s.sites.Key(r.GetValue()))
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "cannot list customers: %v", err)
 	}
 	return entries, nil
 }
+
+// subscriptionBuffer is an amount of events buffered for a slow subscriber before dropping them.
+const subscriptionBuffer = 256
+
+// SubscribeEvents streams the events of the domain as they are ingested until the client disconnects.
+func (s *analyticsServer) SubscribeEvents(r *analytics.SubscribeEventsRequest, stream analytics.Analytics_SubscribeEventsServer) error {
+	if r.GetDomain() == "" {
+		return status.Error(codes.InvalidArgument, "domain is missing")
+	}
+	events, cancel := s.bus.Subscribe(s.sites.Key(r.GetDomain()), subscriptionBuffer)
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-events:
+			if len(r.GetTypes()) > 0 && !slices.Contains(r.GetTypes(), e.GetType()) {
+				continue
+			}
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ExportEvents streams the stored events of the domain in the time range in the timestamp order.
+func (s *analyticsServer) ExportEvents(r *analytics.ExportEventsRequest, stream analytics.Analytics_ExportEventsServer) error {
+	if r.GetDomain() == "" {
+		return status.Error(codes.InvalidArgument, "domain is missing")
+	}
+	var from, to time.Time
+	if r.GetFrom() != nil {
+		from = r.GetFrom().AsTime()
+	}
+	if r.GetTo() != nil {
+		to = r.GetTo().AsTime()
+	}
+
+	err := s.db.ForEach(stream.Context(), s.sites.Key(r.GetDomain()), from, to, func(e *analytics.Event) error {
+		return stream.Send(e)
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Errorf(codes.Internal, "cannot export events %s: %v", r.GetDomain(), err)
+	}
+	return nil
+}
+
+// ExportVisitor returns all the stored events of the domain with the visitor hash in the timestamp order.
+// The salt of the hashes is rotated, so the hash identifies the visitor within a salt lifetime only.
+func (s *analyticsServer) ExportVisitor(ctx context.Context, r *analytics.ExportVisitorRequest) (*analytics.Events, error) {
+	if r.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is missing")
+	}
+	if r.GetHashedVisit() == "" {
+		return nil, status.Error(codes.InvalidArgument, "visitor hash is missing")
+	}
+
+	res := &analytics.Events{Events: make([]*analytics.Event, 0)}
+	err := s.db.ForEach(ctx, s.sites.Key(r.GetDomain()), time.Time{}, time.Time{}, func(e *analytics.Event) error {
+		if e.GetHashedVisit() == r.GetHashedVisit() {
+			res.Events = append(res.Events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot export visitor events %s: %v", r.GetDomain(), err)
+	}
+	return res, nil
+}
+
+// DeleteVisitor deletes all the stored events of the domain with the visitor hash, the erasure counterpart of ExportVisitor.
+// The events already archived and the ones still queued for the insertion aren't deleted.
+func (s *analyticsServer) DeleteVisitor(ctx context.Context, r *analytics.DeleteVisitorRequest) (*analytics.DeleteVisitorResponse, error) {
+	if r.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is missing")
+	}
+	if r.GetHashedVisit() == "" {
+		return nil, status.Error(codes.InvalidArgument, "visitor hash is missing")
+	}
+
+	site := s.sites.Key(r.GetDomain())
+	deleted, err := s.db.DeleteVisitor(ctx, site, r.GetHashedVisit())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot delete visitor events %s: %v", r.GetDomain(), err)
+	}
+	if deleted > 0 {
+		// The hash isn't logged, the audit log outlives the erased events
+		after := fmt.Sprintf(`{"tenant":%q,"visitor":true,"deleted":%d}`, site.Tenant, deleted)
+		if err = s.db.AppendAudit(ctx, &database.AuditEntry{
+			Time:   time.Now(),
+			Actor:  "api",
+			Action: database.AuditDataDelete,
+			Domain: r.GetDomain(),
+			After:  after,
+		}); err != nil {
+			s.logger.Error("Cannot append audit log entry", zap.String("domain", r.GetDomain()), zap.Error(err))
+		}
+	}
+	s.logger.Info("Deleted visitor events", zap.String("domain", r.GetDomain()), zap.Int("deleted", deleted))
+	return &analytics.DeleteVisitorResponse{Deleted: int64(deleted)}, nil
+}
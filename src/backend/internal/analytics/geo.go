@@ -0,0 +1,60 @@
+package analytics
+
+import (
+	"fmt"
+	"google.golang.org/grpc/metadata"
+	"regexp"
+	"strings"
+)
+
+// Metadata keys of the location of the visitors, as set by the gateway from the country headers of the CDNs
+// and the proxies doing the GeoIP lookup, e.g. CF-IPCountry or CloudFront-Viewer-Country.
+const (
+	MetadataCountry = "x-country-code"
+	MetadataRegion  = "x-region-code"
+)
+
+// geoCodePattern matches the ISO 3166-1 alpha-2 country codes and the ISO 3166-2 region codes, e.g. DE and US-CA.
+var geoCodePattern = regexp.MustCompile(`^[A-Z]{2}(-[A-Z0-9]{1,3})?$`)
+
+// GeoBlocklist is the set of the countries and the regions the events aren't stored from.
+type GeoBlocklist map[string]struct{}
+
+// ParseGeoBlocklist returns GeoBlocklist of the ISO 3166-1 country codes, blocking the whole countries,
+// and the ISO 3166-2 region codes, blocking the regions only.
+func ParseGeoBlocklist(codes []string) (GeoBlocklist, error) {
+	b := make(GeoBlocklist, len(codes))
+	for _, code := range codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !geoCodePattern.MatchString(code) {
+			return nil, fmt.Errorf("invalid country or region code %q", code)
+		}
+		b[code] = struct{}{}
+	}
+	return b, nil
+}
+
+// blocked reports whether the events of the visitor located by md aren't stored.
+// The visitors of the unknown location aren't blocked.
+func (b GeoBlocklist) blocked(md metadata.MD) bool {
+	if len(b) == 0 {
+		return false
+	}
+	v := md.Get(MetadataCountry)
+	if len(v) == 0 || v[0] == "" {
+		return false
+	}
+	country := strings.ToUpper(v[0])
+	if _, ok := b[country]; ok {
+		return true
+	}
+	if v = md.Get(MetadataRegion); len(v) > 0 && v[0] != "" {
+		region := strings.ToUpper(v[0])
+		if !strings.Contains(region, "-") {
+			region = country + "-" + region
+		}
+		_, ok := b[region]
+		return ok
+	}
+	return false
+}
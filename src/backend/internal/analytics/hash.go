@@ -0,0 +1,140 @@
+package analytics
+
+import (
+	"crypto/sha256"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/metadata"
+	"hash"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MetaScreen is the meta key of the screen size of the visitor, e.g. 1920x1080, sent by the tracker script.
+const MetaScreen = "screen"
+
+// HashInput is a component of the visitor hash, which is always salted.
+type HashInput string
+
+const (
+	// HashIP is the client address.
+	HashIP HashInput = "ip"
+	// HashUserAgent is the user agent.
+	HashUserAgent HashInput = "user-agent"
+	// HashScreen is the screen size sent in the MetaScreen meta.
+	HashScreen HashInput = "screen"
+	// HashDomain is the domain of the site, so a visitor isn't linked across the sites.
+	HashDomain HashInput = "domain"
+)
+
+// DefaultHashInputs are the components of the visitor hash, unless configured otherwise.
+var DefaultHashInputs = []HashInput{HashDomain, HashIP, HashUserAgent}
+
+// ParseHashInputs returns the known components of the visitor hash in the order they are hashed.
+func ParseHashInputs(names []string) ([]HashInput, error) {
+	if len(names) == 0 {
+		return nil, errors.New("visitor hash inputs are empty")
+	}
+	inputs := make([]HashInput, 0, len(names))
+	for _, name := range names {
+		input := HashInput(name)
+		switch input {
+		case HashIP, HashUserAgent, HashScreen, HashDomain:
+		default:
+			return nil, fmt.Errorf("unknown visitor hash input %q", name)
+		}
+		if !slices.Contains(inputs, input) {
+			inputs = append(inputs, input)
+		}
+	}
+	// The order of DefaultHashInputs keeps the hashes of the default configuration
+	order := []HashInput{HashDomain, HashIP, HashUserAgent, HashScreen}
+	slices.SortFunc(inputs, func(a, b HashInput) int {
+		return slices.Index(order, a) - slices.Index(order, b)
+	})
+	return inputs, nil
+}
+
+// hashInput returns the value of the component of the visitor hash of the event r sent with md
+// by the client address ip.
+func hashInput(input HashInput, r *analytics.Event, md metadata.MD, ip string) string {
+	switch input {
+	case HashIP:
+		return ip
+	case HashUserAgent:
+		if v := md.Get(MetadataUserAgent); len(v) > 0 {
+			return v[0]
+		}
+	case HashScreen:
+		return r.GetMeta()[MetaScreen]
+	case HashDomain:
+		return r.GetDomain()
+	}
+	return ""
+}
+
+// hashers are the reused SHA-256 hashes of the visitors, a hash.Hash isn't safe for concurrent use
+// and the events are created concurrently.
+var hashers = sync.Pool{New: func() any { return sha256.New() }}
+
+// visitorHash returns the hex encoded hash of the salt and the inputs of the event r sent with md.
+func (s *analyticsServer) visitorHash(salt []byte, r *analytics.Event, md metadata.MD) string {
+	h := hashers.Get().(hash.Hash)
+	defer func() {
+		h.Reset()
+		hashers.Put(h)
+	}()
+	h.Write(salt)
+	ip := s.proxies.clientIP(md)
+	for _, input := range s.hashInputs {
+		h.Write([]byte(hashInput(input, r, md, ip)))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recentVisitors are the visitor hashes seen within the window, so the visitors active before the salt rotation
+// keep their hashes of the previous salt during its grace period.
+//
+// It's safe for concurrent use.
+type recentVisitors struct {
+	window time.Duration
+
+	mutex  sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// newRecentVisitors returns new recentVisitors instance remembering the hashes for the window.
+func newRecentVisitors(window time.Duration) *recentVisitors {
+	return &recentVisitors{
+		window: window,
+		seen:   make(map[string]time.Time),
+		pruned: time.Now(),
+	}
+}
+
+// match returns the hash of the previous salt if it's seen within the window, the current one otherwise,
+// and records the returned hash as seen at now. The previous hash is empty outside the grace period.
+func (v *recentVisitors) match(current string, previous string, now time.Time) string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	hash := current
+	if seen, ok := v.seen[previous]; ok && previous != "" && now.Sub(seen) <= v.window {
+		hash = previous
+	}
+	v.seen[hash] = now
+
+	if now.Sub(v.pruned) > v.window {
+		for h, seen := range v.seen {
+			if now.Sub(seen) > v.window {
+				delete(v.seen, h)
+			}
+		}
+		v.pruned = now
+	}
+	return hash
+}
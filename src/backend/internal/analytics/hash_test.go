@@ -0,0 +1,58 @@
+package analytics
+
+import (
+	"crypto/sha256"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/grpc/metadata"
+	"sync"
+	"testing"
+)
+
+// TestVisitorHashConcurrent checks the pooled hashers aren't shared by the concurrent events,
+// it's meant to be run with -race.
+func TestVisitorHashConcurrent(t *testing.T) {
+	s := &analyticsServer{hashInputs: DefaultHashInputs}
+	salt := []byte("salt")
+
+	type visitor struct {
+		event *analytics.Event
+		md    metadata.MD
+		want  string
+	}
+	visitors := make([]visitor, 16)
+	for i := range visitors {
+		domain := fmt.Sprintf("site-%d.example.com", i%4)
+		ip := fmt.Sprintf("203.0.113.%d", i)
+		userAgent := fmt.Sprintf("Mozilla/5.0 Firefox/%d.0", 100+i)
+		want := sha256.Sum256([]byte(string(salt) + domain + ip + userAgent))
+		visitors[i] = visitor{
+			event: &analytics.Event{Domain: domain},
+			md:    metadata.Pairs(MetadataClientAddress, ip, MetadataUserAgent, userAgent),
+			want:  hex.EncodeToString(want[:]),
+		}
+	}
+
+	const goroutines, iterations = 32, 500
+	var wg sync.WaitGroup
+	errs := make(chan string, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				v := visitors[(g+i)%len(visitors)]
+				if got := s.visitorHash(salt, v.event, v.md); got != v.want {
+					errs <- fmt.Sprintf("visitorHash() of %s = %s, want %s", v.event.GetDomain(), got, v.want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,34 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"diploma/analytics-exporter/internal/importer"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Import stores the data of the file exported from other analytics or from the own JSONL export.
+//
+// Imported events are not published to the sinks, as they are historical.
+func (s *analyticsServer) Import(ctx context.Context, r *analytics.ImportRequest) (*analytics.ImportResponse, error) {
+	if r.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is missing")
+	}
+
+	res, err := importer.Parse(importer.Source(r.GetSource()), r.GetDomain(), r.GetName(), bytes.NewReader(r.GetContent()))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot parse %s: %v", r.GetName(), err)
+	}
+
+	rollups, err := importer.Store(ctx, s.db, s.sites.Key(r.GetDomain()), s.sites.Location(r.GetDomain()), s.sites.StatsSettings(r.GetDomain()), res)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot import %s: %v", r.GetName(), err)
+	}
+
+	return &analytics.ImportResponse{
+		Events:  int64(len(res.Events)),
+		Rollups: int64(rollups),
+	}, nil
+}
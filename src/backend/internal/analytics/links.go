@@ -0,0 +1,39 @@
+package analytics
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// CreateSharedLink mints the shared link token of the stats of the domain.
+func (s *analyticsServer) CreateSharedLink(_ context.Context, r *analytics.CreateSharedLinkRequest) (*analytics.SharedLink, error) {
+	if r.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is missing")
+	}
+	signer := s.sites.LinkSigner()
+	if signer == nil {
+		return nil, status.Error(codes.FailedPrecondition, "shared links are disabled")
+	}
+	if _, ok := s.sites.Get(r.GetDomain()); !ok {
+		return nil, status.Errorf(codes.NotFound, "site %s is not found", r.GetDomain())
+	}
+
+	ttl := sites.DefaultSharedLinkTTL
+	if r.GetTTL() != nil {
+		ttl = r.GetTTL().AsDuration()
+	}
+	if ttl <= 0 || ttl > sites.MaxSharedLinkTTL {
+		return nil, status.Errorf(codes.InvalidArgument, "ttl must be positive and at most %s", sites.MaxSharedLinkTTL)
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	return &analytics.SharedLink{
+		Token:     signer.Sign(r.GetDomain(), expires),
+		ExpiresAt: timestamppb.New(expires),
+	}, nil
+}
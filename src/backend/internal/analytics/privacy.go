@@ -0,0 +1,46 @@
+package analytics
+
+import (
+	"fmt"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys of the privacy signals of the visitors, as set by the gateway from the DNT and Sec-GPC headers.
+const (
+	MetadataDoNotTrack           = "dnt"
+	MetadataGlobalPrivacyControl = "sec-gpc"
+)
+
+// PrivacyPolicy is the handling of the events sent with the Do Not Track or the Global Privacy Control signal.
+type PrivacyPolicy string
+
+const (
+	// PrivacyIgnore records the events as usual.
+	PrivacyIgnore PrivacyPolicy = "ignore"
+	// PrivacyAnonymize records the events without the visitor hash, so they aren't linked into visits.
+	PrivacyAnonymize PrivacyPolicy = "anonymize"
+	// PrivacyDrop drops the events, which isn't an error for the client.
+	PrivacyDrop PrivacyPolicy = "drop"
+)
+
+// Validate checks that the policy is known.
+func (p PrivacyPolicy) Validate() error {
+	switch p {
+	case PrivacyIgnore, PrivacyAnonymize, PrivacyDrop:
+		return nil
+	default:
+		return fmt.Errorf("unknown privacy policy %q", p)
+	}
+}
+
+// privacySignals returns the privacy signals sent by the visitor, "dnt" and "gpc".
+func privacySignals(md metadata.MD) []string {
+	signals := make([]string, 0, 2)
+	if v := md.Get(MetadataDoNotTrack); len(v) > 0 && v[0] == "1" {
+		signals = append(signals, "dnt")
+	}
+	if v := md.Get(MetadataGlobalPrivacyControl); len(v) > 0 && v[0] == "1" {
+		signals = append(signals, "gpc")
+	}
+	return signals
+}
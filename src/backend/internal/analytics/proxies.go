@@ -0,0 +1,93 @@
+package analytics
+
+import (
+	"fmt"
+	"google.golang.org/grpc/metadata"
+	"net/netip"
+	"strings"
+)
+
+// DefaultTrustedProxies are the addresses of the proxies the client addresses are forwarded by,
+// unless configured otherwise: the loopback and the private networks.
+var DefaultTrustedProxies = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// TrustedProxies are the networks of the proxies in front of the service, their addresses are skipped
+// in X-Forwarded-For to get the address of the client.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies returns TrustedProxies of the addresses and the CIDRs, e.g. 10.0.0.0/8.
+func ParseTrustedProxies(values []string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(v, "/") {
+			prefix, err = netip.ParsePrefix(v)
+			prefix = prefix.Masked()
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(v)
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", v)
+		}
+		proxies = append(proxies, prefix)
+	}
+	return proxies, nil
+}
+
+// trusts reports whether the address is of a trusted proxy.
+func (p TrustedProxies) trusts(addr netip.Addr) bool {
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client from the forwarded addresses, which every proxy appends
+// the address it has received the request from to, the gateway included. It's the rightmost address
+// which isn't of a trusted proxy, or the leftmost one if all of them are trusted.
+//
+// The ports and the malformed entries, e.g. "unknown", are dropped.
+func (p TrustedProxies) clientIP(md metadata.MD) string {
+	v := md.Get(MetadataClientAddress)
+	if len(v) == 0 {
+		return ""
+	}
+	// The repeated headers are the parts of a single list
+	hops := strings.Split(strings.Join(v, ","), ",")
+	var ip string
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			continue
+		}
+		ip = addr.String()
+		if !p.trusts(addr) {
+			break
+		}
+	}
+	if ip == "" {
+		return strings.TrimSpace(hops[0])
+	}
+	return ip
+}
+
+// parseHop returns the address of an X-Forwarded-For entry, which may have a port, e.g. [2001:db8::1]:8080.
+// The IPv6 zone is dropped, it's meaningful only on the host of the proxy and the zoned addresses aren't in any network.
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.TrimSpace(hop)
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), true
+	}
+	addr, err := netip.ParseAddr(hop)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
@@ -0,0 +1,82 @@
+package analytics
+
+import (
+	"google.golang.org/grpc/metadata"
+	"slices"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies(slices.Concat(DefaultTrustedProxies, []string{"198.51.100.7", "2001:db8:ffff::/48"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		forwarded []string
+		want      string
+	}{
+		{name: "missing", want: ""},
+		{name: "single client", forwarded: []string{"203.0.113.1"}, want: "203.0.113.1"},
+		{name: "client behind trusted proxies", forwarded: []string{"203.0.113.1, 198.51.100.7, 10.0.0.1"}, want: "203.0.113.1"},
+		{name: "rightmost untrusted hop", forwarded: []string{"192.0.2.9, 203.0.113.1, 10.0.0.1"}, want: "203.0.113.1"},
+		{name: "spoofed leftmost hop", forwarded: []string{"10.0.0.5, 203.0.113.1, 127.0.0.1"}, want: "203.0.113.1"},
+		{name: "repeated headers", forwarded: []string{"192.0.2.9, 203.0.113.1", "198.51.100.7", "10.0.0.1"}, want: "203.0.113.1"},
+		{name: "all trusted", forwarded: []string{"10.0.0.5, 192.168.1.1, 127.0.0.1"}, want: "10.0.0.5"},
+		{name: "all trusted with malformed leftmost", forwarded: []string{"unknown, 10.0.0.5, 127.0.0.1"}, want: "10.0.0.5"},
+		{name: "ports", forwarded: []string{"203.0.113.1:51234, 10.0.0.1:8080"}, want: "203.0.113.1"},
+		{name: "IPv6 with port", forwarded: []string{"[2001:db8::1]:8080, [::1]:443"}, want: "2001:db8::1"},
+		{name: "IPv4-mapped IPv6", forwarded: []string{"::ffff:203.0.113.1, ::ffff:10.0.0.1"}, want: "203.0.113.1"},
+		{name: "trusted IPv6 network", forwarded: []string{"2001:db8::1, 2001:db8:ffff::2"}, want: "2001:db8::1"},
+		{name: "IPv6 zone", forwarded: []string{"fe80::1%eth0"}, want: "fe80::1"},
+		{name: "trusted IPv6 zone", forwarded: []string{"2001:db8::1, [::1%lo]:443"}, want: "2001:db8::1"},
+		{name: "malformed entries skipped", forwarded: []string{"203.0.113.1, unknown, , 10.0.0.1"}, want: "203.0.113.1"},
+		{name: "malformed rightmost entry", forwarded: []string{"203.0.113.1, 999.0.0.1"}, want: "203.0.113.1"},
+		{name: "whitespace", forwarded: []string{"  203.0.113.1 ,\t10.0.0.1 "}, want: "203.0.113.1"},
+		{name: "all malformed", forwarded: []string{" unknown , _hidden"}, want: "unknown"},
+		{name: "empty header", forwarded: []string{""}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := metadata.MD{}
+			if tt.forwarded != nil {
+				md.Append(MetadataClientAddress, tt.forwarded...)
+			}
+			if got := proxies.clientIP(md); got != tt.want {
+				t.Errorf("clientIP(%q) = %q, want %q", tt.forwarded, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "networks", values: []string{"10.0.0.0/8", " 2001:db8::/32 "}, want: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{name: "unmasked network", values: []string{"10.1.2.3/8"}, want: []string{"10.0.0.0/8"}},
+		{name: "addresses", values: []string{"198.51.100.7", "::ffff:10.0.0.1", "2001:db8::1"}, want: []string{"198.51.100.7/32", "10.0.0.1/32", "2001:db8::1/128"}},
+		{name: "invalid address", values: []string{"10.0.0.256"}, wantErr: true},
+		{name: "invalid network", values: []string{"10.0.0.0/33"}, wantErr: true},
+		{name: "hostname", values: []string{"proxy.internal"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTrustedProxies(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTrustedProxies(%q) error = %v, wantErr %v", tt.values, err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseTrustedProxies(%q) = %v, want %v", tt.values, got, tt.want)
+			}
+			for i := range got {
+				if got[i].String() != tt.want[i] {
+					t.Errorf("ParseTrustedProxies(%q)[%d] = %s, want %s", tt.values, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
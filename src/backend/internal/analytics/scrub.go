@@ -0,0 +1,83 @@
+package analytics
+
+import (
+	"net/url"
+	"strings"
+)
+
+// DefaultQueryAllowlist are the query parameters kept by QueryScrubber, unless configured otherwise.
+var DefaultQueryAllowlist = []string{"utm_*", "ref"}
+
+// QueryScrubber removes the query parameters which aren't allowlisted from the URLs and the referrers,
+// so the personal data embedded in them, e.g. the tokens and the emails, isn't stored.
+//
+// The nil QueryScrubber keeps the URLs as is.
+type QueryScrubber struct {
+	exact    map[string]struct{}
+	prefixes []string
+}
+
+// NewQueryScrubber returns new QueryScrubber instance keeping the parameters of the allowlist,
+// the names ending with * match the parameters by the prefix, e.g. utm_*. The names are case-insensitive.
+func NewQueryScrubber(allowlist []string) *QueryScrubber {
+	q := &QueryScrubber{exact: make(map[string]struct{}, len(allowlist))}
+	for _, name := range allowlist {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if prefix, ok := strings.CutSuffix(name, "*"); ok {
+			q.prefixes = append(q.prefixes, prefix)
+		} else if name != "" {
+			q.exact[name] = struct{}{}
+		}
+	}
+	return q
+}
+
+// Scrub returns the URL without the query parameters which aren't allowlisted, the kept ones and the fragment
+// are left encoded as is. The parameters with the malformed names are removed.
+func (q *QueryScrubber) Scrub(rawURL string) string {
+	if q == nil {
+		return rawURL
+	}
+	rest, fragment, hasFragment := strings.Cut(rawURL, "#")
+	base, query, ok := strings.Cut(rest, "?")
+	if !ok {
+		return rawURL
+	}
+
+	kept := make([]string, 0)
+	for _, pair := range strings.Split(query, "&") {
+		name, _, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(name)
+		if err != nil {
+			continue
+		}
+		if q.allows(strings.ToLower(name)) {
+			kept = append(kept, pair)
+		}
+	}
+
+	res := base
+	if len(kept) > 0 {
+		res += "?" + strings.Join(kept, "&")
+	}
+	if hasFragment {
+		res += "#" + fragment
+	}
+	return res
+}
+
+// allows reports whether the lowercase parameter name is allowlisted.
+func (q *QueryScrubber) allows(name string) bool {
+	if name == "" {
+		return false
+	}
+	if _, ok := q.exact[name]; ok {
+		return true
+	}
+	for _, prefix := range q.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
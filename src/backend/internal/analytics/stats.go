@@ -0,0 +1,191 @@
+package analytics
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// GetStats returns the stats of the domain aggregated over the stored events in the time range,
+// or in the named period whose days start at midnight in the site timezone.
+func (s *analyticsServer) GetStats(ctx context.Context, r *analytics.GetStatsRequest) (*analytics.Stats, error) {
+	if r.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is missing")
+	}
+
+	if r.GetPeriod() != "" && (r.GetFrom() != nil || r.GetTo() != nil) {
+		return nil, status.Error(codes.InvalidArgument, "period cannot be combined with from and to")
+	}
+	from, to, err := s.periodRange(r.GetDomain(), r.GetPeriod())
+	if err != nil {
+		return nil, err
+	}
+	if r.GetFrom() != nil {
+		from = r.GetFrom().AsTime()
+	}
+	if r.GetTo() != nil {
+		to = r.GetTo().AsTime()
+	}
+	return s.stats(ctx, r.GetDomain(), from, to)
+}
+
+const (
+	// defaultStatsInterval is the period the subscribed stats are recalculated after without new events.
+	defaultStatsInterval = 10 * time.Second
+	// minStatsInterval is the shortest period between the recalculations of the subscribed stats,
+	// so the bursts of events are aggregated once.
+	minStatsInterval = time.Second
+)
+
+// SubscribeStats streams the stats of the domain in the named period, or of all the stored events,
+// until the client disconnects. They are recalculated after the new events of the domain and every interval,
+// and sent when they change, the first ones right away.
+func (s *analyticsServer) SubscribeStats(r *analytics.SubscribeStatsRequest, stream analytics.Analytics_SubscribeStatsServer) error {
+	if r.GetDomain() == "" {
+		return status.Error(codes.InvalidArgument, "domain is missing")
+	}
+	if _, _, err := s.periodRange(r.GetDomain(), r.GetPeriod()); err != nil {
+		return err
+	}
+	interval := defaultStatsInterval
+	if r.GetInterval() != nil {
+		interval = max(r.GetInterval().AsDuration(), minStatsInterval)
+	}
+
+	// The events only signal the changes, so a slow subscriber doesn't need to buffer many of them
+	events, cancel := s.bus.Subscribe(s.sites.Key(r.GetDomain()), 1)
+	defer cancel()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var sent *analytics.Stats
+	var refresh <-chan time.Time
+	send := func() error {
+		// The named periods move with the time, e.g. today at midnight
+		from, to, err := s.periodRange(r.GetDomain(), r.GetPeriod())
+		if err != nil {
+			return err
+		}
+		stats, err := s.stats(stream.Context(), r.GetDomain(), from, to)
+		if err != nil {
+			return err
+		}
+		if !changed(sent, stats) {
+			return nil
+		}
+		sent = stats
+		return stream.Send(stats)
+	}
+
+	if err := send(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-events:
+			if refresh == nil {
+				refresh = time.After(minStatsInterval)
+			}
+		case <-refresh:
+			refresh = nil
+			if err := send(); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// changed reports whether the stats differ from the sent ones, which may be nil,
+// other than by the end of the period moving with the time.
+func changed(sent *analytics.Stats, stats *analytics.Stats) bool {
+	if sent == nil {
+		return true
+	}
+	a, b := proto.Clone(sent).(*analytics.Stats), proto.Clone(stats).(*analytics.Stats)
+	a.To, b.To = nil, nil
+	return !proto.Equal(a, b)
+}
+
+// periodRange returns the time range of the named period in the timezone of the site of the domain,
+// or the unbounded one if the period is empty.
+func (s *analyticsServer) periodRange(domain string, period string) (time.Time, time.Time, error) {
+	if period == "" {
+		return time.Time{}, time.Time{}, nil
+	}
+	from, to, err := sites.PeriodRange(period, time.Now(), s.sites.Location(domain))
+	if err != nil {
+		return time.Time{}, time.Time{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return from, to, nil
+}
+
+// stats returns the stats of the domain aggregated over the stored events in the time range.
+func (s *analyticsServer) stats(ctx context.Context, domain string, from, to time.Time) (*analytics.Stats, error) {
+	loc := s.sites.Location(domain)
+	var stats *prometheus.AnalyticsStats
+	var err error
+	if s.statsCache != nil {
+		stats, err = s.statsCache.Range(ctx, s.sites.Key(domain), s.sites.StatsSettings(domain), from, to)
+	} else {
+		stats, err = prometheus.GetAnalyticsStatsRange(ctx, s.db, s.sites.Key(domain), s.sites.StatsSettings(domain), from, to)
+	}
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "cannot get stats %s: %v", domain, err)
+	}
+
+	annotations, err := s.annotations(ctx, domain, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return &analytics.Stats{
+		UniqueVisitors:  stats.UniqueVisitors,
+		TotalVisits:     stats.TotalVisits,
+		TotalPageViews:  stats.TotalPageViews,
+		CurrentVisitors: stats.CurrentVisitors,
+		BounceRate:      stats.BounceRate,
+		Pages:           toCounts(stats.PagesRate),
+		Sources:         toCounts(stats.SourcesRate),
+		Devices:         toCounts(stats.DevicesRate),
+		OSs:             toCounts(stats.OSsRate),
+		Browsers:        toCounts(stats.BrowsersRate),
+		EntryPages:      toCounts(stats.EntryPagesRate),
+		ExitPages:       toCounts(stats.ExitPagesRate),
+		Annotations:     annotations,
+		Timezone:        loc.String(),
+		From:            optionalTimestamp(from),
+		To:              optionalTimestamp(to),
+	}, nil
+}
+
+// optionalTimestamp returns the timestamp of t, or nil if it's zero.
+func optionalTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// toCounts converts the rating to the API counts.
+func toCounts(rating map[string]int) map[string]int64 {
+	counts := make(map[string]int64, len(rating))
+	for k, v := range rating {
+		counts[k] = int64(v)
+	}
+	return counts
+}
@@ -0,0 +1,55 @@
+package analytics
+
+import (
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// The sources of the event timestamps.
+const (
+	TimestampServer = "server"
+	TimestampClient = "client"
+)
+
+// TimestampPolicy is the validation of the timestamps sent with the events, e.g. by the offline
+// and the batching trackers, which send the events after they happened.
+type TimestampPolicy struct {
+	// MaxSkew is the period the client timestamps may be ahead of the server time by, as the client clocks drift.
+	MaxSkew time.Duration
+	// MaxAge is the period the client timestamps may be behind the server time by,
+	// the client timestamps aren't accepted if it's 0.
+	MaxAge time.Duration
+}
+
+// Validate checks the policy.
+func (p TimestampPolicy) Validate() error {
+	if p.MaxSkew < 0 || p.MaxAge < 0 {
+		return errors.New("timestamp max skew and max age must not be negative")
+	}
+	return nil
+}
+
+// timestamp returns the time the event sent with the client timestamp happened at and its source.
+// It's the server time now if the client doesn't send one or the client timestamps aren't accepted.
+//
+// The client timestamps ahead of now by more than the max skew or behind it by more than the max age are rejected,
+// so the clients with the wrong clocks don't store the events into the past or into the future.
+func (p TimestampPolicy) timestamp(client *timestamppb.Timestamp, now time.Time) (time.Time, string, error) {
+	if client == nil || p.MaxAge == 0 {
+		return now, TimestampServer, nil
+	}
+	if err := client.CheckValid(); err != nil {
+		return time.Time{}, "", status.Errorf(codes.InvalidArgument, "invalid timestamp: %v", err)
+	}
+	t := client.AsTime()
+	if t.After(now.Add(p.MaxSkew)) {
+		return time.Time{}, "", status.Errorf(codes.InvalidArgument, "timestamp %s is ahead of the server time by more than %s", t.Format(time.RFC3339), p.MaxSkew)
+	}
+	if t.Before(now.Add(-p.MaxAge)) {
+		return time.Time{}, "", status.Errorf(codes.InvalidArgument, "timestamp %s is older than %s", t.Format(time.RFC3339), p.MaxAge)
+	}
+	return t, TimestampClient, nil
+}
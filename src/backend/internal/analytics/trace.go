@@ -0,0 +1,40 @@
+package analytics
+
+import (
+	"encoding/hex"
+	"google.golang.org/grpc/metadata"
+	"strings"
+)
+
+// MetadataTraceParent is the metadata key of the W3C trace context the event is sent with.
+const MetadataTraceParent = "traceparent"
+
+// traceID returns the trace ID of the W3C traceparent of md, e.g. "4bf92f3577b34da6a3ce929d0e0e4736"
+// of "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", or an empty string if it's missing or invalid.
+func traceID(md metadata.MD) string {
+	v := md.Get(MetadataTraceParent)
+	if len(v) == 0 {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(v[0]), "-")
+	// The future versions may append the fields, the version ff is invalid
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return ""
+	}
+	version, trace, parent, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version) || len(trace) != 32 || !isLowerHex(trace) || len(parent) != 16 || !isLowerHex(parent) ||
+		len(flags) != 2 || !isLowerHex(flags) {
+		return ""
+	}
+	// The all zero IDs are invalid
+	if trace == strings.Repeat("0", 32) || parent == strings.Repeat("0", 16) {
+		return ""
+	}
+	return trace
+}
+
+// isLowerHex reports whether s is lowercase hex encoded.
+func isLowerHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
@@ -0,0 +1,68 @@
+package analytics
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/usage"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// GetUsage returns the usage of the tenant of the domain in the month.
+func (s *analyticsServer) GetUsage(ctx context.Context, r *analytics.GetUsageRequest) (*analytics.Usage, error) {
+	if r.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is missing")
+	}
+	if s.meter == nil {
+		return nil, status.Error(codes.FailedPrecondition, "usage metering is disabled")
+	}
+	month := r.GetMonth()
+	if month == "" {
+		month = usage.Month(time.Now())
+	} else if _, err := time.Parse("2006-01", month); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid month %q, expected like 2024-05", month)
+	}
+
+	tenant := s.sites.Key(r.GetDomain()).Tenant
+	events, quota, err := s.meter.Usage(ctx, tenant, month)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot get usage of %s: %v", tenant, err)
+	}
+	return &analytics.Usage{
+		Tenant: tenant,
+		Month:  month,
+		Events: events,
+		Quota:  quota,
+	}, nil
+}
+
+// usageStatus converts the metering error to the gRPC status, describing the exceeded quota.
+func usageStatus(err error, tenant string) error {
+	if !errors.Is(err, usage.ErrQuotaExceeded) {
+		return status.Errorf(codes.Internal, "cannot meter usage of %s: %v", tenant, err)
+	}
+	st := status.Newf(codes.ResourceExhausted, "monthly quota of %s is exceeded", tenant)
+	if detailed, err := st.WithDetails(&errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     "tenant:" + tenant,
+			Description: usage.ErrQuotaExceeded.Error(),
+		}},
+	}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// IsQuotaExceeded reports whether the error is returned for an event over the quota of its tenant,
+// unlike the transient codes.ResourceExhausted errors, e.g. of the full ingestion queue.
+func IsQuotaExceeded(err error) bool {
+	for _, d := range status.Convert(err).Details() {
+		if _, ok := d.(*errdetails.QuotaFailure); ok {
+			return true
+		}
+	}
+	return false
+}
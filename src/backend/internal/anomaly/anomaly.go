@@ -0,0 +1,75 @@
+// Package anomaly implements the detection of the unusual visitor counts over the hourly rollups.
+package anomaly
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/sites"
+	"math"
+	"time"
+)
+
+const (
+	// Seasons is the amount of the previous days the hour is compared to.
+	Seasons = 14
+	// MinSamples is the minimal amount of the previous days with the data for the hour to be scored.
+	MinSamples = 7
+)
+
+// ZScore returns the z-score of the visitors of the last hour completed at now against the same hours
+// of the previous Seasons days, so the daily traffic cycle isn't reported as anomalous.
+//
+// The previous days are read from the hourly rollups, while the scored hour is aggregated from the events,
+// so it doesn't depend on whether the rollups are recalculated yet. The hours without a rollup count
+// as zero visitors, unless they precede the first rollup of the range, in which case the site didn't have
+// the data yet. The standard deviation is at least 1, so a flat history doesn't turn every single visitor
+// into an anomaly. Zero is returned without MinSamples previous days.
+func ZScore(ctx context.Context, db database.Database, site sites.Key, now time.Time) (float64, error) {
+	hour := now.UTC().Truncate(time.Hour).Add(-time.Hour)
+	from := hour.AddDate(0, 0, -Seasons)
+	rollups, err := db.ListRollups(ctx, site, database.RollupHourly, from, hour)
+	if err != nil {
+		return 0, err
+	}
+	// Only the visitors are scored, they don't depend on the stats settings of the site
+	current, err := prometheus.GetAnalyticsStatsRange(ctx, db, site, sites.StatsSettings{}, hour, hour.Add(time.Hour))
+	if err != nil {
+		return 0, err
+	}
+
+	visitors := make(map[time.Time]int64, len(rollups))
+	first := hour
+	for _, r := range rollups {
+		start := r.Start.UTC()
+		visitors[start] = r.Visitors
+		if start.Before(first) {
+			first = start
+		}
+	}
+
+	samples := make([]float64, 0, Seasons)
+	for day := 1; day <= Seasons; day++ {
+		t := hour.AddDate(0, 0, -day)
+		if t.Before(first) {
+			break
+		}
+		samples = append(samples, float64(visitors[t]))
+	}
+	if len(samples) < MinSamples {
+		return 0, nil
+	}
+
+	var mean float64
+	for _, v := range samples {
+		mean += v
+	}
+	mean /= float64(len(samples))
+	var variance float64
+	for _, v := range samples {
+		variance += (v - mean) * (v - mean)
+	}
+	std := math.Max(math.Sqrt(variance/float64(len(samples))), 1)
+
+	return (float64(current.UniqueVisitors) - mean) / std, nil
+}
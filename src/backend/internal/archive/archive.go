@@ -0,0 +1,195 @@
+// Package archive implements the job moving old events to cold object storage.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Archiver periodically exports the events older than the threshold to the store
+// as gzipped JSONL files partitioned by tenant, domain and day, and deletes them from the database.
+//
+// Only whole UTC days are archived.
+type Archiver struct {
+	db       database.Database
+	store    Store
+	interval time.Duration
+	logger   *zap.Logger
+
+	mutex     sync.Mutex
+	keys      []sites.Key
+	threshold time.Duration
+	retention map[sites.Key]time.Duration
+
+	archivedTotal *prometheus.CounterVec
+}
+
+// NewArchiver returns new Archiver instance.
+func NewArchiver(db database.Database, store Store, keys []sites.Key, threshold time.Duration, interval time.Duration) (*Archiver, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if store == nil {
+		return nil, errors.New("archive store is nil")
+	}
+	if threshold <= 0 || interval <= 0 {
+		return nil, errors.New("threshold and interval must be positive")
+	}
+
+	a := &Archiver{
+		db:        db,
+		store:     store,
+		keys:      keys,
+		threshold: threshold,
+		interval:  interval,
+		logger:    zap.L().Named("archive"),
+		archivedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "archived_events_total",
+			Help: "Total number of events moved to the archive",
+		}, []string{"domain"}),
+	}
+	prometheus.MustRegister(a.archivedTotal)
+
+	return a, nil
+}
+
+// Reconfigure replaces the sites and the thresholds used by the following runs.
+//
+// retention overrides the threshold of the sites, it may be nil.
+func (a *Archiver) Reconfigure(keys []sites.Key, threshold time.Duration, retention map[sites.Key]time.Duration) error {
+	if threshold <= 0 {
+		return errors.New("threshold must be positive")
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.keys = keys
+	a.threshold = threshold
+	a.retention = retention
+	return nil
+}
+
+// Run archives the events every interval until ctx is done.
+func (a *Archiver) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		a.mutex.Lock()
+		keys := a.keys
+		a.mutex.Unlock()
+
+		for _, site := range keys {
+			if err := a.Archive(ctx, site, time.Now()); err != nil {
+				a.logger.Error("cannot archive events", zap.Stringer("site", site), zap.Error(err))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Archive moves the site events of the days which ended before now minus threshold to the store.
+//
+// The events are deleted only after all the days are stored.
+func (a *Archiver) Archive(ctx context.Context, site sites.Key, now time.Time) error {
+	a.mutex.Lock()
+	threshold, ok := a.retention[site]
+	if !ok {
+		threshold = a.threshold
+	}
+	a.mutex.Unlock()
+	cutoff := now.Add(-threshold).UTC().Truncate(24 * time.Hour)
+
+	var day time.Time
+	var count int
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if err := a.store.Put(ctx, objectKey(site, day, now), bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+			return err
+		}
+		buf.Reset()
+		zw.Reset(&buf)
+		count = 0
+		return nil
+	}
+
+	total := 0
+	err := a.db.ForEach(ctx, site, time.Time{}, cutoff, func(e *analytics.Event) error {
+		// The events are ordered by timestamp, so a day is complete once the next one begins
+		eventDay := e.GetTimestamp().AsTime().UTC().Truncate(24 * time.Hour)
+		if !eventDay.Equal(day) {
+			if err := flush(); err != nil {
+				return err
+			}
+			day = eventDay
+		}
+
+		b, err := protojson.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err = zw.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		count++
+		total++
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot store archive: %w", err)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	deleted, err := a.db.DeleteRange(ctx, site, time.Time{}, cutoff)
+	if err != nil {
+		return fmt.Errorf("cannot delete archived events: %w", err)
+	}
+	a.archivedTotal.WithLabelValues(site.Domain).Add(float64(total))
+	after := fmt.Sprintf(`{"tenant":%q,"to":%q,"deleted":%d,"archived":%d}`, site.Tenant, cutoff.Format(time.RFC3339), deleted, total)
+	if err = a.db.AppendAudit(ctx, &database.AuditEntry{
+		Time:   time.Now(),
+		Actor:  "archive",
+		Action: database.AuditDataDelete,
+		Domain: site.Domain,
+		After:  after,
+	}); err != nil {
+		a.logger.Error("Cannot append audit log entry", zap.Stringer("site", site), zap.Error(err))
+	}
+	a.logger.Info("Archived events", zap.Stringer("site", site), zap.Int("archived", total), zap.Int("deleted", deleted))
+
+	return nil
+}
+
+// objectKey returns the key of the site day archive written at now.
+//
+// The archive time is a part of the key, so a day archived in several runs never overwrites itself.
+func objectKey(site sites.Key, day time.Time, now time.Time) string {
+	return fmt.Sprintf("tenant=%s/domain=%s/date=%s/events-%d.jsonl.gz", url.PathEscape(site.Tenant), site.Domain, day.Format(time.DateOnly), now.Unix())
+}
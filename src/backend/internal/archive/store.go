@@ -0,0 +1,102 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store is an object storage the archives are written to.
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+}
+
+// NewStore returns Store of the URL:
+//   - file:///path/to/dir stores the objects in a local directory;
+//   - s3://bucket/prefix stores the objects in an S3 compatible bucket (including GCS in interoperability mode).
+//
+// S3 endpoint and credentials are taken from S3_ENDPOINT (s3.amazonaws.com by default),
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+func NewStore(rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return &fileStore{dir: u.Path}, nil
+	case "s3":
+		endpoint := os.Getenv("S3_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "s3.amazonaws.com"
+		}
+		secure := true
+		if strings.HasPrefix(endpoint, "http://") {
+			secure = false
+		}
+		endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+
+		client, err := minio.New(endpoint, &minio.Options{
+			Creds:  credentials.NewEnvAWS(),
+			Secure: secure,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &s3Store{
+			client: client,
+			bucket: u.Host,
+			prefix: strings.Trim(u.Path, "/"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported archive storage scheme %q", u.Scheme)
+	}
+}
+
+// fileStore stores the objects as files in the directory.
+type fileStore struct {
+	dir string
+}
+
+// Put writes the object to the file, creating its parent directories.
+func (s *fileStore) Put(_ context.Context, key string, r io.Reader, _ int64) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// s3Store stores the objects in the S3 bucket.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// Put uploads the object to the bucket.
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: "application/x-ndjson",
+	})
+	return err
+}
@@ -0,0 +1,162 @@
+package arrow
+
+import (
+	"encoding/binary"
+)
+
+// builder builds a flatbuffer back to front, the same way as the flatbuffers library does,
+// so the offsets to the already built objects always point forward.
+//
+// The offsets returned by its methods are the distances of the objects from the end of the buffer.
+type builder struct {
+	// buf is the built part of the buffer, it grows at the front
+	buf      []byte
+	minAlign int
+
+	// the table being built
+	tableStart int
+	slots      []int
+}
+
+// offset returns the offset of the object built last.
+func (b *builder) offset() int {
+	return len(b.buf)
+}
+
+// prepend adds the bytes to the front of the buffer.
+func (b *builder) prepend(p ...byte) {
+	b.buf = append(p, b.buf...)
+}
+
+// prep pads the buffer, so after the additional bytes are prepended, the value of the size is aligned.
+func (b *builder) prep(size int, additional int) {
+	b.minAlign = max(b.minAlign, size)
+	if pad := (size - (len(b.buf)+additional)%size) % size; pad > 0 {
+		b.prepend(make([]byte, pad)...)
+	}
+}
+
+func (b *builder) prependUint16(v uint16) {
+	b.prep(2, 0)
+	b.prepend(binary.LittleEndian.AppendUint16(nil, v)...)
+}
+
+func (b *builder) prependUint32(v uint32) {
+	b.prep(4, 0)
+	b.prepend(binary.LittleEndian.AppendUint32(nil, v)...)
+}
+
+func (b *builder) prependUint64(v uint64) {
+	b.prep(8, 0)
+	b.prepend(binary.LittleEndian.AppendUint64(nil, v)...)
+}
+
+// prependOffset adds the offset of the object, relative to the position it's stored at.
+func (b *builder) prependOffset(off int) {
+	b.prep(4, 0)
+	b.prependUint32(uint32(len(b.buf) + 4 - off))
+}
+
+// string builds the zero terminated string.
+func (b *builder) string(s string) int {
+	b.prep(4, len(s)+1)
+	b.prepend(append([]byte(s), 0)...)
+	b.prependUint32(uint32(len(s)))
+	return b.offset()
+}
+
+// offsets builds the vector of the offsets of the objects.
+func (b *builder) offsets(offs []int) int {
+	b.prep(4, 4*len(offs))
+	for i := len(offs) - 1; i >= 0; i-- {
+		b.prependOffset(offs[i])
+	}
+	b.prependUint32(uint32(len(offs)))
+	return b.offset()
+}
+
+// structs builds the vector of the structs of the pairs of the int64 fields, e.g. the FieldNode or the Buffer.
+func (b *builder) structs(pairs [][2]int64) int {
+	b.prep(4, 16*len(pairs))
+	b.prep(8, 16*len(pairs))
+	for i := len(pairs) - 1; i >= 0; i-- {
+		b.prependUint64(uint64(pairs[i][1]))
+		b.prependUint64(uint64(pairs[i][0]))
+	}
+	b.prependUint32(uint32(len(pairs)))
+	return b.offset()
+}
+
+// startTable starts the table of the amount of the fields, the objects it references must be built before.
+func (b *builder) startTable(fields int) {
+	b.tableStart = b.offset()
+	b.slots = make([]int, fields)
+}
+
+// slot records the field of the table built last.
+func (b *builder) slot(id int) {
+	b.slots[id] = b.offset()
+}
+
+func (b *builder) addBool(id int, v bool) {
+	var u byte
+	if v {
+		u = 1
+	}
+	b.addUint8(id, u)
+}
+
+func (b *builder) addUint8(id int, v uint8) {
+	b.prepend(v)
+	b.slot(id)
+}
+
+func (b *builder) addInt16(id int, v int16) {
+	b.prependUint16(uint16(v))
+	b.slot(id)
+}
+
+func (b *builder) addInt32(id int, v int32) {
+	b.prependUint32(uint32(v))
+	b.slot(id)
+}
+
+func (b *builder) addInt64(id int, v int64) {
+	b.prependUint64(uint64(v))
+	b.slot(id)
+}
+
+func (b *builder) addOffset(id int, off int) {
+	b.prependOffset(off)
+	b.slot(id)
+}
+
+// endTable builds the table with its vtable in front of it.
+func (b *builder) endTable() int {
+	b.prependUint32(0)
+	table := b.offset()
+
+	// the vtable is the sizes of the vtable and the table and the positions of the fields in the table,
+	// zero for the missing ones
+	for i := len(b.slots) - 1; i >= 0; i-- {
+		var pos uint16
+		if b.slots[i] != 0 {
+			pos = uint16(table - b.slots[i])
+		}
+		b.prependUint16(pos)
+	}
+	b.prependUint16(uint16(table - b.tableStart))
+	b.prependUint16(uint16(2 * (len(b.slots) + 2)))
+
+	// the table starts with the distance back to its vtable
+	binary.LittleEndian.PutUint32(b.buf[len(b.buf)-table:], uint32(int32(b.offset()-table)))
+	b.slots = nil
+	return table
+}
+
+// finish returns the buffer with the root table.
+func (b *builder) finish(root int) []byte {
+	b.prep(max(b.minAlign, 8), 4)
+	b.prependOffset(root)
+	return b.buf
+}
@@ -0,0 +1,208 @@
+package arrow
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+const (
+	// EventsPath is the gateway path the events of a domain are streamed on.
+	EventsPath = "/api/arrow/events"
+	// RollupsPath is the gateway path the hourly or the daily rollups of a domain are streamed on.
+	RollupsPath = "/api/arrow/rollups"
+)
+
+// ContentType is the media type of the Arrow IPC stream.
+const ContentType = "application/vnd.apache.arrow.stream"
+
+// batchRows is the maximal amount of the rows of a record batch.
+const batchRows = 64 * 1024
+
+// eventFields are the columns of the events.
+var eventFields = []Field{
+	{Name: "id", Type: Utf8},
+	{Name: "timestamp", Type: Timestamp},
+	{Name: "type", Type: Utf8},
+	{Name: "url", Type: Utf8},
+	{Name: "domain", Type: Utf8},
+	{Name: "referrer", Type: Utf8, Nullable: true},
+	{Name: "source", Type: Utf8, Nullable: true},
+	{Name: "browser", Type: Utf8},
+	{Name: "os", Type: Utf8},
+	{Name: "device", Type: Utf8},
+	{Name: "hashed_visit", Type: Utf8, Nullable: true},
+}
+
+// rollupFields are the columns of the rollups.
+var rollupFields = []Field{
+	{Name: "start", Type: Timestamp},
+	{Name: "period", Type: Utf8},
+	{Name: "visitors", Type: Int64},
+	{Name: "visits", Type: Int64},
+	{Name: "pageviews", Type: Int64},
+}
+
+// Handler streams the events and the rollups of the sites as the Arrow record batches.
+type Handler struct {
+	db     database.Database
+	sites  *sites.Registry
+	logger *zap.Logger
+}
+
+// NewHandler returns new Handler instance, access to the sites is checked against sitesRegistry.
+func NewHandler(db database.Database, sitesRegistry *sites.Registry) (*Handler, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if sitesRegistry == nil {
+		return nil, errors.New("sites.Registry instance is nil")
+	}
+	return &Handler{db: db, sites: sitesRegistry, logger: zap.L().Named("arrow")}, nil
+}
+
+// Events streams the events of the "domain" query parameter within the optional "from" and "to" RFC 3339 timestamps
+// in the timestamp order, the whole history by default.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	domain, from, to, ok := h.request(w, r, sites.PermissionEvents)
+	if !ok {
+		return
+	}
+
+	s := NewStreamWriter(w, eventFields...)
+	b := s.NewBatch()
+	w.Header().Set("Content-Type", ContentType)
+	err := h.db.ForEach(r.Context(), h.sites.Key(domain), from, to, func(e *analytics.Event) error {
+		if err := b.Append(eventRow(e)...); err != nil {
+			return err
+		}
+		if b.Len() < batchRows {
+			return nil
+		}
+		defer b.Reset()
+		return s.WriteBatch(b)
+	})
+	h.end(r.Context(), s, b, domain, err)
+}
+
+// Rollups streams the rollups of the "domain" query parameter of the "period" one, hour or day by default,
+// starting within the optional "from" and "to" RFC 3339 timestamps in the start order, until now by default.
+func (h *Handler) Rollups(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	domain, from, to, ok := h.request(w, r, sites.PermissionStats)
+	if !ok {
+		return
+	}
+	period := database.RollupPeriod(r.URL.Query().Get("period"))
+	switch period {
+	case "":
+		period = database.RollupDaily
+	case database.RollupHourly, database.RollupDaily:
+	default:
+		http.Error(w, fmt.Sprintf("unknown period %q", period), http.StatusBadRequest)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	rollups, err := h.db.ListRollups(r.Context(), h.sites.Key(domain), period, from, to)
+	if err != nil {
+		http.Error(w, "cannot list rollups", http.StatusInternalServerError)
+		return
+	}
+
+	s := NewStreamWriter(w, rollupFields...)
+	b := s.NewBatch()
+	w.Header().Set("Content-Type", ContentType)
+	for _, ru := range rollups {
+		if err = b.Append(ru.Start, string(ru.Period), ru.Visitors, ru.Visits, ru.Pageviews); err != nil {
+			break
+		}
+		if b.Len() == batchRows {
+			if err = s.WriteBatch(b); err != nil {
+				break
+			}
+			b.Reset()
+		}
+	}
+	h.end(r.Context(), s, b, domain, err)
+}
+
+// request returns the domain and the time range of the request, or responds with the error
+// if they're invalid or the caller has no permission.
+func (h *Handler) request(w http.ResponseWriter, r *http.Request, permission sites.Permission) (string, time.Time, time.Time, bool) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		http.Error(w, "domain is missing", http.StatusBadRequest)
+		return "", time.Time{}, time.Time{}, false
+	}
+	err := h.sites.Authorize(sites.BearerKey(r.Header.Get("Authorization")), domain, permission)
+	switch {
+	case errors.Is(err, sites.ErrUnauthenticated):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return "", time.Time{}, time.Time{}, false
+	case err != nil:
+		http.Error(w, "access to "+domain+" is denied", http.StatusForbidden)
+		return "", time.Time{}, time.Time{}, false
+	}
+
+	var times [2]time.Time
+	for i, name := range []string{"from", "to"} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		if times[i], err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, fmt.Sprintf("%s must be an RFC 3339 timestamp", name), http.StatusBadRequest)
+			return "", time.Time{}, time.Time{}, false
+		}
+	}
+	return domain, times[0], times[1], true
+}
+
+// end writes the last batch and ends the stream. The status is already sent once the batches are written,
+// so the failed streams are cut without the end of the stream, and the readers fail on them.
+func (h *Handler) end(ctx context.Context, s *StreamWriter, b *Batch, domain string, err error) {
+	if err == nil && b.Len() > 0 {
+		err = s.WriteBatch(b)
+	}
+	if err == nil {
+		err = s.Close()
+	}
+	if err != nil && ctx.Err() == nil {
+		h.logger.Error("cannot stream", zap.String("domain", domain), zap.Error(err))
+	}
+}
+
+// eventRow returns the values of the columns of the event.
+func eventRow(e *analytics.Event) []any {
+	row := []any{
+		e.GetID(),
+		e.GetTimestamp().AsTime(),
+		e.GetType(),
+		e.GetURL(),
+		e.GetDomain(),
+		nil,
+		nil,
+		prometheus.EventBrowser(e),
+		prometheus.EventOS(e),
+		prometheus.EventDevice(e),
+		nil,
+	}
+	if e.GetReferrer() != "" {
+		row[5] = e.GetReferrer()
+	}
+	if source, err := prometheus.EventSource(e); err == nil && source != "" {
+		row[6] = source
+	}
+	if e.GetHashedVisit() != "" {
+		row[10] = e.GetHashedVisit()
+	}
+	return row
+}
@@ -0,0 +1,276 @@
+// Package arrow implements the Apache Arrow IPC stream endpoints of the events and the rollups,
+// so the large slices of the data are read into pandas or Polars as the columnar batches,
+// e.g. pyarrow.ipc.open_stream(requests.get(url, stream=True).raw).read_pandas().
+//
+// The streams are written without the Arrow library, only the types the endpoints use are supported.
+package arrow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Type is a type of the column.
+type Type int
+
+const (
+	// Utf8 is the column of the strings.
+	Utf8 Type = iota
+	// Int64 is the column of the signed 64-bit integers.
+	Int64
+	// Timestamp is the column of the UTC timestamps in milliseconds.
+	Timestamp
+)
+
+// Field is a column of the schema.
+type Field struct {
+	Name     string
+	Type     Type
+	Nullable bool
+}
+
+// The flatbuffers enums and the union types of the Arrow format.
+const (
+	metadataV5       = 4
+	headerSchema     = 1
+	headerRecord     = 3
+	typeInt          = 2
+	typeUtf8         = 5
+	typeTimestamp    = 10
+	unitMilliseconds = 1
+)
+
+// continuation starts the encapsulated messages of the stream.
+const continuation = 0xFFFFFFFF
+
+// StreamWriter writes the record batches of the schema as the Arrow IPC stream.
+type StreamWriter struct {
+	w      io.Writer
+	fields []Field
+	// started is set after the schema is written
+	started bool
+}
+
+// NewStreamWriter returns new StreamWriter instance writing the batches of the fields to w.
+func NewStreamWriter(w io.Writer, fields ...Field) *StreamWriter {
+	return &StreamWriter{w: w, fields: fields}
+}
+
+// NewBatch returns an empty batch of the schema of the stream.
+func (s *StreamWriter) NewBatch() *Batch {
+	b := &Batch{fields: s.fields, columns: make([]*column, len(s.fields))}
+	b.Reset()
+	return b
+}
+
+// WriteBatch writes the batch, preceded by the schema if it's the first one.
+func (s *StreamWriter) WriteBatch(b *Batch) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+
+	// the buffers of a column are its validity bitmap, the offsets of the strings and the values
+	var (
+		body    []byte
+		nodes   [][2]int64
+		buffers [][2]int64
+	)
+	addBuffer := func(p []byte) {
+		buffers = append(buffers, [2]int64{int64(len(body)), int64(len(p))})
+		body = append(body, p...)
+		body = append(body, make([]byte, padding(len(p)))...)
+	}
+	for i, c := range b.columns {
+		nodes = append(nodes, [2]int64{int64(b.rows), int64(c.nulls)})
+		if c.nulls > 0 {
+			addBuffer(c.validity)
+		} else {
+			addBuffer(nil)
+		}
+		if s.fields[i].Type == Utf8 {
+			addBuffer(c.offsets)
+		}
+		addBuffer(c.data)
+	}
+
+	fb := &builder{}
+	buffersOff := fb.structs(buffers)
+	nodesOff := fb.structs(nodes)
+	fb.startTable(5)
+	fb.addInt64(0, int64(b.rows))
+	fb.addOffset(1, nodesOff)
+	fb.addOffset(2, buffersOff)
+	return s.writeMessage(fb, headerRecord, fb.endTable(), body)
+}
+
+// Close ends the stream, the schema is written if there were no batches.
+func (s *StreamWriter) Close() error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	_, err := s.w.Write(binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, continuation), 0))
+	return err
+}
+
+// start writes the schema message once.
+func (s *StreamWriter) start() error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+
+	fb := &builder{}
+	fields := make([]int, 0, len(s.fields))
+	for _, f := range s.fields {
+		name := fb.string(f.Name)
+		children := fb.offsets(nil)
+		var typeType uint8
+		switch f.Type {
+		case Utf8:
+			typeType = typeUtf8
+			fb.startTable(0)
+		case Int64:
+			typeType = typeInt
+			fb.startTable(2)
+			fb.addInt32(0, 64)
+			fb.addBool(1, true)
+		case Timestamp:
+			typeType = typeTimestamp
+			tz := fb.string("UTC")
+			fb.startTable(2)
+			fb.addInt16(0, unitMilliseconds)
+			fb.addOffset(1, tz)
+		default:
+			return fmt.Errorf("unsupported type of field %q", f.Name)
+		}
+		typ := fb.endTable()
+
+		fb.startTable(7)
+		fb.addOffset(0, name)
+		fb.addBool(1, f.Nullable)
+		fb.addUint8(2, typeType)
+		fb.addOffset(3, typ)
+		fb.addOffset(5, children)
+		fields = append(fields, fb.endTable())
+	}
+	fieldsOff := fb.offsets(fields)
+	fb.startTable(4)
+	fb.addInt16(0, 0) // little endian
+	fb.addOffset(1, fieldsOff)
+	return s.writeMessage(fb, headerSchema, fb.endTable(), nil)
+}
+
+// writeMessage writes the encapsulated message of the header and its body:
+// the continuation, the padded size of the metadata, the metadata and the body.
+func (s *StreamWriter) writeMessage(fb *builder, headerType uint8, header int, body []byte) error {
+	fb.startTable(5)
+	fb.addInt64(3, int64(len(body)))
+	fb.addOffset(2, header)
+	fb.addInt16(0, metadataV5)
+	fb.addUint8(1, headerType)
+	metadata := fb.finish(fb.endTable())
+
+	// the metadata is padded, so the body starts at the 8 byte boundary
+	size := len(metadata) + padding(8+len(metadata))
+	msg := make([]byte, 0, 8+size+len(body))
+	msg = binary.LittleEndian.AppendUint32(msg, continuation)
+	msg = binary.LittleEndian.AppendUint32(msg, uint32(size))
+	msg = append(msg, metadata...)
+	msg = append(msg, make([]byte, size-len(metadata))...)
+	msg = append(msg, body...)
+	_, err := s.w.Write(msg)
+	return err
+}
+
+// padding returns the amount of the bytes aligning n to 8 bytes.
+func padding(n int) int {
+	return (8 - n%8) % 8
+}
+
+// column is the buffers of a column of the batch.
+type column struct {
+	validity []byte
+	nulls    int
+	// offsets are the int32 offsets of the strings in the data, starting with 0
+	offsets []byte
+	data    []byte
+}
+
+// Batch is the record batch of the rows being appended.
+type Batch struct {
+	fields  []Field
+	columns []*column
+	rows    int
+}
+
+// Len returns the amount of the rows of the batch.
+func (b *Batch) Len() int {
+	return b.rows
+}
+
+// Reset removes the rows of the batch, so it's reused for the next one.
+func (b *Batch) Reset() {
+	b.rows = 0
+	for i := range b.columns {
+		b.columns[i] = &column{}
+		if b.fields[i].Type == Utf8 {
+			b.columns[i].offsets = binary.LittleEndian.AppendUint32(nil, 0)
+		}
+	}
+}
+
+// Append adds the row of the values of the fields: a string of Utf8, an int64 of Int64, a time.Time of Timestamp
+// or nil of the nullable fields.
+func (b *Batch) Append(values ...any) error {
+	if len(values) != len(b.fields) {
+		return fmt.Errorf("row has %d values instead of %d", len(values), len(b.fields))
+	}
+	for i, v := range values {
+		if v == nil && !b.fields[i].Nullable {
+			return fmt.Errorf("field %q is not nullable", b.fields[i].Name)
+		}
+		ok := v == nil
+		switch b.fields[i].Type {
+		case Utf8:
+			_, ok = v.(string)
+		case Int64:
+			_, ok = v.(int64)
+		case Timestamp:
+			_, ok = v.(time.Time)
+		}
+		if !ok && v != nil {
+			return fmt.Errorf("value of field %q is %T", b.fields[i].Name, v)
+		}
+	}
+
+	for i, v := range values {
+		c := b.columns[i]
+		if b.rows%8 == 0 {
+			c.validity = append(c.validity, 0)
+		}
+		if v != nil {
+			c.validity[b.rows/8] |= 1 << (b.rows % 8)
+		} else {
+			c.nulls++
+		}
+		switch v := v.(type) {
+		case string:
+			c.data = append(c.data, v...)
+		case int64:
+			c.data = binary.LittleEndian.AppendUint64(c.data, uint64(v))
+		case time.Time:
+			c.data = binary.LittleEndian.AppendUint64(c.data, uint64(v.UnixMilli()))
+		case nil:
+			if b.fields[i].Type != Utf8 {
+				c.data = append(c.data, make([]byte, 8)...)
+			}
+		}
+		if b.fields[i].Type == Utf8 {
+			c.offsets = binary.LittleEndian.AppendUint32(c.offsets, uint32(len(c.data)))
+		}
+	}
+	b.rows++
+	return nil
+}
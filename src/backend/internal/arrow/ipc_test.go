@@ -0,0 +1,445 @@
+package arrow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden streams in testdata")
+
+// The reader below follows the Arrow columnar format and the flatbuffers binary format independently of the writer,
+// so the layout the writer shares with its builder is checked, e.g. the vtables, the alignment and the union types.
+
+// table is a flatbuffers table at pos of buf.
+type table struct {
+	buf []byte
+	pos int
+}
+
+// fbReader reads the flatbuffers of the messages, failing the test on the malformed ones.
+type fbReader struct {
+	t   *testing.T
+	buf []byte
+}
+
+func (r *fbReader) uint16(pos int) uint16 {
+	r.check(pos, 2)
+	return binary.LittleEndian.Uint16(r.buf[pos:])
+}
+
+func (r *fbReader) uint32(pos int) uint32 {
+	r.check(pos, 4)
+	return binary.LittleEndian.Uint32(r.buf[pos:])
+}
+
+func (r *fbReader) uint64(pos int) uint64 {
+	r.check(pos, 8)
+	return binary.LittleEndian.Uint64(r.buf[pos:])
+}
+
+// check fails the test unless the value of the size is within the buffer and aligned to its size.
+func (r *fbReader) check(pos int, size int) {
+	r.t.Helper()
+	r.bounds(pos, size)
+	if pos%size != 0 {
+		r.t.Fatalf("value at %d of %d bytes isn't aligned", pos, size)
+	}
+}
+
+// bounds fails the test unless the bytes are within the buffer.
+func (r *fbReader) bounds(pos int, size int) {
+	r.t.Helper()
+	if pos < 0 || pos+size > len(r.buf) {
+		r.t.Fatalf("bytes at %d of %d bytes are out of the buffer of %d bytes", pos, size, len(r.buf))
+	}
+}
+
+// root returns the root table.
+func (r *fbReader) root() table {
+	return r.indirect(0)
+}
+
+// indirect returns the table the offset at pos points to.
+func (r *fbReader) indirect(pos int) table {
+	return table{buf: r.buf, pos: pos + int(r.uint32(pos))}
+}
+
+// field returns the position of the field of the table, 0 if it's missing.
+func (r *fbReader) field(t table, id int) int {
+	vtable := t.pos - int(int32(r.uint32(t.pos)))
+	vtableSize := int(r.uint16(vtable))
+	if vtableSize < 4 || vtableSize%2 != 0 {
+		r.t.Fatalf("vtable at %d has invalid size %d", vtable, vtableSize)
+	}
+	if 4+2*id >= vtableSize {
+		return 0
+	}
+	if off := int(r.uint16(vtable + 4 + 2*id)); off != 0 {
+		if tableSize := int(r.uint16(vtable + 2)); off >= tableSize {
+			r.t.Fatalf("field %d of table at %d is beyond its size %d", id, t.pos, tableSize)
+		}
+		return t.pos + off
+	}
+	return 0
+}
+
+func (r *fbReader) int16(t table, id int) int16 {
+	if pos := r.field(t, id); pos != 0 {
+		return int16(r.uint16(pos))
+	}
+	return 0
+}
+
+func (r *fbReader) int32(t table, id int) int32 {
+	if pos := r.field(t, id); pos != 0 {
+		return int32(r.uint32(pos))
+	}
+	return 0
+}
+
+func (r *fbReader) int64(t table, id int) int64 {
+	if pos := r.field(t, id); pos != 0 {
+		return int64(r.uint64(pos))
+	}
+	return 0
+}
+
+func (r *fbReader) uint8(t table, id int) uint8 {
+	if pos := r.field(t, id); pos != 0 {
+		return r.buf[pos]
+	}
+	return 0
+}
+
+func (r *fbReader) table(t table, id int) (table, bool) {
+	pos := r.field(t, id)
+	if pos == 0 {
+		return table{}, false
+	}
+	return r.indirect(pos), true
+}
+
+func (r *fbReader) string(t table, id int) string {
+	pos := r.field(t, id)
+	if pos == 0 {
+		return ""
+	}
+	s := pos + int(r.uint32(pos))
+	n := int(r.uint32(s))
+	r.bounds(s+4, n+1)
+	if r.buf[s+4+n] != 0 {
+		r.t.Fatalf("string at %d isn't zero terminated", s)
+	}
+	return string(r.buf[s+4 : s+4+n])
+}
+
+// vector returns the position of the first element of the vector and its length.
+func (r *fbReader) vector(t table, id int) (int, int) {
+	pos := r.field(t, id)
+	if pos == 0 {
+		return 0, 0
+	}
+	v := pos + int(r.uint32(pos))
+	return v + 4, int(r.uint32(v))
+}
+
+// pairs returns the vector of the structs of the pairs of the int64 fields.
+func (r *fbReader) pairs(t table, id int) [][2]int64 {
+	start, n := r.vector(t, id)
+	pairs := make([][2]int64, n)
+	for i := range pairs {
+		pairs[i] = [2]int64{int64(r.uint64(start + 16*i)), int64(r.uint64(start + 16*i + 8))}
+	}
+	return pairs
+}
+
+// readStream returns the schema and the rows of the batches of the stream.
+func readStream(t *testing.T, stream []byte) ([]Field, [][][]any) {
+	t.Helper()
+	var fields []Field
+	var batches [][][]any
+	for pos := 0; ; {
+		if pos+8 > len(stream) {
+			t.Fatalf("stream is cut at %d without the end", pos)
+		}
+		if binary.LittleEndian.Uint32(stream[pos:]) != continuation {
+			t.Fatalf("message at %d has no continuation", pos)
+		}
+		size := int(binary.LittleEndian.Uint32(stream[pos+4:]))
+		pos += 8
+		if size == 0 {
+			if pos != len(stream) {
+				t.Fatalf("stream has %d bytes after the end", len(stream)-pos)
+			}
+			return fields, batches
+		}
+		if (pos+size)%8 != 0 {
+			t.Fatalf("body of message at %d isn't aligned", pos)
+		}
+		r := &fbReader{t: t, buf: stream[pos : pos+size]}
+		message := r.root()
+		pos += size
+		if version := r.int16(message, 0); version != metadataV5 {
+			t.Fatalf("message version = %d, want %d", version, metadataV5)
+		}
+		bodyLength := int(r.int64(message, 3))
+		if pos+bodyLength > len(stream) || bodyLength%8 != 0 {
+			t.Fatalf("body of %d bytes is cut or isn't padded", bodyLength)
+		}
+		body := stream[pos : pos+bodyLength]
+		pos += bodyLength
+		header, ok := r.table(message, 2)
+		if !ok {
+			t.Fatal("message has no header")
+		}
+
+		switch typ := r.uint8(message, 1); {
+		case typ == headerSchema && fields == nil:
+			fields = readSchema(t, r, header)
+		case typ == headerRecord && fields != nil:
+			batches = append(batches, readBatch(t, r, header, body, fields))
+		default:
+			t.Fatalf("unexpected message of type %d", typ)
+		}
+	}
+}
+
+// readSchema returns the fields of the schema.
+func readSchema(t *testing.T, r *fbReader, schema table) []Field {
+	t.Helper()
+	if endianness := r.int16(schema, 0); endianness != 0 {
+		t.Fatalf("schema endianness = %d, want little", endianness)
+	}
+	fields := make([]Field, 0)
+	start, n := r.vector(schema, 1)
+	for i := 0; i < n; i++ {
+		f := r.indirect(start + 4*i)
+		field := Field{Name: r.string(f, 0), Nullable: r.uint8(f, 1) == 1}
+		if _, children := r.vector(f, 5); children != 0 {
+			t.Fatalf("field %q has %d children", field.Name, children)
+		}
+		typ, ok := r.table(f, 3)
+		if !ok {
+			t.Fatalf("field %q has no type", field.Name)
+		}
+		switch r.uint8(f, 2) {
+		case typeUtf8:
+			field.Type = Utf8
+		case typeInt:
+			if bits, signed := r.int32(typ, 0), r.uint8(typ, 1); bits != 64 || signed != 1 {
+				t.Fatalf("field %q is the int of %d bits, signed %d", field.Name, bits, signed)
+			}
+			field.Type = Int64
+		case typeTimestamp:
+			if unit, tz := r.int16(typ, 0), r.string(typ, 1); unit != unitMilliseconds || tz != "UTC" {
+				t.Fatalf("field %q is the timestamp of unit %d in %q", field.Name, unit, tz)
+			}
+			field.Type = Timestamp
+		default:
+			t.Fatalf("field %q has unexpected type %d", field.Name, r.uint8(f, 2))
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// readBatch returns the rows of the record batch of the fields.
+func readBatch(t *testing.T, r *fbReader, batch table, body []byte, fields []Field) [][]any {
+	t.Helper()
+	length := int(r.int64(batch, 0))
+	nodes := r.pairs(batch, 1)
+	buffers := r.pairs(batch, 2)
+	if len(nodes) != len(fields) {
+		t.Fatalf("batch has %d nodes of %d fields", len(nodes), len(fields))
+	}
+	next := func() []byte {
+		if len(buffers) == 0 {
+			t.Fatal("batch has too few buffers")
+		}
+		b := buffers[0]
+		buffers = buffers[1:]
+		if b[0]%8 != 0 || b[0]+b[1] > int64(len(body)) {
+			t.Fatalf("buffer %v isn't aligned or is out of the body of %d bytes", b, len(body))
+		}
+		return body[b[0] : b[0]+b[1]]
+	}
+
+	rows := make([][]any, length)
+	for i := range rows {
+		rows[i] = make([]any, len(fields))
+	}
+	for i, f := range fields {
+		if nodes[i][0] != int64(length) {
+			t.Fatalf("column %q has %d rows of %d", f.Name, nodes[i][0], length)
+		}
+		validity := next()
+		var offsets []byte
+		if f.Type == Utf8 {
+			offsets = next()
+		}
+		data := next()
+		nulls := 0
+		for row := 0; row < length; row++ {
+			if len(validity) > 0 && validity[row/8]&(1<<(row%8)) == 0 {
+				nulls++
+				continue
+			}
+			switch f.Type {
+			case Utf8:
+				start, end := binary.LittleEndian.Uint32(offsets[4*row:]), binary.LittleEndian.Uint32(offsets[4*row+4:])
+				rows[row][i] = string(data[start:end])
+			case Int64:
+				rows[row][i] = int64(binary.LittleEndian.Uint64(data[8*row:]))
+			case Timestamp:
+				rows[row][i] = time.UnixMilli(int64(binary.LittleEndian.Uint64(data[8*row:]))).UTC()
+			}
+		}
+		if int64(nulls) != nodes[i][1] {
+			t.Fatalf("column %q has %d nulls, the node has %d", f.Name, nulls, nodes[i][1])
+		}
+		if f.Type == Utf8 && len(offsets) != 4*(length+1) {
+			t.Fatalf("column %q has %d bytes of offsets", f.Name, len(offsets))
+		}
+	}
+	if len(buffers) != 0 {
+		t.Fatalf("batch has %d extra buffers", len(buffers))
+	}
+	return rows
+}
+
+// testFields are the columns of all the supported types.
+var testFields = []Field{
+	{Name: "id", Type: Utf8},
+	{Name: "timestamp", Type: Timestamp},
+	{Name: "count", Type: Int64},
+	{Name: "referrer", Type: Utf8, Nullable: true},
+	{Name: "visitors", Type: Int64, Nullable: true},
+	{Name: "seen", Type: Timestamp, Nullable: true},
+}
+
+// testRows returns the rows of the test fields, every third one of which has the nulls.
+func testRows(amount int) [][]any {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rows := make([][]any, amount)
+	for i := range rows {
+		rows[i] = []any{fmt.Sprintf("event-%d", i), start.Add(time.Duration(i) * time.Second), int64(i - 5), nil, nil, nil}
+		if i%3 != 0 {
+			rows[i][3] = fmt.Sprintf("https://example.com/%s", string(rune('a'+i%26)))
+			rows[i][4] = int64(1) << (i % 63)
+			rows[i][5] = start.Add(-time.Duration(i) * time.Millisecond)
+		}
+	}
+	return rows
+}
+
+// writeStream returns the stream of the batches of the rows.
+func writeStream(t *testing.T, fields []Field, batches ...[][]any) []byte {
+	t.Helper()
+	out := &bytes.Buffer{}
+	s := NewStreamWriter(out, fields...)
+	b := s.NewBatch()
+	for _, rows := range batches {
+		for _, row := range rows {
+			if err := b.Append(row...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.WriteBatch(b); err != nil {
+			t.Fatal(err)
+		}
+		b.Reset()
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	rows := testRows(100)
+	tests := []struct {
+		name    string
+		fields  []Field
+		batches [][][]any
+	}{
+		{name: "schema only", fields: testFields},
+		{name: "single row", fields: testFields, batches: [][][]any{rows[1:2]}},
+		{name: "nulls", fields: testFields, batches: [][][]any{rows[:9]}},
+		{name: "batches", fields: testFields, batches: [][][]any{rows[:37], rows[37:38], rows[38:]}},
+		{name: "empty strings", fields: testFields[:1], batches: [][][]any{{{""}, {"a"}, {""}}}},
+		{name: "empty batch", fields: testFields, batches: [][][]any{{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, batches := readStream(t, writeStream(t, tt.fields, tt.batches...))
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("schema = %+v, want %+v", fields, tt.fields)
+			}
+			if len(batches) != len(tt.batches) {
+				t.Fatalf("stream has %d batches, want %d", len(batches), len(tt.batches))
+			}
+			for i := range batches {
+				if len(batches[i]) != len(tt.batches[i]) {
+					t.Fatalf("batch %d has %d rows, want %d", i, len(batches[i]), len(tt.batches[i]))
+				}
+				for row := range batches[i] {
+					if !reflect.DeepEqual(batches[i][row], tt.batches[i][row]) {
+						t.Errorf("row %d of batch %d = %v, want %v", row, i, batches[i][row], tt.batches[i][row])
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestStreamGolden checks the stream layout doesn't change unnoticed. Once it's changed deliberately,
+// the new stream is checked with the reference reader, e.g. pyarrow.ipc.open_stream(open(path, "rb")).read_all(),
+// and written with -update.
+func TestStreamGolden(t *testing.T) {
+	rows := testRows(10)
+	got := writeStream(t, testFields, rows[:7], rows[7:])
+	path := filepath.Join("testdata", "rows.arrows")
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("stream of %d bytes differs from the golden one of %d bytes", len(got), len(want))
+	}
+}
+
+func TestBatchAppend(t *testing.T) {
+	b := NewStreamWriter(&bytes.Buffer{}, testFields...).NewBatch()
+	now := time.Now()
+	tests := []struct {
+		name   string
+		values []any
+	}{
+		{name: "too few values", values: []any{"id", now, int64(1)}},
+		{name: "null of required field", values: []any{nil, now, int64(1), nil, nil, nil}},
+		{name: "wrong type", values: []any{"id", now, 1, nil, nil, nil}},
+		{name: "string of timestamp", values: []any{"id", "2024-05-01", int64(1), nil, nil, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := b.Append(tt.values...); err == nil {
+				t.Error("Append() error = nil")
+			}
+			if b.Len() != 0 {
+				t.Errorf("Len() after the rejected row = %d, want 0", b.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package database
+
+import "time"
+
+// Annotation is a marker of a change of the site, e.g. a deployment or a campaign.
+type Annotation struct {
+	ID          string
+	Tenant      string
+	Domain      string
+	Timestamp   time.Time
+	Kind        string
+	Description string
+}
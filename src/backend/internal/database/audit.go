@@ -0,0 +1,32 @@
+package database
+
+import "time"
+
+// Actions of the audit entries.
+const (
+	AuditSiteCreate  = "site.create"
+	AuditSiteUpdate  = "site.update"
+	AuditSiteDelete  = "site.delete"
+	AuditKeyRotate   = "key.rotate"
+	AuditDataDelete  = "data.delete"
+	AuditTokenCreate = "token.create"
+	AuditTokenRevoke = "token.revoke"
+	AuditUserCreate  = "user.create"
+	AuditUserDelete  = "user.delete"
+	AuditTeamCreate  = "team.create"
+	AuditTeamUpdate  = "team.update"
+	AuditTeamDelete  = "team.delete"
+)
+
+// AuditEntry is a record of an administrative action, the audit log is append-only.
+type AuditEntry struct {
+	// Seq is the position of the entry in the log, it's assigned on append
+	Seq    uint64
+	Time   time.Time
+	Actor  string
+	Action string
+	Domain string
+	// Before and After are the JSON encoded states of the changed object, empty if there are none
+	Before string
+	After  string
+}
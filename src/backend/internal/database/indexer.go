@@ -0,0 +1,52 @@
+package database
+
+import (
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// timestampIndex is memdb.Indexer of the analytics.Event timestamp.
+//
+// Timestamps are encoded as big-endian unix nanoseconds with the sign bit flipped,
+// so the byte order of the index matches the chronological order.
+type timestampIndex struct{}
+
+// FromObject implements memdb.SingleIndexer.
+func (timestampIndex) FromObject(raw interface{}) (bool, []byte, error) {
+	e, ok := raw.(*analytics.Event)
+	if !ok {
+		return false, nil, fmt.Errorf("unsupported value type %T", raw)
+	}
+	if e.GetTimestamp() == nil {
+		return false, nil, nil
+	}
+	return true, encodeTimestamp(e.GetTimestamp().AsTime()), nil
+}
+
+// FromArgs implements memdb.Indexer.
+func (timestampIndex) FromArgs(args ...interface{}) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("must provide only a single argument")
+	}
+	t, ok := args[0].(time.Time)
+	if !ok {
+		return nil, fmt.Errorf("argument must be a time.Time: %#v", args[0])
+	}
+	return encodeTimestamp(t), nil
+}
+
+// encodeTimestamp returns the order preserving encoding of t.
+func encodeTimestamp(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano())^(1<<63))
+	return b
+}
+
+// minTime and maxTime are the bounds of time representable by encodeTimestamp.
+var (
+	minTime = time.Unix(0, math.MinInt64)
+	maxTime = time.Unix(0, math.MaxInt64)
+)
@@ -2,13 +2,26 @@ package database
 
 import (
 	"context"
+	"diploma/analytics-exporter/internal/sites"
 	"diploma/analytics-exporter/pkg/api/analytics"
 	"fmt"
 	"github.com/hashicorp/go-memdb"
 	"go.uber.org/zap"
+	"slices"
+	"time"
 )
 
-const tableEvents = "events"
+const (
+	tableEvents      = "events"
+	tableRollups     = "rollups"
+	tableSites       = "sites"
+	tableUsage       = "usage"
+	tableAudit       = "audit"
+	tableAnnotations = "annotations"
+	tableTokens      = "tokens"
+	tableUsers       = "users"
+	tableTeams       = "teams"
+)
 
 // schemaAnalytics defines in-memory database schema.
 var schemaAnalytics = &memdb.DBSchema{
@@ -20,12 +33,166 @@ var schemaAnalytics = &memdb.DBSchema{
 					Name:         "id",
 					AllowMissing: false,
 					Unique:       true,
-					Indexer:      &memdb.StringFieldIndex{Field: "ID"},
+					Indexer: &memdb.CompoundIndex{
+						Indexes: []memdb.Indexer{
+							&memdb.StringFieldIndex{Field: "Tenant"},
+							&memdb.StringFieldIndex{Field: "ID"},
+						},
+					},
+				},
+				"site": {
+					Name:         "site",
+					AllowMissing: false,
+					Unique:       false,
+					Indexer: &memdb.CompoundIndex{
+						Indexes: []memdb.Indexer{
+							&memdb.StringFieldIndex{Field: "Tenant"},
+							&memdb.StringFieldIndex{Field: "Domain"},
+						},
+					},
+				},
+				"site_timestamp": {
+					Name:         "site_timestamp",
+					AllowMissing: true,
+					Unique:       false,
+					Indexer: &memdb.CompoundIndex{
+						Indexes: []memdb.Indexer{
+							&memdb.StringFieldIndex{Field: "Tenant"},
+							&memdb.StringFieldIndex{Field: "Domain"},
+							timestampIndex{},
+						},
+					},
+				},
+			},
+		},
+		tableRollups: {
+			Name: tableRollups,
+			Indexes: map[string]*memdb.IndexSchema{
+				"id": {
+					Name:         "id",
+					AllowMissing: false,
+					Unique:       true,
+					Indexer: &memdb.CompoundIndex{
+						Indexes: []memdb.Indexer{
+							&memdb.StringFieldIndex{Field: "Tenant"},
+							&memdb.StringFieldIndex{Field: "ID"},
+						},
+					},
+				},
+				"site_period": {
+					Name:         "site_period",
+					AllowMissing: false,
+					Unique:       false,
+					Indexer: &memdb.CompoundIndex{
+						Indexes: []memdb.Indexer{
+							&memdb.StringFieldIndex{Field: "Tenant"},
+							&memdb.StringFieldIndex{Field: "Domain"},
+							&memdb.StringFieldIndex{Field: "Period"},
+						},
+					},
+				},
+			},
+		},
+		tableUsage: {
+			Name: tableUsage,
+			Indexes: map[string]*memdb.IndexSchema{
+				"id": {
+					Name:         "id",
+					AllowMissing: false,
+					Unique:       true,
+					Indexer: &memdb.CompoundIndex{
+						Indexes: []memdb.Indexer{
+							&memdb.StringFieldIndex{Field: "Tenant"},
+							&memdb.StringFieldIndex{Field: "Month"},
+						},
+					},
+				},
+			},
+		},
+		tableAnnotations: {
+			Name: tableAnnotations,
+			Indexes: map[string]*memdb.IndexSchema{
+				"id": {
+					Name:         "id",
+					AllowMissing: false,
+					Unique:       true,
+					Indexer: &memdb.CompoundIndex{
+						Indexes: []memdb.Indexer{
+							&memdb.StringFieldIndex{Field: "Tenant"},
+							&memdb.StringFieldIndex{Field: "ID"},
+						},
+					},
 				},
-				"domain": {
-					Name:         "domain",
+				"site": {
+					Name:         "site",
 					AllowMissing: false,
 					Unique:       false,
+					Indexer: &memdb.CompoundIndex{
+						Indexes: []memdb.Indexer{
+							&memdb.StringFieldIndex{Field: "Tenant"},
+							&memdb.StringFieldIndex{Field: "Domain"},
+						},
+					},
+				},
+			},
+		},
+		tableTokens: {
+			Name: tableTokens,
+			Indexes: map[string]*memdb.IndexSchema{
+				"id": {
+					Name:         "id",
+					AllowMissing: false,
+					Unique:       true,
+					Indexer:      &memdb.StringFieldIndex{Field: "ID"},
+				},
+			},
+		},
+		tableUsers: {
+			Name: tableUsers,
+			Indexes: map[string]*memdb.IndexSchema{
+				"id": {
+					Name:         "id",
+					AllowMissing: false,
+					Unique:       true,
+					Indexer:      &memdb.StringFieldIndex{Field: "ID"},
+				},
+				"email": {
+					Name:         "email",
+					AllowMissing: false,
+					Unique:       true,
+					Indexer:      &memdb.StringFieldIndex{Field: "Email", Lowercase: true},
+				},
+			},
+		},
+		tableTeams: {
+			Name: tableTeams,
+			Indexes: map[string]*memdb.IndexSchema{
+				"id": {
+					Name:         "id",
+					AllowMissing: false,
+					Unique:       true,
+					Indexer:      &memdb.StringFieldIndex{Field: "ID"},
+				},
+			},
+		},
+		tableAudit: {
+			Name: tableAudit,
+			Indexes: map[string]*memdb.IndexSchema{
+				"id": {
+					Name:         "id",
+					AllowMissing: false,
+					Unique:       true,
+					Indexer:      &memdb.UintFieldIndex{Field: "Seq"},
+				},
+			},
+		},
+		tableSites: {
+			Name: tableSites,
+			Indexes: map[string]*memdb.IndexSchema{
+				"id": {
+					Name:         "id",
+					AllowMissing: false,
+					Unique:       true,
 					Indexer:      &memdb.StringFieldIndex{Field: "Domain"},
 				},
 			},
@@ -49,7 +216,7 @@ func newInMem() (*inMem, error) {
 	}, nil
 }
 
-// Insert inserts new or updates existing record.
+// Insert inserts new record unless the one with its ID is already stored, the record must have the tenant set.
 //
 // error is returned on any non-functional error.
 func (d *inMem) Insert(_ context.Context, msg *analytics.Event) error {
@@ -57,8 +224,12 @@ func (d *inMem) Insert(_ context.Context, msg *analytics.Event) error {
 	txn := d.db.Txn(true)
 	defer txn.Abort()
 
+	if err := checkTenant(msg); err != nil {
+		return err
+	}
+
 	// Insert value
-	err := txn.Insert(tableEvents, msg)
+	err := insertEvent(txn, msg)
 	zap.L().Named("memdb").Debug("insert "+msg.ID, zap.Bool("success", err == nil))
 	if err != nil {
 		return err
@@ -70,18 +241,57 @@ func (d *inMem) Insert(_ context.Context, msg *analytics.Event) error {
 	return nil
 }
 
-// List returns all records found in database by the domain value.
+// InsertBatch inserts new records in a single transaction, skipping the ones with the IDs already stored,
+// the records must have the tenant set.
+//
+// error is returned on any non-functional error, in which case none of the records are inserted.
+func (d *inMem) InsertBatch(_ context.Context, msgs []*analytics.Event) error {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	// Insert values
+	for _, msg := range msgs {
+		if err := checkTenant(msg); err != nil {
+			return err
+		}
+		if err := insertEvent(txn, msg); err != nil {
+			return err
+		}
+	}
+	zap.L().Named("memdb").Debug("insert batch", zap.Int("size", len(msgs)))
+
+	// Commit the transaction
+	txn.Commit()
+
+	return nil
+}
+
+// insertEvent inserts the event unless the one with its ID is already stored, e.g. by the retry of the client,
+// the stored one is kept.
+func insertEvent(txn *memdb.Txn, msg *analytics.Event) error {
+	existing, err := txn.First(tableEvents, "id", msg.GetTenant(), msg.GetID())
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return nil
+	}
+	return txn.Insert(tableEvents, msg)
+}
+
+// List returns all records of the site.
 //
 // # If no records present - an empty slice is returned
 //
 // error is returned on any non-functional error.
-func (d *inMem) List(_ context.Context, domain string) (*analytics.Events, error) {
+func (d *inMem) List(_ context.Context, site sites.Key) (*analytics.Events, error) {
 	// Create read-only transaction
 	txn := d.db.Txn(false)
 	defer txn.Abort()
 
 	// List all the instances
-	it, err := txn.Get(tableEvents, "domain", domain)
+	it, err := txn.Get(tableEvents, "site", site.Tenant, site.Domain)
 	if err != nil {
 		return nil, err
 	}
@@ -100,3 +310,690 @@ func (d *inMem) List(_ context.Context, domain string) (*analytics.Events, error
 		Events: c,
 	}, nil
 }
+
+// ListRange returns records of the site with timestamps in [from, to).
+//
+// # If no records present - an empty slice is returned
+//
+// error is returned on any non-functional error.
+func (d *inMem) ListRange(ctx context.Context, site sites.Key, from, to time.Time) (*analytics.Events, error) {
+	c := make([]*analytics.Event, 0)
+	err := d.ForEach(ctx, site, from, to, func(e *analytics.Event) error {
+		c = append(c, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &analytics.Events{
+		Events: c,
+	}, nil
+}
+
+// ForEach calls fn for every record of the site with timestamp in [from, to) in the timestamp order.
+// Zero from and to values are treated as unbounded.
+//
+// The iteration stops at the first error returned by fn, which is returned as is.
+func (d *inMem) ForEach(_ context.Context, site sites.Key, from, to time.Time, fn func(e *analytics.Event) error) error {
+	if from.IsZero() {
+		from = minTime
+	}
+	if to.IsZero() {
+		to = maxTime
+	}
+
+	// Create read-only transaction
+	txn := d.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.LowerBound(tableEvents, "site_timestamp", site.Tenant, site.Domain, from)
+	if err != nil {
+		return err
+	}
+
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		switch record := obj.(type) {
+		case *analytics.Event:
+			// The index is ordered by site first, so the iteration is over once another site is reached
+			if record.GetTenant() != site.Tenant || record.GetDomain() != site.Domain || !record.GetTimestamp().AsTime().Before(to) {
+				return nil
+			}
+			if err = fn(record); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported value type %s", record)
+		}
+	}
+
+	return nil
+}
+
+// DeleteRange deletes records of the site with timestamps in [from, to) and returns their amount.
+// Zero from and to values are treated as unbounded.
+//
+// error is returned on any non-functional error.
+func (d *inMem) DeleteRange(ctx context.Context, site sites.Key, from, to time.Time) (int, error) {
+	events, err := d.ListRange(ctx, site, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	// Delete values
+	for _, e := range events.GetEvents() {
+		if err = txn.Delete(tableEvents, e); err != nil {
+			return 0, err
+		}
+	}
+	zap.L().Named("memdb").Debug("delete range of "+site.String(), zap.Int("amount", len(events.GetEvents())))
+
+	// Commit the transaction
+	txn.Commit()
+
+	return len(events.GetEvents()), nil
+}
+
+// DeleteVisitor deletes records of the site with the visitor hash and returns their amount.
+//
+// error is returned on any non-functional error.
+func (d *inMem) DeleteVisitor(ctx context.Context, site sites.Key, hashedVisit string) (int, error) {
+	events := make([]*analytics.Event, 0)
+	err := d.ForEach(ctx, site, time.Time{}, time.Time{}, func(e *analytics.Event) error {
+		if e.GetHashedVisit() == hashedVisit {
+			events = append(events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	// Delete values
+	for _, e := range events {
+		if err = txn.Delete(tableEvents, e); err != nil {
+			return 0, err
+		}
+	}
+	zap.L().Named("memdb").Debug("delete visitor of "+site.String(), zap.Int("amount", len(events)))
+
+	// Commit the transaction
+	txn.Commit()
+
+	return len(events), nil
+}
+
+// ListEventSites returns the sites of the stored events in the order of the tenants and the domains.
+//
+// error is returned on any non-functional error.
+func (d *inMem) ListEventSites(_ context.Context) ([]sites.Key, error) {
+	// Create read-only transaction
+	txn := d.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.Get(tableEvents, "site_prefix")
+	if err != nil {
+		return nil, err
+	}
+
+	// The index is ordered by site, so the events of a site follow each other
+	keys := make([]sites.Key, 0)
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		switch record := obj.(type) {
+		case *analytics.Event:
+			key := sites.Key{Tenant: record.GetTenant(), Domain: record.GetDomain()}
+			if len(keys) == 0 || keys[len(keys)-1] != key {
+				keys = append(keys, key)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported value type %s", record)
+		}
+	}
+
+	return keys, nil
+}
+
+// UpsertRollups inserts new or updates existing rollups in a single transaction.
+//
+// error is returned on any non-functional error.
+func (d *inMem) UpsertRollups(_ context.Context, rollups []*Rollup) error {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	// Insert values
+	for _, r := range rollups {
+		if r.Tenant == "" {
+			return fmt.Errorf("tenant of rollup %s is missing", r.ID)
+		}
+		if err := txn.Insert(tableRollups, r); err != nil {
+			return err
+		}
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return nil
+}
+
+// ListRollups returns rollups of the site period which start in [from, to).
+//
+// # If no records present - an empty slice is returned
+//
+// error is returned on any non-functional error.
+func (d *inMem) ListRollups(_ context.Context, site sites.Key, period RollupPeriod, from, to time.Time) ([]*Rollup, error) {
+	// Create read-only transaction
+	txn := d.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.Get(tableRollups, "site_period", site.Tenant, site.Domain, string(period))
+	if err != nil {
+		return nil, err
+	}
+
+	c := make([]*Rollup, 0)
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		switch record := obj.(type) {
+		case *Rollup:
+			if !record.Start.Before(from) && record.Start.Before(to) {
+				c = append(c, record)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported value type %s", record)
+		}
+	}
+
+	return c, nil
+}
+
+// ListSites returns the managed sites.
+//
+// error is returned on any non-functional error.
+func (d *inMem) ListSites(_ context.Context) ([]*sites.Site, error) {
+	// Create read-only transaction
+	txn := d.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.Get(tableSites, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	c := make([]*sites.Site, 0)
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		switch record := obj.(type) {
+		case *sites.Site:
+			c = append(c, record)
+		default:
+			return nil, fmt.Errorf("unsupported value type %s", record)
+		}
+	}
+
+	return c, nil
+}
+
+// UpsertSite inserts new or replaces existing site of the same domain.
+//
+// The site must not be modified after that.
+func (d *inMem) UpsertSite(_ context.Context, site *sites.Site) error {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	if err := txn.Insert(tableSites, site); err != nil {
+		return err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return nil
+}
+
+// DeleteSite deletes the site of the domain, returning false if there is none.
+func (d *inMem) DeleteSite(_ context.Context, domain string) (bool, error) {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	n, err := txn.DeleteAll(tableSites, "id", domain)
+	if err != nil {
+		return false, err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return n > 0, nil
+}
+
+// checkTenant returns error if the event isn't scoped to a tenant,
+// so the events can't be stored outside the data of their tenants.
+func checkTenant(e *analytics.Event) error {
+	if e.GetTenant() == "" {
+		return fmt.Errorf("%w: tenant of event %s is missing", ErrInvalidEvent, e.GetID())
+	}
+	return nil
+}
+
+// AddUsage adds the events to the usage of the tenant month and returns the new total.
+//
+// error is returned on any non-functional error.
+func (d *inMem) AddUsage(_ context.Context, tenant string, month string, events int64) (int64, error) {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	total := events
+	obj, err := txn.First(tableUsage, "id", tenant, month)
+	if err != nil {
+		return 0, err
+	}
+	if obj != nil {
+		record, ok := obj.(*Usage)
+		if !ok {
+			return 0, fmt.Errorf("unsupported value type %s", obj)
+		}
+		total += record.Events
+	}
+	// Stored records must not be modified in place
+	if err = txn.Insert(tableUsage, &Usage{Tenant: tenant, Month: month, Events: total}); err != nil {
+		return 0, err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return total, nil
+}
+
+// GetUsage returns the usage of the tenant month, zero if there is none.
+//
+// error is returned on any non-functional error.
+func (d *inMem) GetUsage(_ context.Context, tenant string, month string) (int64, error) {
+	// Create read-only transaction
+	txn := d.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First(tableUsage, "id", tenant, month)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	record, ok := obj.(*Usage)
+	if !ok {
+		return 0, fmt.Errorf("unsupported value type %s", obj)
+	}
+	return record.Events, nil
+}
+
+// AppendAudit appends the entry to the audit log, assigning its Seq.
+//
+// The entry must not be modified after that.
+func (d *inMem) AppendAudit(_ context.Context, entry *AuditEntry) error {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	obj, err := txn.Last(tableAudit, "id")
+	if err != nil {
+		return err
+	}
+	entry.Seq = 1
+	if obj != nil {
+		last, ok := obj.(*AuditEntry)
+		if !ok {
+			return fmt.Errorf("unsupported value type %s", obj)
+		}
+		entry.Seq = last.Seq + 1
+	}
+	if err = txn.Insert(tableAudit, entry); err != nil {
+		return err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return nil
+}
+
+// ListAudit returns the audit entries of the domain, or of all the domains if it's empty,
+// in the [from, to) range in the order of appending. Zero from or to leaves the range open.
+//
+// error is returned on any non-functional error.
+func (d *inMem) ListAudit(_ context.Context, domain string, from, to time.Time) ([]*AuditEntry, error) {
+	// Create read-only transaction
+	txn := d.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.Get(tableAudit, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	c := make([]*AuditEntry, 0)
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		record, ok := obj.(*AuditEntry)
+		if !ok {
+			return nil, fmt.Errorf("unsupported value type %s", obj)
+		}
+		if domain != "" && record.Domain != domain {
+			continue
+		}
+		if (!from.IsZero() && record.Time.Before(from)) || (!to.IsZero() && !record.Time.Before(to)) {
+			continue
+		}
+		c = append(c, record)
+	}
+
+	return c, nil
+}
+
+// InsertAnnotation inserts new or replaces existing annotation, the annotation must have the tenant set.
+//
+// The annotation must not be modified after that.
+func (d *inMem) InsertAnnotation(_ context.Context, annotation *Annotation) error {
+	if annotation.Tenant == "" {
+		return fmt.Errorf("tenant of annotation %s is missing", annotation.ID)
+	}
+
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	if err := txn.Insert(tableAnnotations, annotation); err != nil {
+		return err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return nil
+}
+
+// ListAnnotations returns the annotations of the site in the [from, to) range ordered by their timestamps.
+// Zero from or to leaves the range open.
+//
+// error is returned on any non-functional error.
+func (d *inMem) ListAnnotations(_ context.Context, site sites.Key, from, to time.Time) ([]*Annotation, error) {
+	// Create read-only transaction
+	txn := d.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.Get(tableAnnotations, "site", site.Tenant, site.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make([]*Annotation, 0)
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		record, ok := obj.(*Annotation)
+		if !ok {
+			return nil, fmt.Errorf("unsupported value type %s", obj)
+		}
+		if (!from.IsZero() && record.Timestamp.Before(from)) || (!to.IsZero() && !record.Timestamp.Before(to)) {
+			continue
+		}
+		c = append(c, record)
+	}
+	slices.SortStableFunc(c, func(a, b *Annotation) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	return c, nil
+}
+
+// DeleteAnnotation deletes the annotation of the site, reporting whether it existed.
+//
+// error is returned on any non-functional error.
+func (d *inMem) DeleteAnnotation(_ context.Context, site sites.Key, id string) (bool, error) {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	obj, err := txn.First(tableAnnotations, "id", site.Tenant, id)
+	if err != nil {
+		return false, err
+	}
+	record, ok := obj.(*Annotation)
+	if !ok || record.Domain != site.Domain {
+		return false, nil
+	}
+	if err = txn.Delete(tableAnnotations, record); err != nil {
+		return false, err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return true, nil
+}
+
+// ListAccessTokens returns all the personal access tokens.
+//
+// error is returned on any non-functional error.
+func (d *inMem) ListAccessTokens(_ context.Context) ([]*sites.AccessToken, error) {
+	// Create read-only transaction
+	txn := d.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.Get(tableTokens, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	c := make([]*sites.AccessToken, 0)
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		switch record := obj.(type) {
+		case *sites.AccessToken:
+			c = append(c, record)
+		default:
+			return nil, fmt.Errorf("unsupported value type %s", record)
+		}
+	}
+
+	return c, nil
+}
+
+// InsertAccessToken inserts new personal access token.
+//
+// The token must not be modified after that.
+func (d *inMem) InsertAccessToken(_ context.Context, token *sites.AccessToken) error {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	if err := txn.Insert(tableTokens, token); err != nil {
+		return err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return nil
+}
+
+// DeleteAccessToken deletes the personal access token, reporting whether it existed.
+//
+// error is returned on any non-functional error.
+func (d *inMem) DeleteAccessToken(_ context.Context, id string) (bool, error) {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	n, err := txn.DeleteAll(tableTokens, "id", id)
+	if err != nil {
+		return false, err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return n > 0, nil
+}
+
+// ListUsers returns all the users.
+//
+// error is returned on any non-functional error.
+func (d *inMem) ListUsers(_ context.Context) ([]*sites.User, error) {
+	// Create read-only transaction
+	txn := d.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.Get(tableUsers, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	c := make([]*sites.User, 0)
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		switch record := obj.(type) {
+		case *sites.User:
+			c = append(c, record)
+		default:
+			return nil, fmt.Errorf("unsupported value type %s", record)
+		}
+	}
+
+	return c, nil
+}
+
+// InsertUser inserts new user, returning ErrUserExists if the email is already used.
+//
+// The user must not be modified after that.
+func (d *inMem) InsertUser(_ context.Context, user *sites.User) error {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	existing, err := txn.First(tableUsers, "email", user.Email)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return ErrUserExists
+	}
+	if err = txn.Insert(tableUsers, user); err != nil {
+		return err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return nil
+}
+
+// DeleteUser deletes the user and their memberships of the teams, reporting whether the user existed.
+//
+// error is returned on any non-functional error.
+func (d *inMem) DeleteUser(_ context.Context, id string) (bool, error) {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	n, err := txn.DeleteAll(tableUsers, "id", id)
+	if err != nil {
+		return false, err
+	}
+
+	it, err := txn.Get(tableTeams, "id")
+	if err != nil {
+		return false, err
+	}
+	var changed []*sites.Team
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		team, ok := obj.(*sites.Team)
+		if !ok {
+			return false, fmt.Errorf("unsupported value type %s", obj)
+		}
+		members := slices.DeleteFunc(slices.Clone(team.Members), func(m sites.Member) bool {
+			return m.UserID == id
+		})
+		if len(members) != len(team.Members) {
+			updated := *team
+			updated.Members = members
+			changed = append(changed, &updated)
+		}
+	}
+	for _, team := range changed {
+		if err = txn.Insert(tableTeams, team); err != nil {
+			return false, err
+		}
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return n > 0, nil
+}
+
+// ListTeams returns all the teams.
+//
+// error is returned on any non-functional error.
+func (d *inMem) ListTeams(_ context.Context) ([]*sites.Team, error) {
+	// Create read-only transaction
+	txn := d.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.Get(tableTeams, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	c := make([]*sites.Team, 0)
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		switch record := obj.(type) {
+		case *sites.Team:
+			c = append(c, record)
+		default:
+			return nil, fmt.Errorf("unsupported value type %s", record)
+		}
+	}
+
+	return c, nil
+}
+
+// UpsertTeam inserts new or replaces the existing team of the ID.
+//
+// The team must not be modified after that.
+func (d *inMem) UpsertTeam(_ context.Context, team *sites.Team) error {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	if err := txn.Insert(tableTeams, team); err != nil {
+		return err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return nil
+}
+
+// DeleteTeam deletes the team, reporting whether it existed.
+//
+// error is returned on any non-functional error.
+func (d *inMem) DeleteTeam(_ context.Context, id string) (bool, error) {
+	// Create write transaction
+	txn := d.db.Txn(true)
+	defer txn.Abort()
+
+	n, err := txn.DeleteAll(tableTeams, "id", id)
+	if err != nil {
+		return false, err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return n > 0, nil
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"fmt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+// benchmarkEvent returns the i-th page view of the benchmarks, spread over a hundred visitors and ten pages.
+func benchmarkEvent(i int) *analytics.Event {
+	return &analytics.Event{
+		ID:          fmt.Sprintf("event-%d", i),
+		Type:        "pageview",
+		URL:         fmt.Sprintf("https://example.com/page-%d", i%10),
+		Domain:      "example.com",
+		Tenant:      "example.com",
+		HashedVisit: fmt.Sprintf("visitor-%d", i%100),
+		Timestamp:   timestamppb.New(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second)),
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	// The inserts go into the database seeded with the events of a busy site
+	for _, seeded := range []int{0, 100000} {
+		b.Run(fmt.Sprintf("seeded=%d", seeded), func(b *testing.B) {
+			db, err := newInMem()
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx := context.Background()
+			seed := make([]*analytics.Event, seeded)
+			for i := range seed {
+				seed[i] = benchmarkEvent(i)
+			}
+			if err = db.InsertBatch(ctx, seed); err != nil {
+				b.Fatal(err)
+			}
+			events := make([]*analytics.Event, b.N)
+			for i := range events {
+				events[i] = benchmarkEvent(seeded + i)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for _, e := range events {
+				if err = db.Insert(ctx, e); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteVisitor(t *testing.T) {
+	db, err := newInMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	events := make([]*analytics.Event, 1000)
+	for i := range events {
+		events[i] = benchmarkEvent(i)
+	}
+	// The same visitor hash of another site isn't deleted
+	other := benchmarkEvent(len(events))
+	other.Domain, other.Tenant = "example.org", "example.org"
+	if err = db.InsertBatch(ctx, append(events, other)); err != nil {
+		t.Fatal(err)
+	}
+	site := sites.Key{Tenant: "example.com", Domain: "example.com"}
+
+	deleted, err := db.DeleteVisitor(ctx, site, "visitor-0")
+	if err != nil {
+		t.Fatalf("DeleteVisitor() error = %v", err)
+	}
+	if deleted != 10 {
+		t.Errorf("DeleteVisitor() = %d, want 10", deleted)
+	}
+	if deleted, err = db.DeleteVisitor(ctx, site, "visitor-0"); err != nil || deleted != 0 {
+		t.Errorf("DeleteVisitor() of the deleted visitor = %d, %v, want 0", deleted, err)
+	}
+
+	count := 0
+	err = db.ForEach(ctx, site, time.Time{}, time.Time{}, func(e *analytics.Event) error {
+		if e.GetHashedVisit() == "visitor-0" {
+			t.Errorf("event %s of the deleted visitor is stored", e.GetID())
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 990 {
+		t.Errorf("stored %d events, want 990", count)
+	}
+	otherSite := sites.Key{Tenant: "example.org", Domain: "example.org"}
+	if stored, err := db.List(ctx, otherSite); err != nil || len(stored.GetEvents()) != 1 {
+		t.Errorf("List() of the other site = %v, %v, want its event", stored, err)
+	}
+}
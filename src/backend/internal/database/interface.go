@@ -2,13 +2,70 @@ package database
 
 import (
 	"context"
+	"diploma/analytics-exporter/internal/sites"
 	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
 	"go.uber.org/zap"
+	"time"
 )
 
+// ErrUserExists is returned by InsertUser if the email of the user is already used.
+var ErrUserExists = errors.New("user with the email already exists")
+
+// ErrInvalidEvent is returned for the event which can't be stored, e.g. the one without the tenant,
+// so inserting it again fails the same way.
+var ErrInvalidEvent = errors.New("invalid event")
+
+// Database stores the events and the rollups scoped by the sites.Key of their sites,
+// so the data of a tenant is never read or overwritten through another tenant.
 type Database interface {
-	List(ctx context.Context, domain string) (*analytics.Events, error)
+	List(ctx context.Context, site sites.Key) (*analytics.Events, error)
+	ListRange(ctx context.Context, site sites.Key, from, to time.Time) (*analytics.Events, error)
+	ForEach(ctx context.Context, site sites.Key, from, to time.Time, fn func(e *analytics.Event) error) error
+	// Insert and InsertBatch reject the events without the tenant and skip the ones with the IDs of the stored events,
+	// so the events retried by the clients are stored once
 	Insert(ctx context.Context, msg *analytics.Event) error
+	InsertBatch(ctx context.Context, msgs []*analytics.Event) error
+	DeleteRange(ctx context.Context, site sites.Key, from, to time.Time) (int, error)
+	// DeleteVisitor deletes the events of the site with the visitor hash, e.g. on the erasure request of the visitor
+	DeleteVisitor(ctx context.Context, site sites.Key, hashedVisit string) (int, error)
+	// ListEventSites returns the sites of the stored events, including the ones which aren't configured
+	ListEventSites(ctx context.Context) ([]sites.Key, error)
+
+	UpsertRollups(ctx context.Context, rollups []*Rollup) error
+	ListRollups(ctx context.Context, site sites.Key, period RollupPeriod, from, to time.Time) ([]*Rollup, error)
+
+	// Usage of the tenants by the calendar month, e.g. 2024-05
+	AddUsage(ctx context.Context, tenant string, month string, events int64) (int64, error)
+	GetUsage(ctx context.Context, tenant string, month string) (int64, error)
+
+	// Sites managed at runtime, in addition to the ones of the sites file
+	ListSites(ctx context.Context) ([]*sites.Site, error)
+	UpsertSite(ctx context.Context, site *sites.Site) error
+	DeleteSite(ctx context.Context, domain string) (bool, error)
+
+	// Personal access tokens of the tenants
+	ListAccessTokens(ctx context.Context) ([]*sites.AccessToken, error)
+	InsertAccessToken(ctx context.Context, token *sites.AccessToken) error
+	DeleteAccessToken(ctx context.Context, id string) (bool, error)
+
+	// Users and the teams granting them the access to the sites, InsertUser returns ErrUserExists
+	// if the email is already used and DeleteUser removes the user from the teams
+	ListUsers(ctx context.Context) ([]*sites.User, error)
+	InsertUser(ctx context.Context, user *sites.User) error
+	DeleteUser(ctx context.Context, id string) (bool, error)
+	ListTeams(ctx context.Context) ([]*sites.Team, error)
+	UpsertTeam(ctx context.Context, team *sites.Team) error
+	DeleteTeam(ctx context.Context, id string) (bool, error)
+
+	// Annotations of the sites
+	InsertAnnotation(ctx context.Context, annotation *Annotation) error
+	ListAnnotations(ctx context.Context, site sites.Key, from, to time.Time) ([]*Annotation, error)
+	DeleteAnnotation(ctx context.Context, site sites.Key, id string) (bool, error)
+
+	// Audit log of the administrative actions, the entries can't be changed or deleted
+	AppendAudit(ctx context.Context, entry *AuditEntry) error
+	ListAudit(ctx context.Context, domain string, from, to time.Time) ([]*AuditEntry, error)
 }
 
 // NewDatabase returns Database implementation
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"diploma/analytics-exporter/internal/sites"
+	"time"
+)
+
+// RollupPeriod is a length of the period a Rollup aggregates.
+type RollupPeriod string
+
+const (
+	RollupHourly RollupPeriod = "hour"
+	RollupDaily  RollupPeriod = "day"
+)
+
+// Rollup holds pre-aggregated statistics of the site for a period starting at Start.
+type Rollup struct {
+	ID         string
+	Tenant     string
+	Domain     string
+	Period     RollupPeriod
+	Start      time.Time
+	Visitors   int64
+	Visits     int64
+	Pageviews  int64
+	TopPages   map[string]int
+	TopSources map[string]int
+}
+
+// RollupID returns a unique Rollup identifier of the site period.
+func RollupID(site sites.Key, period RollupPeriod, start time.Time) string {
+	return site.String() + "/" + string(period) + "/" + start.UTC().Format(time.RFC3339)
+}
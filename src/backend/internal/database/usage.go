@@ -0,0 +1,8 @@
+package database
+
+// Usage is the amount of the events of the tenant accepted in the calendar month.
+type Usage struct {
+	Tenant string
+	Month  string
+	Events int64
+}
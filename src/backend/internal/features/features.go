@@ -0,0 +1,82 @@
+// Package features gates the experimental behavior of the service by the feature flags,
+// so it's rolled out per deployment and compared by the feature_enabled metric.
+package features
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"slices"
+	"strconv"
+)
+
+// Flag is a name of the feature flag.
+type Flag string
+
+// Known feature flags.
+const (
+	// AsyncPipeline queues the incoming events and inserts them in batches, same as --ingest-async.
+	AsyncPipeline Flag = "async-pipeline"
+	// GraphQL serves the GraphQL endpoint of the stats on the gateway.
+	GraphQL Flag = "graphql"
+)
+
+// Known are the descriptions of the known feature flags.
+var Known = map[Flag]string{
+	AsyncPipeline: "Queue incoming events and insert them in batches in the background",
+	GraphQL:       "Serve the GraphQL endpoint of the stats on the gateway",
+}
+
+// Set is a set of the enabled feature flags, the zero value has all the flags disabled.
+type Set struct {
+	enabled map[Flag]bool
+}
+
+// Parse returns the Set of the flags with the true values, e.g. {"async-pipeline": "true"}.
+//
+// Unknown flags are rejected, so misspelled ones don't go unnoticed.
+func Parse(values map[string]string) (Set, error) {
+	s := Set{enabled: make(map[Flag]bool, len(values))}
+	for name, value := range values {
+		if _, ok := Known[Flag(name)]; !ok {
+			return Set{}, fmt.Errorf("unknown feature flag %q", name)
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return Set{}, fmt.Errorf("invalid value of feature flag %q: %w", name, err)
+		}
+		if enabled {
+			s.enabled[Flag(name)] = true
+		}
+	}
+	return s, nil
+}
+
+// Enabled reports whether the flag is enabled.
+func (s Set) Enabled(f Flag) bool {
+	return s.enabled[f]
+}
+
+// List returns the enabled flags sorted by name.
+func (s Set) List() []Flag {
+	flags := make([]Flag, 0, len(s.enabled))
+	for f := range s.enabled {
+		flags = append(flags, f)
+	}
+	slices.Sort(flags)
+	return flags
+}
+
+// RegisterMetrics exposes the state of the known flags as the feature_enabled metric.
+func (s Set) RegisterMetrics() {
+	for f := range Known {
+		value := 0.0
+		if s.Enabled(f) {
+			value = 1
+		}
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "feature_enabled",
+			Help:        "State of the feature flag, 1 if enabled",
+			ConstLabels: prometheus.Labels{"feature": string(f)},
+		}, func() float64 { return value }))
+	}
+}
@@ -0,0 +1,339 @@
+// Package graphql implements the GraphQL endpoint of the stats, so the frontends query the sites,
+// the aggregates, the time series and the breakdowns they need in one request.
+//
+// It executes the queries of the schema of schema.go without the fragments, the directives
+// and the introspection. The API keys are sent as the bearer tokens, the same way as to the REST API.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+// Path is the gateway path of the endpoint.
+const Path = "/api/graphql"
+
+const (
+	// maxQuerySize is the maximal size of the request body, or of the query and the variables of the GET request.
+	maxQuerySize = 64 << 10
+	// maxRootFields is the maximal amount of the fields selected by the operation, including the aliased ones.
+	maxRootFields = 20
+	// maxScans is the maximal amount of the executed fields which scan the events, e.g. the aggregates of all the sites.
+	maxScans = 100
+)
+
+// request is the body of the GraphQL request.
+type request struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// response is the body of the GraphQL response, the data is nil if the request isn't executed.
+type response struct {
+	Data   any             `json:"data"`
+	Errors []responseError `json:"errors,omitempty"`
+}
+
+// responseError is an error of the response, with the path of the field it's of.
+type responseError struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// Handler serves the GraphQL queries.
+type Handler struct {
+	db    database.Database
+	sites *sites.Registry
+}
+
+// NewHandler returns new Handler instance, access to the sites is checked against sitesRegistry.
+func NewHandler(db database.Database, sitesRegistry *sites.Registry) (*Handler, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if sitesRegistry == nil {
+		return nil, errors.New("sites.Registry instance is nil")
+	}
+	return &Handler{db: db, sites: sitesRegistry}, nil
+}
+
+// Serve executes the query of the POST request body, either JSON or application/graphql,
+// or of the query parameter of the GET request, and responds with {"data": ..., "errors": [...]}.
+//
+// The queries are limited to maxRootFields fields nested maxDepth levels deep at most, and the fields
+// scanning the events fail once maxScans of them are executed, so a single request can't scan them without bound.
+func (h *Handler) Serve(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	var req request
+	switch {
+	case r.Method == http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if len(req.Query)+len(r.URL.Query().Get("variables")) > maxQuerySize {
+			writeResponse(w, http.StatusRequestEntityTooLarge, &response{Errors: []responseError{{Message: "query is too large"}}})
+			return
+		}
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeResponse(w, http.StatusBadRequest, &response{Errors: []responseError{{Message: "invalid variables"}}})
+				return
+			}
+		}
+	case strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql"):
+		b := &bytes.Buffer{}
+		if _, err := b.ReadFrom(http.MaxBytesReader(w, r.Body, maxQuerySize)); err != nil {
+			writeResponse(w, http.StatusBadRequest, &response{Errors: []responseError{{Message: "cannot read query"}}})
+			return
+		}
+		req.Query = b.String()
+	default:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQuerySize)).Decode(&req); err != nil {
+			writeResponse(w, http.StatusBadRequest, &response{Errors: []responseError{{Message: "invalid request body"}}})
+			return
+		}
+	}
+
+	op, vars, err := prepare(req)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, &response{Errors: []responseError{{Message: err.Error()}}})
+		return
+	}
+	e := &executor{
+		ctx:     r.Context(),
+		handler: h,
+		key:     sites.BearerKey(r.Header.Get("Authorization")),
+		vars:    vars,
+	}
+	data := e.object(queryType, nil, op.selections, nil)
+	writeResponse(w, http.StatusOK, &response{Data: data, Errors: e.errors})
+}
+
+// prepare parses the query and returns its operation to execute with the values of the variables.
+func prepare(req request) (*operation, map[string]value, error) {
+	if req.Query == "" {
+		return nil, nil, errors.New("query is missing")
+	}
+	operations, err := parse(req.Query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var op *operation
+	switch {
+	case req.OperationName != "":
+		for _, o := range operations {
+			if o.name == req.OperationName {
+				op = o
+			}
+		}
+		if op == nil {
+			return nil, nil, fmt.Errorf("operation %q is not found", req.OperationName)
+		}
+	case len(operations) > 1:
+		return nil, nil, errors.New("operationName is required for the documents with several operations")
+	default:
+		op = operations[0]
+	}
+	if len(op.selections) > maxRootFields {
+		return nil, nil, fmt.Errorf("operation selects more than %d fields", maxRootFields)
+	}
+
+	vars := make(map[string]value, len(op.defaults))
+	for name, def := range op.defaults {
+		vars[name] = def
+		if v, ok := req.Variables[name]; ok {
+			vars[name] = v
+		}
+	}
+	return op, vars, nil
+}
+
+// executor executes the operation, collecting the errors of the fields.
+type executor struct {
+	ctx     context.Context
+	handler *Handler
+	key     string
+	vars    map[string]value
+	errors  []responseError
+	// scans is the amount of the executed fields which scan the events
+	scans int
+}
+
+// object returns the fields of the value of the type selected by the selections, in their order.
+// The fields whose resolvers fail are null, the errors are reported with their paths.
+func (e *executor) object(typ *objectType, parent any, selections []*selection, path []any) orderedMap {
+	res := make(orderedMap, 0, len(selections))
+	keys := make(map[string]bool, len(selections))
+	for _, s := range selections {
+		fieldPath := append(path[:len(path):len(path)], s.key())
+		if keys[s.key()] {
+			e.fail(fieldPath, fmt.Errorf("field %q is selected twice", s.key()))
+			continue
+		}
+		keys[s.key()] = true
+		res = append(res, entry{key: s.key(), value: e.field(typ, parent, s, fieldPath)})
+	}
+	return res
+}
+
+// field resolves the selected field of the value of the type.
+func (e *executor) field(typ *objectType, parent any, s *selection, path []any) any {
+	if s.name == "__typename" {
+		return typ.name
+	}
+	f, ok := typ.fields[s.name]
+	if !ok {
+		e.fail(path, fmt.Errorf("type %s has no field %q", typ.name, s.name))
+		return nil
+	}
+	if f.scans {
+		if e.scans++; e.scans > maxScans {
+			e.fail(path, fmt.Errorf("query scans the events more than %d times", maxScans))
+			return nil
+		}
+	}
+	args, err := e.arguments(f, s)
+	if err != nil {
+		e.fail(path, err)
+		return nil
+	}
+	v, err := f.resolve(e, parent, args)
+	if err != nil {
+		e.fail(path, err)
+		return nil
+	}
+	return e.complete(f.typ, v, s, path)
+}
+
+// complete returns the resolved value of the field with its selections applied to the objects.
+func (e *executor) complete(typ *objectType, v any, s *selection, path []any) any {
+	if typ == nil {
+		if len(s.selections) > 0 {
+			e.fail(path, fmt.Errorf("field %q is a scalar and has no fields", s.key()))
+			return nil
+		}
+		return v
+	}
+	if len(s.selections) == 0 {
+		e.fail(path, fmt.Errorf("field %q of type %s requires the selection of its fields", s.key(), typ.name))
+		return nil
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []any:
+		list := make([]any, 0, len(v))
+		for i, item := range v {
+			list = append(list, e.object(typ, item, s.selections, append(path[:len(path):len(path)], i)))
+		}
+		return list
+	default:
+		return e.object(typ, v, s.selections, path)
+	}
+}
+
+// arguments returns the arguments of the selected field with the variables replaced by their values,
+// checking the field has them.
+func (e *executor) arguments(f *field, s *selection) (arguments, error) {
+	args := make(arguments, len(s.args))
+	for name, v := range s.args {
+		if !f.hasArg(name) {
+			return nil, fmt.Errorf("field %q has no argument %q", s.name, name)
+		}
+		resolved, err := e.resolve(v)
+		if err != nil {
+			return nil, err
+		}
+		args[name] = resolved
+	}
+	return args, nil
+}
+
+// resolve replaces the variables of the value by their values.
+func (e *executor) resolve(v value) (value, error) {
+	switch v := v.(type) {
+	case variable:
+		resolved, ok := e.vars[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s is not defined", v)
+		}
+		return resolved, nil
+	case []value:
+		list := make([]value, 0, len(v))
+		for _, item := range v {
+			resolved, err := e.resolve(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, resolved)
+		}
+		return list, nil
+	case map[string]value:
+		object := make(map[string]value, len(v))
+		for name, item := range v {
+			resolved, err := e.resolve(item)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = resolved
+		}
+		return object, nil
+	default:
+		return v, nil
+	}
+}
+
+// fail records the error of the field.
+func (e *executor) fail(path []any, err error) {
+	e.errors = append(e.errors, responseError{Message: err.Error(), Path: path})
+}
+
+// entry is a field of the response object.
+type entry struct {
+	key   string
+	value any
+}
+
+// orderedMap is the response object, its fields are encoded in the order of their selection.
+type orderedMap []entry
+
+// MarshalJSON implements json.Marshaler.
+func (m orderedMap) MarshalJSON() ([]byte, error) {
+	b := &bytes.Buffer{}
+	b.WriteByte('{')
+	for i, e := range m {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(e.key)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		v, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// writeResponse responds with the GraphQL response.
+func writeResponse(w http.ResponseWriter, code int, res *response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		zap.L().Named("graphql").Debug("cannot write response", zap.Error(err))
+	}
+}
@@ -0,0 +1,77 @@
+package graphql
+
+import (
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServeLimits(t *testing.T) {
+	db, err := database.NewDatabase(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &sites.Config{}
+	for i := 0; i <= maxScans; i++ {
+		cfg.Sites = append(cfg.Sites, sites.Site{Domain: fmt.Sprintf("site-%d.example.com", i)})
+	}
+	h, err := NewHandler(db, sites.NewRegistry(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliases := make([]string, maxRootFields+1)
+	for i := range aliases {
+		aliases[i] = fmt.Sprintf("s%d: sites { domain }", i)
+	}
+	tests := []struct {
+		name     string
+		query    string
+		get      bool
+		wantCode int
+		wantErr  string
+	}{
+		{name: "root fields", query: "{ " + strings.Join(aliases[:maxRootFields], " ") + " }", wantCode: http.StatusOK},
+		{name: "too many root fields", query: "{ " + strings.Join(aliases, " ") + " }", wantCode: http.StatusBadRequest, wantErr: "operation selects more than 20 fields"},
+		{name: "too many scans", query: "{ sites { currentVisitors } }", wantCode: http.StatusOK, wantErr: "query scans the events more than 100 times"},
+		{name: "GET query", query: "{ sites { domain } }", get: true, wantCode: http.StatusOK},
+		{name: "too large GET query", query: "{ sites { domain " + strings.Repeat(" ", maxQuerySize) + "} }", get: true, wantCode: http.StatusRequestEntityTooLarge, wantErr: "query is too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			if tt.get {
+				req = httptest.NewRequest(http.MethodGet, "/api/graphql?query="+url.QueryEscape(tt.query), nil)
+			} else {
+				req = httptest.NewRequest(http.MethodPost, "/api/graphql", strings.NewReader(tt.query))
+				req.Header.Set("Content-Type", "application/graphql")
+			}
+			w := httptest.NewRecorder()
+			h.Serve(w, req, nil)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Serve() code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			var res struct {
+				Errors []struct {
+					Message string `json:"message"`
+				} `json:"errors"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("Serve() body %s error = %v", w.Body, err)
+			}
+			switch {
+			case tt.wantErr == "" && len(res.Errors) > 0:
+				t.Errorf("Serve() errors = %+v, want none", res.Errors)
+			case tt.wantErr != "" && (len(res.Errors) == 0 || res.Errors[0].Message != tt.wantErr):
+				t.Errorf("Serve() errors = %+v, want %q", res.Errors, tt.wantErr)
+			}
+		})
+	}
+}
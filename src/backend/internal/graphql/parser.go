@@ -0,0 +1,578 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// selection is a field selected by the query, with the selections of its fields if it's an object.
+type selection struct {
+	alias      string
+	name       string
+	args       map[string]value
+	selections []*selection
+}
+
+// key returns the name of the field in the response, the alias if it's set.
+func (s *selection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// operation is a query of the document.
+type operation struct {
+	name string
+	// defaults are the default values of the variables, nil for the variables without them
+	defaults   map[string]value
+	selections []*selection
+}
+
+// value is an argument value: a literal, a variable, a list or an input object,
+// the same types as of the JSON decoded variables.
+type value = any
+
+// variable is a reference to the variable of the operation in the arguments.
+type variable string
+
+// enum is an enum value literal, e.g. PAGE.
+type enum string
+
+// tokenKind is a kind of the lexical token.
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+// token is a lexical token of the document.
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// maxDepth is the maximal nesting of the selection sets and of the list and object values,
+// the schema fields are nested three levels deep.
+const maxDepth = 5
+
+// parser parses the query documents. Only the queries are supported, without the fragments and the directives.
+type parser struct {
+	src string
+	pos int
+	tok token
+	// depth is the nesting of the current selection set or value
+	depth int
+}
+
+// parse returns the operations of the document.
+func parse(src string) ([]*operation, error) {
+	p := &parser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var operations []*operation
+	for p.tok.kind != tokenEOF {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, op)
+	}
+	if len(operations) == 0 {
+		return nil, fmt.Errorf("document has no operations")
+	}
+	return operations, nil
+}
+
+// operation parses the operation, either the shorthand selection set or the query with the name and the variables.
+func (p *parser) operation() (*operation, error) {
+	op := &operation{defaults: make(map[string]value)}
+	if p.is(tokenPunctuator, "{") {
+		selections, err := p.selectionSet()
+		if err != nil {
+			return nil, err
+		}
+		op.selections = selections
+		return op, nil
+	}
+
+	if p.tok.kind != tokenName {
+		return nil, p.errorf("expected an operation")
+	}
+	switch p.tok.value {
+	case "query":
+	case "mutation", "subscription":
+		return nil, p.errorf("%ss are not supported", p.tok.value)
+	case "fragment":
+		return nil, p.errorf("fragments are not supported")
+	default:
+		return nil, p.errorf("unexpected %q", p.tok.value)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokenName {
+		op.name = p.tok.value
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.is(tokenPunctuator, "(") {
+		if err := p.variableDefinitions(op); err != nil {
+			return nil, err
+		}
+	}
+	if p.is(tokenPunctuator, "@") {
+		return nil, p.errorf("directives are not supported")
+	}
+	selections, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = selections
+	return op, nil
+}
+
+// variableDefinitions parses the variables of the operation, e.g. ($domain: String!, $limit: Int = 10).
+// The types aren't checked, the arguments are checked by the fields.
+func (p *parser) variableDefinitions(op *operation) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.is(tokenPunctuator, ")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		if p.tok.kind != tokenName {
+			return p.errorf("expected a variable name")
+		}
+		name := p.tok.value
+		if err := p.next(); err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		op.defaults[name] = nil
+		if p.is(tokenPunctuator, "=") {
+			if err := p.next(); err != nil {
+				return err
+			}
+			v, err := p.value(true)
+			if err != nil {
+				return err
+			}
+			op.defaults[name] = v
+		}
+	}
+	return p.next()
+}
+
+// skipType parses the type of the variable, e.g. [String!]!.
+func (p *parser) skipType() error {
+	switch {
+	case p.is(tokenPunctuator, "["):
+		if err := p.next(); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	case p.tok.kind == tokenName:
+		if err := p.next(); err != nil {
+			return err
+		}
+	default:
+		return p.errorf("expected a type")
+	}
+	if p.is(tokenPunctuator, "!") {
+		return p.next()
+	}
+	return nil
+}
+
+// selectionSet parses the fields in the braces.
+func (p *parser) selectionSet() ([]*selection, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []*selection
+	for !p.is(tokenPunctuator, "}") {
+		if p.is(tokenPunctuator, "...") {
+			return nil, p.errorf("fragments are not supported")
+		}
+		s, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+	if len(selections) == 0 {
+		return nil, p.errorf("selection set is empty")
+	}
+	return selections, p.next()
+}
+
+// field parses the field with the alias, the arguments and the selections.
+func (p *parser) field() (*selection, error) {
+	if p.tok.kind != tokenName {
+		return nil, p.errorf("expected a field name")
+	}
+	s := &selection{name: p.tok.value}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.is(tokenPunctuator, ":") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokenName {
+			return nil, p.errorf("expected a field name")
+		}
+		s.alias, s.name = s.name, p.tok.value
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.is(tokenPunctuator, "(") {
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		s.args = args
+	}
+	if p.is(tokenPunctuator, "@") {
+		return nil, p.errorf("directives are not supported")
+	}
+	if p.is(tokenPunctuator, "{") {
+		selections, err := p.selectionSet()
+		if err != nil {
+			return nil, err
+		}
+		s.selections = selections
+	}
+	return s, nil
+}
+
+// arguments parses the arguments of the field in the parentheses.
+func (p *parser) arguments() (map[string]value, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	args := make(map[string]value)
+	for !p.is(tokenPunctuator, ")") {
+		if p.tok.kind != tokenName {
+			return nil, p.errorf("expected an argument name")
+		}
+		name := p.tok.value
+		if _, ok := args[name]; ok {
+			return nil, p.errorf("argument %q is repeated", name)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value(false)
+		if err != nil {
+			return nil, err
+		}
+		args[name] = v
+	}
+	return args, p.next()
+}
+
+// value parses the argument value, the constant ones can't refer to the variables.
+func (p *parser) value(constant bool) (value, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	tok := p.tok
+	switch {
+	case tok.kind == tokenPunctuator && tok.value == "$":
+		if constant {
+			return nil, p.errorf("variables can't be used in default values")
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokenName {
+			return nil, p.errorf("expected a variable name")
+		}
+		name := p.tok.value
+		return variable(name), p.next()
+	case tok.kind == tokenPunctuator && tok.value == "[":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := make([]value, 0)
+		for !p.is(tokenPunctuator, "]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.next()
+	case tok.kind == tokenPunctuator && tok.value == "{":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		object := make(map[string]value)
+		for !p.is(tokenPunctuator, "}") {
+			if p.tok.kind != tokenName {
+				return nil, p.errorf("expected a field name")
+			}
+			name := p.tok.value
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = v
+		}
+		return object, p.next()
+	case tok.kind == tokenInt:
+		n, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid integer %s", tok.value)
+		}
+		return n, p.next()
+	case tok.kind == tokenFloat:
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, p.errorf("invalid float %s", tok.value)
+		}
+		return f, p.next()
+	case tok.kind == tokenString:
+		return tok.value, p.next()
+	case tok.kind == tokenName:
+		var v value
+		switch tok.value {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = enum(tok.value)
+		}
+		return v, p.next()
+	default:
+		return nil, p.errorf("expected a value")
+	}
+}
+
+// enter descends into the selection set or the value, checking the nesting isn't deeper than maxDepth.
+func (p *parser) enter() error {
+	if p.depth++; p.depth > maxDepth {
+		return p.errorf("nested deeper than %d levels", maxDepth)
+	}
+	return nil
+}
+
+// leave ascends from the selection set or the value.
+func (p *parser) leave() {
+	p.depth--
+}
+
+// is reports whether the current token is of the kind and the value.
+func (p *parser) is(kind tokenKind, v string) bool {
+	return p.tok.kind == kind && p.tok.value == v
+}
+
+// expect consumes the punctuator.
+func (p *parser) expect(punctuator string) error {
+	if !p.is(tokenPunctuator, punctuator) {
+		return p.errorf("expected %q", punctuator)
+	}
+	return p.next()
+}
+
+// errorf returns the syntax error at the current token.
+func (p *parser) errorf(format string, args ...any) error {
+	found := p.tok.value
+	if p.tok.kind == tokenEOF {
+		found = "end of document"
+	}
+	return fmt.Errorf("syntax error at %d near %q: %s", p.tok.pos, found, fmt.Sprintf(format, args...))
+}
+
+// next reads the next token, skipping the whitespace, the commas and the comments.
+func (p *parser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = token{kind: tokenEOF, pos: start}
+		return nil
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = token{kind: tokenPunctuator, value: "...", pos: start}
+	case strings.IndexByte("!$()&:=@[]{}|", c) >= 0:
+		p.pos++
+		p.tok = token{kind: tokenPunctuator, value: string(c), pos: start}
+	case c == '_' || isLetter(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = token{kind: tokenName, value: p.src[start:p.pos], pos: start}
+	case c == '-' || isDigit(c):
+		return p.number()
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		return p.blockString()
+	case c == '"':
+		return p.string()
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		return fmt.Errorf("syntax error at %d: unexpected character %q", start, r)
+	}
+	return nil
+}
+
+// number reads the integer or the float token.
+func (p *parser) number() error {
+	start := p.pos
+	kind := tokenInt
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	digits := func() {
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+		}
+	}
+	digits()
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		kind = tokenFloat
+		p.pos++
+		digits()
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		kind = tokenFloat
+		p.pos++
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		digits()
+	}
+	p.tok = token{kind: kind, value: p.src[start:p.pos], pos: start}
+	return nil
+}
+
+// string reads the quoted string token, decoding the escapes.
+func (p *parser) string() error {
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' || p.src[p.pos] == '\r' {
+			return fmt.Errorf("syntax error at %d: unterminated string", start)
+		}
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			p.tok = token{kind: tokenString, value: b.String(), pos: start}
+			return nil
+		case c == '\\' && p.pos+1 < len(p.src):
+			escape := p.src[p.pos+1]
+			p.pos += 2
+			switch escape {
+			case '"', '\\', '/':
+				b.WriteByte(escape)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					return fmt.Errorf("syntax error at %d: invalid unicode escape", p.pos)
+				}
+				r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					return fmt.Errorf("syntax error at %d: invalid unicode escape", p.pos)
+				}
+				b.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				return fmt.Errorf("syntax error at %d: invalid escape \\%c", p.pos-1, escape)
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// blockString reads the """block string""" token, trimming the surrounding whitespace
+// instead of the common indentation.
+func (p *parser) blockString() error {
+	start := p.pos
+	end := strings.Index(p.src[p.pos+3:], `"""`)
+	if end < 0 {
+		return fmt.Errorf("syntax error at %d: unterminated block string", start)
+	}
+	value := p.src[p.pos+3 : p.pos+3+end]
+	p.pos += 3 + end + 3
+	p.tok = token{kind: tokenString, value: strings.TrimSpace(value), pos: start}
+	return nil
+}
+
+// isLetter reports whether c is an ASCII letter.
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// isDigit reports whether c is an ASCII digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,187 @@
+package graphql
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    []*operation
+		wantErr string
+	}{
+		{
+			name: "shorthand",
+			src:  `{ sites { domain } }`,
+			want: []*operation{{defaults: map[string]value{}, selections: []*selection{
+				{name: "sites", selections: []*selection{{name: "domain"}}},
+			}}},
+		},
+		{
+			name: "named query with variables",
+			src: `query Stats($domain: String!, $limit: Int = 10, $props: [Property!]) {
+				site(domain: $domain) { breakdown(property: PAGE, limit: $limit) { value } }
+			}`,
+			want: []*operation{{
+				name:     "Stats",
+				defaults: map[string]value{"domain": nil, "limit": int64(10), "props": nil},
+				selections: []*selection{{
+					name: "site",
+					args: map[string]value{"domain": variable("domain")},
+					selections: []*selection{{
+						name:       "breakdown",
+						args:       map[string]value{"property": enum("PAGE"), "limit": variable("limit")},
+						selections: []*selection{{name: "value"}},
+					}},
+				}},
+			}},
+		},
+		{
+			name: "aliases and values",
+			src: `{
+				a: site(domain: "a.com") { aggregate(filter: {page: "/", device: null}) { visitors } }
+				b: site(domain: "b.com\n") { x: aggregate(from: """ 2024-01-01 """, to: "2024-02-01") { bounceRate } }
+				sites { timeseries(interval: DAY, list: [1, -2.5e3, true, false]) { date } }
+			}`,
+			want: []*operation{{defaults: map[string]value{}, selections: []*selection{
+				{alias: "a", name: "site", args: map[string]value{"domain": "a.com"}, selections: []*selection{
+					{name: "aggregate", args: map[string]value{"filter": map[string]value{"page": "/", "device": nil}}, selections: []*selection{{name: "visitors"}}},
+				}},
+				{alias: "b", name: "site", args: map[string]value{"domain": "b.com\n"}, selections: []*selection{
+					{alias: "x", name: "aggregate", args: map[string]value{"from": "2024-01-01", "to": "2024-02-01"}, selections: []*selection{{name: "bounceRate"}}},
+				}},
+				{name: "sites", selections: []*selection{
+					{name: "timeseries", args: map[string]value{"interval": enum("DAY"), "list": []value{int64(1), -2500.0, true, false}}, selections: []*selection{{name: "date"}}},
+				}},
+			}}},
+		},
+		{
+			name: "comments and commas",
+			src:  "# the sites\n{ sites { domain, timezone } } # trailing",
+			want: []*operation{{defaults: map[string]value{}, selections: []*selection{
+				{name: "sites", selections: []*selection{{name: "domain"}, {name: "timezone"}}},
+			}}},
+		},
+		{
+			name: "several operations",
+			src:  `query A { sites { domain } } query B { sites { timezone } }`,
+			want: []*operation{
+				{name: "A", defaults: map[string]value{}, selections: []*selection{{name: "sites", selections: []*selection{{name: "domain"}}}}},
+				{name: "B", defaults: map[string]value{}, selections: []*selection{{name: "sites", selections: []*selection{{name: "timezone"}}}}},
+			},
+		},
+		{name: "empty document", src: " # nothing\n", wantErr: "document has no operations"},
+		{name: "empty selection set", src: `{ }`, wantErr: "selection set is empty"},
+		{name: "unclosed selection set", src: `{ sites { domain }`, wantErr: "end of document"},
+		{name: "mutation", src: `mutation { deleteSite }`, wantErr: "mutations are not supported"},
+		{name: "subscription", src: `subscription { sites }`, wantErr: "subscriptions are not supported"},
+		{name: "fragment definition", src: `fragment F on Site { domain }`, wantErr: "fragments are not supported"},
+		{name: "fragment spread", src: `{ sites { ...F } }`, wantErr: "fragments are not supported"},
+		{name: "directive", src: `{ sites @skip(if: true) { domain } }`, wantErr: "directives are not supported"},
+		{name: "repeated argument", src: `{ site(domain: "a", domain: "b") { domain } }`, wantErr: `argument "domain" is repeated`},
+		{name: "variable in default", src: `query ($a: Int = $b) { sites { domain } }`, wantErr: "variables can't be used in default values"},
+		{name: "unterminated string", src: `{ site(domain: "a.com) { domain } }`, wantErr: "unterminated string"},
+		{name: "string with newline", src: "{ site(domain: \"a\n\") { domain } }", wantErr: "unterminated string"},
+		{name: "unterminated block string", src: `{ site(domain: """a) { domain } }`, wantErr: "unterminated block string"},
+		{name: "invalid escape", src: `{ site(domain: "\x") { domain } }`, wantErr: `invalid escape \x`},
+		{name: "invalid unicode escape", src: `{ site(domain: "\u00zz") { domain } }`, wantErr: "invalid unicode escape"},
+		{name: "short unicode escape", src: `{ site(domain: "\u00`, wantErr: "invalid unicode escape"},
+		{name: "integer overflow", src: `{ site(limit: 99999999999999999999) { domain } }`, wantErr: "invalid integer"},
+		{name: "unexpected character", src: `{ sites { domain; } }`, wantErr: `unexpected character ';'`},
+		{name: "missing value", src: `{ site(domain: ) { domain } }`, wantErr: "expected a value"},
+		{name: "missing type", src: `query ($a: ) { sites { domain } }`, wantErr: "expected a type"},
+		{name: "selections nested too deep", src: `{ a { b { c { d { e { f } } } } } }`, wantErr: "nested deeper than 5 levels"},
+		{name: "values nested too deep", src: `{ site(domain: [[[[[1]]]]]) { domain } }`, wantErr: "nested deeper than 5 levels"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parse(tt.src)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parse() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parse() = %s, want %s", dump(got), dump(tt.want))
+			}
+		})
+	}
+}
+
+// FuzzParse checks the parser neither panics nor exceeds the nesting limit on any document.
+func FuzzParse(f *testing.F) {
+	for _, src := range []string{
+		`{ sites { domain } }`,
+		`query Stats($domain: String!, $limit: Int = 10) { site(domain: $domain) { breakdown(property: PAGE, limit: $limit) { value visitors } } }`,
+		`{ a: site(domain: "a.com") { aggregate(filter: {page: "/"}, from: """2024-01-01""") { visitors bounceRate } } }`,
+		`{ sites { timeseries(interval: HOUR, list: [1, -2.5e3, true, null]) { date } } } # comment`,
+		`query A { sites { domain } } query B { sites { timezone } }`,
+		`{ sites { ...F } }`,
+		`{ site(domain: "\x") }`,
+	} {
+		f.Add(src)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		operations, err := parse(src)
+		if err != nil {
+			return
+		}
+		if len(operations) == 0 {
+			t.Fatal("parse() returned no operations without an error")
+		}
+		for _, op := range operations {
+			if d := depth(op.selections); d > maxDepth {
+				t.Fatalf("parse() returned selections nested %d levels deep", d)
+			}
+		}
+	})
+}
+
+// depth returns the nesting of the selections.
+func depth(selections []*selection) int {
+	d := 0
+	for _, s := range selections {
+		d = max(d, depth(s.selections))
+	}
+	if len(selections) == 0 {
+		return 0
+	}
+	return d + 1
+}
+
+// dump returns the operations for the failure messages, the selections of which are pointers.
+func dump(operations []*operation) string {
+	var b strings.Builder
+	for _, op := range operations {
+		fmt.Fprintf(&b, "%s%v%s ", op.name, op.defaults, dumpSelections(op.selections))
+	}
+	return b.String()
+}
+
+// dumpSelections returns the selections for the failure messages.
+func dumpSelections(selections []*selection) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for _, s := range selections {
+		if s.alias != "" {
+			fmt.Fprintf(&b, " %s:", s.alias)
+		}
+		fmt.Fprintf(&b, " %s", s.name)
+		if s.args != nil {
+			fmt.Fprintf(&b, "%v", s.args)
+		}
+		if len(s.selections) > 0 {
+			b.WriteString(dumpSelections(s.selections))
+		}
+	}
+	b.WriteString(" }")
+	return b.String()
+}
@@ -0,0 +1,587 @@
+package graphql
+
+import (
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Schema is the schema of the queries, the timestamps are RFC 3339 or the dates in the site timezone.
+const Schema = `type Query {
+  sites: [Site!]!
+  site(domain: String!): Site
+}
+
+type Site {
+  domain: String!
+  timezone: String!
+  currentVisitors: Int!
+  aggregate(period: String, from: String, to: String, filter: Filter): Aggregate!
+  timeseries(period: String, from: String, to: String, interval: Interval, filter: Filter): [Bucket!]!
+  breakdown(property: Property!, period: String, from: String, to: String, filter: Filter, limit: Int): [Row!]!
+}
+
+type Aggregate {
+  visitors: Int!
+  visits: Int!
+  pageviews: Int!
+  events: Int!
+  bounceRate: Float!
+  viewsPerVisit: Float!
+}
+
+type Bucket {
+  date: String!
+  visitors: Int!
+  visits: Int!
+  pageviews: Int!
+  events: Int!
+  bounceRate: Float!
+  viewsPerVisit: Float!
+}
+
+type Row {
+  value: String!
+  visitors: Int
+  visits: Int
+  events: Int
+  pageviews: Int
+}
+
+input Filter {
+  page: String
+  source: String
+  referrer: String
+  device: String
+  os: String
+  browser: String
+  event: String
+}
+
+enum Interval { HOUR DAY MONTH }
+
+enum Property { PAGE SOURCE REFERRER DEVICE OS BROWSER EVENT ENTRY_PAGE EXIT_PAGE }
+`
+
+const (
+	// defaultLimit is the amount of the breakdown rows returned without the limit.
+	defaultLimit = 100
+	// maxLimit is the maximal amount of the breakdown rows.
+	maxLimit = 1000
+	// maxBuckets is the maximal amount of the time series buckets, e.g. a month of hours.
+	maxBuckets = 31 * 24
+)
+
+// objectType is an object type of the schema.
+type objectType struct {
+	name   string
+	fields map[string]*field
+}
+
+// field is a field of the object type, its type is nil if it's a scalar.
+type field struct {
+	args []string
+	typ  *objectType
+	// scans fields read the events, their executions are limited by maxScans
+	scans   bool
+	resolve func(e *executor, parent any, args arguments) (any, error)
+}
+
+// hasArg reports whether the field has the argument.
+func (f *field) hasArg(name string) bool {
+	return slices.Contains(f.args, name)
+}
+
+// arguments are the arguments of the selected field with the values of the variables.
+type arguments map[string]value
+
+// string returns the string or the enum argument, the empty string if it's missing.
+func (a arguments) string(name string) (string, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case enum:
+		return string(v), nil
+	default:
+		return "", fmt.Errorf("argument %q must be a string", name)
+	}
+}
+
+// int returns the integer argument, def if it's missing.
+func (a arguments) int(name string, def int) (int, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		if v == math.Trunc(v) {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q must be an integer", name)
+}
+
+// site is the site of the domain the caller has access to.
+type site struct {
+	domain string
+}
+
+// rangeStats are the stats of the time range, with its label in the time series.
+type rangeStats struct {
+	label string
+	stats *prometheus.AnalyticsStats
+}
+
+// row is a value of the breakdown property with its metrics, nil if they aren't counted for the property.
+type row struct {
+	value     string
+	visitors  any
+	visits    any
+	events    any
+	pageviews any
+}
+
+var (
+	queryType     = &objectType{name: "Query"}
+	siteType      = &objectType{name: "Site"}
+	aggregateType = &objectType{name: "Aggregate"}
+	bucketType    = &objectType{name: "Bucket"}
+	rowType       = &objectType{name: "Row"}
+)
+
+// rangeArgs are the arguments of the time range of the stats.
+var rangeArgs = []string{"period", "from", "to", "filter"}
+
+func init() {
+	queryType.fields = map[string]*field{
+		"sites": {typ: siteType, resolve: func(e *executor, _ any, _ arguments) (any, error) {
+			res := make([]any, 0)
+			for _, s := range e.handler.sites.Config().Sites {
+				if e.handler.sites.Authorize(e.key, s.Domain, sites.PermissionStats) == nil {
+					res = append(res, &site{domain: s.Domain})
+				}
+			}
+			return res, nil
+		}},
+		"site": {args: []string{"domain"}, typ: siteType, resolve: func(e *executor, _ any, args arguments) (any, error) {
+			domain, err := args.string("domain")
+			if err != nil {
+				return nil, err
+			}
+			if domain == "" {
+				return nil, errors.New("domain is missing")
+			}
+			switch err := e.handler.sites.Authorize(e.key, domain, sites.PermissionStats); {
+			case errors.Is(err, sites.ErrUnauthenticated):
+				return nil, err
+			case err != nil:
+				return nil, fmt.Errorf("access to %s is denied", domain)
+			}
+			return &site{domain: domain}, nil
+		}},
+	}
+
+	siteType.fields = map[string]*field{
+		"domain": {resolve: func(_ *executor, parent any, _ arguments) (any, error) {
+			return parent.(*site).domain, nil
+		}},
+		"timezone": {resolve: func(e *executor, parent any, _ arguments) (any, error) {
+			return e.handler.sites.Location(parent.(*site).domain).String(), nil
+		}},
+		"currentVisitors": {scans: true, resolve: func(e *executor, parent any, _ arguments) (any, error) {
+			domain := parent.(*site).domain
+			return prometheus.GetCurrentVisitors(e.ctx, e.handler.db, e.handler.sites.Key(domain), e.handler.sites.StatsSettings(domain), time.Now())
+		}},
+		"aggregate": {args: rangeArgs, typ: aggregateType, scans: true, resolve: func(e *executor, parent any, args arguments) (any, error) {
+			domain := parent.(*site).domain
+			from, to, err := e.timeRange(domain, args)
+			if err != nil {
+				return nil, err
+			}
+			match, err := filter(e.handler.sites.StatsSettings(domain), args)
+			if err != nil {
+				return nil, err
+			}
+			stats, err := e.stats(domain, from, to, match)
+			if err != nil {
+				return nil, err
+			}
+			return &rangeStats{stats: stats}, nil
+		}},
+		"timeseries": {args: append(slices.Clone(rangeArgs), "interval"), typ: bucketType, scans: true, resolve: func(e *executor, parent any, args arguments) (any, error) {
+			domain := parent.(*site).domain
+			from, to, err := e.timeRange(domain, args)
+			if err != nil {
+				return nil, err
+			}
+			if from.IsZero() || to.IsZero() {
+				return nil, errors.New("timeseries requires a bounded time range")
+			}
+			interval, err := args.string("interval")
+			if err != nil {
+				return nil, err
+			}
+			match, err := filter(e.handler.sites.StatsSettings(domain), args)
+			if err != nil {
+				return nil, err
+			}
+			buckets, err := buckets(from, to, e.handler.sites.Location(domain), interval)
+			if err != nil {
+				return nil, err
+			}
+			res := make([]any, 0, len(buckets))
+			for _, b := range buckets {
+				stats, err := e.stats(domain, b.from, b.to, match)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, &rangeStats{label: b.label, stats: stats})
+			}
+			return res, nil
+		}},
+		"breakdown": {args: append(slices.Clone(rangeArgs), "property", "limit"), typ: rowType, scans: true, resolve: func(e *executor, parent any, args arguments) (any, error) {
+			domain := parent.(*site).domain
+			from, to, err := e.timeRange(domain, args)
+			if err != nil {
+				return nil, err
+			}
+			property, err := args.string("property")
+			if err != nil {
+				return nil, err
+			}
+			limit, err := args.int("limit", defaultLimit)
+			if err != nil {
+				return nil, err
+			}
+			if limit < 1 || limit > maxLimit {
+				return nil, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+			}
+			match, err := filter(e.handler.sites.StatsSettings(domain), args)
+			if err != nil {
+				return nil, err
+			}
+			rows, err := e.breakdown(domain, property, from, to, match)
+			if err != nil {
+				return nil, err
+			}
+			res := make([]any, 0, min(limit, len(rows)))
+			for _, r := range rows[:min(limit, len(rows))] {
+				res = append(res, r)
+			}
+			return res, nil
+		}},
+	}
+
+	aggregateType.fields = map[string]*field{
+		"visitors": metric(func(s *prometheus.AnalyticsStats) any { return s.UniqueVisitors }),
+		"visits":   metric(func(s *prometheus.AnalyticsStats) any { return s.TotalVisits }),
+		"pageviews": metric(func(s *prometheus.AnalyticsStats) any {
+			return s.TotalPageViews
+		}),
+		"events": metric(func(s *prometheus.AnalyticsStats) any {
+			// every event is counted for its page
+			var events int64
+			for _, n := range s.PagesRate {
+				events += int64(n)
+			}
+			return events
+		}),
+		"bounceRate": metric(func(s *prometheus.AnalyticsStats) any { return s.BounceRate }),
+		"viewsPerVisit": metric(func(s *prometheus.AnalyticsStats) any {
+			if s.TotalVisits == 0 {
+				return 0.0
+			}
+			return math.Round(float64(s.TotalPageViews)/float64(s.TotalVisits)*100) / 100
+		}),
+	}
+
+	bucketType.fields = map[string]*field{
+		"date": {resolve: func(_ *executor, parent any, _ arguments) (any, error) {
+			return parent.(*rangeStats).label, nil
+		}},
+	}
+	for name, f := range aggregateType.fields {
+		bucketType.fields[name] = f
+	}
+
+	rowType.fields = map[string]*field{
+		"value":     {resolve: func(_ *executor, parent any, _ arguments) (any, error) { return parent.(*row).value, nil }},
+		"visitors":  {resolve: func(_ *executor, parent any, _ arguments) (any, error) { return parent.(*row).visitors, nil }},
+		"visits":    {resolve: func(_ *executor, parent any, _ arguments) (any, error) { return parent.(*row).visits, nil }},
+		"events":    {resolve: func(_ *executor, parent any, _ arguments) (any, error) { return parent.(*row).events, nil }},
+		"pageviews": {resolve: func(_ *executor, parent any, _ arguments) (any, error) { return parent.(*row).pageviews, nil }},
+	}
+}
+
+// metric returns the field of the metric of the stats of the aggregate and the bucket.
+func metric(value func(s *prometheus.AnalyticsStats) any) *field {
+	return &field{resolve: func(_ *executor, parent any, _ arguments) (any, error) {
+		return value(parent.(*rangeStats).stats), nil
+	}}
+}
+
+// timeRange returns the time range of the arguments, either of the named period or from and to,
+// the last 30 days by default.
+func (e *executor) timeRange(domain string, args arguments) (time.Time, time.Time, error) {
+	period, err := args.string("period")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	_, hasFrom := args["from"]
+	_, hasTo := args["to"]
+	loc := e.handler.sites.Location(domain)
+	if period != "" || !hasFrom && !hasTo {
+		if hasFrom || hasTo {
+			return time.Time{}, time.Time{}, errors.New("period cannot be combined with from and to")
+		}
+		if period == "" {
+			period = sites.Period30Days
+		}
+		return sites.PeriodRange(period, time.Now(), loc)
+	}
+
+	parseTime := func(name string) (time.Time, error) {
+		s, err := args.string(name)
+		if err != nil || s == "" {
+			return time.Time{}, err
+		}
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, nil
+		}
+		t, err := time.ParseInLocation(time.DateOnly, s, loc)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("argument %q must be an RFC 3339 timestamp or a date", name)
+		}
+		return t, nil
+	}
+	from, err := parseTime("from")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	to, err := parseTime("to")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return from, to, nil
+}
+
+// stats returns the stats of the events of the domain in the time range which match, all of them if match is nil.
+func (e *executor) stats(domain string, from, to time.Time, match func(ev *analytics.Event) bool) (*prometheus.AnalyticsStats, error) {
+	key, settings := e.handler.sites.Key(domain), e.handler.sites.StatsSettings(domain)
+	if match == nil {
+		return prometheus.GetAnalyticsStatsRange(e.ctx, e.handler.db, key, settings, from, to)
+	}
+	var events []*analytics.Event
+	err := e.handler.db.ForEach(e.ctx, key, from, to, func(ev *analytics.Event) error {
+		if match(ev) {
+			events = append(events, ev)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prometheus.CalculateAnalyticsStats(events, settings)
+}
+
+// properties return the values of the properties of the events, the same way as in the stats.
+func properties(settings sites.StatsSettings) map[string]func(ev *analytics.Event) (string, error) {
+	return map[string]func(ev *analytics.Event) (string, error){
+		"PAGE": func(ev *analytics.Event) (string, error) {
+			path, err := prometheus.PagePath(ev.GetURL())
+			return settings.URLRules.NormalizePath(path), err
+		},
+		"SOURCE":   prometheus.EventSource,
+		"REFERRER": prometheus.EventReferrer,
+		"DEVICE":   func(ev *analytics.Event) (string, error) { return prometheus.EventDevice(ev), nil },
+		"OS":       func(ev *analytics.Event) (string, error) { return prometheus.EventOS(ev), nil },
+		"BROWSER":  func(ev *analytics.Event) (string, error) { return prometheus.EventBrowser(ev), nil },
+		"EVENT":    func(ev *analytics.Event) (string, error) { return ev.GetType(), nil },
+	}
+}
+
+// filterFields are the properties of the fields of the filter.
+var filterFields = map[string]string{
+	"page":     "PAGE",
+	"source":   "SOURCE",
+	"referrer": "REFERRER",
+	"device":   "DEVICE",
+	"os":       "OS",
+	"browser":  "BROWSER",
+	"event":    "EVENT",
+}
+
+// filter returns the function matching the events with all the properties of the filter argument,
+// nil if it isn't set.
+func filter(settings sites.StatsSettings, args arguments) (func(ev *analytics.Event) bool, error) {
+	var fields map[string]value
+	switch v := args["filter"].(type) {
+	case nil:
+		return nil, nil
+	case map[string]value:
+		fields = v
+	default:
+		return nil, errors.New("argument \"filter\" must be an object")
+	}
+
+	props := properties(settings)
+	type condition struct {
+		value    func(ev *analytics.Event) (string, error)
+		expected string
+	}
+	conditions := make([]condition, 0, len(fields))
+	for name, v := range fields {
+		property, ok := filterFields[name]
+		if !ok {
+			return nil, fmt.Errorf("filter has no field %q", name)
+		}
+		if v == nil {
+			continue
+		}
+		expected, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("filter field %q must be a string", name)
+		}
+		conditions = append(conditions, condition{value: props[property], expected: expected})
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+	return func(ev *analytics.Event) bool {
+		for _, c := range conditions {
+			if v, err := c.value(ev); err != nil || v != c.expected {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// breakdown returns the rows of the values of the property of the matching events in the time range,
+// sorted by the visitors, or by the visits of the entry and the exit pages, and by the value on ties.
+func (e *executor) breakdown(domain string, property string, from, to time.Time, match func(ev *analytics.Event) bool) ([]*row, error) {
+	var rows []*row
+	if property == "ENTRY_PAGE" || property == "EXIT_PAGE" {
+		stats, err := e.stats(domain, from, to, match)
+		if err != nil {
+			return nil, err
+		}
+		rating := stats.EntryPagesRate
+		if property == "EXIT_PAGE" {
+			rating = stats.ExitPagesRate
+		}
+		for v, visits := range rating {
+			rows = append(rows, &row{value: v, visits: int64(visits)})
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			a, b := rows[i].visits.(int64), rows[j].visits.(int64)
+			return a > b || a == b && rows[i].value < rows[j].value
+		})
+		return rows, nil
+	}
+
+	value, ok := properties(e.handler.sites.StatsSettings(domain))[property]
+	if !ok {
+		return nil, fmt.Errorf("property %q is not supported", property)
+	}
+	type counts struct {
+		visitors  map[string]struct{}
+		anonymous int64
+		events    int64
+		pageviews int64
+	}
+	values := make(map[string]*counts)
+	err := e.handler.db.ForEach(e.ctx, e.handler.sites.Key(domain), from, to, func(ev *analytics.Event) error {
+		if match != nil && !match(ev) {
+			return nil
+		}
+		v, err := value(ev)
+		if err != nil || v == "" {
+			return err
+		}
+		c, ok := values[v]
+		if !ok {
+			c = &counts{visitors: make(map[string]struct{})}
+			values[v] = c
+		}
+		// the events without the visitor hash are of the unknown visitors, which are counted once each
+		if hash := ev.GetHashedVisit(); hash != "" {
+			c.visitors[hash] = struct{}{}
+		} else {
+			c.anonymous++
+		}
+		c.events++
+		if ev.GetType() == "pageview" {
+			c.pageviews++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for v, c := range values {
+		rows = append(rows, &row{value: v, visitors: int64(len(c.visitors)) + c.anonymous, events: c.events, pageviews: c.pageviews})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i].visitors.(int64), rows[j].visitors.(int64)
+		return a > b || a == b && rows[i].value < rows[j].value
+	})
+	return rows, nil
+}
+
+// bucket is a time range of the time series.
+type bucket struct {
+	label    string
+	from, to time.Time
+}
+
+// buckets splits the time range into the intervals in the site timezone, days by default.
+func buckets(from, to time.Time, loc *time.Location, interval string) ([]bucket, error) {
+	var (
+		start  time.Time
+		next   func(t time.Time) time.Time
+		layout string
+	)
+	from = from.In(loc)
+	switch interval {
+	case "HOUR":
+		start, layout = from.Truncate(time.Hour), "2006-01-02 15:00:00"
+		next = func(t time.Time) time.Time { return t.Add(time.Hour) }
+	case "DAY", "":
+		start, layout = sites.StartOfDay(from, loc), time.DateOnly
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case "MONTH":
+		day := sites.StartOfDay(from, loc)
+		start, layout = day.AddDate(0, 0, 1-day.Day()), time.DateOnly
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	default:
+		return nil, fmt.Errorf("interval %q is not supported", interval)
+	}
+
+	var res []bucket
+	for t := start; t.Before(to); t = next(t) {
+		if len(res) == maxBuckets {
+			return nil, fmt.Errorf("time range has more than %d intervals", maxBuckets)
+		}
+		// the first and the last buckets are cut to the time range
+		b := bucket{label: t.Format(layout), from: t, to: next(t)}
+		if b.from.Before(from) {
+			b.from = from
+		}
+		if b.to.After(to) {
+			b.to = to
+		}
+		res = append(res, b)
+	}
+	return res, nil
+}
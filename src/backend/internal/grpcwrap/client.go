@@ -1,6 +1,7 @@
 package grpcwrap
 
 import (
+	"context"
 	"crypto/tls"
 	grpcRetry "github.com/grpc-ecosystem/go-grpc-middleware/retry"
 	"google.golang.org/grpc"
@@ -9,8 +10,8 @@ import (
 	"time"
 )
 
-// NewClientConn returns new grpc.ClientConn instance.
-func NewClientConn(addr string, tlsEnabled bool) (*grpc.ClientConn, error) {
+// NewClientConn returns new grpc.ClientConn instance, extraOpts are applied after the default options.
+func NewClientConn(addr string, tlsEnabled bool, extraOpts ...grpc.DialOption) (*grpc.ClientConn, error) {
 	var newCredentials credentials.TransportCredentials
 	if tlsEnabled {
 		tlsConfig := &tls.Config{
@@ -29,14 +30,37 @@ func NewClientConn(addr string, tlsEnabled bool) (*grpc.ClientConn, error) {
 		grpcRetry.WithCodes(grpcRetry.DefaultRetriableCodes...),
 	}
 
-	conn, err := grpc.Dial(addr,
+	dialOpts := []grpc.DialOption{
 		grpc.WithTransportCredentials(newCredentials),
 		grpc.WithStreamInterceptor(grpcRetry.StreamClientInterceptor(opts...)),
 		grpc.WithUnaryInterceptor(grpcRetry.UnaryClientInterceptor(opts...)),
-	)
+	}
+	conn, err := grpc.Dial(addr, append(dialOpts, extraOpts...)...)
 	if err != nil {
 		return nil, err
 	}
 
 	return conn, nil
 }
+
+// WithAPIKey returns grpc.DialOption sending the API key as the bearer token with every call.
+//
+// An empty key sends nothing.
+func WithAPIKey(key string) grpc.DialOption {
+	if key == "" {
+		return grpc.EmptyDialOption{}
+	}
+	return grpc.WithPerRPCCredentials(apiKeyCredentials(key))
+}
+
+// apiKeyCredentials is credentials.PerRPCCredentials sending the API key.
+type apiKeyCredentials string
+
+func (k apiKeyCredentials) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(k)}, nil
+}
+
+// RequireTransportSecurity allows sending the key without TLS, e.g. to a local instance.
+func (k apiKeyCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -2,13 +2,24 @@ package grpcwrap
 
 import (
 	"context"
+	"diploma/analytics-exporter/internal/tracker"
 	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"net/http"
+	"net/textproto"
+	"strings"
 )
 
+// GatewayPath describes an additional plain HTTP endpoint served by the gateway.
+type GatewayPath struct {
+	Method  string
+	Pattern string
+	Handler runtime.HandlerFunc
+}
+
 // NewGatewayServer returns new grpc.ClientConn instance.
-func NewGatewayServer(gwAddr string, grpcAddr string, tlsEnabled bool) (*http.Server, error) {
+func NewGatewayServer(gwAddr string, grpcAddr string, tlsEnabled bool, paths ...GatewayPath) (*http.Server, error) {
 	// Create gRPC client connection
 	conn, err := NewClientConn(grpcAddr, tlsEnabled)
 	if err != nil {
@@ -16,12 +27,109 @@ func NewGatewayServer(gwAddr string, grpcAddr string, tlsEnabled bool) (*http.Se
 	}
 
 	// Register gRPC server endpoint
-	mux := runtime.NewServeMux()
+	mux := runtime.NewServeMux(runtime.WithIncomingHeaderMatcher(headerMatcher))
 	if err = analytics.RegisterAnalyticsHandler(context.Background(), mux, conn); err != nil {
 		return nil, err
 	}
+	if err = analytics.RegisterAdminHandler(context.Background(), mux, conn); err != nil {
+		return nil, err
+	}
+	client := analytics.NewAnalyticsClient(conn)
+	createEvent := func(r *http.Request, e *analytics.Event) error {
+		ctx, err := runtime.AnnotateContext(r.Context(), mux, r, analytics.Analytics_CreateEvent_FullMethodName)
+		if err != nil {
+			return err
+		}
+		_, err = client.CreateEvent(ctx, e)
+		return err
+	}
+	if err = registerGatewayPaths(mux, createEvent, paths); err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:    gwAddr,
+		Handler: mux,
+	}, nil
+}
+
+// NewInProcessGatewayServer returns new http.Server instance which calls srv directly,
+// skipping the loopback gRPC connection.
+//
+// The admin endpoints are served only if adminSrv is set.
+//
+// Note that gRPC interceptors are not applied to the calls made this way.
+func NewInProcessGatewayServer(gwAddr string, srv analytics.AnalyticsServer, adminSrv analytics.AdminServer, paths ...GatewayPath) (*http.Server, error) {
+	if srv == nil {
+		return nil, errors.New("analytics.AnalyticsServer instance is nil")
+	}
+
+	// Register handlers calling the server implementation
+	mux := runtime.NewServeMux(runtime.WithIncomingHeaderMatcher(headerMatcher))
+	if err := analytics.RegisterAnalyticsHandlerServer(context.Background(), mux, srv); err != nil {
+		return nil, err
+	}
+	if adminSrv != nil {
+		if err := analytics.RegisterAdminHandlerServer(context.Background(), mux, adminSrv); err != nil {
+			return nil, err
+		}
+	}
+	createEvent := func(r *http.Request, e *analytics.Event) error {
+		ctx, err := runtime.AnnotateIncomingContext(r.Context(), mux, r, analytics.Analytics_CreateEvent_FullMethodName)
+		if err != nil {
+			return err
+		}
+		_, err = srv.CreateEvent(ctx, e)
+		return err
+	}
+	if err := registerGatewayPaths(mux, createEvent, paths); err != nil {
+		return nil, err
+	}
 	return &http.Server{
 		Addr:    gwAddr,
 		Handler: mux,
 	}, nil
 }
+
+// headerMatcher passes the privacy signal headers of the visitors as the "dnt" and "sec-gpc" metadata,
+// the W3C trace context as the "traceparent" one, the device client hints as the "sec-ch-ua-mobile" and "sec-ch-ua-platform" ones
+// and the country headers set by the CDNs and the proxies as the "x-country-code" and "x-region-code" ones,
+// in addition to the headers passed by default.
+func headerMatcher(key string) (string, bool) {
+	switch textproto.CanonicalMIMEHeaderKey(key) {
+	case "Dnt", "Sec-Gpc", "Traceparent", "Sec-Ch-Ua-Mobile", "Sec-Ch-Ua-Platform":
+		return strings.ToLower(key), true
+	case "Cf-Ipcountry", "Cloudfront-Viewer-Country", "X-Country-Code":
+		return "x-country-code", true
+	case "Cloudfront-Viewer-Country-Region", "X-Region-Code":
+		return "x-region-code", true
+	default:
+		return runtime.DefaultHeaderMatcher(key)
+	}
+}
+
+// registerGatewayPaths registers plain HTTP endpoints served by the gateway next to the gRPC ones.
+func registerGatewayPaths(mux *runtime.ServeMux, createEvent tracker.EventCreator, paths []GatewayPath) error {
+	if err := mux.HandlePath("GET", tracker.ScriptPath, tracker.ScriptHandler); err != nil {
+		return err
+	}
+	if err := mux.HandlePath("GET", tracker.PixelPath, tracker.NewPixelHandler(createEvent)); err != nil {
+		return err
+	}
+	for _, method := range []string{"GET", "POST"} {
+		if err := mux.HandlePath(method, tracker.AMPPath, tracker.NewAMPHandler(createEvent)); err != nil {
+			return err
+		}
+	}
+	if err := mux.HandlePath("POST", tracker.SegmentPath, tracker.NewSegmentHandler(createEvent)); err != nil {
+		return err
+	}
+	if err := mux.HandlePath("POST", tracker.CloudflarePath, tracker.NewCloudflareHandler(createEvent)); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := mux.HandlePath(p.Method, p.Pattern, p.Handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
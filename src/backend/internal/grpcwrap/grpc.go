@@ -23,15 +23,22 @@ type Server struct {
 
 // NewServer returns new Server instance.
 //
-// This includes logging (with request duration time), tracing in case of errors, and a health check gRPC endpoint.
-func NewServer() (*Server, error) {
-	grpcSrv, hgSrv := setupGRPCServer()
+// This includes logging (with request duration time), tracing in case of errors, and a health check gRPC endpoint,
+// which reports NOT_SERVING until SetServing is called. opts are applied after the default ones,
+// e.g. the interceptors they chain run after the logging.
+func NewServer(opts ...grpc.ServerOption) (*Server, error) {
+	grpcSrv, hgSrv := setupGRPCServer(opts)
 	return &Server{
 		GRPCServer:       grpcSrv,
 		grpcHealthServer: hgSrv,
 	}, nil
 }
 
+// SetServing reports SERVING on the health check endpoint.
+func (s *Server) SetServing() {
+	s.grpcHealthServer.SetServingStatus("", healthPb.HealthCheckResponse_SERVING)
+}
+
 // Shutdown ensures Server graceful stop.
 func (s *Server) Shutdown() {
 	zap.L().Info("Shutting down gRPC server...")
@@ -40,7 +47,7 @@ func (s *Server) Shutdown() {
 }
 
 // setupGRPCServer sets up gRPC options, health check, tracing and logging.
-func setupGRPCServer() (*grpc.Server, *health.Server) {
+func setupGRPCServer(opts []grpc.ServerOption) (*grpc.Server, *health.Server) {
 	logger := zap.L()
 	// Make sure that log statements internal to gRPC library are logged using the logger as well.
 	grpcZap.ReplaceGrpcLoggerV2(logger)
@@ -81,10 +88,10 @@ func setupGRPCServer() (*grpc.Server, *health.Server) {
 		}),
 		grpc.MaxConcurrentStreams(50),
 	}
-	grpcSrv := grpc.NewServer(grpcOpts...)
+	grpcSrv := grpc.NewServer(append(grpcOpts, opts...)...)
 
 	grpcHealthSrv := health.NewServer()
-	grpcHealthSrv.SetServingStatus("", healthPb.HealthCheckResponse_SERVING)
+	grpcHealthSrv.SetServingStatus("", healthPb.HealthCheckResponse_NOT_SERVING)
 	healthPb.RegisterHealthServer(grpcSrv, grpcHealthSrv)
 
 	return grpcSrv, grpcHealthSrv
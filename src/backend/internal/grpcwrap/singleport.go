@@ -0,0 +1,31 @@
+package grpcwrap
+
+import (
+	"errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"net/http"
+	"strings"
+)
+
+// NewSinglePortHandler returns http.Handler serving gRPC requests with grpcSrv and the rest with next,
+// so that the gRPC server and the gateway share one listener.
+//
+// Plain text HTTP/2 (h2c) is accepted for the gRPC clients which don't use TLS.
+func NewSinglePortHandler(grpcSrv *grpc.Server, next http.Handler) (http.Handler, error) {
+	if grpcSrv == nil {
+		return nil, errors.New("grpc.Server instance is nil")
+	}
+	if next == nil {
+		return nil, errors.New("http.Handler instance is nil")
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcSrv.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return h2c.NewHandler(handler, &http2.Server{}), nil
+}
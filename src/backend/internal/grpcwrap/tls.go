@@ -0,0 +1,62 @@
+package grpcwrap
+
+import (
+	"crypto/tls"
+	"errors"
+	"golang.org/x/crypto/acme/autocert"
+	"net/http"
+)
+
+// TLSConfig holds the gateway HTTPS settings.
+//
+// Either a certificate/key pair or ACME hosts should be set, not both.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	// ACMEHosts enables automatic certificate management for the listed public hostnames.
+	ACMEHosts    []string
+	ACMECacheDir string
+	ACMEEmail    string
+}
+
+// Enabled reports whether the gateway should be served over HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || len(c.ACMEHosts) > 0
+}
+
+// EnableTLS configures srv to be served over HTTPS.
+//
+// When ACME hosts are configured, certificates are obtained from Let's Encrypt
+// using the TLS-ALPN-01 challenge, so srv must be reachable on port 443.
+// Use ServeTLS or ListenAndServeTLS to start the returned server: certificate files are passed
+// as is and are empty in ACME mode.
+func EnableTLS(srv *http.Server, cfg TLSConfig) (certFile string, keyFile string, err error) {
+	if srv == nil {
+		return "", "", errors.New("http.Server instance is nil")
+	}
+	if len(cfg.ACMEHosts) > 0 {
+		if cfg.CertFile != "" || cfg.KeyFile != "" {
+			return "", "", errors.New("certificate files cannot be used together with ACME")
+		}
+		if cfg.ACMECacheDir == "" {
+			return "", "", errors.New("ACME cache directory is empty")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEHosts...),
+			Cache:      autocert.DirCache(cfg.ACMECacheDir),
+			Email:      cfg.ACMEEmail,
+		}
+		srv.TLSConfig = m.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		return "", "", nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return "", "", errors.New("both certificate and key files must be set")
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	return cfg.CertFile, cfg.KeyFile, nil
+}
@@ -0,0 +1,181 @@
+// Package handoff passes the listening sockets to a new process of the service,
+// so the binary is restarted without refusing connections.
+//
+// The parent starts the child with the sockets inherited as the extra files, the child
+// uses them instead of binding the addresses, and the parent shuts down gracefully,
+// finishing the requests in flight while the child already accepts the new ones.
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// envListeners is the comma separated names of the inherited listeners, in the order of their descriptors.
+	envListeners = "ANALYTICS_HANDOFF_LISTENERS"
+	// envParent is the process ID of the parent which is stopped once the child is ready.
+	envParent = "ANALYTICS_HANDOFF_PARENT"
+	// firstFD is the descriptor of the first inherited listener, following stdin, stdout and stderr.
+	firstFD = 3
+)
+
+// Listeners creates the named listeners, reusing the ones inherited from the parent.
+//
+// It's safe for concurrent use.
+type Listeners struct {
+	mutex     sync.Mutex
+	inherited map[string]net.Listener
+	active    map[string]*net.TCPListener
+	names     []string
+	parent    int
+	handedOff bool
+}
+
+// New returns new Listeners instance holding the listeners inherited from the parent, if any.
+func New() (*Listeners, error) {
+	h := &Listeners{
+		inherited: make(map[string]net.Listener),
+		active:    make(map[string]*net.TCPListener),
+	}
+	if v := os.Getenv(envParent); v != "" {
+		parent, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envParent, err)
+		}
+		h.parent = parent
+	}
+	names := os.Getenv(envListeners)
+	// Don't pass the variables to the processes started by the service
+	_ = os.Unsetenv(envListeners)
+	_ = os.Unsetenv(envParent)
+	if names == "" {
+		return h, nil
+	}
+
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(firstFD+i), name)
+		if f == nil {
+			return nil, fmt.Errorf("inherited listener %s is missing", name)
+		}
+		l, err := net.FileListener(f)
+		// The listener holds its own copy of the descriptor
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot use inherited listener %s: %w", name, err)
+		}
+		h.inherited[name] = l
+	}
+	h.handedOff = true
+	return h, nil
+}
+
+// Inherited reports whether the listeners are inherited from the parent.
+func (h *Listeners) Inherited() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.handedOff
+}
+
+// Listen returns the listener inherited under the name, or listens on the TCP address.
+func (h *Listeners) Listen(name string, addr string) (net.Listener, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.active[name]; ok {
+		return nil, fmt.Errorf("listener %s already exists", name)
+	}
+	l, ok := h.inherited[name]
+	if ok {
+		delete(h.inherited, name)
+	} else {
+		var err error
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	tcp, ok := l.(*net.TCPListener)
+	if !ok {
+		_ = l.Close()
+		return nil, fmt.Errorf("listener %s is not a TCP listener", name)
+	}
+	h.active[name] = tcp
+	h.names = append(h.names, name)
+	return tcp, nil
+}
+
+// Restart starts a new process of the same binary with the same arguments, passing it the listeners.
+//
+// The caller is expected to shut down gracefully once the child calls Ready.
+func (h *Listeners) Restart() (*os.Process, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.names) == 0 {
+		return nil, errors.New("no listeners to pass")
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, len(h.names))
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, name := range h.names {
+		f, err := h.active[name].File()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get descriptor of listener %s: %w", name, err)
+		}
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+strings.Join(h.names, ","),
+		envParent+"="+strconv.Itoa(os.Getpid()),
+	)
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
+
+// Ready asks the parent to shut down, as the child accepts the connections now,
+// and closes the inherited listeners which weren't used.
+//
+// The parent isn't signaled if the process isn't started by Restart.
+func (h *Listeners) Ready() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// The inherited listeners which aren't configured anymore
+	for name, l := range h.inherited {
+		_ = l.Close()
+		delete(h.inherited, name)
+	}
+	if h.parent == 0 {
+		return nil
+	}
+	parent := h.parent
+	h.parent = 0
+	// The parent might have been replaced in the meantime, e.g. if it was killed
+	if os.Getppid() != parent {
+		return fmt.Errorf("parent %d is gone", parent)
+	}
+	return syscall.Kill(parent, syscall.SIGTERM)
+}
@@ -0,0 +1,132 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"strconv"
+	"time"
+)
+
+// parseGoogleAnalytics converts the table of the Google Analytics CSV export.
+//
+// GA4 BigQuery event exports flattened to the event_timestamp, event_name, user_pseudo_id,
+// page_location, page_referrer, device_category, browser and operating_system columns
+// are converted into events. Universal Analytics reports by date are converted into daily rollups.
+func parseGoogleAnalytics(domain string, t *table) (*Result, error) {
+	switch {
+	case t.has("event_timestamp", "event_name", "user_pseudo_id"):
+		return parseGA4Events(domain, t)
+	case t.has("date") || t.has("day index"):
+		return parseUAReport(domain, t)
+	default:
+		return nil, errors.New("unsupported Google Analytics export: neither GA4 events nor a report by date")
+	}
+}
+
+// parseGA4Events converts the GA4 BigQuery events into events.
+//
+// The visit hash is derived from the pseudo user identifier and the day, as the daily salt would do.
+func parseGA4Events(domain string, t *table) (*Result, error) {
+	res := &Result{Events: make([]*analytics.Event, 0, len(t.rows))}
+	for _, row := range t.rows {
+		// event_timestamp is in microseconds
+		micros, err := strconv.ParseInt(t.get(row, "event_timestamp"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event_timestamp: %w", err)
+		}
+		ts := time.UnixMicro(micros).UTC()
+
+		eventType := t.get(row, "event_name")
+		if eventType == "page_view" {
+			eventType = "pageview"
+		}
+
+		h := sha256.Sum256([]byte(ts.Format(time.DateOnly) + domain + t.get(row, "user_pseudo_id")))
+
+		res.Events = append(res.Events, &analytics.Event{
+			ID:          uuid.New().String(),
+			Type:        eventType,
+			URL:         t.get(row, "page_location"),
+			Domain:      domain,
+			Referrer:    t.get(row, "page_referrer"),
+			Browser:     t.get(row, "browser"),
+			OS:          t.get(row, "operating_system"),
+			Device:      gaDevice(t.get(row, "device_category")),
+			HashedVisit: hex.EncodeToString(h[:]),
+			Timestamp:   timestamppb.New(ts),
+		})
+	}
+	return res, nil
+}
+
+// gaDevice returns the device of the GA device category.
+func gaDevice(category string) *analytics.Device {
+	switch category {
+	case "desktop":
+		return &analytics.Device{Device: &analytics.Device_Desktop{Desktop: true}}
+	case "mobile":
+		return &analytics.Device{Device: &analytics.Device_Mobile{Mobile: true}}
+	case "tablet":
+		return &analytics.Device{Device: &analytics.Device_Tablet{Tablet: true}}
+	default:
+		return &analytics.Device{Device: &analytics.Device_Unknown{Unknown: true}}
+	}
+}
+
+// parseUAReport converts the Universal Analytics report by date into daily rollups.
+//
+// Reports with the page or the source dimension fill the top pages and sources of the day.
+func parseUAReport(domain string, t *table) (*Result, error) {
+	dateColumn := "date"
+	if !t.has(dateColumn) {
+		dateColumn = "day index"
+	}
+
+	rollups := newDailyRollups(domain)
+	for _, row := range t.rows {
+		// Reports end with the totals row without a date
+		if t.get(row, dateColumn) == "" {
+			continue
+		}
+		date, err := parseDate(t.get(row, dateColumn))
+		if err != nil {
+			return nil, err
+		}
+		r := rollups.day(date)
+
+		users, err := t.getInt(row, "users")
+		if err != nil {
+			return nil, err
+		}
+		sessions, err := t.getInt(row, "sessions")
+		if err != nil {
+			return nil, err
+		}
+		pageviews, err := t.getInt(row, "pageviews")
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case t.has("page"):
+			r.TopPages[t.get(row, "page")] += int(pageviews)
+		case t.has("source"):
+			source := t.get(row, "source")
+			if source == "(direct)" {
+				source = "Direct/None"
+			}
+			r.TopSources[source] += int(sessions)
+		default:
+			r.Visitors += users
+			r.Visits += sessions
+			r.Pageviews += pageviews
+		}
+	}
+
+	return rollups.result(), nil
+}
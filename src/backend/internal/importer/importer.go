@@ -0,0 +1,177 @@
+// Package importer converts the data exported from other analytics into events and rollups.
+package importer
+
+import (
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Source is the analytics the data was exported from.
+type Source string
+
+const (
+	SourcePlausible       Source = "plausible"
+	SourceGoogleAnalytics Source = "ga"
+	SourceJSONL           Source = "jsonl"
+	SourceMatomo          Source = "matomo"
+)
+
+// Result holds the imported data.
+//
+// Aggregated exports are converted into daily rollups, raw exports into events.
+// They are scoped to the tenant of the site by Store.
+type Result struct {
+	Events  []*analytics.Event
+	Rollups []*database.Rollup
+}
+
+// Parse converts the file of the source export into the data of the domain.
+//
+// The files of the own JSONL export are read as is, Matomo exports are JSON visits or CSV dumps,
+// the other exports are CSV files.
+// name is the exported file name, Plausible tables are detected by it.
+func Parse(source Source, domain string, name string, r io.Reader) (*Result, error) {
+	if domain == "" {
+		return nil, errors.New("domain is missing")
+	}
+	switch source {
+	case SourceJSONL:
+		return parseJSONL(domain, r)
+	case SourceMatomo:
+		return parseMatomo(domain, r)
+	}
+
+	table, err := readTable(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch source {
+	case SourcePlausible:
+		return parsePlausible(domain, name, table)
+	case SourceGoogleAnalytics:
+		return parseGoogleAnalytics(domain, table)
+	default:
+		return nil, fmt.Errorf("unsupported import source %q", source)
+	}
+}
+
+// table is a CSV file with the columns indexed by their names.
+type table struct {
+	columns map[string]int
+	rows    [][]string
+}
+
+// readTable reads the CSV file, skipping the comment lines starting with #.
+func readTable(r io.Reader) (*table, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CSV: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("CSV file is empty")
+	}
+
+	t := &table{
+		columns: make(map[string]int, len(records[0])),
+		rows:    records[1:],
+	}
+	for i, name := range records[0] {
+		t.columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	return t, nil
+}
+
+// has reports whether the table has all the columns.
+func (t *table) has(columns ...string) bool {
+	for _, c := range columns {
+		if _, ok := t.columns[c]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns the value of the row column, or an empty string if there is no such column.
+func (t *table) get(row []string, column string) string {
+	i, ok := t.columns[column]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// getInt returns the integer value of the row column, ignoring the thousands separators.
+//
+// Zero is returned if there is no such column.
+func (t *table) getInt(row []string, column string) (int64, error) {
+	v := strings.ReplaceAll(t.get(row, column), ",", "")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value %q: %w", column, v, err)
+	}
+	return n, nil
+}
+
+// dailyRollups collects the daily rollups of the domain by their dates.
+type dailyRollups struct {
+	domain  string
+	rollups map[time.Time]*database.Rollup
+}
+
+// newDailyRollups returns new dailyRollups instance.
+func newDailyRollups(domain string) *dailyRollups {
+	return &dailyRollups{
+		domain:  domain,
+		rollups: make(map[time.Time]*database.Rollup),
+	}
+}
+
+// day returns the rollup of the day, creating it if needed.
+func (d *dailyRollups) day(date time.Time) *database.Rollup {
+	if r, ok := d.rollups[date]; ok {
+		return r
+	}
+	r := &database.Rollup{
+		Domain:     d.domain,
+		Period:     database.RollupDaily,
+		Start:      date,
+		TopPages:   make(map[string]int),
+		TopSources: make(map[string]int),
+	}
+	d.rollups[date] = r
+	return r
+}
+
+// result returns the collected rollups.
+func (d *dailyRollups) result() *Result {
+	res := &Result{Rollups: make([]*database.Rollup, 0, len(d.rollups))}
+	for _, r := range d.rollups {
+		res.Rollups = append(res.Rollups, r)
+	}
+	return res
+}
+
+// parseDate parses the date in one of the formats used by the exports.
+func parseDate(v string) (time.Time, error) {
+	for _, layout := range []string{time.DateOnly, "20060102", "1/2/06", "01/02/2006"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", v)
+}
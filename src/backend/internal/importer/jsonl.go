@@ -0,0 +1,39 @@
+package importer
+
+import (
+	"bufio"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+)
+
+// maxJSONLLine is the maximum length of a single event in the JSONL export.
+const maxJSONLLine = 1 << 20
+
+// parseJSONL reads the events of the JSONL export, keeping their identifiers and timestamps.
+//
+// The events are imported for the domain regardless of the one they were exported from.
+func parseJSONL(domain string, r io.Reader) (*Result, error) {
+	res := &Result{Events: make([]*analytics.Event, 0)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJSONLLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e := &analytics.Event{}
+		if err := protojson.Unmarshal(scanner.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if e.GetTimestamp() == nil {
+			return nil, fmt.Errorf("line %d: timestamp is missing", line)
+		}
+		e.Domain = domain
+		res.Events = append(res.Events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
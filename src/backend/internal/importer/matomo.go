@@ -0,0 +1,242 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matomoVisit is the part of the visit of the Matomo Live.getLastVisitsDetails API mapped into the events.
+type matomoVisit struct {
+	VisitorID           string         `json:"visitorId"`
+	DeviceType          string         `json:"deviceType"`
+	OperatingSystemName string         `json:"operatingSystemName"`
+	BrowserName         string         `json:"browserName"`
+	ReferrerURL         string         `json:"referrerUrl"`
+	ActionDetails       []matomoAction `json:"actionDetails"`
+}
+
+// matomoAction is the part of the action of the Matomo visit mapped into the event.
+type matomoAction struct {
+	Type          string          `json:"type"`
+	URL           string          `json:"url"`
+	Timestamp     json.RawMessage `json:"timestamp"`
+	EventCategory string          `json:"eventCategory"`
+	EventAction   string          `json:"eventAction"`
+	EventName     string          `json:"eventName"`
+}
+
+// parseMatomo converts the Matomo raw data export into events.
+//
+// The visits of the Live.getLastVisitsDetails API are read from the JSON array or from the JSONL file
+// of a visit per line. Their page actions are converted into the pageviews, the events into the events
+// of the event action with the category and the name props, the downloads and the outlinks into
+// the "download" and the "outbound" events like the tracker script sends, the other actions are skipped.
+//
+// The database dumps are CSV files of the actions joined with their visits, e.g. of
+//
+//	SELECT hex(v.idvisitor) AS idvisitor, a.server_time, u.name AS url, v.referer_url,
+//	       v.config_browser_name AS browser, v.config_os AS os, v.config_device_type AS device_type
+//	FROM matomo_log_link_visit_action a
+//	JOIN matomo_log_visit v ON v.idvisit = a.idvisit
+//	JOIN matomo_log_action u ON u.idaction = a.idaction_url
+//
+// which are all converted into the pageviews.
+//
+// The visit hash is derived from the visitor identifier and the day, as the daily salt would do.
+func parseMatomo(domain string, r io.Reader) (*Result, error) {
+	br := bufio.NewReader(r)
+	first, err := firstByte(br)
+	if err != nil {
+		return nil, err
+	}
+	switch first {
+	case '[':
+		var visits []*matomoVisit
+		if err := json.NewDecoder(br).Decode(&visits); err != nil {
+			return nil, fmt.Errorf("invalid Matomo visits: %w", err)
+		}
+		return matomoVisitsEvents(domain, visits)
+	case '{':
+		var visits []*matomoVisit
+		dec := json.NewDecoder(br)
+		for {
+			v := &matomoVisit{}
+			err := dec.Decode(v)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid Matomo visit: %w", err)
+			}
+			visits = append(visits, v)
+		}
+		return matomoVisitsEvents(domain, visits)
+	default:
+		t, err := readTable(br)
+		if err != nil {
+			return nil, err
+		}
+		return parseMatomoDump(domain, t)
+	}
+}
+
+// firstByte returns the first byte of r which isn't a white space, without consuming it.
+func firstByte(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if errors.Is(err, io.EOF) {
+			return 0, errors.New("Matomo export is empty")
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			return b[0], nil
+		}
+		_, _ = r.ReadByte()
+	}
+}
+
+// matomoVisitsEvents converts the actions of the visits into events.
+func matomoVisitsEvents(domain string, visits []*matomoVisit) (*Result, error) {
+	res := &Result{Events: make([]*analytics.Event, 0, len(visits))}
+	for _, v := range visits {
+		if v == nil {
+			continue
+		}
+		// The first action is referred by the referrer of the visit, the next ones by the previous page
+		referrer, page := v.ReferrerURL, ""
+		for _, a := range v.ActionDetails {
+			ts, err := matomoTimestamp(a.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+			e := &analytics.Event{
+				ID:          uuid.New().String(),
+				Domain:      domain,
+				URL:         a.URL,
+				Referrer:    referrer,
+				Browser:     v.BrowserName,
+				OS:          v.OperatingSystemName,
+				Device:      matomoDevice(v.DeviceType),
+				HashedVisit: matomoVisitHash(domain, v.VisitorID, ts),
+				Timestamp:   timestamppb.New(ts),
+			}
+			switch a.Type {
+			case "action":
+				e.Type = "pageview"
+				referrer, page = a.URL, a.URL
+			case "event":
+				e.Type = a.EventAction
+				e.URL = page
+				e.Props = map[string]string{"category": a.EventCategory, "name": a.EventName}
+			case "download", "outlink":
+				e.Type = "download"
+				if a.Type == "outlink" {
+					e.Type = "outbound"
+				}
+				e.URL = page
+				e.Props = map[string]string{"url": a.URL}
+			default:
+				continue
+			}
+			// The events before the first pageview are recorded for the link or skipped
+			if e.URL == "" {
+				e.URL = a.URL
+			}
+			if e.Type == "" || e.URL == "" {
+				continue
+			}
+			res.Events = append(res.Events, e)
+		}
+	}
+	return res, nil
+}
+
+// parseMatomoDump converts the actions of the database dump into the pageviews.
+func parseMatomoDump(domain string, t *table) (*Result, error) {
+	if !t.has("idvisitor", "server_time", "url") {
+		return nil, errors.New("unsupported Matomo export: neither visits of the API nor actions with idvisitor, server_time and url")
+	}
+	res := &Result{Events: make([]*analytics.Event, 0, len(t.rows))}
+	for _, row := range t.rows {
+		ts, err := time.Parse(time.DateTime, t.get(row, "server_time"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid server_time: %w", err)
+		}
+		url := t.get(row, "url")
+		// The URLs are stored without the scheme
+		if url != "" && !strings.Contains(url, "://") {
+			url = "https://" + url
+		}
+		res.Events = append(res.Events, &analytics.Event{
+			ID:          uuid.New().String(),
+			Type:        "pageview",
+			Domain:      domain,
+			URL:         url,
+			Referrer:    t.get(row, "referer_url"),
+			Browser:     t.get(row, "browser"),
+			OS:          t.get(row, "os"),
+			Device:      matomoDeviceType(t.get(row, "device_type")),
+			HashedVisit: matomoVisitHash(domain, t.get(row, "idvisitor"), ts),
+			Timestamp:   timestamppb.New(ts),
+		})
+	}
+	return res, nil
+}
+
+// matomoTimestamp parses the Unix timestamp of the action, which is a number or a string.
+func matomoTimestamp(raw json.RawMessage) (time.Time, error) {
+	v := string(bytes.Trim(raw, `"`))
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid action timestamp %q", v)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// matomoVisitHash returns the visit hash of the visitor on the day of ts.
+func matomoVisitHash(domain string, visitor string, ts time.Time) string {
+	h := sha256.Sum256([]byte(ts.Format(time.DateOnly) + domain + visitor))
+	return hex.EncodeToString(h[:])
+}
+
+// matomoDevice returns the device of the Matomo device type name.
+func matomoDevice(deviceType string) *analytics.Device {
+	switch deviceType {
+	case "Desktop":
+		return &analytics.Device{Device: &analytics.Device_Desktop{Desktop: true}}
+	case "Smartphone", "Phablet", "Feature phone":
+		return &analytics.Device{Device: &analytics.Device_Mobile{Mobile: true}}
+	case "Tablet":
+		return &analytics.Device{Device: &analytics.Device_Tablet{Tablet: true}}
+	default:
+		return &analytics.Device{Device: &analytics.Device_Unknown{Unknown: true}}
+	}
+}
+
+// matomoDeviceType returns the device of the config_device_type code of the database.
+func matomoDeviceType(code string) *analytics.Device {
+	switch code {
+	case "0":
+		return matomoDevice("Desktop")
+	case "1", "3", "10":
+		return matomoDevice("Smartphone")
+	case "2":
+		return matomoDevice("Tablet")
+	default:
+		return &analytics.Device{Device: &analytics.Device_Unknown{Unknown: true}}
+	}
+}
@@ -0,0 +1,66 @@
+package importer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Plausible export tables, the exported file names start with them.
+const (
+	plausibleVisitors = "imported_visitors"
+	plausiblePages    = "imported_pages"
+	plausibleSources  = "imported_sources"
+)
+
+// parsePlausible converts the table of the Plausible CSV export into daily rollups.
+//
+// Only the visitors, pages and sources tables are imported.
+func parsePlausible(domain string, name string, t *table) (*Result, error) {
+	if !t.has("date") {
+		return nil, fmt.Errorf("%s: date column is missing", name)
+	}
+
+	base := filepath.Base(name)
+	rollups := newDailyRollups(domain)
+	for _, row := range t.rows {
+		date, err := parseDate(t.get(row, "date"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		r := rollups.day(date)
+
+		switch {
+		case strings.HasPrefix(base, plausibleVisitors):
+			if r.Visitors, err = t.getInt(row, "visitors"); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if r.Visits, err = t.getInt(row, "visits"); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if r.Pageviews, err = t.getInt(row, "pageviews"); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		case strings.HasPrefix(base, plausiblePages):
+			pageviews, err := t.getInt(row, "pageviews")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			r.TopPages[t.get(row, "page")] += int(pageviews)
+		case strings.HasPrefix(base, plausibleSources):
+			visits, err := t.getInt(row, "visits")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			source := t.get(row, "source")
+			if source == "" {
+				source = "Direct/None"
+			}
+			r.TopSources[source] += int(visits)
+		default:
+			return nil, fmt.Errorf("%s: unsupported Plausible table", name)
+		}
+	}
+
+	return rollups.result(), nil
+}
@@ -0,0 +1,79 @@
+package importer
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/rollup"
+	"diploma/analytics-exporter/internal/sites"
+	"fmt"
+	"time"
+)
+
+// Store stores the imported data of the site and returns the amount of the stored rollups.
+//
+// The rollups of the days of the imported events in loc, the site timezone, are recalculated with the stats
+// settings of the site.
+// Imported rollups are merged into the stored ones, so the tables of an export can be imported one by one,
+// their dates are the days in loc as the analytics exports report them in the site timezone.
+func Store(ctx context.Context, db database.Database, site sites.Key, loc *time.Location, settings sites.StatsSettings, res *Result) (int, error) {
+	rollups := make([]*database.Rollup, 0, len(res.Rollups))
+	if len(res.Events) > 0 {
+		for _, e := range res.Events {
+			e.Tenant = site.Tenant
+			e.Domain = site.Domain
+		}
+		if err := db.InsertBatch(ctx, res.Events); err != nil {
+			return 0, fmt.Errorf("cannot insert imported events: %w", err)
+		}
+
+		days := make(map[time.Time]struct{})
+		for _, e := range res.Events {
+			days[sites.StartOfDay(e.GetTimestamp().AsTime(), loc)] = struct{}{}
+		}
+		for day := range days {
+			events, err := db.ListRange(ctx, site, day, day.AddDate(0, 0, 1))
+			if err != nil {
+				return 0, fmt.Errorf("cannot list imported events: %w", err)
+			}
+			dayRollups, err := rollup.Calculate(site, loc, settings, events.GetEvents())
+			if err != nil {
+				return 0, fmt.Errorf("cannot roll up imported events: %w", err)
+			}
+			// The hours crossing the day boundaries in the zones of the half hour offsets are partial
+			for _, r := range dayRollups {
+				if r.Period == database.RollupHourly && (r.Start.Before(day) || r.Start.Add(time.Hour).After(day.AddDate(0, 0, 1))) {
+					continue
+				}
+				rollups = append(rollups, r)
+			}
+		}
+	}
+
+	for _, imported := range res.Rollups {
+		if imported.Period == database.RollupDaily {
+			year, month, day := imported.Start.Date()
+			imported.Start = time.Date(year, month, day, 0, 0, 0, 0, loc)
+		}
+		imported.ID = database.RollupID(site, imported.Period, imported.Start)
+		imported.Tenant = site.Tenant
+		imported.Domain = site.Domain
+		stored, err := db.ListRollups(ctx, site, imported.Period, imported.Start, imported.Start.Add(time.Nanosecond))
+		if err != nil {
+			return 0, fmt.Errorf("cannot list stored rollups: %w", err)
+		}
+		if len(stored) > 0 {
+			// Stored rollups must not be modified in place
+			merged := *stored[0]
+			rollup.Merge(&merged, imported)
+			imported = &merged
+		} else {
+			rollup.Merge(imported, &database.Rollup{})
+		}
+		rollups = append(rollups, imported)
+	}
+	if err := db.UpsertRollups(ctx, rollups); err != nil {
+		return 0, fmt.Errorf("cannot store imported rollups: %w", err)
+	}
+
+	return len(rollups), nil
+}
@@ -0,0 +1,446 @@
+// Package ingest implements an asynchronous buffered ingestion pipeline.
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"os"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy defines what happens to the inserted event when the queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock blocks the caller until there is space in the queue.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest drops the oldest queued event to make space for the new one.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowReject rejects the new event with codes.ResourceExhausted.
+	OverflowReject OverflowPolicy = "reject"
+)
+
+// Config holds the pipeline settings.
+type Config struct {
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	Workers       int
+	Overflow      OverflowPolicy
+
+	// WALPath is the path of the write-ahead log file for the queued events.
+	// The log is disabled if the path is empty.
+	WALPath string
+}
+
+// The batches failed with a transient error are retried after the backoff doubling
+// from minRetryBackoff up to maxRetryBackoff, maxInsertAttempts times at most.
+const (
+	minRetryBackoff   = time.Second
+	maxRetryBackoff   = 30 * time.Second
+	maxInsertAttempts = 6
+)
+
+// ErrClosed is returned by Insert once the pipeline is shutting down.
+var ErrClosed = status.Error(codes.Unavailable, "ingestion pipeline is shut down")
+
+// item is an event waiting in the queue.
+type item struct {
+	event    *analytics.Event
+	enqueued time.Time
+}
+
+// Pipeline is database.Database which queues inserted events and
+// batch-inserts them into the underlying database from the background workers.
+//
+// All the other operations are passed to the underlying database as is.
+type Pipeline struct {
+	database.Database
+
+	cfg   Config
+	queue chan item
+	wal   *wal
+	// mutex guards closing, the queue is sent to under the read lock only, so it isn't closed meanwhile
+	mutex   sync.RWMutex
+	closing bool
+	// stopping is closed on shutdown, so the failed batches aren't retried anymore
+	stopping chan struct{}
+	wg       sync.WaitGroup
+	logger   *zap.Logger
+
+	enqueuedTotal prometheus.Counter
+	insertedTotal prometheus.Counter
+	failedTotal   prometheus.Counter
+	droppedTotal  *prometheus.CounterVec
+	batchSize     prometheus.Histogram
+	latency       prometheus.Histogram
+}
+
+// Validate reports the first invalid setting of the configuration.
+func (cfg Config) Validate() error {
+	if cfg.QueueSize <= 0 {
+		return errors.New("queue size must be positive")
+	}
+	if cfg.BatchSize <= 0 {
+		return errors.New("batch size must be positive")
+	}
+	if cfg.FlushInterval <= 0 {
+		return errors.New("flush interval must be positive")
+	}
+	if cfg.Workers <= 0 {
+		return errors.New("workers amount must be positive")
+	}
+	switch cfg.Overflow {
+	case OverflowBlock, OverflowDropOldest, OverflowReject, "":
+	default:
+		return fmt.Errorf("unsupported overflow policy %q", cfg.Overflow)
+	}
+	return nil
+}
+
+// NewPipeline returns new Pipeline instance and starts its workers.
+func NewPipeline(db database.Database, cfg Config) (*Pipeline, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Overflow == "" {
+		cfg.Overflow = OverflowBlock
+	}
+
+	p := &Pipeline{
+		Database: db,
+		cfg:      cfg,
+		queue:    make(chan item, cfg.QueueSize),
+		stopping: make(chan struct{}),
+		logger:   zap.L().Named("ingest"),
+		enqueuedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ingest_events_enqueued_total",
+			Help: "Total number of events accepted into the ingestion queue",
+		}),
+		insertedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ingest_events_inserted_total",
+			Help: "Total number of events inserted into the database by the ingestion pipeline",
+		}),
+		failedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ingest_events_failed_total",
+			Help: "Total number of events the ingestion pipeline failed to insert, counted on every attempt",
+		}),
+		droppedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ingest_events_dropped_total",
+			Help: "Total number of events dropped because the ingestion queue was full or they couldn't be inserted",
+		}, []string{"reason"}),
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ingest_batch_size",
+			Help:    "Number of events inserted per batch",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ingest_latency_seconds",
+			Help:    "Time from accepting an event to inserting it into the database",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	prometheus.MustRegister(
+		p.enqueuedTotal,
+		p.insertedTotal,
+		p.failedTotal,
+		p.droppedTotal,
+		p.batchSize,
+		p.latency,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ingest_queue_depth",
+			Help: "Number of events waiting in the ingestion queue",
+		}, func() float64 {
+			return float64(len(p.queue))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ingest_queue_capacity",
+			Help: "Maximum number of events waiting in the ingestion queue",
+		}, func() float64 {
+			return float64(cap(p.queue))
+		}),
+	)
+
+	var replayed []*analytics.Event
+	if cfg.WALPath != "" {
+		w, events, err := openWAL(cfg.WALPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open the write-ahead log: %w", err)
+		}
+		p.wal, replayed = w, events
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+
+	// The events left from the previous run are already logged, they are queued before any new ones
+	if len(replayed) > 0 {
+		p.logger.Info("Replaying the write-ahead log", zap.Int("events", len(replayed)))
+		now := time.Now()
+		for _, e := range replayed {
+			p.queue <- item{event: e, enqueued: now}
+		}
+	}
+
+	return p, nil
+}
+
+// Insert queues the event for the insertion.
+//
+// When the queue is full, the configured OverflowPolicy is applied.
+// ErrClosed is returned once Shutdown is called.
+func (p *Pipeline) Insert(ctx context.Context, msg *analytics.Event) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.closing {
+		return ErrClosed
+	}
+
+	it := item{event: msg, enqueued: time.Now()}
+
+	// Log the event before it becomes visible to the workers
+	if p.wal != nil {
+		if err := p.wal.append(msg); err != nil {
+			return fmt.Errorf("cannot write the event to the write-ahead log: %w", err)
+		}
+	}
+
+	switch p.cfg.Overflow {
+	case OverflowReject:
+		select {
+		case p.queue <- it:
+		default:
+			p.droppedTotal.WithLabelValues("rejected").Inc()
+			p.ack(msg)
+			return status.Error(codes.ResourceExhausted, "ingestion queue is full")
+		}
+	case OverflowDropOldest:
+		for queued := false; !queued; {
+			select {
+			case p.queue <- it:
+				queued = true
+			default:
+				// Make space by dropping the oldest event, unless a worker has already taken it
+				select {
+				case dropped := <-p.queue:
+					p.droppedTotal.WithLabelValues("dropped_oldest").Inc()
+					p.ack(dropped.event)
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case p.queue <- it:
+		case <-ctx.Done():
+			p.ack(msg)
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+
+	p.enqueuedTotal.Inc()
+	return nil
+}
+
+// Shutdown stops accepting events and waits until the queued ones are inserted or ctx is done.
+func (p *Pipeline) Shutdown(ctx context.Context) error {
+	p.logger.Info("Shutting down ingestion pipeline...")
+	close(p.stopping)
+
+	// Wait for the inserts sending to the queue, the workers keep draining it meanwhile
+	p.mutex.Lock()
+	p.closing = true
+	close(p.queue)
+	p.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		if p.wal != nil {
+			return p.wal.close()
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ack removes the events from the write-ahead log, if it is enabled.
+func (p *Pipeline) ack(events ...*analytics.Event) {
+	if p.wal == nil {
+		return
+	}
+	if err := p.wal.ack(events); err != nil {
+		p.logger.Error("cannot acknowledge events in the write-ahead log", zap.Error(err))
+	}
+}
+
+// work collects queued events into batches and flushes them
+// once the batch is full or the flush interval has passed.
+func (p *Pipeline) work() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]item, 0, p.cfg.BatchSize)
+	for {
+		select {
+		case it, ok := <-p.queue:
+			if !ok {
+				p.flush(batch)
+				return
+			}
+			batch = append(batch, it)
+			if len(batch) >= p.cfg.BatchSize {
+				p.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			p.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush inserts the batch into the underlying database.
+//
+// The events of the batch failed permanently are inserted one by one, so only the invalid ones are dropped.
+// The events failed with a transient error on every attempt are dropped too, unless the pipeline is shutting down:
+// then they stay in the write-ahead log to be replayed on the next start.
+func (p *Pipeline) flush(batch []item) {
+	if len(batch) == 0 {
+		return
+	}
+
+	events := make([]*analytics.Event, len(batch))
+	for i, it := range batch {
+		events[i] = it.event
+	}
+	err := p.insert(events)
+	switch {
+	case err == nil:
+	case permanent(err) && len(batch) > 1:
+		p.logger.Warn("cannot insert batch, inserting its events one by one", zap.Int("size", len(batch)), zap.Error(err))
+		for i := range batch {
+			p.flush(batch[i : i+1])
+		}
+		return
+	case !permanent(err) && p.isStopping():
+		p.logger.Error("cannot insert batch on shutdown", zap.Int("size", len(batch)), zap.Error(err))
+		return
+	default:
+		p.logger.Error("cannot insert batch, dropping its events", zap.Int("size", len(batch)), zap.Bool("permanent", permanent(err)), zap.Error(err))
+		p.droppedTotal.WithLabelValues("failed").Add(float64(len(batch)))
+		p.deadLetter(events)
+		p.ack(events...)
+		return
+	}
+	p.ack(events...)
+
+	now := time.Now()
+	p.insertedTotal.Add(float64(len(batch)))
+	p.batchSize.Observe(float64(len(batch)))
+	for _, it := range batch {
+		p.latency.Observe(now.Sub(it.enqueued).Seconds())
+	}
+}
+
+// insert inserts the events, retrying the transient errors with backoff up to maxInsertAttempts times
+// or until the pipeline is shutting down.
+func (p *Pipeline) insert(events []*analytics.Event) error {
+	backoff := minRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := p.Database.InsertBatch(context.Background(), events)
+		if err == nil {
+			return nil
+		}
+		p.failedTotal.Add(float64(len(events)))
+		if permanent(err) || attempt == maxInsertAttempts || p.isStopping() {
+			return err
+		}
+
+		p.logger.Warn("cannot insert batch, retrying", zap.Int("size", len(events)), zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-p.stopping:
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// isStopping reports whether Shutdown is called.
+func (p *Pipeline) isStopping() bool {
+	select {
+	case <-p.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// permanent reports whether inserting the events again fails with the same error.
+func permanent(err error) bool {
+	if errors.Is(err, database.ErrInvalidEvent) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange, codes.AlreadyExists, codes.PermissionDenied, codes.Unimplemented:
+		return true
+	default:
+		return false
+	}
+}
+
+// deadLetter appends the dropped events to the dead-letter file next to the write-ahead log, if it is enabled,
+// as JSONL restorable by the import command.
+func (p *Pipeline) deadLetter(events []*analytics.Event) {
+	if p.wal == nil {
+		return
+	}
+	path := p.cfg.WALPath + ".dead"
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		p.logger.Error("cannot open the dead-letter file", zap.String("path", path), zap.Error(err))
+		return
+	}
+	defer f.Close()
+
+	out := bufio.NewWriter(f)
+	for _, e := range events {
+		b, err := protojson.Marshal(e)
+		if err == nil {
+			_, err = out.Write(append(b, '\n'))
+		}
+		if err != nil {
+			p.logger.Error("cannot write the dead-letter file", zap.String("path", path), zap.Error(err))
+			return
+		}
+	}
+	if err = out.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		p.logger.Error("cannot write the dead-letter file", zap.String("path", path), zap.Error(err))
+	}
+}
@@ -0,0 +1,259 @@
+package ingest
+
+import (
+	"bufio"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// WAL record kinds
+const (
+	walRecordEvent byte = 1
+	walRecordAck   byte = 2
+)
+
+// walCompactSize is the WAL file size after which it is rewritten with the pending events only.
+const walCompactSize = 64 << 20
+
+// wal is an append-only log of the events which are queued but not yet inserted.
+//
+// Every queued event is appended as an event record and synced before it's queued, so the accepted events
+// survive a crash or a power loss, and acknowledged with an ack record once it has left the pipeline.
+// The file is truncated whenever no events are pending.
+type wal struct {
+	mutex   sync.Mutex
+	path    string
+	f       *os.File
+	size    int64
+	pending map[string]*analytics.Event
+}
+
+// openWAL opens the WAL file at path and returns the events that were not acknowledged,
+// in the order they were appended.
+func openWAL(path string) (*wal, []*analytics.Event, error) {
+	events, err := readWAL(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Keep the replayed events in the log until they are inserted, the log is replaced only once
+	// they are synced to the new one, so a crash meanwhile leaves the old one
+	w := &wal{
+		path:    path,
+		pending: make(map[string]*analytics.Event),
+	}
+	for _, e := range events {
+		w.pending[e.GetID()] = e
+	}
+	if w.f, w.size, err = writeWAL(path, events); err != nil {
+		return nil, nil, err
+	}
+
+	return w, events, nil
+}
+
+// writeWAL replaces the WAL file at path with the one of the event records and returns it opened for appending.
+// The records are written to the temporary file, which is synced and renamed over the old one.
+func writeWAL(path string, events []*analytics.Event) (*os.File, int64, error) {
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	w := &wal{f: tmp}
+	for _, e := range events {
+		payload, err := proto.Marshal(e)
+		if err == nil {
+			err = w.write(walRecordEvent, payload)
+		}
+		if err != nil {
+			_ = tmp.Close()
+			return nil, 0, err
+		}
+	}
+	if err = tmp.Sync(); err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return nil, 0, err
+	}
+	return tmp, w.size, nil
+}
+
+// syncDir syncs the directory, so the renames of its files survive a crash.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readWAL returns the events without ack records from the WAL file at path.
+//
+// A partially written trailing record, e.g. after a crash, is ignored.
+func readWAL(path string) ([]*analytics.Event, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	order := make([]string, 0)
+	events := make(map[string]*analytics.Event)
+	r := bufio.NewReader(f)
+	for {
+		kind, payload, err := readWALRecord(r)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case walRecordEvent:
+			e := &analytics.Event{}
+			if err = proto.Unmarshal(payload, e); err != nil {
+				return nil, fmt.Errorf("cannot decode WAL event: %w", err)
+			}
+			if _, ok := events[e.GetID()]; !ok {
+				order = append(order, e.GetID())
+			}
+			events[e.GetID()] = e
+		case walRecordAck:
+			delete(events, string(payload))
+		default:
+			return nil, fmt.Errorf("unsupported WAL record kind %d", kind)
+		}
+	}
+
+	res := make([]*analytics.Event, 0, len(events))
+	for _, id := range order {
+		if e, ok := events[id]; ok {
+			res = append(res, e)
+			delete(events, id)
+		}
+	}
+	return res, nil
+}
+
+// readWALRecord reads a single record: kind (1 byte), payload length (4 bytes) and payload.
+func readWALRecord(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// append logs the event as pending and syncs the log.
+func (w *wal) append(e *analytics.Event) error {
+	payload, err := proto.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err = w.write(walRecordEvent, payload); err != nil {
+		return err
+	}
+	if err = w.f.Sync(); err != nil {
+		return err
+	}
+	w.pending[e.GetID()] = e
+	return nil
+}
+
+// ack marks the events as no longer pending.
+func (w *wal) ack(events []*analytics.Event) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, e := range events {
+		if err := w.write(walRecordAck, []byte(e.GetID())); err != nil {
+			return err
+		}
+		delete(w.pending, e.GetID())
+	}
+
+	switch {
+	case len(w.pending) == 0:
+		if err := w.f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		w.size = 0
+	case w.size > walCompactSize:
+		if err := w.compact(); err != nil {
+			return err
+		}
+	}
+
+	return w.f.Sync()
+}
+
+// compact rewrites the WAL file with the pending events only.
+//
+// w.mutex must be held by the caller.
+func (w *wal) compact() error {
+	events := make([]*analytics.Event, 0, len(w.pending))
+	for _, e := range w.pending {
+		events = append(events, e)
+	}
+	f, size, err := writeWAL(w.path, events)
+	if err != nil {
+		return err
+	}
+
+	old := w.f
+	w.f, w.size = f, size
+	return old.Close()
+}
+
+// write appends a single record to the WAL file.
+//
+// w.mutex must be held by the caller.
+func (w *wal) write(kind byte, payload []byte) error {
+	record := make([]byte, 5+len(payload))
+	record[0] = kind
+	binary.BigEndian.PutUint32(record[1:], uint32(len(payload)))
+	copy(record[5:], payload)
+
+	n, err := w.f.Write(record)
+	w.size += int64(n)
+	return err
+}
+
+// close syncs and closes the WAL file.
+func (w *wal) close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,91 @@
+// Package kafka implements the producer publishing accepted events to a Kafka topic.
+package kafka
+
+import (
+	"context"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	kafkaGo "github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"time"
+)
+
+// Producer publishes events to a Kafka topic asynchronously.
+//
+// Messages are keyed by the event domain and contain the protojson encoded event.
+type Producer struct {
+	writer *kafkaGo.Writer
+	logger *zap.Logger
+
+	publishedTotal prometheus.Counter
+	failedTotal    prometheus.Counter
+}
+
+// NewProducer returns new Producer instance.
+func NewProducer(brokers []string, topic string) (*Producer, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("the broker list is empty")
+	}
+	if topic == "" {
+		return nil, errors.New("topic is empty")
+	}
+
+	p := &Producer{
+		logger: zap.L().Named("kafka"),
+		publishedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kafka_events_published_total",
+			Help: "Total number of events published to Kafka",
+		}),
+		failedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kafka_events_failed_total",
+			Help: "Total number of events failed to be published to Kafka",
+		}),
+	}
+	prometheus.MustRegister(p.publishedTotal, p.failedTotal)
+
+	p.writer = &kafkaGo.Writer{
+		Addr:         kafkaGo.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafkaGo.Hash{},
+		BatchTimeout: 100 * time.Millisecond,
+		RequiredAcks: kafkaGo.RequireOne,
+		Async:        true,
+		Completion: func(messages []kafkaGo.Message, err error) {
+			if err != nil {
+				p.failedTotal.Add(float64(len(messages)))
+				p.logger.Error("cannot publish events", zap.Int("amount", len(messages)), zap.Error(err))
+				return
+			}
+			p.publishedTotal.Add(float64(len(messages)))
+		},
+	}
+
+	return p, nil
+}
+
+// Publish queues the event to be published.
+func (p *Producer) Publish(e *analytics.Event) {
+	value, err := protojson.Marshal(e)
+	if err != nil {
+		p.failedTotal.Inc()
+		p.logger.Error("cannot encode event", zap.String("id", e.GetID()), zap.Error(err))
+		return
+	}
+
+	// The writer is asynchronous, so the call doesn't wait for the delivery
+	if err = p.writer.WriteMessages(context.Background(), kafkaGo.Message{
+		Key:   []byte(e.GetDomain()),
+		Value: value,
+	}); err != nil {
+		p.failedTotal.Inc()
+		p.logger.Error("cannot publish event", zap.String("id", e.GetID()), zap.Error(err))
+	}
+}
+
+// Close flushes the pending messages and closes the producer.
+func (p *Producer) Close() error {
+	p.logger.Info("Shutting down Kafka producer...")
+	return p.writer.Close()
+}
@@ -0,0 +1,216 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir is the directory the service account of the pod is mounted to.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// microTime is the layout of the MicroTime fields of the Kubernetes objects.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// lease is the coordination.k8s.io/v1 Lease object, its metadata are sent back as they're received.
+type lease struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   map[string]any `json:"metadata"`
+	Spec       leaseSpec      `json:"spec"`
+}
+
+// leaseSpec is the spec of the Lease object.
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// expired reports whether the lease isn't renewed within its duration at now.
+func (s leaseSpec) expired(now time.Time) bool {
+	renewed, err := time.Parse(microTime, s.RenewTime)
+	if err != nil {
+		return true
+	}
+	return !now.Before(renewed.Add(time.Duration(s.LeaseDurationSeconds) * time.Second))
+}
+
+// KubernetesLock is Lock of the Lease object of the name in the namespace of the pod,
+// accessed by the API server with the service account of the pod, which must be allowed
+// to get, create and update the leases.
+//
+// The updates of the Lease are conditional on its resource version, so only one of the replicas
+// racing for it gets it.
+type KubernetesLock struct {
+	client *http.Client
+	// leases is the URL of the leases of the namespace
+	leases string
+	name   string
+}
+
+// NewKubernetesLock returns new KubernetesLock instance of the Lease of the name, configured from the environment
+// of the pod.
+func NewKubernetesLock(name string) (*KubernetesLock, error) {
+	if name == "" {
+		return nil, errors.New("lease name is empty")
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is not set")
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("cluster CA has no certificates")
+	}
+	namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the namespace: %w", err)
+	}
+
+	return &KubernetesLock{
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+			Timeout:   30 * time.Second,
+		},
+		leases: fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases",
+			net.JoinHostPort(host, port), strings.TrimSpace(string(namespace))),
+		name: name,
+	}, nil
+}
+
+// Acquire implements Lock. The lease is taken if it's missing, released or expired, and renewed if it's the holder's.
+func (l *KubernetesLock) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	current, err := l.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	duration := int(math.Ceil(ttl.Seconds()))
+	if current == nil {
+		return l.write(ctx, http.MethodPost, l.leases, &lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   map[string]any{"name": l.name},
+			Spec: leaseSpec{
+				HolderIdentity:       holder,
+				LeaseDurationSeconds: duration,
+				AcquireTime:          now.UTC().Format(microTime),
+				RenewTime:            now.UTC().Format(microTime),
+			},
+		})
+	}
+
+	if current.Spec.HolderIdentity != holder {
+		if current.Spec.HolderIdentity != "" && !current.Spec.expired(now) {
+			return false, nil
+		}
+		current.Spec.HolderIdentity = holder
+		current.Spec.AcquireTime = now.UTC().Format(microTime)
+		current.Spec.LeaseTransitions++
+	}
+	current.Spec.LeaseDurationSeconds = duration
+	current.Spec.RenewTime = now.UTC().Format(microTime)
+	return l.write(ctx, http.MethodPut, l.leases+"/"+l.name, current)
+}
+
+// Release implements Lock, the holder of the released lease is cleared.
+func (l *KubernetesLock) Release(ctx context.Context, holder string) error {
+	current, err := l.get(ctx)
+	if err != nil || current == nil || current.Spec.HolderIdentity != holder {
+		return err
+	}
+	current.Spec.HolderIdentity = ""
+	current.Spec.LeaseDurationSeconds = 1
+	current.Spec.RenewTime = time.Now().UTC().Format(microTime)
+	_, err = l.write(ctx, http.MethodPut, l.leases+"/"+l.name, current)
+	return err
+}
+
+// get returns the Lease, nil if it doesn't exist.
+func (l *KubernetesLock) get(ctx context.Context) (*lease, error) {
+	res, err := l.do(ctx, http.MethodGet, l.leases+"/"+l.name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		current := &lease{}
+		if err = json.NewDecoder(res.Body).Decode(current); err != nil {
+			return nil, fmt.Errorf("cannot decode the lease: %w", err)
+		}
+		return current, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, responseError(res)
+	}
+}
+
+// write creates or updates the Lease and reports whether it's written,
+// it isn't if another replica has created or updated it since it was read.
+func (l *KubernetesLock) write(ctx context.Context, method string, url string, value *lease) (bool, error) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	res, err := l.do(ctx, method, url, body)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, responseError(res)
+	}
+}
+
+// do sends the request to the API server with the token of the service account,
+// which is read every time, as it's rotated.
+func (l *KubernetesLock) do(ctx context.Context, method string, url string, body []byte) (*http.Response, error) {
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the service account token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return l.client.Do(req)
+}
+
+// responseError returns the error of the unexpected response of the API server.
+func responseError(res *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("unexpected response of the API server %s: %s", res.Status, bytes.TrimSpace(msg))
+}
@@ -0,0 +1,129 @@
+// Package leader implements the leader election of the replicas, so the background jobs,
+// e.g. the rollups and the retention, run on exactly one of them while all of them serve the traffic.
+package leader
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Lock is the lease held by one of the replicas at a time.
+type Lock interface {
+	// Acquire takes or renews the lease for the holder for ttl and reports whether the holder has it.
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+	// Release gives up the lease if it's held by the holder.
+	Release(ctx context.Context, holder string) error
+}
+
+// releaseTimeout is the time the lease is released within on shutdown.
+const releaseTimeout = 5 * time.Second
+
+// Elector runs the jobs on the replica holding the lease.
+type Elector struct {
+	lock   Lock
+	id     string
+	ttl    time.Duration
+	logger *zap.Logger
+
+	leader prometheus.Gauge
+}
+
+// NewElector returns new Elector instance campaigning for the lease of lock for ttl as the replica of id,
+// which must be unique, e.g. the pod name with a random suffix.
+func NewElector(lock Lock, id string, ttl time.Duration) (*Elector, error) {
+	if lock == nil {
+		return nil, errors.New("leader.Lock instance is nil")
+	}
+	if id == "" {
+		return nil, errors.New("replica identity is empty")
+	}
+	if ttl <= 0 {
+		return nil, errors.New("lease ttl must be positive")
+	}
+	e := &Elector{
+		lock:   lock,
+		id:     id,
+		ttl:    ttl,
+		logger: zap.L().Named("leader"),
+		leader: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "leader",
+			Help: "Whether the replica is the leader running the background jobs, 1 or 0",
+		}),
+	}
+	prometheus.MustRegister(e.leader)
+	return e, nil
+}
+
+// Run campaigns for the lease until ctx is done, trying to take or renew it every third of its ttl.
+// The jobs run while the replica holds the lease, their context is cancelled once it isn't renewed,
+// before it expires. On shutdown the lease is released after the jobs stop, so another replica takes over right away.
+func (e *Elector) Run(ctx context.Context, jobs ...func(ctx context.Context)) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	var stop func()
+	defer func() {
+		if stop == nil {
+			return
+		}
+		stop()
+		releaseCtx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+		defer cancel()
+		if err := e.lock.Release(releaseCtx, e.id); err != nil {
+			e.logger.Error("Cannot release the lease", zap.Error(err))
+		}
+	}()
+
+	for {
+		acquired, err := e.acquire(ctx)
+		if err != nil && ctx.Err() == nil {
+			e.logger.Error("Cannot acquire the lease", zap.Error(err))
+		}
+		switch {
+		case acquired && stop == nil:
+			e.logger.Info("Elected as the leader, starting the background jobs", zap.String("id", e.id))
+			stop = e.start(ctx, jobs)
+		case !acquired && stop != nil:
+			e.logger.Warn("Lost the leadership, stopping the background jobs", zap.String("id", e.id))
+			stop()
+			stop = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// acquire takes or renews the lease, the attempt is cancelled after a third of the ttl,
+// so the lease is never held by the jobs longer than the ttl.
+func (e *Elector) acquire(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.ttl/3)
+	defer cancel()
+	return e.lock.Acquire(ctx, e.id, e.ttl)
+}
+
+// start runs the jobs and returns the function stopping them and waiting until they return.
+func (e *Elector) start(ctx context.Context, jobs []func(ctx context.Context)) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job(ctx)
+		}()
+	}
+	e.leader.Set(1)
+	return func() {
+		cancel()
+		wg.Wait()
+		e.leader.Set(0)
+	}
+}
@@ -0,0 +1,133 @@
+// Package live implements a Server-Sent Events stream of live domain statistics.
+package live
+
+import (
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/pubsub"
+	"diploma/analytics-exporter/internal/sites"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+// Path is the gateway path the live stream is served on.
+const Path = "/live"
+
+// subscriptionBuffer is an amount of pageviews buffered for the slow clients before dropping them.
+const subscriptionBuffer = 64
+
+// visitorsMessage is sent periodically with the current visitors count.
+type visitorsMessage struct {
+	Domain          string `json:"domain"`
+	CurrentVisitors int64  `json:"current_visitors"`
+}
+
+// pageviewMessage is sent for every ingested pageview.
+//
+// It deliberately doesn't include the visit hash.
+type pageviewMessage struct {
+	URL       string    `json:"url"`
+	Referrer  string    `json:"referrer"`
+	Browser   string    `json:"browser"`
+	OS        string    `json:"os"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewHandler returns runtime.HandlerFunc streaming current visitors of the "domain" query parameter
+// every interval and every incoming pageview as Server-Sent Events.
+//
+// Access to the domains is checked against sitesRegistry, which may be nil.
+func NewHandler(db database.Database, bus *pubsub.Bus, sitesRegistry *sites.Registry, interval time.Duration) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		domain := r.URL.Query().Get("domain")
+		if domain == "" {
+			http.Error(w, "domain is missing", http.StatusBadRequest)
+			return
+		}
+		if sitesRegistry != nil {
+			err := sitesRegistry.Authorize(sites.BearerKey(r.Header.Get("Authorization")), domain, sites.PermissionStats)
+			switch {
+			case errors.Is(err, sites.ErrUnauthenticated):
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			case err != nil:
+				http.Error(w, "access to "+domain+" is denied", http.StatusForbidden)
+				return
+			}
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		site := sitesRegistry.Key(domain)
+		events, cancel := bus.Subscribe(site, subscriptionBuffer)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		sendVisitors := func() error {
+			visitors, err := prometheus.GetCurrentVisitors(r.Context(), db, site, sitesRegistry.StatsSettings(domain), time.Now())
+			if err != nil {
+				return err
+			}
+			return writeEvent(w, "visitors", visitorsMessage{
+				Domain:          domain,
+				CurrentVisitors: visitors,
+			})
+		}
+
+		if err := sendVisitors(); err != nil {
+			zap.L().Named("live").Debug("cannot send visitors", zap.Error(err))
+			return
+		}
+		flusher.Flush()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				err = sendVisitors()
+			case e := <-events:
+				if e.GetType() != "pageview" {
+					continue
+				}
+				err = writeEvent(w, "pageview", pageviewMessage{
+					URL:       e.GetURL(),
+					Referrer:  e.GetReferrer(),
+					Browser:   e.GetBrowser(),
+					OS:        e.GetOS(),
+					Timestamp: e.GetTimestamp().AsTime(),
+				})
+			}
+			if err != nil {
+				zap.L().Named("live").Debug("cannot send live event", zap.Error(err))
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes a single Server-Sent Event with JSON encoded data.
+func writeEvent(w http.ResponseWriter, name string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+	return err
+}
@@ -0,0 +1,137 @@
+// Package logging builds the zap logger of the service.
+package logging
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"strings"
+)
+
+// Config holds the logging settings.
+type Config struct {
+	// Level is the minimal level of the entries: debug, info, warn or error.
+	Level string
+	// Format is the encoding of the entries: json or console.
+	Format string
+	// File is the path of the log file, the entries are written to stderr if empty.
+	File string
+	// MaxSizeMB is the size of the log file at which it's rotated.
+	MaxSizeMB int
+	// MaxAgeDays is the age after which the rotated files are removed, they're kept forever if 0.
+	MaxAgeDays int
+	// MaxBackups is the maximum amount of the kept rotated files, all of them are kept if 0.
+	MaxBackups int
+	// Components override the level of the named loggers and their children, e.g. ingest=debug.
+	Components map[string]string
+	// Development enables the stack traces of the warnings and the panics on DPanic.
+	Development bool
+}
+
+// New returns the logger of the configuration and its level, which can be changed at runtime.
+//
+// The component levels are not affected by the level changes.
+func New(cfg Config) (*zap.Logger, zap.AtomicLevel, error) {
+	level, err := zap.ParseAtomicLevel(cfg.Level)
+	if err != nil {
+		return nil, level, err
+	}
+
+	components := make(map[string]zapcore.Level, len(cfg.Components))
+	for name, l := range cfg.Components {
+		if components[name], err = zapcore.ParseLevel(l); err != nil {
+			return nil, level, fmt.Errorf("invalid level of %s: %w", name, err)
+		}
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	if cfg.Development {
+		encoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+	var encoder zapcore.Encoder
+	switch cfg.Format {
+	case "json":
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case "console":
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, level, fmt.Errorf("unsupported log format %q", cfg.Format)
+	}
+
+	var sink zapcore.WriteSyncer = zapcore.Lock(os.Stderr)
+	if cfg.File != "" {
+		sink = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxAge:     cfg.MaxAgeDays,
+			MaxBackups: cfg.MaxBackups,
+		})
+	}
+
+	// The core accepts every level, the levels are checked by componentCore
+	core := &componentCore{
+		Core:       zapcore.NewCore(encoder, sink, zapcore.DebugLevel),
+		level:      level,
+		components: components,
+	}
+
+	opts := []zap.Option{zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel)}
+	if cfg.Development {
+		opts = []zap.Option{zap.AddCaller(), zap.AddStacktrace(zapcore.WarnLevel), zap.Development()}
+	}
+	return zap.New(core, opts...), level, nil
+}
+
+// componentCore is zapcore.Core checking the entries against the level of their logger.
+type componentCore struct {
+	zapcore.Core
+	level      zap.AtomicLevel
+	components map[string]zapcore.Level
+}
+
+// Enabled reports whether the level is enabled for any of the loggers.
+func (c *componentCore) Enabled(l zapcore.Level) bool {
+	if c.level.Enabled(l) {
+		return true
+	}
+	for _, cl := range c.components {
+		if cl.Enabled(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// With returns the child core with the fields.
+func (c *componentCore) With(fields []zapcore.Field) zapcore.Core {
+	return &componentCore{
+		Core:       c.Core.With(fields),
+		level:      c.level,
+		components: c.components,
+	}
+}
+
+// Check adds the core to ce if the entry level is enabled for its logger.
+func (c *componentCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.levelOf(e.LoggerName).Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+// levelOf returns the level of the logger, the closest named parent override is used for the children.
+func (c *componentCore) levelOf(name string) zapcore.LevelEnabler {
+	for name != "" {
+		if l, ok := c.components[name]; ok {
+			return l
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return c.level
+}
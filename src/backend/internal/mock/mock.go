@@ -0,0 +1,340 @@
+// Package mock generates mocked visits of the domains.
+package mock
+
+import (
+	"crypto/sha256"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"math/rand"
+	"net/netip"
+	"time"
+)
+
+// Choice is a value picked with the probability proportional to its weight.
+type Choice[T any] struct {
+	Value  T
+	Weight float64
+}
+
+// Country is a country the visitors come from, their addresses are picked from the CIDR.
+type Country struct {
+	Code   string
+	CIDR   string
+	Weight float64
+}
+
+var (
+	EventType = "pageview"
+	// OSs are weighted by the share of the visits.
+	OSs = []Choice[string]{
+		{"Windows", 30},
+		{"Android", 28},
+		{"iOS", 18},
+		{"macOS", 12},
+		{"Linux", 4},
+		{"ChromeOS", 2},
+		{"Windows Phone", 0.5},
+		{"FreeBSD", 0.2},
+		{"BlackBerry", 0.1},
+	}
+	// Browsers are weighted by the share of the visits.
+	Browsers = []Choice[string]{
+		{"Chrome", 60},
+		{"Safari", 20},
+		{"Edge", 6},
+		{"Firefox", 5},
+		{"Opera", 3},
+		{"Headless Chrome", 1},
+		{"Vivaldi", 1},
+		{"Opera Mini", 0.5},
+		{"Opera Touch", 0.3},
+		{"Internet Explorer", 0.2},
+	}
+	// Countries are weighted by the share of the visits,
+	// the CIDRs are ranges allocated to the countries.
+	Countries = []Country{
+		{"US", "3.0.0.0/10", 35},
+		{"DE", "5.1.0.0/16", 10},
+		{"GB", "2.24.0.0/13", 8},
+		{"UA", "5.58.0.0/15", 8},
+		{"FR", "2.0.0.0/12", 7},
+		{"IN", "1.22.0.0/15", 7},
+		{"BR", "177.0.0.0/12", 5},
+		{"JP", "1.72.0.0/13", 5},
+		{"PL", "5.172.0.0/15", 4},
+		{"CA", "24.48.0.0/14", 4},
+	}
+	// CustomEvents are the names of the custom events, weighted by how often they are sent.
+	CustomEvents = []Choice[string]{
+		{"signup", 3},
+		{"download", 5},
+		{"outbound-link", 10},
+	}
+	// Diurnal is the relative traffic by the hour of the day, peaking in the evening.
+	Diurnal = [24]float64{
+		0.25, 0.15, 0.1, 0.08, 0.08, 0.1,
+		0.2, 0.35, 0.55, 0.7, 0.8, 0.85,
+		0.9, 0.9, 0.85, 0.85, 0.9, 0.95,
+		1, 1, 0.95, 0.8, 0.6, 0.4,
+	}
+	Referrers = []string{
+		"",
+		"https://www.google.com",
+		"https://ua.linkedin.com",
+		"https://www.bing.com",
+		"https://yahoo.com",
+	}
+	Paths = []string{
+		"/",
+		"/foo",
+		"/bar",
+		"/foo/bar",
+		"/bar/foo",
+	}
+	Devices = []*analytics.Device{
+		{
+			Device: &analytics.Device_Mobile{
+				Mobile: true,
+			},
+		},
+		{
+			Device: &analytics.Device_Tablet{
+				Tablet: true,
+			},
+		},
+		{
+			Device: &analytics.Device_Desktop{
+				Desktop: true,
+			},
+		},
+		{
+			Device: &analytics.Device_Bot{
+				Bot: true,
+			},
+		},
+	}
+	// UserAgents are the user agents of the generated visitors, the first ones are the most frequent.
+	UserAgents = []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0",
+		"Mozilla/5.0 (iPad; CPU OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+	}
+)
+
+// Config holds the generator settings.
+type Config struct {
+	Domains []string
+	// MaxVisitors is the number of visitors in a batch at the traffic peak
+	MaxVisitors int
+	// Seed fully determines the generated data
+	Seed int64
+
+	Browsers  []Choice[string]
+	OSs       []Choice[string]
+	Countries []Country
+	// CustomEvents are sent along with the page views with the CustomEventRate probability
+	CustomEvents    []Choice[string]
+	CustomEventRate float64
+	// Diurnal scales the number of visitors by the hour of the batch start, no scaling if nil
+	Diurnal *[24]float64
+}
+
+// DefaultConfig returns the config generating realistic traffic of the domains.
+func DefaultConfig(domains []string, maxVisitors int, seed int64) Config {
+	return Config{
+		Domains:         domains,
+		MaxVisitors:     maxVisitors,
+		Seed:            seed,
+		Browsers:        Browsers,
+		OSs:             OSs,
+		Countries:       Countries,
+		CustomEvents:    CustomEvents,
+		CustomEventRate: 0.1,
+		Diurnal:         &Diurnal,
+	}
+}
+
+// Visit is a mocked visit of a single visitor.
+type Visit struct {
+	IP        string
+	Country   string
+	UserAgent string
+	Browser   string
+	OS        string
+	Device    *analytics.Device
+	// Events are the page views and the custom events of the visit in the timestamp order
+	Events []*analytics.Event
+}
+
+// Generator generates the mocked visits.
+//
+// It's not safe for concurrent use.
+type Generator struct {
+	rnd       *rand.Rand
+	cfg       Config
+	countries []Choice[country]
+}
+
+// country is a Country with the parsed CIDR.
+type country struct {
+	code string
+	ip   netip.Prefix
+}
+
+// NewGenerator returns new Generator instance producing from 1 to cfg.MaxVisitors visits of the domains per batch.
+func NewGenerator(cfg Config) (*Generator, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("the domain list is empty")
+	}
+	if cfg.MaxVisitors <= 0 {
+		return nil, errors.New("maxVisitors must be positive")
+	}
+	if len(cfg.Browsers) == 0 || len(cfg.OSs) == 0 || len(cfg.Countries) == 0 {
+		return nil, errors.New("browsers, OSs and countries must not be empty")
+	}
+	if len(cfg.CustomEvents) == 0 && cfg.CustomEventRate > 0 {
+		return nil, errors.New("custom event rate is set without custom events")
+	}
+	countries := make([]Choice[country], len(cfg.Countries))
+	for i, c := range cfg.Countries {
+		prefix, err := netip.ParsePrefix(c.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("country %s: %w", c.Code, err)
+		}
+		if !prefix.Addr().Is4() {
+			return nil, fmt.Errorf("country %s: only IPv4 ranges are supported", c.Code)
+		}
+		countries[i] = Choice[country]{Value: country{code: c.Code, ip: prefix.Masked()}, Weight: c.Weight}
+	}
+	return &Generator{
+		rnd:       rand.New(rand.NewSource(cfg.Seed)),
+		cfg:       cfg,
+		countries: countries,
+	}, nil
+}
+
+// Visits returns a batch of the visits starting at initialTime.
+//
+// The events are complete, so they can be inserted into the database as is,
+// or have their visitor details derived from the IP and the user agent of the visit.
+func (g *Generator) Visits(initialTime time.Time) []*Visit {
+	h := sha256.New()
+
+	maxVisitors := g.cfg.MaxVisitors
+	if g.cfg.Diurnal != nil {
+		maxVisitors = max(int(float64(maxVisitors)*g.cfg.Diurnal[initialTime.Hour()]), 1)
+	}
+	totalVisitors := g.rnd.Intn(maxVisitors) + 1
+	visits := make([]*Visit, totalVisitors)
+	for i := range visits {
+		domain := g.cfg.Domains[g.rnd.Intn(len(g.cfg.Domains))]
+		url := "https://" + domain
+		c := pick(g.rnd, g.countries)
+		v := &Visit{
+			IP:        g.randomAddr(c.ip).String(),
+			Country:   c.code,
+			UserAgent: UserAgents[g.rnd.Intn(len(UserAgents))],
+			Browser:   pick(g.rnd, g.cfg.Browsers),
+			OS:        pick(g.rnd, g.cfg.OSs),
+			Device:    Devices[g.rnd.Intn(len(Devices))],
+		}
+
+		h.Write([]byte(v.IP + v.Browser + v.Device.String()))
+		visitHash := hex.EncodeToString(h.Sum(nil))
+		h.Reset()
+
+		pageViewsAmount := g.rnd.Intn(5) + 1
+		timeShift := 0
+		for j := 0; j < pageViewsAmount; j++ {
+			var referrer string
+			if g.rnd.Intn(2) == 1 {
+				referrer = url
+			} else {
+				referrer = Referrers[g.rnd.Intn(len(Referrers))]
+			}
+
+			e := &analytics.Event{
+				ID:          g.uuid(),
+				Type:        EventType,
+				URL:         url + Paths[g.rnd.Intn(len(Paths))],
+				Domain:      domain,
+				Referrer:    referrer,
+				Browser:     v.Browser,
+				OS:          v.OS,
+				Device:      v.Device,
+				HashedVisit: visitHash,
+				Timestamp:   timestamppb.New(initialTime.Add(time.Minute * time.Duration(timeShift))),
+			}
+			v.Events = append(v.Events, e)
+
+			if g.cfg.CustomEventRate > 0 && g.rnd.Float64() < g.cfg.CustomEventRate {
+				v.Events = append(v.Events, &analytics.Event{
+					ID:          g.uuid(),
+					Type:        pick(g.rnd, g.cfg.CustomEvents),
+					URL:         e.URL,
+					Domain:      domain,
+					Referrer:    referrer,
+					Browser:     v.Browser,
+					OS:          v.OS,
+					Device:      v.Device,
+					HashedVisit: visitHash,
+					Props:       map[string]string{"country": v.Country},
+					Timestamp:   timestamppb.New(e.GetTimestamp().AsTime().Add(time.Duration(g.rnd.Intn(60)) * time.Second)),
+				})
+			}
+
+			timeShift += g.rnd.Intn(40) + 1
+		}
+		visits[i] = v
+	}
+
+	return visits
+}
+
+// randomAddr returns a random address in the IPv4 prefix.
+func (g *Generator) randomAddr(prefix netip.Prefix) netip.Addr {
+	base := prefix.Addr().As4()
+	n := binary.BigEndian.Uint32(base[:])
+	if hostBits := 32 - prefix.Bits(); hostBits > 0 {
+		n |= uint32(g.rnd.Int63n(1 << hostBits))
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return netip.AddrFrom4(b)
+}
+
+// uuid returns a random UUID derived from the seed.
+func (g *Generator) uuid() string {
+	id, err := uuid.NewRandomFromReader(g.rnd)
+	if err != nil {
+		return uuid.New().String()
+	}
+	return id.String()
+}
+
+// pick returns a value of the choices with the probability proportional to its weight.
+func pick[T any](rnd *rand.Rand, choices []Choice[T]) T {
+	var total float64
+	for _, c := range choices {
+		total += c.Weight
+	}
+	r := rnd.Float64() * total
+	for _, c := range choices {
+		if r < c.Weight {
+			return c.Value
+		}
+		r -= c.Weight
+	}
+	return choices[len(choices)-1].Value
+}
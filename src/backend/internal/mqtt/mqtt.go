@@ -0,0 +1,122 @@
+// Package mqtt implements ingestion of the events published to an MQTT topic.
+package mqtt
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/analytics"
+	analyticsApi "diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqttGo "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"time"
+)
+
+// Message is the payload of an MQTT message.
+//
+// MQTT messages have no headers, so the visitor details are passed next to the event.
+type Message struct {
+	// Event is the protojson encoded analytics.Event
+	Event         json.RawMessage `json:"event"`
+	ClientAddress string          `json:"client_address"`
+	UserAgent     string          `json:"user_agent"`
+	APIKey        string          `json:"api_key,omitempty"`
+}
+
+// Config holds the MQTT subscription settings.
+type Config struct {
+	Broker   string
+	Topic    string
+	QoS      byte
+	ClientID string
+}
+
+// Subscriber creates events from the messages published to an MQTT topic.
+type Subscriber struct {
+	cfg    Config
+	srv    analyticsApi.AnalyticsServer
+	client mqttGo.Client
+	logger *zap.Logger
+}
+
+// Validate reports the first invalid setting of the configuration.
+func (cfg Config) Validate() error {
+	if cfg.Broker == "" {
+		return errors.New("MQTT broker is empty")
+	}
+	if cfg.Topic == "" {
+		return errors.New("MQTT topic is empty")
+	}
+	if cfg.QoS > 2 {
+		return fmt.Errorf("unsupported MQTT QoS %d", cfg.QoS)
+	}
+	return nil
+}
+
+// NewSubscriber returns new Subscriber instance.
+func NewSubscriber(cfg Config, srv analyticsApi.AnalyticsServer) (*Subscriber, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if srv == nil {
+		return nil, errors.New("analytics.AnalyticsServer instance is nil")
+	}
+
+	s := &Subscriber{
+		cfg:    cfg,
+		srv:    srv,
+		logger: zap.L().Named("mqtt"),
+	}
+
+	// Subscribe on every (re)connect, so that the subscription survives broker restarts
+	opts := mqttGo.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(func(c mqttGo.Client) {
+			if token := c.Subscribe(cfg.Topic, cfg.QoS, s.handle); token.Wait() && token.Error() != nil {
+				s.logger.Error("cannot subscribe to MQTT topic", zap.String("topic", cfg.Topic), zap.Error(token.Error()))
+				return
+			}
+			s.logger.Info("MQTT subscriber started", zap.String("topic", cfg.Topic))
+		}).
+		SetConnectionLostHandler(func(_ mqttGo.Client, err error) {
+			s.logger.Warn("MQTT connection lost", zap.Error(err))
+		})
+	s.client = mqttGo.NewClient(opts)
+
+	return s, nil
+}
+
+// Connect connects to the broker, the connection is retried in the background if it fails.
+func (s *Subscriber) Connect() {
+	s.client.Connect()
+}
+
+// Close disconnects from the broker.
+func (s *Subscriber) Close() {
+	s.logger.Info("Shutting down MQTT subscriber...")
+	s.client.Disconnect(uint((time.Second).Milliseconds()))
+}
+
+// handle creates the event of the message.
+func (s *Subscriber) handle(_ mqttGo.Client, msg mqttGo.Message) {
+	var m Message
+	if err := json.Unmarshal(msg.Payload(), &m); err != nil {
+		s.logger.Debug("dropping malformed message", zap.Error(err))
+		return
+	}
+	e := &analyticsApi.Event{}
+	if err := protojson.Unmarshal(m.Event, e); err != nil {
+		s.logger.Debug("dropping malformed event", zap.Error(err))
+		return
+	}
+
+	ctx := analytics.WithAPIKey(analytics.WithVisitor(context.Background(), m.ClientAddress, m.UserAgent), m.APIKey)
+	if _, err := s.srv.CreateEvent(ctx, e); err != nil {
+		s.logger.Debug("cannot create event", zap.Error(err))
+	}
+}
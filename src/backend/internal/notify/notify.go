@@ -0,0 +1,155 @@
+// Package notify posts the alert and the report messages to the Slack and Discord channels of the sites.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"diploma/analytics-exporter/internal/sites"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// The colors of the message side bars.
+const (
+	ColorFiring   = 0xd93f0b
+	ColorResolved = 0x2da44e
+	ColorReport   = 0x0969da
+)
+
+// maxText is the length the message text is truncated to, below the limits of Discord embeds and Slack attachments.
+const maxText = 3900
+
+// Message is a chat message rendered into the payload of the channel type.
+type Message struct {
+	Title string
+	// Text is the body of the message, it may use the *bold*, `code` and list markdown both services support.
+	Text   string
+	Color  int
+	Fields []Field
+	// Timestamp is shown in the footer of the message if set.
+	Timestamp time.Time
+}
+
+// Field is a short name and value pair shown in the columns of the message.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Notifier posts the messages to the channel webhooks.
+type Notifier struct {
+	client *http.Client
+}
+
+// NewNotifier returns new Notifier instance posting with the timeout.
+func NewNotifier(timeout time.Duration) *Notifier {
+	return &Notifier{client: &http.Client{Timeout: timeout}}
+}
+
+// Send posts the message to the channel.
+func (n *Notifier) Send(ctx context.Context, ch *sites.Channel, m *Message) error {
+	var payload any
+	switch ch.Type {
+	case sites.ChannelSlack:
+		payload = slackPayload(m)
+	case sites.ChannelDiscord:
+		payload = discordPayload(m)
+	default:
+		return fmt.Errorf("unknown channel type %q", ch.Type)
+	}
+	return n.post(ctx, ch.URL, payload)
+}
+
+// slackPayload returns the incoming webhook payload of the message as an attachment with the colored side bar.
+func slackPayload(m *Message) map[string]any {
+	fields := make([]map[string]any, 0, len(m.Fields))
+	for _, f := range m.Fields {
+		fields = append(fields, map[string]any{"title": f.Name, "value": f.Value, "short": true})
+	}
+	attachment := map[string]any{
+		"fallback":  m.Title,
+		"color":     fmt.Sprintf("#%06x", m.Color),
+		"title":     m.Title,
+		"text":      truncate(m.Text, maxText),
+		"fields":    fields,
+		"mrkdwn_in": []string{"text"},
+	}
+	if !m.Timestamp.IsZero() {
+		attachment["ts"] = m.Timestamp.Unix()
+	}
+	return map[string]any{"text": m.Title, "attachments": []any{attachment}}
+}
+
+// discordPayload returns the webhook payload of the message as an embed.
+//
+// Discord uses **bold**, so the single asterisks of the text are doubled.
+func discordPayload(m *Message) map[string]any {
+	fields := make([]map[string]any, 0, len(m.Fields))
+	for _, f := range m.Fields {
+		fields = append(fields, map[string]any{"name": f.Name, "value": f.Value, "inline": true})
+	}
+	embed := map[string]any{
+		"title":       truncate(m.Title, 256),
+		"description": truncate(discordMarkdown(m.Text), maxText),
+		"color":       m.Color,
+		"fields":      fields,
+	}
+	if !m.Timestamp.IsZero() {
+		embed["timestamp"] = m.Timestamp.UTC().Format(time.RFC3339)
+	}
+	return map[string]any{"embeds": []any{embed}}
+}
+
+// discordMarkdown converts the *bold* of the text into the Discord **bold**, leaving the code spans as they are.
+func discordMarkdown(text string) string {
+	var b bytes.Buffer
+	code := false
+	for _, r := range text {
+		switch {
+		case r == '`':
+			code = !code
+		case r == '*' && !code:
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// truncate shortens the text to at most max bytes, ending it with an ellipsis.
+func truncate(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	cut := max - len("…")
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "…"
+}
+
+// post posts the JSON encoded payload to the URL.
+func (n *Notifier) post(ctx context.Context, url string, payload any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package oidc
+
+import (
+	"diploma/analytics-exporter/internal/sites"
+	"encoding/json"
+	"errors"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Path is the gateway path the ID tokens are exchanged for the sessions on.
+const Path = "/api/auth/oidc"
+
+// loginRequest is the JSON body of the exchange.
+type loginRequest struct {
+	IDToken string `json:"id_token"`
+}
+
+// loginResponse is the JSON response of the exchange, the token is sent as "Bearer <token>" to the APIs.
+type loginResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	User    loginUser `json:"user"`
+}
+
+// loginUser is the user signed in.
+type loginUser struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	Admin bool   `json:"admin"`
+}
+
+// NewHandler returns runtime.HandlerFunc exchanging the ID tokens of the provider for the sessions
+// of the users of sitesRegistry with the same email, signed by signer and valid for ttl.
+//
+// The users must be created beforehand, their roles are the ones of their teams. The members of adminGroup,
+// if it's set and the provider sends the "groups" claim, access as the admin users.
+func NewHandler(provider *Provider, sitesRegistry *sites.Registry, signer *sites.SessionSigner, ttl time.Duration, adminGroup string) runtime.HandlerFunc {
+	logger := zap.L().Named("oidc")
+	return func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		req := loginRequest{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || req.IDToken == "" {
+			http.Error(w, "id_token is missing", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		claims, err := provider.Verify(r.Context(), req.IDToken, now)
+		switch {
+		case errors.Is(err, ErrInvalidToken):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			logger.Error("Cannot verify ID token", zap.Error(err))
+			http.Error(w, "identity provider is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+			http.Error(w, "verified email is required", http.StatusForbidden)
+			return
+		}
+		user, ok := sitesRegistry.UserByEmail(claims.Email)
+		if !ok {
+			http.Error(w, "user "+claims.Email+" is not registered", http.StatusForbidden)
+			return
+		}
+
+		admin := adminGroup != "" && slices.Contains(claims.Groups, adminGroup)
+		expires := now.Add(ttl)
+		token, err := signer.Sign(user, admin, now, expires)
+		if err != nil {
+			http.Error(w, "cannot sign session", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("User signed in", zap.String("email", user.Email), zap.Bool("admin", user.Admin || admin))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(loginResponse{
+			Token:   token,
+			Expires: expires,
+			User: loginUser{
+				ID:    user.ID,
+				Email: user.Email,
+				Name:  user.Name,
+				Admin: user.Admin || admin,
+			},
+		})
+	}
+}
@@ -0,0 +1,321 @@
+// Package oidc implements the single sign-on with an external OpenID Connect provider,
+// exchanging its ID tokens for the sessions of the users.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clockSkew is the tolerated difference of the clocks of the provider and the service.
+	clockSkew = time.Minute
+	// refreshInterval is the minimal interval of the refreshes of the provider keys on an unknown key ID.
+	refreshInterval = time.Minute
+	// minRSABits is the minimal size of the RSA keys of the provider.
+	minRSABits = 2048
+)
+
+// ErrInvalidToken is returned for the ID tokens which aren't valid.
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// Claims are the claims of the ID tokens used for the sign-on.
+type Claims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expires         int64    `json:"exp"`
+	NotBefore       int64    `json:"nbf"`
+	Email           string   `json:"email"`
+	EmailVerified   *bool    `json:"email_verified"`
+	Name            string   `json:"name"`
+	Groups          []string `json:"groups"`
+}
+
+// audience is the "aud" claim, which is either a string or an array of them.
+type audience []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// Provider verifies the ID tokens issued by an OpenID Connect provider for the client.
+//
+// The provider configuration is discovered and its keys are fetched on the first use,
+// the keys are refreshed when a token is signed by an unknown one.
+type Provider struct {
+	issuer   string
+	clientID string
+	client   *http.Client
+
+	mutex   sync.Mutex
+	jwksURI string
+	keys    map[string]publicKey
+	// refreshed is the time the keys are last fetched at or failed to, they're fetched at most once per refreshInterval
+	refreshed time.Time
+}
+
+// publicKey is the key of the provider with the algorithm it's restricted to, any of the supported ones if empty.
+type publicKey struct {
+	key       crypto.PublicKey
+	algorithm string
+}
+
+// NewProvider returns new Provider instance of the issuer URL, the tokens must be issued for the client ID.
+func NewProvider(issuer string, clientID string) (*Provider, error) {
+	if issuer == "" {
+		return nil, errors.New("issuer is missing")
+	}
+	if clientID == "" {
+		return nil, errors.New("client ID is missing")
+	}
+	return &Provider{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		clientID: clientID,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Verify returns the claims of the ID token, if it's signed by the provider for the client and isn't expired at now.
+func (p *Provider) Verify(ctx context.Context, token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	header := struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, err := p.key(ctx, header.KeyID, now)
+	if err != nil {
+		return nil, err
+	}
+	if key.algorithm != "" && key.algorithm != header.Algorithm {
+		return nil, fmt.Errorf("%w: key %q isn't used with %q", ErrInvalidToken, header.KeyID, header.Algorithm)
+	}
+	if err = verifySignature(header.Algorithm, key.key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	if err = decodeSegment(parts[1], claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if !slices.Contains(claims.Audience, p.clientID) {
+		return nil, fmt.Errorf("%w: token isn't issued for the client", ErrInvalidToken)
+	}
+	if claims.AuthorizedParty != "" && claims.AuthorizedParty != p.clientID {
+		return nil, fmt.Errorf("%w: token is issued to the client %q", ErrInvalidToken, claims.AuthorizedParty)
+	}
+	if !now.Add(-clockSkew).Before(time.Unix(claims.Expires, 0)) {
+		return nil, fmt.Errorf("%w: token is expired", ErrInvalidToken)
+	}
+	if claims.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("%w: token isn't valid yet", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// key returns the public key of the provider of the ID, refreshing the keys if it's unknown.
+// The failed refreshes are throttled as well, so the tokens of the unknown keys don't flood the unavailable provider.
+func (p *Provider) key(ctx context.Context, id string, now time.Time) (publicKey, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+	if !p.refreshed.IsZero() && now.Sub(p.refreshed) < refreshInterval {
+		if p.keys == nil {
+			return publicKey{}, errors.New("provider keys aren't fetched, retrying later")
+		}
+		return publicKey{}, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, id)
+	}
+	p.refreshed = now
+	if err := p.refresh(ctx); err != nil {
+		return publicKey{}, fmt.Errorf("cannot fetch provider keys: %w", err)
+	}
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+	return publicKey{}, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, id)
+}
+
+// refresh discovers the provider configuration, if it isn't yet, and fetches its keys. The mutex must be held.
+func (p *Provider) refresh(ctx context.Context) error {
+	if p.jwksURI == "" {
+		discovery := struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		if err := p.get(ctx, p.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return err
+		}
+		if discovery.JWKSURI == "" {
+			return errors.New("provider configuration has no jwks_uri")
+		}
+		p.jwksURI = discovery.JWKSURI
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := p.get(ctx, p.jwksURI, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]publicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// The keys of the unsupported types are skipped, the tokens signed by them are rejected
+		if key, err := k.publicKey(); err == nil {
+			keys[k.KeyID] = publicKey{key: key, algorithm: k.Algorithm}
+		}
+	}
+	p.keys = keys
+	return nil
+}
+
+// get fetches the JSON document of the URL into v.
+func (p *Provider) get(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s of %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jwk is a JSON Web Key of the provider.
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+}
+
+// publicKey returns the RSA public key of at least minRSABits or the P-256 ECDSA public key.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		modulus, exponent := new(big.Int).SetBytes(n), new(big.Int).SetBytes(e)
+		if modulus.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key is shorter than %d bits", minRSABits)
+		}
+		if exponent.BitLen() > 31 || exponent.Int64() < 3 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		// The point off the curve is rejected by the conversion
+		if _, err = key.ECDH(); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
+
+// verifySignature checks the RS256 or the ES256 signature of the signed part of the token.
+func verifySignature(algorithm string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return ErrInvalidToken
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve != elliptic.P256() || len(signature) != 64 {
+			return ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return ErrInvalidToken
+		}
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, algorithm)
+	}
+	return nil
+}
+
+// decodeSegment decodes the base64url encoded JSON segment of the token into v.
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
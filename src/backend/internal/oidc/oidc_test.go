@@ -0,0 +1,348 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "analytics"
+
+// testIssuer is the provider serving its configuration and its keys.
+type testIssuer struct {
+	server *httptest.Server
+
+	mutex sync.Mutex
+	keys  []map[string]string
+	// fetches is the amount of the requests of the keys
+	fetches int
+	// failing makes the provider respond with the errors
+	failing bool
+}
+
+// newTestIssuer returns the provider serving the keys.
+func newTestIssuer(t *testing.T, keys ...map[string]string) *testIssuer {
+	i := &testIssuer{keys: keys}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": i.server.URL, "jwks_uri": i.server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		i.mutex.Lock()
+		defer i.mutex.Unlock()
+		i.fetches++
+		if i.failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": i.keys})
+	})
+	i.server = httptest.NewServer(mux)
+	t.Cleanup(i.server.Close)
+	return i
+}
+
+// add adds the key to the served ones.
+func (i *testIssuer) add(key map[string]string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.keys = append(i.keys, key)
+}
+
+// fetched returns the amount of the requests of the keys.
+func (i *testIssuer) fetched() int {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.fetches
+}
+
+// setFailing makes the provider respond with the errors or not.
+func (i *testIssuer) setFailing(failing bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.failing = failing
+}
+
+// encode returns the base64url encoding of the bytes without the padding.
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// rsaJWK returns the JWK of the RSA key.
+func rsaJWK(kid string, alg string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "alg": alg, "n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes())}
+}
+
+// ecJWK returns the JWK of the ECDSA key.
+func ecJWK(kid string, curve string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": curve, "x": encode(key.X.Bytes()), "y": encode(key.Y.Bytes())}
+}
+
+// sign returns the token of the claims signed by the key with the algorithm, signing the HMAC ones with the secret.
+func sign(t *testing.T, alg string, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + encode(signature)
+}
+
+// testKeys are the keys of the provider.
+type testKeys struct {
+	rsa      *rsa.PrivateKey
+	ec       *ecdsa.PrivateKey
+	ec384    *ecdsa.PrivateKey
+	shortRSA *rsa.PrivateKey
+}
+
+// newTestKeys returns the generated keys.
+func newTestKeys(t *testing.T) *testKeys {
+	keys := &testKeys{}
+	var err error
+	if keys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if keys.shortRSA, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if keys.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if keys.ec384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	encryption := rsaJWK("rsa-enc", "", &keys.rsa.PublicKey)
+	encryption["use"] = "enc"
+	issuer := newTestIssuer(t,
+		rsaJWK("rsa", "RS256", &keys.rsa.PublicKey),
+		rsaJWK("rsa-any", "", &keys.rsa.PublicKey),
+		rsaJWK("rsa-pss", "PS256", &keys.rsa.PublicKey),
+		rsaJWK("rsa-short", "RS256", &keys.shortRSA.PublicKey),
+		encryption,
+		ecJWK("ec", "P-256", &keys.ec.PublicKey),
+		ecJWK("ec-384", "P-384", &keys.ec384.PublicKey),
+	)
+	provider, err := NewProvider(issuer.server.URL+"/", testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	// claims returns the valid claims with the changes
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":   issuer.server.URL,
+			"sub":   "user",
+			"aud":   testClientID,
+			"exp":   now.Add(time.Hour).Unix(),
+			"email": "user@example.com",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	valid := sign(t, "RS256", "rsa", keys.rsa, claims(nil))
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "RS256", token: valid},
+		{name: "RS256 of unrestricted key", token: sign(t, "RS256", "rsa-any", keys.rsa, claims(nil))},
+		{name: "ES256", token: sign(t, "ES256", "ec", keys.ec, claims(nil))},
+		{name: "issuer with trailing slash", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"iss": issuer.server.URL + "/"}))},
+		{name: "audience array", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"aud": []string{"other", testClientID}}))},
+		{name: "audience array with authorized party", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"aud": []string{"other", testClientID}, "azp": testClientID}))},
+		{name: "audience array of others", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"aud": []string{"other", "another"}})), wantErr: true},
+		{name: "other authorized party", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"aud": []string{"other", testClientID}, "azp": "other"})), wantErr: true},
+		{name: "other audience", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"aud": "other"})), wantErr: true},
+		{name: "missing audience", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"aud": nil})), wantErr: true},
+		{name: "other issuer", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"iss": "https://issuer.example.com"})), wantErr: true},
+		{name: "expired within skew", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"exp": now.Add(-clockSkew / 2).Unix()}))},
+		{name: "expired", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"exp": now.Add(-2 * clockSkew).Unix()})), wantErr: true},
+		{name: "missing expiration", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"exp": nil})), wantErr: true},
+		{name: "not before within skew", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"nbf": now.Add(clockSkew / 2).Unix()}))},
+		{name: "not before", token: sign(t, "RS256", "rsa", keys.rsa, claims(map[string]any{"nbf": now.Add(2 * clockSkew).Unix()})), wantErr: true},
+		{name: "tampered claims", token: parts[0] + "." + encode([]byte(`{"iss":"`+issuer.server.URL+`","aud":"analytics","exp":9999999999,"email":"admin@example.com"}`)) + "." + parts[2], wantErr: true},
+		{name: "tampered signature", token: parts[0] + "." + parts[1] + "." + encode([]byte("signature")), wantErr: true},
+		{name: "RS256 of EC key", token: sign(t, "RS256", "ec", keys.rsa, claims(nil)), wantErr: true},
+		{name: "ES256 of RSA key", token: sign(t, "ES256", "rsa-any", keys.ec, claims(nil)), wantErr: true},
+		{name: "RS256 of PS256 key", token: sign(t, "RS256", "rsa-pss", keys.rsa, claims(nil)), wantErr: true},
+		{name: "HS256 with public key", token: sign(t, "HS256", "rsa-any", keys.rsa.PublicKey.N.Bytes(), claims(nil)), wantErr: true},
+		{name: "none", token: strings.TrimSuffix(sign(t, "none", "rsa-any", nil, claims(nil)), "."), wantErr: true},
+		{name: "unsigned none", token: sign(t, "none", "rsa-any", nil, claims(nil)), wantErr: true},
+		{name: "ES256 of P-384 key", token: sign(t, "ES256", "ec-384", keys.ec384, claims(nil)), wantErr: true},
+		{name: "short RSA key", token: sign(t, "RS256", "rsa-short", keys.shortRSA, claims(nil)), wantErr: true},
+		{name: "encryption key", token: sign(t, "RS256", "rsa-enc", keys.rsa, claims(nil)), wantErr: true},
+		{name: "unknown key", token: sign(t, "RS256", "unknown", keys.rsa, claims(nil)), wantErr: true},
+		{name: "malformed", token: "token", wantErr: true},
+		{name: "malformed header", token: "e30." + parts[1] + "." + parts[2], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := provider.Verify(context.Background(), tt.token, now)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Errorf("Verify() error = %v, want %v", err, ErrInvalidToken)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if got.Email != "user@example.com" {
+				t.Errorf("Verify() email = %q, want user@example.com", got.Email)
+			}
+		})
+	}
+	// The unknown keys are fetched once per refreshInterval
+	if fetched := issuer.fetched(); fetched != 1 {
+		t.Errorf("keys are fetched %d times, want 1", fetched)
+	}
+}
+
+func TestVerifyRefresh(t *testing.T) {
+	keys := newTestKeys(t)
+	issuer := newTestIssuer(t, rsaJWK("rsa", "RS256", &keys.rsa.PublicKey))
+	provider, err := NewProvider(issuer.server.URL, testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	token := func(kid string, key any, alg string) string {
+		return sign(t, alg, kid, key, map[string]any{"iss": issuer.server.URL, "aud": testClientID, "exp": now.Add(time.Hour).Unix()})
+	}
+	rotated := token("ec", keys.ec, "ES256")
+
+	steps := []struct {
+		name        string
+		token       string
+		at          time.Duration
+		wantFetched int
+		wantErr     error
+	}{
+		{name: "first key", token: token("rsa", keys.rsa, "RS256"), wantFetched: 1},
+		{name: "known key", token: token("rsa", keys.rsa, "RS256"), at: 2 * refreshInterval, wantFetched: 1},
+		// The refresh on the unknown key is throttled, even if the provider has rotated its keys meanwhile
+		{name: "rotated key", token: rotated, at: refreshInterval / 2, wantFetched: 1, wantErr: ErrInvalidToken},
+		{name: "rotated key refreshed", token: rotated, at: refreshInterval, wantFetched: 2},
+		{name: "unknown key", token: token("unknown", keys.rsa, "RS256"), at: 2 * refreshInterval, wantFetched: 3, wantErr: ErrInvalidToken},
+		{name: "unknown key throttled", token: token("unknown", keys.rsa, "RS256"), at: 2*refreshInterval + time.Second, wantFetched: 3, wantErr: ErrInvalidToken},
+	}
+	for i, step := range steps {
+		if i == 3 {
+			issuer.add(ecJWK("ec", "P-256", &keys.ec.PublicKey))
+		}
+		_, err := provider.Verify(context.Background(), step.token, now.Add(step.at))
+		if !errors.Is(err, step.wantErr) {
+			t.Errorf("%s: Verify() error = %v, want %v", step.name, err, step.wantErr)
+		}
+		if fetched := issuer.fetched(); fetched != step.wantFetched {
+			t.Errorf("%s: keys are fetched %d times, want %d", step.name, fetched, step.wantFetched)
+		}
+	}
+}
+
+func TestVerifyUnavailable(t *testing.T) {
+	keys := newTestKeys(t)
+	issuer := newTestIssuer(t, rsaJWK("rsa", "RS256", &keys.rsa.PublicKey))
+	issuer.setFailing(true)
+	provider, err := NewProvider(issuer.server.URL, testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	token := sign(t, "RS256", "rsa", keys.rsa, map[string]any{"iss": issuer.server.URL, "aud": testClientID, "exp": now.Add(time.Hour).Unix()})
+
+	// The failures aren't the invalid tokens, so the users are told the provider is unavailable,
+	// and the failed refreshes are throttled as well
+	for _, at := range []time.Duration{0, time.Second} {
+		if _, err = provider.Verify(context.Background(), token, now.Add(at)); err == nil || errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify() of the unavailable provider error = %v, want the unavailability", err)
+		}
+	}
+	if fetched := issuer.fetched(); fetched != 1 {
+		t.Errorf("keys are fetched %d times, want 1", fetched)
+	}
+
+	issuer.setFailing(false)
+	if _, err = provider.Verify(context.Background(), token, now.Add(refreshInterval)); err != nil {
+		t.Errorf("Verify() of the recovered provider error = %v", err)
+	}
+}
+
+func TestPublicKeyCurve(t *testing.T) {
+	keys := newTestKeys(t)
+
+	// The points off the curve are rejected
+	offCurve := ecJWK("ec", "P-256", &keys.ec.PublicKey)
+	offCurve["y"] = encode(new(big.Int).Add(keys.ec.PublicKey.Y, big.NewInt(1)).Bytes())
+	k := &jwk{KeyType: "EC", Curve: offCurve["crv"], X: offCurve["x"], Y: offCurve["y"]}
+	if _, err := k.publicKey(); err == nil {
+		t.Error("publicKey() of the point off the curve error = nil")
+	}
+
+	// The ES256 signatures are verified by the P-256 keys only
+	digest := sha256.Sum256([]byte("signed"))
+	r, s, err := ecdsa.Sign(rand.Reader, keys.ec384, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 48))[:32], s.FillBytes(make([]byte, 48))[:32]...)
+	if err = verifySignature("ES256", &keys.ec384.PublicKey, "signed", signature); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("verifySignature() of the P-384 key error = %v, want %v", err, ErrInvalidToken)
+	}
+}
@@ -0,0 +1,137 @@
+package plausible
+
+import (
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// eventProperties returns the values of the properties counted per event.
+var eventProperties = map[string]func(e *analytics.Event) (string, error){
+	"event:page":     func(e *analytics.Event) (string, error) { return prometheus.PagePath(e.GetURL()) },
+	"event:name":     func(e *analytics.Event) (string, error) { return e.GetType(), nil },
+	"visit:source":   prometheus.EventSource,
+	"visit:referrer": prometheus.EventReferrer,
+	"visit:device":   func(e *analytics.Event) (string, error) { return prometheus.EventDevice(e), nil },
+	"visit:os":       func(e *analytics.Event) (string, error) { return prometheus.EventOS(e), nil },
+	"visit:browser":  func(e *analytics.Event) (string, error) { return prometheus.EventBrowser(e), nil },
+}
+
+// eventMetrics are the metrics of the breakdowns by the event properties.
+var eventMetrics = []string{"visitors", "events", "pageviews"}
+
+// visitMetrics are the metrics of the breakdowns by the entry and the exit pages, which are counted per visit.
+var visitMetrics = []string{"visits"}
+
+// counts holds the metrics of a value of the property.
+type counts struct {
+	visitors  map[string]struct{}
+	anonymous int64
+	events    int64
+	pageviews int64
+}
+
+// breakdown returns the sorted metrics of every value of the property.
+func (a *API) breakdown(r *http.Request, q *query, property string) ([]map[string]any, error) {
+	name := keyName(property)
+	if property == "visit:entry_page" || property == "visit:exit_page" {
+		metrics, err := q.metrics("visits", visitMetrics)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := prometheus.GetAnalyticsStatsRange(r.Context(), a.db, q.site, q.settings, q.from, q.to)
+		if err != nil {
+			return nil, err
+		}
+		rating := stats.EntryPagesRate
+		if property == "visit:exit_page" {
+			rating = stats.ExitPagesRate
+		}
+		results := make([]map[string]any, 0, len(rating))
+		for value, visits := range rating {
+			results = append(results, map[string]any{name: value, metrics[0]: int64(visits)})
+		}
+		sortResults(results, name, metrics[0])
+		return results, nil
+	}
+
+	value, ok := eventProperties[property]
+	if !ok {
+		return nil, badRequest("property %q is not supported", property)
+	}
+	if property == "event:page" {
+		// The pages are counted the same way as in the stats, with the URL rules of the site
+		value = func(e *analytics.Event) (string, error) {
+			path, err := prometheus.PagePath(e.GetURL())
+			return q.settings.URLRules.NormalizePath(path), err
+		}
+	}
+	metrics, err := q.metrics("visitors", eventMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]*counts)
+	err = a.db.ForEach(r.Context(), q.site, q.from, q.to, func(e *analytics.Event) error {
+		v, err := value(e)
+		if err != nil || v == "" {
+			return err
+		}
+		c, ok := values[v]
+		if !ok {
+			c = &counts{visitors: make(map[string]struct{})}
+			values[v] = c
+		}
+		// the events without the visitor hash are of the unknown visitors, which are counted once each
+		if hash := e.GetHashedVisit(); hash != "" {
+			c.visitors[hash] = struct{}{}
+		} else {
+			c.anonymous++
+		}
+		c.events++
+		if e.GetType() == "pageview" {
+			c.pageviews++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]map[string]any, 0, len(values))
+	for v, c := range values {
+		result := map[string]any{name: v}
+		for _, metric := range metrics {
+			switch metric {
+			case "visitors":
+				result[metric] = int64(len(c.visitors)) + c.anonymous
+			case "events":
+				result[metric] = c.events
+			case "pageviews":
+				result[metric] = c.pageviews
+			}
+		}
+		results = append(results, result)
+	}
+	sortResults(results, name, metrics[0])
+	return results, nil
+}
+
+// sortResults sorts the results by the metric in the descending order, and by the value on ties.
+func sortResults(results []map[string]any, name string, metric string) {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i][metric].(int64), results[j][metric].(int64)
+		if a != b {
+			return a > b
+		}
+		return results[i][name].(string) < results[j][name].(string)
+	})
+}
+
+// keyName returns the name of the property in the breakdown results, e.g. "page" for "event:page".
+func keyName(property string) string {
+	_, name, _ := strings.Cut(property, ":")
+	return name
+}
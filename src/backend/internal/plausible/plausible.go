@@ -0,0 +1,269 @@
+// Package plausible implements the Plausible Stats API v1 compatible endpoints over the stats of the events,
+// so the dashboards, the SDKs and the Grafana plugins made for Plausible work with the service.
+//
+// The sites are passed as site_id, and the API keys as the bearer tokens, the same way as to Plausible.
+// The filters and the metrics without the counterparts in the stats (e.g. visit_duration) are rejected
+// with 400 Bad Request rather than answered with the wrong numbers.
+package plausible
+
+import (
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/sites"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"time"
+)
+
+// The gateway paths of the endpoints.
+const (
+	AggregatePath  = "/api/v1/stats/aggregate"
+	TimeseriesPath = "/api/v1/stats/timeseries"
+	BreakdownPath  = "/api/v1/stats/breakdown"
+	RealtimePath   = "/api/v1/stats/realtime/visitors"
+)
+
+// maxBuckets is the maximal amount of the time series buckets, e.g. a month of hours.
+const maxBuckets = 31 * 24
+
+// apiError is an error responded with the status code as {"error": "..."}, the way Plausible does.
+type apiError struct {
+	code    int
+	message string
+}
+
+// Error implements error.
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// badRequest returns apiError with 400 Bad Request status.
+func badRequest(format string, args ...any) error {
+	return &apiError{code: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+// API serves the Plausible Stats API v1 endpoints.
+type API struct {
+	db    database.Database
+	sites *sites.Registry
+}
+
+// NewAPI returns new API instance, access to the sites is checked against sitesRegistry, which may be nil.
+func NewAPI(db database.Database, sitesRegistry *sites.Registry) (*API, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	return &API{db: db, sites: sitesRegistry}, nil
+}
+
+// Aggregate responds with the metrics of the period, compared to the previous one with compare=previous_period:
+//
+//	{"results": {"visitors": {"value": 201, "change": 12}}}
+func (a *API) Aggregate(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	a.serve(w, r, func(q *query) (any, error) {
+		metrics, err := q.metrics("visitors", aggregateMetrics)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := prometheus.GetAnalyticsStatsRange(r.Context(), a.db, q.site, q.settings, q.from, q.to)
+		if err != nil {
+			return nil, err
+		}
+
+		var previous map[string]any
+		switch compare := r.URL.Query().Get("compare"); compare {
+		case "":
+		case "previous_period":
+			prev, err := prometheus.GetAnalyticsStatsRange(r.Context(), a.db, q.site, q.settings, q.from.Add(-q.to.Sub(q.from)), q.from)
+			if err != nil {
+				return nil, err
+			}
+			previous = metricValues(prev, metrics)
+		default:
+			return nil, badRequest("compare %q is not supported", compare)
+		}
+
+		values := metricValues(stats, metrics)
+		results := make(map[string]any, len(metrics))
+		for _, metric := range metrics {
+			result := map[string]any{"value": values[metric]}
+			if previous != nil {
+				result["change"] = change(metric, values[metric], previous[metric])
+			}
+			results[metric] = result
+		}
+		return results, nil
+	})
+}
+
+// Timeseries responds with the metrics of every interval (hour, date or month) of the period:
+//
+//	{"results": [{"date": "2024-01-01", "visitors": 36}]}
+func (a *API) Timeseries(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	a.serve(w, r, func(q *query) (any, error) {
+		metrics, err := q.metrics("visitors", aggregateMetrics)
+		if err != nil {
+			return nil, err
+		}
+		interval := r.URL.Query().Get("interval")
+		if interval == "" {
+			interval = q.defaultInterval()
+		}
+		buckets, err := q.buckets(interval)
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([]map[string]any, 0, len(buckets))
+		for _, b := range buckets {
+			stats, err := prometheus.GetAnalyticsStatsRange(r.Context(), a.db, q.site, q.settings, b.from, b.to)
+			if err != nil {
+				return nil, err
+			}
+			result := metricValues(stats, metrics)
+			result["date"] = b.label
+			results = append(results, result)
+		}
+		return results, nil
+	})
+}
+
+// Breakdown responds with the metrics of the values of the property, sorted by the first metric:
+//
+//	{"results": [{"page": "/", "visitors": 123}]}
+func (a *API) Breakdown(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	a.serve(w, r, func(q *query) (any, error) {
+		property := r.URL.Query().Get("property")
+		if property == "" {
+			return nil, badRequest("property is missing")
+		}
+		limit, page, err := q.pagination()
+		if err != nil {
+			return nil, err
+		}
+		results, err := a.breakdown(r, q, property)
+		if err != nil {
+			return nil, err
+		}
+
+		start := min((page-1)*limit, len(results))
+		return results[start:min(start+limit, len(results))], nil
+	})
+}
+
+// Realtime responds with the number of the current visitors as a bare number.
+func (a *API) Realtime(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	q, err := a.query(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	visitors, err := prometheus.GetCurrentVisitors(r.Context(), a.db, q.site, q.settings, time.Now())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, visitors)
+}
+
+// serve parses the query and responds with the results of fn as {"results": ...}.
+func (a *API) serve(w http.ResponseWriter, r *http.Request, fn func(q *query) (any, error)) {
+	q, err := a.query(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	results, err := fn(q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, map[string]any{"results": results})
+}
+
+// aggregateMetrics are the metrics of the aggregate and the time series.
+var aggregateMetrics = []string{"visitors", "visits", "pageviews", "events", "bounce_rate", "views_per_visit"}
+
+// metricValues returns the values of the metrics of the stats.
+func metricValues(stats *prometheus.AnalyticsStats, metrics []string) map[string]any {
+	values := make(map[string]any, len(metrics)+1)
+	for _, metric := range metrics {
+		switch metric {
+		case "visitors":
+			values[metric] = stats.UniqueVisitors
+		case "visits":
+			values[metric] = stats.TotalVisits
+		case "pageviews":
+			values[metric] = stats.TotalPageViews
+		case "events":
+			// every event is counted for its page
+			var events int64
+			for _, n := range stats.PagesRate {
+				events += int64(n)
+			}
+			values[metric] = events
+		case "bounce_rate":
+			values[metric] = int64(math.Round(stats.BounceRate * 100))
+		case "views_per_visit":
+			var views float64
+			if stats.TotalVisits > 0 {
+				views = math.Round(float64(stats.TotalPageViews)/float64(stats.TotalVisits)*100) / 100
+			}
+			values[metric] = views
+		}
+	}
+	return values
+}
+
+// change returns the change of the metric from the previous period, in percents or, for the bounce rate,
+// in percentage points.
+func change(metric string, value any, previous any) any {
+	toFloat := func(v any) float64 {
+		switch v := v.(type) {
+		case int64:
+			return float64(v)
+		case float64:
+			return v
+		default:
+			return 0
+		}
+	}
+	cur, prev := toFloat(value), toFloat(previous)
+	switch {
+	case metric == "bounce_rate":
+		return int64(cur - prev)
+	case prev == 0 && cur == 0:
+		return int64(0)
+	case prev == 0:
+		return int64(100)
+	default:
+		return int64(math.Round((cur - prev) / prev * 100))
+	}
+}
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.L().Named("plausible").Debug("cannot write response", zap.Error(err))
+	}
+}
+
+// writeError responds with the error as {"error": "..."}.
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	message := "cannot get stats"
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		code, message = apiErr.code, apiErr.message
+	} else {
+		zap.L().Named("plausible").Error("cannot get stats", zap.Error(err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,206 @@
+package plausible
+
+import (
+	"diploma/analytics-exporter/internal/sites"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateLayout is the layout of the date parameter.
+const dateLayout = "2006-01-02"
+
+// query holds the parameters shared by the endpoints.
+type query struct {
+	r    *http.Request
+	site sites.Key
+	loc  *time.Location
+	// settings are the stats settings of the site
+	settings sites.StatsSettings
+
+	period string
+	// from is inclusive and to is exclusive
+	from, to time.Time
+}
+
+// query authorizes the request and parses the site_id, the period and the date parameters.
+func (a *API) query(r *http.Request) (*query, error) {
+	params := r.URL.Query()
+	domain := params.Get("site_id")
+	if domain == "" {
+		return nil, badRequest("site_id is missing")
+	}
+	if params.Get("filters") != "" {
+		return nil, badRequest("filters are not supported")
+	}
+
+	q := &query{r: r, site: a.sites.Key(domain), loc: time.UTC, settings: a.sites.StatsSettings(domain), period: params.Get("period")}
+	if a.sites != nil {
+		err := a.sites.Authorize(sites.BearerKey(r.Header.Get("Authorization")), domain, sites.PermissionStats)
+		switch {
+		case errors.Is(err, sites.ErrUnauthenticated):
+			return nil, &apiError{code: http.StatusUnauthorized, message: err.Error()}
+		case err != nil:
+			return nil, &apiError{code: http.StatusForbidden, message: "access to " + domain + " is denied"}
+		}
+		if site, ok := a.sites.Get(domain); ok {
+			q.loc = site.Location()
+		}
+	}
+	if q.period == "" {
+		q.period = "30d"
+	}
+	if err := q.parsePeriod(params.Get("date"), time.Now()); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// parsePeriod sets the time range of the period ending on the date, today in the site timezone if it's empty.
+func (q *query) parsePeriod(date string, now time.Time) error {
+	now = now.In(q.loc)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, q.loc)
+	if date != "" && q.period != "custom" {
+		d, err := time.ParseInLocation(dateLayout, date, q.loc)
+		if err != nil {
+			return badRequest("invalid date %q", date)
+		}
+		day = d
+	}
+	month := day.AddDate(0, 0, 1-day.Day())
+
+	switch q.period {
+	case "day":
+		q.from, q.to = day, day.AddDate(0, 0, 1)
+	case "7d":
+		q.from, q.to = day.AddDate(0, 0, -6), day.AddDate(0, 0, 1)
+	case "30d":
+		q.from, q.to = day.AddDate(0, 0, -29), day.AddDate(0, 0, 1)
+	case "month":
+		q.from, q.to = month, month.AddDate(0, 1, 0)
+	case "6mo":
+		q.from, q.to = month.AddDate(0, -5, 0), month.AddDate(0, 1, 0)
+	case "12mo":
+		q.from, q.to = month.AddDate(0, -11, 0), month.AddDate(0, 1, 0)
+	case "custom":
+		first, last, ok := strings.Cut(date, ",")
+		from, err := time.ParseInLocation(dateLayout, first, q.loc)
+		if !ok || err != nil {
+			return badRequest("custom period requires date=YYYY-MM-DD,YYYY-MM-DD")
+		}
+		to, err := time.ParseInLocation(dateLayout, last, q.loc)
+		if err != nil || to.Before(from) {
+			return badRequest("invalid custom period %q", date)
+		}
+		q.from, q.to = from, to.AddDate(0, 0, 1)
+	default:
+		return badRequest("period %q is not supported", q.period)
+	}
+	return nil
+}
+
+// metrics returns the metrics parameter, the default one if it's empty, checking they are supported.
+func (q *query) metrics(defaultMetric string, supported []string) ([]string, error) {
+	param := q.r.URL.Query().Get("metrics")
+	if param == "" {
+		return []string{defaultMetric}, nil
+	}
+	metrics := strings.Split(param, ",")
+	for i, metric := range metrics {
+		metrics[i] = strings.TrimSpace(metric)
+		if !slices.Contains(supported, metrics[i]) {
+			return nil, badRequest("metric %q is not supported, the supported ones are %s", metrics[i], strings.Join(supported, ", "))
+		}
+	}
+	return metrics, nil
+}
+
+// pagination returns the limit and the page parameters of the breakdown.
+func (q *query) pagination() (int, int, error) {
+	params := q.r.URL.Query()
+	limit, page := 100, 1
+	if s := params.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 1000 {
+			return 0, 0, badRequest("limit must be between 1 and 1000")
+		}
+		limit = n
+	}
+	if s := params.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return 0, 0, badRequest("page must be positive")
+		}
+		page = n
+	}
+	return limit, page, nil
+}
+
+// defaultInterval returns the interval of the time series of the period.
+func (q *query) defaultInterval() string {
+	switch q.period {
+	case "day":
+		return "hour"
+	case "6mo", "12mo":
+		return "month"
+	default:
+		return "date"
+	}
+}
+
+// bucket is a time range of the time series.
+type bucket struct {
+	label    string
+	from, to time.Time
+}
+
+// buckets splits the period into the intervals.
+func (q *query) buckets(interval string) ([]bucket, error) {
+	var (
+		start  time.Time
+		next   func(t time.Time) time.Time
+		layout string
+	)
+	switch interval {
+	case "hour":
+		start, layout = q.from, "2006-01-02 15:00:00"
+		next = func(t time.Time) time.Time { return t.Add(time.Hour) }
+	case "date":
+		start, layout = q.from, dateLayout
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case "month":
+		start, layout = q.from.AddDate(0, 0, 1-q.from.Day()), dateLayout
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	default:
+		return nil, badRequest("interval %q is not supported", interval)
+	}
+
+	var buckets []bucket
+	for t := start; t.Before(q.to); t = next(t) {
+		if len(buckets) == maxBuckets {
+			return nil, badRequest("period has more than %d intervals of %s", maxBuckets, interval)
+		}
+		// the first and the last buckets are cut to the period
+		buckets = append(buckets, bucket{label: t.Format(layout), from: maxTime(t, q.from), to: minTime(next(t), q.to)})
+	}
+	return buckets, nil
+}
+
+// maxTime returns the later of the times.
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// minTime returns the earlier of the times.
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -1,21 +1,21 @@
 package prometheus
 
 import (
-	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"sync"
 )
 
 type AnalyticsCollector struct {
-	logger   zap.Logger
-	metrics  map[string]*prometheus.Desc
-	mutex    sync.Mutex
-	database database.Database
-	domain   string
+	logger  zap.Logger
+	metrics map[string]*prometheus.Desc
+	mutex   sync.Mutex
+	cache   *StatsCache
+	site    sites.Key
 }
 
-func NewAnalyticsCollector(constLabels map[string]string, logger *zap.Logger, db database.Database, domain string) *AnalyticsCollector {
+func NewAnalyticsCollector(constLabels map[string]string, logger *zap.Logger, cache *StatsCache, site sites.Key) *AnalyticsCollector {
 	return &AnalyticsCollector{
 		logger: *logger,
 		metrics: map[string]*prometheus.Desc{
@@ -33,9 +33,9 @@ func NewAnalyticsCollector(constLabels map[string]string, logger *zap.Logger, db
 			"exit_pages_rate":       prometheus.NewDesc("exit_pages_rate", "Rating of exit pages", []string{"page"}, constLabels),
 			// TODO: add 404 error pages tracking (https://plausible.io/docs/error-pages-tracking-404)
 		},
-		mutex:    sync.Mutex{},
-		database: db,
-		domain:   domain,
+		mutex: sync.Mutex{},
+		cache: cache,
+		site:  site,
 	}
 }
 
@@ -49,7 +49,7 @@ func (c *AnalyticsCollector) Collect(ch chan<- prometheus.Metric) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	stats, err := GetAnalyticsStats(c.database, c.domain)
+	stats, err := c.cache.Get(c.site)
 	if err != nil {
 		c.logger.Fatal("Error getting stats", zap.Error(err))
 		return
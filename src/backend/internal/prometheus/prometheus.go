@@ -2,17 +2,41 @@ package prometheus
 
 import (
 	"context"
-	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/internal/version"
+	"diploma/analytics-exporter/pkg/api/analytics"
 	"errors"
+	"fmt"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"net/http"
+	"path"
+	"slices"
+	"sync"
 )
 
+// Path is the path the metrics are exposed on.
+const Path = "/metrics"
+
+// Handler serves the metrics of the default registry.
+func Handler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	promhttp.Handler().ServeHTTP(w, r)
+}
+
 type Prometheus struct {
-	db database.Database
+	cache *StatsCache
+
+	mutex      sync.Mutex
+	collectors map[sites.Key]*AnalyticsCollector
+	// tenants are the registries of the collectors of the sites of each tenant
+	tenants map[string]*prometheus.Registry
+	sites   *sites.Registry
+	// autoDomains are the patterns of the domains the collectors are registered for on their first events
+	autoDomains []string
+	// auto are the sites of the registered collectors which aren't configured
+	auto map[sites.Key]bool
 
 	HTTPServer *http.Server
 }
@@ -22,38 +46,130 @@ func (p *Prometheus) Shutdown() error {
 	return p.HTTPServer.Shutdown(context.Background())
 }
 
-func NewPrometheus(db database.Database, addr string, domains []string) (*Prometheus, error) {
-	if db == nil {
-		return nil, errors.New("database.Database instance is nil")
+// NewPrometheus returns new Prometheus instance exposing the metrics of the sites of keys, which may be empty,
+// calculated by cache, which is shared with the stats API.
+// The metrics of the domains which aren't configured and match the path.Match patterns of autoDomains,
+// e.g. *.example.com, are exposed from their first events published to it.
+//
+// The metrics of the sites of each tenant are also exposed on TenantPath, authorized against sitesRegistry.
+func NewPrometheus(cache *StatsCache, addr string, keys []sites.Key, sitesRegistry *sites.Registry, autoDomains []string) (*Prometheus, error) {
+	if cache == nil {
+		return nil, errors.New("StatsCache instance is nil")
 	}
-	if domains == nil {
-		return nil, errors.New("domains is nil")
+	if sitesRegistry == nil {
+		return nil, errors.New("sites.Registry instance is nil")
 	}
-	if len(domains) == 0 {
-		return nil, errors.New("the domain list is empty")
+	for _, pattern := range autoDomains {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid domain pattern %q", pattern)
+		}
 	}
-	for _, d := range domains {
-		labels := make(map[string]string)
-		labels["domain"] = d
-		prometheus.MustRegister(NewAnalyticsCollector(labels, zap.L(), db, d))
+	p := &Prometheus{
+		cache:       cache,
+		collectors:  make(map[sites.Key]*AnalyticsCollector, len(keys)),
+		tenants:     make(map[string]*prometheus.Registry),
+		sites:       sitesRegistry,
+		autoDomains: autoDomains,
+		auto:        make(map[sites.Key]bool),
 	}
-
-	promHandler := func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		promhttp.Handler().ServeHTTP(w, r)
+	for _, k := range keys {
+		p.register(k)
 	}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "build_info",
+		Help:        "Build metadata of the service, always 1",
+		ConstLabels: version.Labels(),
+	}, func() float64 { return 1 }))
 
 	router := runtime.NewServeMux()
-	err := router.HandlePath("GET", "/metrics", promHandler)
+	err := router.HandlePath("GET", Path, Handler)
+	if err != nil {
+		return nil, err
+	}
+	err = router.HandlePath("GET", TenantPath, p.TenantHandler)
 	if err != nil {
 		return nil, err
 	}
-	httpServer := &http.Server{
+	p.HTTPServer = &http.Server{
 		Addr:    addr,
 		Handler: router,
 	}
 
-	return &Prometheus{
-		db:         db,
-		HTTPServer: httpServer,
-	}, nil
+	return p, nil
+}
+
+// SetSites replaces the sites the metrics are exposed for,
+// registering the collectors of the new sites and unregistering the removed ones.
+// The cached stats are dropped, as the settings of the sites may have changed.
+// The collectors registered on the first events of the domains are kept.
+func (p *Prometheus) SetSites(keys []sites.Key) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	keys = slices.Clone(keys)
+	for k := range p.auto {
+		if slices.Contains(keys, k) {
+			delete(p.auto, k)
+		} else {
+			keys = append(keys, k)
+		}
+	}
+	p.cache.Reset()
+	for k, collector := range p.collectors {
+		if !slices.Contains(keys, k) {
+			prometheus.Unregister(collector)
+			p.tenants[k.Tenant].Unregister(collector)
+			delete(p.collectors, k)
+		}
+	}
+	for _, k := range keys {
+		if _, ok := p.collectors[k]; !ok {
+			p.register(k)
+		}
+	}
+}
+
+// Publish registers the collector of the site of the event on its first event, if its domain isn't configured
+// and matches the patterns of the domains.
+func (p *Prometheus) Publish(e *analytics.Event) {
+	if len(p.autoDomains) == 0 {
+		return
+	}
+	site := sites.Key{Tenant: e.GetTenant(), Domain: e.GetDomain()}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.collectors[site]; ok || !p.allows(site.Domain) {
+		return
+	}
+	zap.L().Named("prometheus").Info("Registering collector of the new domain", zap.String("domain", site.Domain))
+	p.auto[site] = true
+	p.register(site)
+}
+
+// allows reports whether the domain matches the patterns of the domains the collectors are registered for.
+func (p *Prometheus) allows(domain string) bool {
+	for _, pattern := range p.autoDomains {
+		if ok, _ := path.Match(pattern, domain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// register registers the collector of the site.
+func (p *Prometheus) register(site sites.Key) {
+	labels := make(map[string]string)
+	labels["domain"] = site.Domain
+	collector := NewAnalyticsCollector(labels, zap.L(), p.cache, site)
+	prometheus.MustRegister(collector)
+	p.collectors[site] = collector
+
+	registry, ok := p.tenants[site.Tenant]
+	if !ok {
+		registry = prometheus.NewRegistry()
+		p.tenants[site.Tenant] = registry
+	}
+	registry.MustRegister(collector)
 }
@@ -1,27 +1,46 @@
 package prometheus
 
 import (
+	"container/heap"
 	"context"
 	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
 	"fmt"
+	"golang.org/x/net/publicsuffix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"regexp"
-	"slices"
+	"hash/fnv"
+	"net/url"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
-// VisitDuration is a time duration after which visit counts as an end of the session (visit)
-const VisitDuration = time.Minute * 30
+// VisitDuration is the default time duration after which visit counts as an end of the session (visit),
+// the sites may set their own one.
+const VisitDuration = sites.DefaultSessionTimeout
+
+// MinShardEvents is a minimal average amount of events per shard for the stats calculation to be sharded.
+const MinShardEvents = 5000
+
+// shardChunkSize is an amount of events passed to a shard at once.
+const shardChunkSize = 256
+
+// ReorderTolerance is the lateness up to which the events are stitched into the visits in the timestamp order,
+// the later ones are merged into the current visits of their visitors.
+const ReorderTolerance = time.Minute
 
 type AnalyticsStats struct {
 	UniqueVisitors  int64
 	TotalVisits     int64
 	TotalPageViews  int64
 	CurrentVisitors int64
-	BounceRate      float64
+	// BounceRate is the share of the visits with a single page view, from 0 to 1
+	BounceRate float64
 
 	PagesRate      map[string]int
 	SourcesRate    map[string]int
@@ -33,184 +52,591 @@ type AnalyticsStats struct {
 }
 
 type Visit struct {
-	EntryPage             string
-	ExitPage              string
-	PagesVisited          int
-	LastPageViewTimestamp time.Time
+	EntryPage              string
+	ExitPage               string
+	PagesVisited           int
+	FirstPageViewTimestamp time.Time
+	LastPageViewTimestamp  time.Time
+}
+
+// GetAnalyticsStats aggregates all the events of the site into AnalyticsStats.
+//
+// The events are streamed from the database in the timestamp order, so the memory used
+// depends on the amount of visitors and pages rather than on the amount of events.
+func GetAnalyticsStats(db database.Database, site sites.Key, settings sites.StatsSettings) (*AnalyticsStats, error) {
+	return GetAnalyticsStatsRange(context.Background(), db, site, settings, time.Time{}, time.Time{})
 }
 
-func GetAnalyticsStats(db database.Database, domain string) (*AnalyticsStats, error) {
+// GetAnalyticsStatsRange aggregates the events of the site in the time range into AnalyticsStats,
+// zero from or to leave the range unbounded on that side.
+//
+// The visits and the pages are the ones of the site settings.
+func GetAnalyticsStatsRange(ctx context.Context, db database.Database, site sites.Key, settings sites.StatsSettings, from, to time.Time) (*AnalyticsStats, error) {
 	if db == nil {
 		return nil, status.Error(codes.InvalidArgument, "database is nil")
 	}
 
-	events, err := db.List(context.Background(), domain)
-
+	stats, err := aggregateRange(ctx, db, site, settings, from, to)
 	if err != nil {
 		return nil, err
 	}
+	if err = setCurrentVisitors(ctx, db, site, settings, stats, to, time.Now()); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
 
-	var pageViewsCount int
+// aggregateRange aggregates the events of the site in the time range without the current visitors.
+func aggregateRange(ctx context.Context, db database.Database, site sites.Key, settings sites.StatsSettings, from, to time.Time) (*AnalyticsStats, error) {
+	return aggregateStats(func(fn func(e *analytics.Event) error) error {
+		return db.ForEach(ctx, site, from, to, fn)
+	}, runtime.GOMAXPROCS(0), settings)
+}
 
-	pages := make(map[string]int)
-	sources := make(map[string]int)
-	devices := make(map[string]int)
-	oss := make(map[string]int)
-	browsers := make(map[string]int)
-	visitsMap := make(map[string][]*Visit)
+// setCurrentVisitors sets the current visitors of the stats of the range ending at to.
+// The visitors are current only for the ranges reaching the current visitors window, e.g. today.
+func setCurrentVisitors(ctx context.Context, db database.Database, site sites.Key, settings sites.StatsSettings, stats *AnalyticsStats, to time.Time, now time.Time) error {
+	if !to.IsZero() && !to.After(now.Add(-currentVisitorsWindow(settings))) {
+		return nil
+	}
+	visitors, err := GetCurrentVisitors(ctx, db, site, settings, now)
+	if err != nil {
+		return err
+	}
+	stats.CurrentVisitors = visitors
+	return nil
+}
 
-	var sortedEvents = events.GetEvents()
-	if sortedEvents != nil {
-		sort.Slice(sortedEvents, func(i, j int) bool {
-			return sortedEvents[i].GetTimestamp().AsTime().Before(sortedEvents[j].GetTimestamp().AsTime())
-		})
+// GetCurrentVisitors returns the amount of the visitors of the site with events within the current visitors window
+// of the settings before now, DefaultCurrentVisitorsWindow if it's zero. Only the events of the window are read,
+// and the ones after now, e.g. of the backfilled data, aren't counted.
+//
+// The events without the visitor hash are of the unknown visitors, which are counted once each.
+func GetCurrentVisitors(ctx context.Context, db database.Database, site sites.Key, settings sites.StatsSettings, now time.Time) (int64, error) {
+	if db == nil {
+		return 0, status.Error(codes.InvalidArgument, "database is nil")
+	}
+	window := currentVisitorsWindow(settings)
+
+	visitors := make(map[string]struct{})
+	var anonymous int64
+	err := db.ForEach(ctx, site, now.Add(-window), now, func(e *analytics.Event) error {
+		if hash := e.GetHashedVisit(); hash != "" {
+			visitors[hash] = struct{}{}
+		} else {
+			anonymous++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(visitors)) + anonymous, nil
+}
+
+// currentVisitorsWindow returns the current visitors window of the settings, DefaultCurrentVisitorsWindow if it's zero.
+func currentVisitorsWindow(settings sites.StatsSettings) time.Duration {
+	if settings.CurrentVisitorsWindow <= 0 {
+		return sites.DefaultCurrentVisitorsWindow
 	}
+	return settings.CurrentVisitorsWindow
+}
 
-	for _, e := range sortedEvents {
+// CalculateAnalyticsStats aggregates the events into AnalyticsStats with the visits and the pages
+// of the site settings.
+//
+// The events slice is sorted by timestamp in place.
+func CalculateAnalyticsStats(events []*analytics.Event, settings sites.StatsSettings) (*AnalyticsStats, error) {
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].GetTimestamp().AsTime().Before(events[j].GetTimestamp().AsTime())
+	})
 
-		// count a total of page views
-		if e.Type == "pageview" {
-			pageViewsCount++
+	return aggregateStats(func(fn func(e *analytics.Event) error) error {
+		for _, e := range events {
+			if err := fn(e); err != nil {
+				return err
+			}
 		}
+		return nil
+	}, runtime.GOMAXPROCS(0), settings)
+}
 
-		// extract full url domain and url relative path
-		fullUrlDomain, urlPath, err := extractDomainAndPath(e.GetURL())
+// aggregateStats aggregates the events, which scan passes to its argument in the timestamp order,
+// the events up to ReorderTolerance late are reordered.
+//
+// With more than one shard the events are partitioned by the visit hash, so that every shard
+// is stitched into visits on its own goroutine, and the partial results are merged.
+// The shards are started once there are MinShardEvents of two shards, the fewer events
+// are aggregated sequentially without the overhead of the goroutines and the merge.
+func aggregateStats(scan func(fn func(e *analytics.Event) error) error, shardsAmount int, settings sites.StatsSettings) (*AnalyticsStats, error) {
+	if shardsAmount < 2 {
+		a := newStatsAggregator(settings)
+		if err := scan(a.add); err != nil {
+			return nil, err
+		}
+		shard, err := a.result()
 		if err != nil {
 			return nil, err
 		}
-		// remove the optional .html at the end and write the url relative path to the map
-		urlPath = regexp.MustCompile(`\.html$`).ReplaceAllString(urlPath, "")
-
-		// add the url path to the pages statistic
-		pages[urlPath]++
-
-		// count a total of visitsMap
-		if v, ok := visitsMap[e.GetHashedVisit()]; !ok {
-			visitsMap[e.GetHashedVisit()] = make([]*Visit, 1)
-			visitsMap[e.GetHashedVisit()][0] = &Visit{
-				EntryPage:             urlPath,
-				ExitPage:              urlPath,
-				PagesVisited:          1,
-				LastPageViewTimestamp: e.GetTimestamp().AsTime(),
-			}
-		} else {
-			lastVisit := v[len(v)-1]
-
-			if e.GetTimestamp().AsTime().Sub(lastVisit.LastPageViewTimestamp) > VisitDuration {
-				visitsMap[e.GetHashedVisit()] = append(visitsMap[e.GetHashedVisit()], &Visit{
-					EntryPage:             urlPath,
-					ExitPage:              urlPath,
-					PagesVisited:          1,
-					LastPageViewTimestamp: e.GetTimestamp().AsTime(),
-				})
-			} else {
-				lastVisit.ExitPage = urlPath
-				lastVisit.PagesVisited++
-				lastVisit.LastPageViewTimestamp = e.GetTimestamp().AsTime()
+		return mergeShardStats(shard), nil
+	}
+
+	// The first events are buffered until it's known whether there are enough of them to be sharded
+	var shards *shardedAggregation
+	head := make([]*analytics.Event, 0)
+	scanErr := scan(func(e *analytics.Event) error {
+		if shards != nil {
+			shards.add(e)
+			return nil
+		}
+		head = append(head, e)
+		if len(head) == MinShardEvents*2 {
+			shards = newShardedAggregation(shardsAmount, settings)
+			for _, e := range head {
+				shards.add(e)
 			}
+			head = nil
 		}
+		return nil
+	})
+	if shards != nil {
+		return shards.result(scanErr)
+	}
+	if scanErr != nil {
+		return nil, scanErr
+	}
 
-		// if referrer is empty that means that the client opened the page directly
-		// or HTTP doesn't support this type of referrer
-		if e.GetReferrer() == "" {
-			sources["Direct/None"]++
-		} else {
-			var referrerDomain string
-			fullReferrerDomain, _, err := extractDomainAndPath(e.GetReferrer())
-			if err != nil {
-				return nil, err
-			}
-			referrerDomains := strings.Split(fullReferrerDomain, ".")
-			if len(referrerDomains) > 1 {
-				slices.Reverse(referrerDomains)
-				referrerDomain = fmt.Sprintf("%s.%s", referrerDomains[1], referrerDomains[0])
-			} else {
-				referrerDomain = fullReferrerDomain
-			}
+	a := newStatsAggregator(settings)
+	for _, e := range head {
+		if err := a.add(e); err != nil {
+			return nil, err
+		}
+	}
+	shard, err := a.result()
+	if err != nil {
+		return nil, err
+	}
+	return mergeShardStats(shard), nil
+}
+
+// shardedAggregation aggregates the events partitioned by the visit hash on the goroutines of the shards,
+// the events of a single visitor always share the shard.
+type shardedAggregation struct {
+	aggregators []*statsAggregator
+	// inputs pass the events in chunks to reduce the synchronisation overhead
+	inputs []chan []*analytics.Event
+	chunks [][]*analytics.Event
+	errs   []error
+	wg     sync.WaitGroup
+}
 
-			// if URL and referrer domains aren't the same - that means that the client
-			// opened the page from the other website
-			if fullUrlDomain != fullReferrerDomain {
-				sources[referrerDomain]++
+// newShardedAggregation starts the workers of the shards.
+func newShardedAggregation(shardsAmount int, settings sites.StatsSettings) *shardedAggregation {
+	s := &shardedAggregation{
+		aggregators: make([]*statsAggregator, shardsAmount),
+		inputs:      make([]chan []*analytics.Event, shardsAmount),
+		chunks:      make([][]*analytics.Event, shardsAmount),
+		errs:        make([]error, shardsAmount),
+	}
+	for i := range s.aggregators {
+		s.aggregators[i] = newStatsAggregator(settings)
+		s.inputs[i] = make(chan []*analytics.Event, 4)
+		s.wg.Add(1)
+		go func(i int) {
+			defer s.wg.Done()
+			for chunk := range s.inputs[i] {
+				for _, e := range chunk {
+					// Keep draining the input after an error, so the producer is never blocked
+					if s.errs[i] == nil {
+						s.errs[i] = s.aggregators[i].add(e)
+					}
+				}
 			}
+		}(i)
+	}
+	return s
+}
+
+// add passes the event to its shard keeping the order of the events.
+func (s *shardedAggregation) add(e *analytics.Event) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(e.GetHashedVisit()))
+	i := h.Sum32() % uint32(len(s.inputs))
+	s.chunks[i] = append(s.chunks[i], e)
+	if len(s.chunks[i]) == shardChunkSize {
+		s.inputs[i] <- s.chunks[i]
+		s.chunks[i] = make([]*analytics.Event, 0, shardChunkSize)
+	}
+}
+
+// result waits for the shards and merges their statistics, scanErr is the error of scanning the events.
+func (s *shardedAggregation) result(scanErr error) (*AnalyticsStats, error) {
+	for i := range s.inputs {
+		if len(s.chunks[i]) > 0 {
+			s.inputs[i] <- s.chunks[i]
 		}
+		close(s.inputs[i])
+	}
+	s.wg.Wait()
+	if err := errors.Join(append(s.errs, scanErr)...); err != nil {
+		return nil, err
+	}
 
-		switch d := e.GetDevice(); {
-		case d.GetDesktop():
-			devices["Desktop"]++
-		case d.GetMobile():
-			devices["Mobile"]++
-		case d.GetTablet():
-			devices["Tablet"]++
-		case d.GetBot():
-			devices["Bot"]++
-		default:
-			devices["Unknown"]++
+	shards := make([]*shardStats, len(s.aggregators))
+	for i, a := range s.aggregators {
+		shard, err := a.result()
+		if err != nil {
+			return nil, err
 		}
+		shards[i] = shard
+	}
+	return mergeShardStats(shards...), nil
+}
 
-		if os := e.GetOS(); os != "" {
-			oss[e.GetOS()]++
-		} else {
-			oss["Unknown"]++
+// shardStats holds the statistics calculated for a part of the events.
+type shardStats struct {
+	AnalyticsStats
+
+	onePageVisits int64
+}
+
+// mergeShardStats sums up the partial statistics and calculates the derived values.
+func mergeShardStats(shards ...*shardStats) *AnalyticsStats {
+	res := &AnalyticsStats{
+		PagesRate:      make(map[string]int),
+		SourcesRate:    make(map[string]int),
+		DevicesRate:    make(map[string]int),
+		OSsRate:        make(map[string]int),
+		BrowsersRate:   make(map[string]int),
+		EntryPagesRate: make(map[string]int),
+		ExitPagesRate:  make(map[string]int),
+	}
+	mergeRate := func(dst, src map[string]int) {
+		for k, v := range src {
+			dst[k] += v
 		}
+	}
 
-		if browser := e.GetBrowser(); browser != "" {
-			browsers[e.GetBrowser()]++
-		} else {
-			browsers["Unknown"]++
+	var onePageVisits int64
+	for _, s := range shards {
+		res.UniqueVisitors += s.UniqueVisitors
+		res.TotalVisits += s.TotalVisits
+		res.TotalPageViews += s.TotalPageViews
+		onePageVisits += s.onePageVisits
+
+		mergeRate(res.PagesRate, s.PagesRate)
+		mergeRate(res.SourcesRate, s.SourcesRate)
+		mergeRate(res.DevicesRate, s.DevicesRate)
+		mergeRate(res.OSsRate, s.OSsRate)
+		mergeRate(res.BrowsersRate, s.BrowsersRate)
+		mergeRate(res.EntryPagesRate, s.EntryPagesRate)
+		mergeRate(res.ExitPagesRate, s.ExitPagesRate)
+	}
+	res.BounceRate = bounceRate(onePageVisits, res.TotalVisits)
+
+	return res
+}
+
+// bounceRate returns the share of the one page visits of all the visits, 0 without visits.
+func bounceRate(onePageVisits int64, visits int64) float64 {
+	if visits <= 0 {
+		return 0
+	}
+	return min(max(float64(onePageVisits)/float64(visits), 0), 1)
+}
+
+// statsAggregator aggregates the events sorted by timestamp in a single pass.
+//
+// Only the last visit of every visitor is kept in memory, the previous ones are counted once they end.
+// The events are buffered for ReorderTolerance, so the slightly late ones are still stitched in order.
+type statsAggregator struct {
+	stats      shardStats
+	lastVisits map[string]*Visit
+	// visitTimeout is the inactivity period ending a visit
+	visitTimeout time.Duration
+	// urlRules normalize the page paths
+	urlRules sites.URLRules
+
+	// pending are the buffered events, latest is the newest timestamp added
+	pending eventHeap
+	latest  time.Time
+}
+
+// newStatsAggregator returns new statsAggregator instance of the site settings,
+// the visits end after VisitDuration if their timeout is zero.
+func newStatsAggregator(settings sites.StatsSettings) *statsAggregator {
+	visitTimeout := settings.VisitTimeout
+	if visitTimeout <= 0 {
+		visitTimeout = VisitDuration
+	}
+	return &statsAggregator{
+		visitTimeout: visitTimeout,
+		urlRules:     settings.URLRules,
+		stats: shardStats{
+			AnalyticsStats: AnalyticsStats{
+				PagesRate:      make(map[string]int),
+				SourcesRate:    make(map[string]int),
+				DevicesRate:    make(map[string]int),
+				OSsRate:        make(map[string]int),
+				BrowsersRate:   make(map[string]int),
+				EntryPagesRate: make(map[string]int),
+				ExitPagesRate:  make(map[string]int),
+			},
+		},
+		lastVisits: make(map[string]*Visit),
+	}
+}
+
+// add buffers the event and aggregates the buffered ones at least ReorderTolerance older than the newest one.
+func (a *statsAggregator) add(e *analytics.Event) error {
+	heap.Push(&a.pending, e)
+	if ts := e.GetTimestamp().AsTime(); ts.After(a.latest) {
+		a.latest = ts
+	}
+	return a.flush(a.latest.Add(-ReorderTolerance))
+}
+
+// flush aggregates the buffered events not newer than until in the timestamp order.
+func (a *statsAggregator) flush(until time.Time) error {
+	for len(a.pending) > 0 && !a.pending[0].GetTimestamp().AsTime().After(until) {
+		if err := a.aggregate(heap.Pop(&a.pending).(*analytics.Event)); err != nil {
+			return err
 		}
 	}
-	entryPages := make(map[string]int)
-	exitPages := make(map[string]int)
-	var totalVisits int
-	var onePageVisits int
-	var currentVisitors int
+	return nil
+}
 
-	for _, visits := range visitsMap {
-		for _, visit := range visits {
-			if visit.PagesVisited == 1 {
-				onePageVisits++
-			}
-			if time.Since(visit.LastPageViewTimestamp).Abs() < 5*time.Minute {
-				currentVisitors++
+// aggregate aggregates the event, the ones older than the last event of their visitor are merged into its visit.
+func (a *statsAggregator) aggregate(e *analytics.Event) error {
+	// count a total of page views
+	if e.Type == "pageview" {
+		a.stats.TotalPageViews++
+	}
+
+	// extract url relative path and write it to the map
+	urlPath, err := PagePath(e.GetURL())
+	if err != nil {
+		return err
+	}
+	urlPath = a.urlRules.NormalizePath(urlPath)
+
+	// add the url path to the pages statistic
+	a.stats.PagesRate[urlPath]++
+
+	// count a total of visits, the events without the visitor hash are single page visits of unknown visitors
+	ts := e.GetTimestamp().AsTime()
+	lastVisit, ok := a.lastVisits[e.GetHashedVisit()]
+	switch {
+	case e.GetHashedVisit() == "":
+		a.endVisit(&Visit{
+			EntryPage:              urlPath,
+			ExitPage:               urlPath,
+			PagesVisited:           1,
+			FirstPageViewTimestamp: ts,
+			LastPageViewTimestamp:  ts,
+		})
+	case !ok || ts.Sub(lastVisit.LastPageViewTimestamp) > a.visitTimeout:
+		if ok {
+			a.endVisit(lastVisit)
+		}
+		a.lastVisits[e.GetHashedVisit()] = &Visit{
+			EntryPage:              urlPath,
+			ExitPage:               urlPath,
+			PagesVisited:           1,
+			FirstPageViewTimestamp: ts,
+			LastPageViewTimestamp:  ts,
+		}
+	case ts.Before(lastVisit.LastPageViewTimestamp):
+		// Later than the tolerance, the event is merged into the visit if it's within the timeout of its start,
+		// otherwise it belongs to an already counted visit and only its page view is counted
+		if lastVisit.FirstPageViewTimestamp.Sub(ts) <= a.visitTimeout {
+			lastVisit.PagesVisited++
+			if ts.Before(lastVisit.FirstPageViewTimestamp) {
+				lastVisit.EntryPage = urlPath
+				lastVisit.FirstPageViewTimestamp = ts
 			}
-			entryPages[visit.EntryPage]++
-			exitPages[visit.ExitPage]++
-			totalVisits++
 		}
+	default:
+		lastVisit.ExitPage = urlPath
+		lastVisit.PagesVisited++
+		lastVisit.LastPageViewTimestamp = ts
+	}
+
+	source, err := EventSource(e)
+	if err != nil {
+		return err
+	}
+	if source != "" {
+		a.stats.SourcesRate[source]++
+	}
+	a.stats.DevicesRate[EventDevice(e)]++
+	a.stats.OSsRate[EventOS(e)]++
+	a.stats.BrowsersRate[EventBrowser(e)]++
+
+	return nil
+}
+
+// endVisit counts the finished visit.
+func (a *statsAggregator) endVisit(visit *Visit) {
+	if visit.PagesVisited == 1 {
+		a.stats.onePageVisits++
+	}
+	a.stats.EntryPagesRate[visit.EntryPage]++
+	a.stats.ExitPagesRate[visit.ExitPage]++
+	a.stats.TotalVisits++
+}
+
+// result aggregates the buffered events, counts the visits which are still open and returns the aggregated statistics.
+func (a *statsAggregator) result() (*shardStats, error) {
+	if err := a.flush(a.latest); err != nil {
+		return nil, err
+	}
+	for _, visit := range a.lastVisits {
+		a.endVisit(visit)
+	}
+	a.stats.UniqueVisitors = int64(len(a.lastVisits))
+	a.lastVisits = make(map[string]*Visit)
+	return &a.stats, nil
+}
+
+// PagePath returns the path the page of the link is counted for in PagesRate,
+// the optional .html at the end is removed.
+func PagePath(link string) (string, error) {
+	_, urlPath, err := extractDomainAndPath(link)
+	if err != nil {
+		return "", err
 	}
+	return strings.TrimSuffix(urlPath, ".html"), nil
+}
 
-	return &AnalyticsStats{
-		UniqueVisitors:  int64(len(visitsMap)),
-		TotalVisits:     int64(totalVisits),
-		TotalPageViews:  int64(pageViewsCount),
-		CurrentVisitors: int64(currentVisitors),
-		BounceRate:      float64(onePageVisits) / float64(pageViewsCount),
+// EventSource returns the source the event is counted for in SourcesRate,
+// or an empty string if the visitor came from the same host.
+func EventSource(e *analytics.Event) (string, error) {
+	// if referrer is empty that means that the client opened the page directly
+	// or HTTP doesn't support this type of referrer
+	if e.GetReferrer() == "" {
+		return "Direct/None", nil
+	}
+	fullUrlDomain, _, err := extractDomainAndPath(e.GetURL())
+	if err != nil {
+		return "", err
+	}
+	fullReferrerDomain, _, err := extractDomainAndPath(e.GetReferrer())
+	if err != nil {
+		return "", err
+	}
 
-		PagesRate:      pages,
-		SourcesRate:    sources,
-		DevicesRate:    devices,
-		OSsRate:        oss,
-		BrowsersRate:   browsers,
-		EntryPagesRate: entryPages,
-		ExitPagesRate:  exitPages,
-	}, nil
+	// if URL and referrer domains aren't the same - that means that the client
+	// opened the page from the other website
+	if fullUrlDomain == fullReferrerDomain {
+		return "", nil
+	}
+	return registrableDomain(fullReferrerDomain), nil
 }
 
+// EventReferrer returns the referrer link of the event without its query and fragment, for the detailed
+// breakdowns of the sources grouped by EventSource. The same values as of EventSource are returned
+// for the events without a referrer and with the internal ones.
+func EventReferrer(e *analytics.Event) (string, error) {
+	source, err := EventSource(e)
+	if err != nil || source == "" || e.GetReferrer() == "" {
+		return source, err
+	}
+	u, err := url.Parse(e.GetReferrer())
+	if err != nil || u.Host == "" {
+		// Referrers without a scheme are kept as they are, they have passed extractDomainAndPath
+		referrer, _, _ := strings.Cut(e.GetReferrer(), "?")
+		referrer, _, _ = strings.Cut(referrer, "#")
+		return referrer, nil
+	}
+	u.RawQuery, u.Fragment, u.RawFragment = "", "", ""
+	u.Host = strings.ToLower(u.Host)
+	return u.String(), nil
+}
+
+// EventDevice returns the device type the event is counted for in DevicesRate.
+func EventDevice(e *analytics.Event) string {
+	switch d := e.GetDevice(); {
+	case d.GetDesktop():
+		return "Desktop"
+	case d.GetMobile():
+		return "Mobile"
+	case d.GetTablet():
+		return "Tablet"
+	case d.GetBot():
+		return "Bot"
+	default:
+		return "Unknown"
+	}
+}
+
+// EventOS returns the operating system the event is counted for in OSsRate.
+func EventOS(e *analytics.Event) string {
+	if os := e.GetOS(); os != "" {
+		return os
+	}
+	return "Unknown"
+}
+
+// EventBrowser returns the browser the event is counted for in BrowsersRate.
+func EventBrowser(e *analytics.Event) string {
+	if browser := e.GetBrowser(); browser != "" {
+		return browser
+	}
+	return "Unknown"
+}
+
+// extractDomainAndPath returns the lowercase host name and the path of the link.
+//
+// Links without a scheme (e.g. "example.com/foo") are accepted, query and fragment are dropped.
 func extractDomainAndPath(link string) (string, string, error) {
-	regex := regexp.MustCompile(`(?:https?://)?([^/]+)(.*)`)
+	// Without a scheme the host would be parsed as a part of the path
+	rawURL := link
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
 
-	matches := regex.FindStringSubmatch(link)
-	if len(matches) < 3 {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
 		return "", "", fmt.Errorf("unable to extract domain and path from the link: %s", link)
 	}
 
-	domain := matches[1]
-	path := matches[2]
-
+	path := u.Path
 	if path == "" {
 		path = "/"
 	}
 
-	return domain, path, nil
+	return strings.ToLower(u.Hostname()), path, nil
+}
+
+// registrableDomain returns the registrable domain (eTLD+1) of the host, e.g. "bbc.co.uk" for "www.bbc.co.uk".
+//
+// Hosts without one, such as IP addresses or "localhost", are returned as is.
+func registrableDomain(host string) string {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// eventHeap is a min-heap of the events by timestamp.
+type eventHeap []*analytics.Event
+
+func (h eventHeap) Len() int { return len(h) }
+
+func (h eventHeap) Less(i, j int) bool {
+	return h[i].GetTimestamp().AsTime().Before(h[j].GetTimestamp().AsTime())
+}
+
+func (h eventHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *eventHeap) Push(x any) { *h = append(*h, x.(*analytics.Event)) }
+
+func (h *eventHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
 }
@@ -0,0 +1,145 @@
+package prometheus
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"fmt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// visitEvents returns the page views of the visits, a visit of every visitor with the amount of the pages.
+func visitEvents(pages ...int) []*analytics.Event {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := make([]*analytics.Event, 0)
+	for visitor, amount := range pages {
+		for page := 0; page < amount; page++ {
+			events = append(events, &analytics.Event{
+				ID:          fmt.Sprintf("%d-%d", visitor, page),
+				Type:        "pageview",
+				URL:         fmt.Sprintf("https://example.com/page-%d", page),
+				Domain:      "example.com",
+				Tenant:      "example.com",
+				HashedVisit: fmt.Sprintf("visitor-%d", visitor),
+				Timestamp:   timestamppb.New(start.Add(time.Duration(visitor)*time.Second + time.Duration(page)*time.Minute)),
+			})
+		}
+	}
+	return events
+}
+
+func TestBounceRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		pages  []int
+		visits int64
+		want   float64
+	}{
+		{name: "all bounce", pages: []int{1, 1, 1, 1}, visits: 4, want: 1},
+		{name: "no bounce", pages: []int{2, 3, 5}, visits: 3, want: 0},
+		{name: "mixed", pages: []int{1, 3, 1, 2}, visits: 4, want: 0.5},
+		{name: "mixed single page majority", pages: []int{1, 1, 1, 4}, visits: 4, want: 0.75},
+		{name: "zero pageviews", pages: nil, visits: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := CalculateAnalyticsStats(visitEvents(tt.pages...), sites.StatsSettings{})
+			if err != nil {
+				t.Fatalf("CalculateAnalyticsStats() error = %v", err)
+			}
+			if stats.TotalVisits != tt.visits {
+				t.Errorf("TotalVisits = %d, want %d", stats.TotalVisits, tt.visits)
+			}
+			if stats.BounceRate != tt.want {
+				t.Errorf("BounceRate = %v, want %v", stats.BounceRate, tt.want)
+			}
+		})
+	}
+}
+
+func TestBounceRateOfCounts(t *testing.T) {
+	tests := []struct {
+		name          string
+		onePageVisits int64
+		visits        int64
+		want          float64
+	}{
+		{name: "all bounce", onePageVisits: 10, visits: 10, want: 1},
+		{name: "no bounce", onePageVisits: 0, visits: 10, want: 0},
+		{name: "mixed", onePageVisits: 1, visits: 4, want: 0.25},
+		{name: "zero visits", onePageVisits: 0, visits: 0, want: 0},
+		{name: "clamped", onePageVisits: 5, visits: 4, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bounceRate(tt.onePageVisits, tt.visits); got != tt.want {
+				t.Errorf("bounceRate(%d, %d) = %v, want %v", tt.onePageVisits, tt.visits, got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkGetAnalyticsStats(b *testing.B) {
+	for _, visitors := range []int{100, 2000, 20000} {
+		db, err := database.NewDatabase(true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		// The visits of one to five pages, so the bounces and the multi-page visits are mixed
+		pages := make([]int, visitors)
+		for i := range pages {
+			pages[i] = 1 + i%5
+		}
+		events := visitEvents(pages...)
+		if err = db.InsertBatch(context.Background(), events); err != nil {
+			b.Fatal(err)
+		}
+		site := sites.Key{Tenant: "example.com", Domain: "example.com"}
+
+		b.Run(fmt.Sprintf("events=%d", len(events)), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := GetAnalyticsStats(db, site, sites.StatsSettings{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregateStatsSharded(t *testing.T) {
+	// Fewer events than the sharding threshold and enough of them for four shards
+	for _, visitors := range []int{100, 2 * MinShardEvents} {
+		pages := make([]int, visitors)
+		for i := range pages {
+			pages[i] = 1 + i%5
+		}
+		events := visitEvents(pages...)
+		scan := func(fn func(e *analytics.Event) error) error {
+			for _, e := range events {
+				if err := fn(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		t.Run(fmt.Sprintf("events=%d", len(events)), func(t *testing.T) {
+			want, err := aggregateStats(scan, 1, sites.StatsSettings{})
+			if err != nil {
+				t.Fatalf("aggregateStats() of one shard error = %v", err)
+			}
+			got, err := aggregateStats(scan, 4, sites.StatsSettings{})
+			if err != nil {
+				t.Fatalf("aggregateStats() of four shards error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("aggregateStats() of four shards = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
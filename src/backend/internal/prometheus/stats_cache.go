@@ -0,0 +1,236 @@
+package prometheus
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+// maxCachedRanges is the maximal amount of the cached ranges, the oldest ones are evicted first.
+const maxCachedRanges = 1024
+
+// StatsCache is database.Database keeping AnalyticsStats of the time ranges of the sites until the events
+// within them are inserted or deleted, so the collectors and the stats API share the calculations.
+// The concurrent requests of a range wait for its single calculation.
+//
+// The ranges ending after now are cached as the open ones, e.g. today, and the current visitors
+// are counted on every request. The stats older than ttl are recalculated anyway,
+// e.g. after the events inserted by the other instances.
+//
+// All the other operations are passed to the underlying database as is.
+type StatsCache struct {
+	database.Database
+
+	sites *sites.Registry
+	ttl   time.Duration
+
+	mutex  sync.Mutex
+	ranges map[statsRange]*cachedStats
+
+	requestsTotal *prometheus.CounterVec
+}
+
+// statsRange is a time range of a site, zero from or to leave it unbounded on that side.
+type statsRange struct {
+	site     sites.Key
+	from, to time.Time
+}
+
+// overlaps reports whether the range overlaps [from, to), zero to leaves it unbounded.
+func (r statsRange) overlaps(from, to time.Time) bool {
+	return (r.to.IsZero() || from.Before(r.to)) && (to.IsZero() || r.from.Before(to))
+}
+
+// cachedStats are the stats of a range, calculated once ready is closed.
+type cachedStats struct {
+	ready   chan struct{}
+	stats   *AnalyticsStats
+	err     error
+	created time.Time
+}
+
+// NewStatsCache returns new StatsCache instance of db, the stats settings of the sites are the ones of sitesRegistry,
+// which may be nil.
+func NewStatsCache(db database.Database, ttl time.Duration, sitesRegistry *sites.Registry) (*StatsCache, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	c := &StatsCache{
+		Database: db,
+		sites:    sitesRegistry,
+		ttl:      ttl,
+		ranges:   make(map[statsRange]*cachedStats),
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stats_cache_requests_total",
+			Help: "Total number of the requested stats by the result, hit if they were cached or miss if they were calculated",
+		}, []string{"result"}),
+	}
+	prometheus.MustRegister(c.requestsTotal)
+	return c, nil
+}
+
+// Reset drops the cached stats, e.g. after the stats settings of the sites change.
+func (c *StatsCache) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.ranges = make(map[statsRange]*cachedStats)
+}
+
+// Get returns AnalyticsStats of all the events of the site with the stats settings of the registry.
+func (c *StatsCache) Get(site sites.Key) (*AnalyticsStats, error) {
+	var settings sites.StatsSettings
+	if c.sites != nil {
+		settings = c.sites.Config().StatsSettings()[site]
+	}
+	return c.Range(context.Background(), site, settings, time.Time{}, time.Time{})
+}
+
+// Range returns AnalyticsStats of the events of the site in the time range, the same as GetAnalyticsStatsRange.
+// The returned stats share the ratings with the cached ones, so they must not be modified.
+func (c *StatsCache) Range(ctx context.Context, site sites.Key, settings sites.StatsSettings, from, to time.Time) (*AnalyticsStats, error) {
+	now := time.Now()
+	key := statsRange{site: site, from: from.Round(0).UTC()}
+	if !to.IsZero() && to.Before(now) {
+		key.to = to.Round(0).UTC()
+	}
+
+	c.mutex.Lock()
+	cached, ok := c.ranges[key]
+	if ok && c.expired(cached, now) {
+		ok = false
+	}
+	if !ok {
+		c.evict(now)
+		cached = &cachedStats{ready: make(chan struct{}), created: now}
+		c.ranges[key] = cached
+	}
+	c.mutex.Unlock()
+
+	if ok {
+		c.requestsTotal.WithLabelValues("hit").Inc()
+		select {
+		case <-cached.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	} else {
+		c.requestsTotal.WithLabelValues("miss").Inc()
+		// The waiting requests get the stats even if the one calculating them is cancelled
+		cached.stats, cached.err = aggregateRange(context.WithoutCancel(ctx), c.Database, site, settings, key.from, key.to)
+		close(cached.ready)
+		if cached.err != nil {
+			c.mutex.Lock()
+			if c.ranges[key] == cached {
+				delete(c.ranges, key)
+			}
+			c.mutex.Unlock()
+		}
+	}
+	if cached.err != nil {
+		return nil, cached.err
+	}
+
+	stats := *cached.stats
+	if err := setCurrentVisitors(ctx, c.Database, site, settings, &stats, to, now); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// expired reports whether the calculated stats are older than ttl.
+func (c *StatsCache) expired(cached *cachedStats, now time.Time) bool {
+	select {
+	case <-cached.ready:
+		return now.Sub(cached.created) >= c.ttl
+	default:
+		return false
+	}
+}
+
+// evict drops the expired stats once the cache is full, and the oldest ones if none of them are.
+func (c *StatsCache) evict(now time.Time) {
+	if len(c.ranges) < maxCachedRanges {
+		return
+	}
+	var oldest statsRange
+	for r, cached := range c.ranges {
+		if c.expired(cached, now) {
+			delete(c.ranges, r)
+		} else if oldestStats, ok := c.ranges[oldest]; !ok || cached.created.Before(oldestStats.created) {
+			oldest = r
+		}
+	}
+	if len(c.ranges) >= maxCachedRanges {
+		delete(c.ranges, oldest)
+	}
+}
+
+// invalidate drops the stats of the ranges of the site overlapping [from, to).
+func (c *StatsCache) invalidate(site sites.Key, from, to time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for r := range c.ranges {
+		if r.site == site && r.overlaps(from, to) {
+			delete(c.ranges, r)
+		}
+	}
+}
+
+// invalidateEvents drops the stats of the ranges including any of the events.
+func (c *StatsCache) invalidateEvents(events ...*analytics.Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for r := range c.ranges {
+		for _, e := range events {
+			ts := e.GetTimestamp().AsTime()
+			if r.site == (sites.Key{Tenant: e.GetTenant(), Domain: e.GetDomain()}) && r.overlaps(ts, ts.Add(time.Nanosecond)) {
+				delete(c.ranges, r)
+				break
+			}
+		}
+	}
+}
+
+// Insert inserts the event and drops the stats of its ranges.
+func (c *StatsCache) Insert(ctx context.Context, msg *analytics.Event) error {
+	if err := c.Database.Insert(ctx, msg); err != nil {
+		return err
+	}
+	c.invalidateEvents(msg)
+	return nil
+}
+
+// InsertBatch inserts the events and drops the stats of their ranges.
+// The ones of the partially inserted batches are dropped too.
+func (c *StatsCache) InsertBatch(ctx context.Context, msgs []*analytics.Event) error {
+	err := c.Database.InsertBatch(ctx, msgs)
+	c.invalidateEvents(msgs...)
+	return err
+}
+
+// DeleteRange deletes the events of the site in the time range and drops the stats of the ranges overlapping it.
+func (c *StatsCache) DeleteRange(ctx context.Context, site sites.Key, from, to time.Time) (int, error) {
+	deleted, err := c.Database.DeleteRange(ctx, site, from, to)
+	if deleted > 0 {
+		c.invalidate(site, from, to)
+	}
+	return deleted, err
+}
+
+// DeleteVisitor deletes the events of the site with the visitor hash and drops all the stats of the site,
+// as the events may be of any range.
+func (c *StatsCache) DeleteVisitor(ctx context.Context, site sites.Key, hashedVisit string) (int, error) {
+	deleted, err := c.Database.DeleteVisitor(ctx, site, hashedVisit)
+	if deleted > 0 {
+		c.invalidate(site, time.Time{}, time.Time{})
+	}
+	return deleted, err
+}
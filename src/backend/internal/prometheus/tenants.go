@@ -0,0 +1,35 @@
+package prometheus
+
+import (
+	"diploma/analytics-exporter/internal/sites"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// TenantPath is the path the metrics of the sites of a tenant are exposed on.
+const TenantPath = "/metrics/tenants/{tenant}"
+
+// TenantHandler serves the metrics of the sites of the tenant of the path,
+// which requires an API key of the tenant in the multi-tenant mode.
+func (p *Prometheus) TenantHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	tenant := params["tenant"]
+	err := p.sites.AuthorizeTenant(sites.BearerKey(r.Header.Get("Authorization")), tenant, sites.PermissionStats)
+	switch {
+	case errors.Is(err, sites.ErrUnauthenticated):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, "access to "+tenant+" is denied", http.StatusForbidden)
+		return
+	}
+
+	p.mutex.Lock()
+	registry, ok := p.tenants[tenant]
+	p.mutex.Unlock()
+	if !ok {
+		http.Error(w, "tenant "+tenant+" is not found", http.StatusNotFound)
+		return
+	}
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,65 @@
+// Package pubsub implements an in-process bus distributing ingested events to subscribers.
+package pubsub
+
+import (
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"sync"
+)
+
+// Bus fans out published events to the subscribers of the event site.
+//
+// Publishing never blocks: events are dropped for subscribers that don't keep up.
+type Bus struct {
+	mutex sync.RWMutex
+	subs  map[sites.Key]map[chan *analytics.Event]struct{}
+}
+
+// NewBus returns new Bus instance.
+func NewBus() *Bus {
+	return &Bus{
+		subs: make(map[sites.Key]map[chan *analytics.Event]struct{}),
+	}
+}
+
+// Subscribe returns a channel receiving events of the site and a function to cancel the subscription.
+//
+// The channel is closed once the subscription is cancelled.
+func (b *Bus) Subscribe(site sites.Key, buffer int) (<-chan *analytics.Event, func()) {
+	ch := make(chan *analytics.Event, buffer)
+
+	b.mutex.Lock()
+	if _, ok := b.subs[site]; !ok {
+		b.subs[site] = make(map[chan *analytics.Event]struct{})
+	}
+	b.subs[site][ch] = struct{}{}
+	b.mutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			delete(b.subs[site], ch)
+			if len(b.subs[site]) == 0 {
+				delete(b.subs, site)
+			}
+			close(ch)
+		})
+	}
+}
+
+// Publish sends e to all subscribers of its site.
+func (b *Bus) Publish(e *analytics.Event) {
+	if b == nil || e == nil {
+		return
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for ch := range b.subs[sites.Key{Tenant: e.GetTenant(), Domain: e.GetDomain()}] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Package readiness tracks the startup conditions of the service and reports its readiness
+// to Kubernetes probes and to systemd.
+package readiness
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Paths of the probes.
+const (
+	ReadyPath = "/readyz"
+	LivePath  = "/healthz"
+)
+
+// Readiness is ready once all its conditions are done.
+//
+// It's safe for concurrent use.
+type Readiness struct {
+	mutex     sync.Mutex
+	pending   map[string]bool
+	listeners []func()
+}
+
+// New returns new Readiness instance waiting for the conditions.
+func New(conditions ...string) *Readiness {
+	r := &Readiness{pending: make(map[string]bool, len(conditions))}
+	for _, c := range conditions {
+		r.pending[c] = true
+	}
+	return r
+}
+
+// OnReady registers fn to be called once all the conditions are done.
+//
+// fn is called immediately if they're already done.
+func (r *Readiness) OnReady(fn func()) {
+	r.mutex.Lock()
+	if len(r.pending) > 0 {
+		r.listeners = append(r.listeners, fn)
+		r.mutex.Unlock()
+		return
+	}
+	r.mutex.Unlock()
+	fn()
+}
+
+// Done marks the condition as done.
+func (r *Readiness) Done(condition string) {
+	r.mutex.Lock()
+	if !r.pending[condition] {
+		r.mutex.Unlock()
+		return
+	}
+	delete(r.pending, condition)
+	var listeners []func()
+	if len(r.pending) == 0 {
+		listeners = r.listeners
+		r.listeners = nil
+	}
+	r.mutex.Unlock()
+
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+// Pending returns the sorted conditions which are not done yet.
+func (r *Readiness) Pending() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	res := make([]string, 0, len(r.pending))
+	for c := range r.pending {
+		res = append(res, c)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ReadyHandler responds with 200 once ready and with 503 listing the pending conditions before.
+func (r *Readiness) ReadyHandler(w http.ResponseWriter, _ *http.Request, _ map[string]string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if pending := r.Pending(); len(pending) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("waiting for " + strings.Join(pending, ", ") + "\n"))
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// LiveHandler always responds with 200, the process is alive as long as it serves the requests.
+func LiveHandler(w http.ResponseWriter, _ *http.Request, _ map[string]string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Notify sends the state to the systemd service manager, e.g. READY=1 or STOPPING=1.
+//
+// It does nothing if the service isn't started by systemd with Type=notify.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract socket names start with @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	n, err := conn.Write([]byte(state))
+	if err != nil {
+		return err
+	}
+	if n != len(state) {
+		return errors.New("short write to the notify socket")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/json"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// EventsPath is the gateway path the peers post the events inserted into them to.
+	EventsPath = "/api/replication/events"
+	// DeletePath is the gateway path the peers post the time ranges and the visitors deleted from them to.
+	DeletePath = "/api/replication/delete"
+	// SnapshotPath is the gateway path the restarted peers read all the events from.
+	SnapshotPath = "/api/replication/snapshot"
+)
+
+// protobufType is the media type of the posted analytics.Events and of the snapshot,
+// the events of which are delimited by their varint sizes.
+const protobufType = "application/x-protobuf"
+
+// maxBodySize is the maximal size of the posted changes.
+const maxBodySize = 64 << 20
+
+// Events inserts the events posted by a peer, without replicating them.
+func (r *Replicator) Events(w http.ResponseWriter, req *http.Request, _ map[string]string) {
+	if !r.authorize(w, req) {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "cannot read the events", http.StatusBadRequest)
+		return
+	}
+	events := &analytics.Events{}
+	if err = proto.Unmarshal(body, events); err != nil {
+		http.Error(w, "cannot decode the events", http.StatusBadRequest)
+		return
+	}
+	if err = r.Database.InsertBatch(req.Context(), events.GetEvents()); err != nil {
+		r.logger.Error("Cannot insert the replicated events", zap.Error(err))
+		http.Error(w, "cannot insert the events", http.StatusInternalServerError)
+		return
+	}
+	r.receivedTotal.Add(float64(len(events.GetEvents())))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete deletes the time range or the visitor of the events posted by a peer, without replicating it.
+func (r *Replicator) Delete(w http.ResponseWriter, req *http.Request, _ map[string]string) {
+	if !r.authorize(w, req) {
+		return
+	}
+	deleted := &deletedRange{}
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxBodySize)).Decode(deleted); err != nil {
+		http.Error(w, "cannot decode the deleted range", http.StatusBadRequest)
+		return
+	}
+	site := sites.Key{Tenant: deleted.Tenant, Domain: deleted.Domain}
+	var err error
+	if deleted.HashedVisit != "" {
+		_, err = r.Database.DeleteVisitor(req.Context(), site, deleted.HashedVisit)
+	} else {
+		_, err = r.Database.DeleteRange(req.Context(), site, deleted.From, deleted.To)
+	}
+	if err != nil {
+		r.logger.Error("Cannot delete the replicated range", zap.String("site", site.String()), zap.Error(err))
+		http.Error(w, "cannot delete the range", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Snapshot streams all the events stored by the replica to a restarted peer, ended by the empty event,
+// so the peer tells the complete snapshot from the cut one.
+func (r *Replicator) Snapshot(w http.ResponseWriter, req *http.Request, _ map[string]string) {
+	if !r.authorize(w, req) {
+		return
+	}
+	keys, err := r.Database.ListEventSites(req.Context())
+	if err != nil {
+		http.Error(w, "cannot list the sites", http.StatusInternalServerError)
+		return
+	}
+
+	start := time.Now()
+	w.Header().Set("Content-Type", protobufType)
+	out := bufio.NewWriter(w)
+	count := 0
+	for _, key := range keys {
+		err = r.Database.ForEach(req.Context(), key, time.Time{}, time.Time{}, func(e *analytics.Event) error {
+			count++
+			_, err := protodelim.MarshalTo(out, e)
+			return err
+		})
+		if err != nil {
+			// The status is already sent, the peer fails on the snapshot without the end
+			if req.Context().Err() == nil {
+				r.logger.Error("Cannot stream the snapshot", zap.Error(err))
+			}
+			return
+		}
+	}
+	if _, err = protodelim.MarshalTo(out, &analytics.Event{}); err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		r.logger.Error("Cannot stream the snapshot", zap.Error(err))
+		return
+	}
+	r.logger.Info("Streamed the snapshot to the peer", zap.Int("events", count), zap.Duration("duration", time.Since(start)))
+}
+
+// authorize checks the replication key of the request, or responds with the error.
+func (r *Replicator) authorize(w http.ResponseWriter, req *http.Request) bool {
+	key := sites.BearerKey(req.Header.Get("Authorization"))
+	if key == "" {
+		http.Error(w, "replication key is required", http.StatusUnauthorized)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(r.key)) != 1 {
+		http.Error(w, "invalid replication key", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,555 @@
+// Package replication streams the events inserted into and deleted from the in-memory database to the peers,
+// the replicas of the service keeping their own in-memory databases, so a restart or a failover of one of them
+// doesn't lose the events: the restarted replica restores them from the snapshot of a peer
+// and catches up on the changes the peers have queued for it meanwhile.
+//
+// Every replica sends only its own changes to all of its peers, which apply them without forwarding,
+// so the peers must list each other. The events are applied idempotently by their IDs.
+// A peer falling too far behind is sent all the events of the replica instead of the queued ones.
+// The rollups, the usage and the managed sites, tokens and users aren't replicated.
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPendingEvents is the maximal amount of the events queued for a peer, the queued events are replaced
+	// by the snapshot of the replica once it falls that far behind. The deleted ranges are never dropped.
+	maxPendingEvents = 1 << 20
+	// batchEvents is the maximal amount of the queued events sent to a peer in one request.
+	batchEvents = 1000
+
+	// requestTimeout is the time a peer applies the sent changes within.
+	requestTimeout = 30 * time.Second
+	// snapshotTimeout is the time the snapshot of a peer is restored within.
+	snapshotTimeout = 10 * time.Minute
+	// flushTimeout is the time the queued changes are sent within on shutdown.
+	flushTimeout = 5 * time.Second
+
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// deletedRange is the time range of the events of a site deleted by DeleteRange,
+// or the visitor the events of a site are deleted of by DeleteVisitor.
+type deletedRange struct {
+	Tenant      string    `json:"tenant"`
+	Domain      string    `json:"domain"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	HashedVisit string    `json:"hashedVisit,omitempty"`
+}
+
+// change is the inserted events, the deleted range or the snapshot queued for a peer.
+type change struct {
+	events  []*analytics.Event
+	deleted *deletedRange
+	// snapshot is set for the peer which fell too far behind, all the events stored once it's sent
+	// replace the queued ones dropped before it
+	snapshot bool
+	created  time.Time
+}
+
+// peer is the queue of the changes of a peer.
+type peer struct {
+	url string
+
+	mutex   sync.Mutex
+	pending []change
+	// events is the amount of the pending events
+	events int
+	// inflight is the creation time of the oldest change being sent, zero if none are
+	inflight       time.Time
+	inflightEvents int
+	// notify is signalled once a change is queued
+	notify chan struct{}
+}
+
+// batch is the changes sent to a peer in one request, either the inserted events or a deleted range,
+// or all the stored events sent in the requests of batchEvents.
+type batch struct {
+	events   []*analytics.Event
+	deleted  *deletedRange
+	snapshot bool
+}
+
+// Replicator is database.Database sending the inserted and the deleted events to the peers,
+// all the other operations are passed to the underlying database as is.
+type Replicator struct {
+	database.Database
+
+	peers  []*peer
+	key    string
+	client *http.Client
+	logger *zap.Logger
+
+	sentTotal      *prometheus.CounterVec
+	droppedTotal   *prometheus.CounterVec
+	snapshotsTotal *prometheus.CounterVec
+	failuresTotal  *prometheus.CounterVec
+	receivedTotal  prometheus.Counter
+}
+
+// NewReplicator returns new Replicator instance of db replicating to the peers, the base URLs of their gateways,
+// e.g. http://analytics-1:8080. The requests of the peers are authenticated with the shared key.
+func NewReplicator(db database.Database, peers []string, key string) (*Replicator, error) {
+	return newReplicator(db, peers, key, prometheus.DefaultRegisterer)
+}
+
+// newReplicator returns new Replicator instance with the metrics registered to registerer,
+// so several of them run in one process.
+func newReplicator(db database.Database, peers []string, key string, registerer prometheus.Registerer) (*Replicator, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if len(peers) == 0 {
+		return nil, errors.New("no peers are configured")
+	}
+	if key == "" {
+		return nil, errors.New("replication key is empty")
+	}
+	r := &Replicator{
+		Database: db,
+		key:      key,
+		client:   &http.Client{},
+		logger:   zap.L().Named("replication"),
+		sentTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "replication_sent_events_total",
+			Help: "Total number of the events applied by the peers",
+		}, []string{"peer"}),
+		droppedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "replication_dropped_events_total",
+			Help: "Total number of the events dropped from the queues of the peers because they fell too far behind, they're sent with the snapshots",
+		}, []string{"peer"}),
+		snapshotsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "replication_snapshots_total",
+			Help: "Total number of the snapshots sent to the peers which fell too far behind",
+		}, []string{"peer"}),
+		failuresTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "replication_failures_total",
+			Help: "Total number of the failed requests to the peers, which are retried",
+		}, []string{"peer"}),
+		receivedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "replication_received_events_total",
+			Help: "Total number of the events applied from the peers, including the restored ones",
+		}),
+	}
+	registerer.MustRegister(r.sentTotal, r.droppedTotal, r.snapshotsTotal, r.failuresTotal, r.receivedTotal)
+
+	for _, addr := range peers {
+		u, err := url.Parse(addr)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("peer %q must be the http or https URL of its gateway", addr)
+		}
+		p := &peer{url: strings.TrimSuffix(addr, "/"), notify: make(chan struct{}, 1)}
+		r.peers = append(r.peers, p)
+		labels := prometheus.Labels{"peer": p.url}
+		registerer.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "replication_lag_seconds",
+				Help:        "Age of the oldest change not yet applied by the peer, 0 if it's caught up",
+				ConstLabels: labels,
+			}, p.lag),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "replication_pending_events",
+				Help:        "Number of the events not yet applied by the peer",
+				ConstLabels: labels,
+			}, p.pendingEvents),
+		)
+	}
+	return r, nil
+}
+
+// Insert inserts the event and queues it for the peers.
+func (r *Replicator) Insert(ctx context.Context, msg *analytics.Event) error {
+	if err := r.Database.Insert(ctx, msg); err != nil {
+		return err
+	}
+	r.enqueue(change{events: []*analytics.Event{msg}})
+	return nil
+}
+
+// InsertBatch inserts the events and queues them for the peers once all of them are inserted.
+func (r *Replicator) InsertBatch(ctx context.Context, msgs []*analytics.Event) error {
+	if err := r.Database.InsertBatch(ctx, msgs); err != nil {
+		return err
+	}
+	if len(msgs) > 0 {
+		r.enqueue(change{events: msgs})
+	}
+	return nil
+}
+
+// DeleteRange deletes the events of the site in the time range and queues the range for the peers,
+// which may store the events this replica doesn't, e.g. the ones inserted before it was restored.
+func (r *Replicator) DeleteRange(ctx context.Context, site sites.Key, from, to time.Time) (int, error) {
+	deleted, err := r.Database.DeleteRange(ctx, site, from, to)
+	if err != nil {
+		return deleted, err
+	}
+	r.enqueue(change{deleted: &deletedRange{Tenant: site.Tenant, Domain: site.Domain, From: from, To: to}})
+	return deleted, nil
+}
+
+// DeleteVisitor deletes the events of the site with the visitor hash and queues the visitor for the peers.
+func (r *Replicator) DeleteVisitor(ctx context.Context, site sites.Key, hashedVisit string) (int, error) {
+	deleted, err := r.Database.DeleteVisitor(ctx, site, hashedVisit)
+	if err != nil {
+		return deleted, err
+	}
+	r.enqueue(change{deleted: &deletedRange{Tenant: site.Tenant, Domain: site.Domain, HashedVisit: hashedVisit}})
+	return deleted, nil
+}
+
+// enqueue queues the change for every peer. The queued events of the peers which fell too far behind
+// are dropped and replaced by the snapshot, keeping the deleted ranges in their order.
+func (r *Replicator) enqueue(c change) {
+	c.created = time.Now()
+	for _, p := range r.peers {
+		p.mutex.Lock()
+		p.pending = append(p.pending, c)
+		p.events += len(c.events)
+		dropped := 0
+		if p.events > maxPendingEvents {
+			dropped = p.events
+			p.compact()
+		}
+		p.mutex.Unlock()
+
+		if dropped > 0 {
+			r.droppedTotal.WithLabelValues(p.url).Add(float64(dropped))
+			r.logger.Warn("Peer fell too far behind, the snapshot is sent instead of the queued events",
+				zap.String("peer", p.url), zap.Int("dropped_events", dropped))
+		}
+		select {
+		case p.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// compact drops the pending events and the snapshots and queues the snapshot after the deleted ranges,
+// it's read once it's sent, so it has all the dropped events. The mutex must be held.
+func (p *peer) compact() {
+	pending := make([]change, 0, len(p.pending)+1)
+	snapshot := change{snapshot: true}
+	for _, c := range p.pending {
+		switch {
+		case c.deleted != nil:
+			pending = append(pending, c)
+		case snapshot.created.IsZero():
+			snapshot.created = c.created
+		}
+	}
+	p.pending = append(pending, snapshot)
+	p.events = 0
+}
+
+// next takes the next batch of the pending changes, nil if there are none.
+// The inserted events of the consecutive changes are merged up to batchEvents.
+func (p *peer) next() *batch {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.pending) == 0 {
+		return nil
+	}
+	p.inflight = p.pending[0].created
+	if p.pending[0].deleted != nil || p.pending[0].snapshot {
+		b := &batch{deleted: p.pending[0].deleted, snapshot: p.pending[0].snapshot}
+		p.pending[0] = change{}
+		p.pending = p.pending[1:]
+		return b
+	}
+
+	b := &batch{}
+	for len(p.pending) > 0 && p.pending[0].deleted == nil && !p.pending[0].snapshot &&
+		(len(b.events) == 0 || len(b.events)+len(p.pending[0].events) <= batchEvents) {
+		b.events = append(b.events, p.pending[0].events...)
+		p.events -= len(p.pending[0].events)
+		p.pending[0] = change{}
+		p.pending = p.pending[1:]
+	}
+	p.inflightEvents = len(b.events)
+	return b
+}
+
+// done marks the batch taken by next as applied.
+func (p *peer) done() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.inflight = time.Time{}
+	p.inflightEvents = 0
+}
+
+// lag returns the age of the oldest change not yet applied by the peer in seconds.
+func (p *peer) lag() float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	oldest := p.inflight
+	if oldest.IsZero() && len(p.pending) > 0 {
+		oldest = p.pending[0].created
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest).Seconds()
+}
+
+// pendingEvents returns the amount of the events not yet applied by the peer.
+func (p *peer) pendingEvents() float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return float64(p.events + p.inflightEvents)
+}
+
+// Run sends the queued changes to the peers until ctx is done, the failed requests are retried with the backoff,
+// so the changes reach the peers in the order they're made once they're available.
+// On shutdown the queued changes are sent within flushTimeout without the retries.
+func (r *Replicator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range r.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.replicate(ctx, p)
+		}()
+	}
+	wg.Wait()
+}
+
+// replicate sends the changes of the peer until ctx is done and flushes the rest.
+func (r *Replicator) replicate(ctx context.Context, p *peer) {
+	for {
+		b := p.next()
+		if b == nil {
+			select {
+			case <-ctx.Done():
+				r.flush(p, nil)
+				return
+			case <-p.notify:
+				continue
+			}
+		}
+		if !r.retry(ctx, p, b) {
+			r.flush(p, b)
+			return
+		}
+		p.done()
+	}
+}
+
+// retry sends the batch until it's applied by the peer and reports whether it is, it isn't once ctx is done.
+func (r *Replicator) retry(ctx context.Context, p *peer, b *batch) bool {
+	for backoff := minBackoff; ; backoff = min(2*backoff, maxBackoff) {
+		err := r.send(ctx, p, b)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		r.failuresTotal.WithLabelValues(p.url).Inc()
+		r.logger.Warn("Cannot replicate to the peer, retrying", zap.String("peer", p.url), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// flush sends the batch being sent, if any, and the queued changes of the peer within flushTimeout,
+// giving up at the first failure.
+func (r *Replicator) flush(p *peer, b *batch) {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	if b == nil {
+		b = p.next()
+	}
+	for ; b != nil; b = p.next() {
+		err := r.send(ctx, p, b)
+		p.done()
+		if err != nil {
+			r.failuresTotal.WithLabelValues(p.url).Inc()
+			r.logger.Error("Cannot flush the changes to the peer", zap.String("peer", p.url), zap.Float64("pending_events", p.pendingEvents()), zap.Error(err))
+			return
+		}
+	}
+}
+
+// send posts the batch to the peer.
+func (r *Replicator) send(ctx context.Context, p *peer, b *batch) error {
+	if b.snapshot {
+		return r.sendSnapshot(ctx, p)
+	}
+	path, contentType := EventsPath, protobufType
+	var body []byte
+	var err error
+	if b.deleted != nil {
+		path, contentType = DeletePath, "application/json"
+		body, err = json.Marshal(b.deleted)
+	} else {
+		body, err = proto.Marshal(&analytics.Events{Events: b.events})
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+r.key)
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err = responseError(res); err != nil {
+		return err
+	}
+	r.sentTotal.WithLabelValues(p.url).Add(float64(len(b.events)))
+	return nil
+}
+
+// sendSnapshot posts all the events stored by the replica to the peer in the batches of batchEvents,
+// the ones sent before the failure are sent again on the retry.
+func (r *Replicator) sendSnapshot(ctx context.Context, p *peer) error {
+	keys, err := r.Database.ListEventSites(ctx)
+	if err != nil {
+		return err
+	}
+	events := make([]*analytics.Event, 0, batchEvents)
+	post := func() error {
+		if len(events) == 0 {
+			return nil
+		}
+		err := r.send(ctx, p, &batch{events: events})
+		events = events[:0]
+		return err
+	}
+	for _, key := range keys {
+		err = r.Database.ForEach(ctx, key, time.Time{}, time.Time{}, func(e *analytics.Event) error {
+			if events = append(events, e); len(events) == batchEvents {
+				return post()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err = post(); err != nil {
+		return err
+	}
+	r.snapshotsTotal.WithLabelValues(p.url).Inc()
+	return nil
+}
+
+// Restore inserts the events of the snapshot of the first available peer, so the restarted replica
+// has the events stored before it's started. The failures of the peers are logged and the next one is tried,
+// the replica starts empty if none of them are available, e.g. all of them start at once.
+//
+// The events are applied idempotently, so the ones the peers send while the snapshot is read are kept,
+// but the events the peers delete meanwhile may be restored back.
+func (r *Replicator) Restore(ctx context.Context) int {
+	for _, p := range r.peers {
+		restored, err := r.restore(ctx, p)
+		if err == nil {
+			r.logger.Info("Restored the events from the peer", zap.String("peer", p.url), zap.Int("events", restored))
+			return restored
+		}
+		r.logger.Warn("Cannot restore the events from the peer", zap.String("peer", p.url), zap.Int("events", restored), zap.Error(err))
+	}
+	return 0
+}
+
+// restore inserts the events of the snapshot of the peer and returns their amount,
+// the ones read before the failure are kept.
+func (r *Replicator) restore(ctx context.Context, p *peer) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+SnapshotPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.key)
+	res, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if err = responseError(res); err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	events := make([]*analytics.Event, 0, batchEvents)
+	insert := func() error {
+		if err := r.Database.InsertBatch(ctx, events); err != nil {
+			return fmt.Errorf("cannot insert the restored events: %w", err)
+		}
+		restored += len(events)
+		r.receivedTotal.Add(float64(len(events)))
+		events = events[:0]
+		return nil
+	}
+	body := bufio.NewReader(res.Body)
+	for {
+		e := &analytics.Event{}
+		if err = protodelim.UnmarshalFrom(body, e); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("snapshot is truncated")
+			}
+			if insertErr := insert(); insertErr != nil {
+				return restored, insertErr
+			}
+			return restored, err
+		}
+		// The empty event ends the snapshot
+		if e.GetID() == "" {
+			return restored, insert()
+		}
+		if events = append(events, e); len(events) == batchEvents {
+			if err = insert(); err != nil {
+				return restored, err
+			}
+		}
+	}
+}
+
+// responseError returns the error of the unsuccessful response of the peer.
+func responseError(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("unexpected response of the peer %s: %s", res.Status, bytes.TrimSpace(msg))
+}
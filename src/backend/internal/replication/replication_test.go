@@ -0,0 +1,328 @@
+package replication
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKey = "replication-key"
+
+var testSite = sites.Key{Tenant: "example.com", Domain: "example.com"}
+
+// testEvents returns the page views of the site a second apart, starting with the one of index from.
+func testEvents(from, amount int) []*analytics.Event {
+	events := make([]*analytics.Event, amount)
+	for i := range events {
+		events[i] = &analytics.Event{
+			ID:          fmt.Sprintf("event-%d", from+i),
+			Type:        "pageview",
+			URL:         "https://example.com/",
+			Domain:      testSite.Domain,
+			Tenant:      testSite.Tenant,
+			HashedVisit: fmt.Sprintf("visitor-%d", from+i),
+			Timestamp:   timestamppb.New(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(from+i) * time.Second)),
+		}
+	}
+	return events
+}
+
+// replica is a Replicator served by its own gateway.
+type replica struct {
+	*Replicator
+	server *httptest.Server
+}
+
+// newReplicas returns the replicas replicating to each other, their metrics aren't registered globally.
+func newReplicas(t *testing.T, amount int) []*replica {
+	replicas := make([]*replica, amount)
+	for i := range replicas {
+		rep := &replica{}
+		mux := http.NewServeMux()
+		mux.HandleFunc(EventsPath, func(w http.ResponseWriter, req *http.Request) { rep.Events(w, req, nil) })
+		mux.HandleFunc(DeletePath, func(w http.ResponseWriter, req *http.Request) { rep.Delete(w, req, nil) })
+		mux.HandleFunc(SnapshotPath, func(w http.ResponseWriter, req *http.Request) { rep.Snapshot(w, req, nil) })
+		rep.server = httptest.NewServer(mux)
+		t.Cleanup(rep.server.Close)
+		replicas[i] = rep
+	}
+	for i, rep := range replicas {
+		var peers []string
+		for j, peer := range replicas {
+			if j != i {
+				peers = append(peers, peer.server.URL)
+			}
+		}
+		db, err := database.NewDatabase(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Replicator, err = newReplicator(db, peers, testKey, prometheus.NewRegistry()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return replicas
+}
+
+// run sends the changes of the replica until the test ends.
+func (rep *replica) run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rep.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// count returns the amount of the stored events of the site, bypassing the replication.
+func count(t *testing.T, db database.Database) int {
+	events, err := db.List(context.Background(), testSite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(events.GetEvents())
+}
+
+// waitFor waits until the value is the wanted one, as the replicas apply the changes asynchronously.
+func waitFor[T comparable](t *testing.T, what string, value func() T, want T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for got := value(); got != want; got = value() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %v, want %v", what, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitCount waits until the replica stores the amount of the events of the site.
+func waitCount(t *testing.T, db database.Database, want int) {
+	t.Helper()
+	waitFor(t, "stored events", func() int { return count(t, db) }, want)
+}
+
+// newQueue returns the Replicator queueing the changes for a peer which isn't sent to.
+func newQueue(t *testing.T) *Replicator {
+	db, err := database.NewDatabase(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newReplicator(db, []string{"http://peer.invalid"}, testKey, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestNext(t *testing.T) {
+	r := newQueue(t)
+	deleted := &deletedRange{Tenant: testSite.Tenant, Domain: testSite.Domain}
+	r.enqueue(change{events: testEvents(0, 600)})
+	r.enqueue(change{events: testEvents(600, 600)})
+	r.enqueue(change{events: testEvents(1200, 1)})
+	r.enqueue(change{deleted: deleted})
+	r.enqueue(change{events: testEvents(1201, 1)})
+	r.enqueue(change{events: testEvents(1202, 1)})
+	r.enqueue(change{events: testEvents(1203, 1500)})
+
+	p := r.peers[0]
+	if got := p.pendingEvents(); got != 2703 {
+		t.Fatalf("pendingEvents() = %v, want 2703", got)
+	}
+	// The consecutive events are merged up to batchEvents, a larger change is sent whole
+	for _, want := range []struct {
+		events  int
+		deleted bool
+	}{{events: 600}, {events: 601}, {deleted: true}, {events: 2}, {events: 1500}} {
+		b := p.next()
+		if b == nil {
+			t.Fatalf("next() = nil, want %+v", want)
+		}
+		if len(b.events) != want.events || (b.deleted != nil) != want.deleted || b.snapshot {
+			t.Fatalf("next() = %d events, deleted %v, snapshot %v, want %+v", len(b.events), b.deleted != nil, b.snapshot, want)
+		}
+		if p.lag() == 0 {
+			t.Error("lag() of the batch being sent = 0")
+		}
+		p.done()
+	}
+	if b := p.next(); b != nil {
+		t.Errorf("next() of the empty queue = %+v, want nil", b)
+	}
+	if got := p.pendingEvents(); got != 0 {
+		t.Errorf("pendingEvents() of the empty queue = %v, want 0", got)
+	}
+}
+
+func TestEnqueueBehind(t *testing.T) {
+	r := newQueue(t)
+	first := &deletedRange{Tenant: testSite.Tenant, Domain: testSite.Domain, To: time.Unix(1, 0)}
+	second := &deletedRange{Tenant: testSite.Tenant, Domain: testSite.Domain, To: time.Unix(2, 0)}
+	r.enqueue(change{events: testEvents(0, 10)})
+	r.enqueue(change{deleted: first})
+	r.enqueue(change{events: make([]*analytics.Event, maxPendingEvents)})
+	r.enqueue(change{deleted: second})
+	r.enqueue(change{events: testEvents(10, 10)})
+	// Falling behind again replaces the queued snapshot, so it's read after the events dropped again
+	r.enqueue(change{events: make([]*analytics.Event, maxPendingEvents)})
+	r.enqueue(change{events: testEvents(20, 10)})
+
+	p := r.peers[0]
+	if got := testutil.ToFloat64(r.droppedTotal.WithLabelValues(p.url)); got != 2*maxPendingEvents+20 {
+		t.Errorf("dropped events = %v, want %d", got, 2*maxPendingEvents+20)
+	}
+	for _, want := range []batch{{deleted: first}, {deleted: second}, {snapshot: true}, {events: testEvents(20, 10)}} {
+		b := p.next()
+		if b == nil || b.deleted != want.deleted || b.snapshot != want.snapshot || len(b.events) != len(want.events) {
+			t.Fatalf("next() = %+v, want %+v", b, want)
+		}
+		p.done()
+	}
+	if b := p.next(); b != nil {
+		t.Errorf("next() of the empty queue = %+v, want nil", b)
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	replicas := newReplicas(t, 2)
+	a, b := replicas[0], replicas[1]
+	a.run(t)
+	b.run(t)
+	ctx := context.Background()
+
+	if err := a.InsertBatch(ctx, testEvents(0, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Insert(ctx, testEvents(1500, 1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	waitCount(t, b.Database, 1501)
+	// The events are counted once the peer responds
+	waitFor(t, "sent events", func() float64 { return testutil.ToFloat64(a.sentTotal.WithLabelValues(b.server.URL)) }, 1501)
+	waitFor(t, "received events", func() float64 { return testutil.ToFloat64(b.receivedTotal) }, 1501)
+
+	// The events inserted into the peer are sent back to the replica, which doesn't store them yet
+	if err := b.Insert(ctx, testEvents(1501, 1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	waitCount(t, a.Database, 1502)
+
+	from, to := testEvents(0, 1)[0].GetTimestamp().AsTime(), testEvents(1000, 1)[0].GetTimestamp().AsTime()
+	if _, err := a.DeleteRange(ctx, testSite, from, to); err != nil {
+		t.Fatal(err)
+	}
+	waitCount(t, b.Database, 502)
+
+	if deleted, err := a.DeleteVisitor(ctx, testSite, "visitor-1200"); err != nil || deleted != 1 {
+		t.Fatalf("DeleteVisitor() = %d, %v, want 1", deleted, err)
+	}
+	waitCount(t, b.Database, 501)
+}
+
+func TestReplicateSnapshot(t *testing.T) {
+	replicas := newReplicas(t, 2)
+	a, b := replicas[0], replicas[1]
+	ctx := context.Background()
+
+	// The events stored bypassing the replication reach the peer only with the snapshot
+	if err := a.Database.InsertBatch(ctx, testEvents(0, 2500)); err != nil {
+		t.Fatal(err)
+	}
+	p := a.peers[0]
+	p.mutex.Lock()
+	p.compact()
+	p.mutex.Unlock()
+	a.run(t)
+	p.notify <- struct{}{}
+
+	waitCount(t, b.Database, 2500)
+	// The snapshot is counted once the peer responds to its last request
+	waitFor(t, "sent snapshots", func() float64 { return testutil.ToFloat64(a.snapshotsTotal.WithLabelValues(p.url)) }, 1)
+	if b := p.next(); b != nil {
+		t.Errorf("next() after the snapshot = %+v, want nil", b)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	replicas := newReplicas(t, 2)
+	a, b := replicas[0], replicas[1]
+	ctx := context.Background()
+	if err := a.Database.InsertBatch(ctx, testEvents(0, 2500)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := b.Restore(ctx); got != 2500 {
+		t.Errorf("Restore() = %d, want 2500", got)
+	}
+	if got := count(t, b.Database); got != 2500 {
+		t.Errorf("restored replica stores %d events, want 2500", got)
+	}
+}
+
+func TestRestoreTruncated(t *testing.T) {
+	tests := []struct {
+		name    string
+		events  int
+		end     bool
+		status  int
+		want    int
+		wantErr string
+	}{
+		{name: "complete", events: 1500, end: true, status: http.StatusOK, want: 1500},
+		{name: "empty", end: true, status: http.StatusOK},
+		{name: "truncated", events: 1500, status: http.StatusOK, want: 1500, wantErr: "snapshot is truncated"},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantErr: "503 Service Unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != SnapshotPath || req.Header.Get("Authorization") != "Bearer "+testKey {
+					http.Error(w, "unexpected request", http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(tt.status)
+				for _, e := range testEvents(0, tt.events) {
+					if _, err := protodelim.MarshalTo(w, e); err != nil {
+						return
+					}
+				}
+				if tt.end {
+					_, _ = protodelim.MarshalTo(w, &analytics.Event{})
+				}
+			}))
+			defer server.Close()
+			db, err := database.NewDatabase(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := newReplicator(db, []string{server.URL}, testKey, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := r.restore(context.Background(), r.peers[0])
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("restore() error = %v, want %q", err, tt.wantErr)
+			}
+			// The events read before the failure are kept
+			if got != tt.want || count(t, db) != tt.want {
+				t.Errorf("restore() = %d, stored %d events, want %d", got, count(t, db), tt.want)
+			}
+		})
+	}
+}
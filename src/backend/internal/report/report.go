@@ -0,0 +1,234 @@
+// Package report implements the scheduler emailing and posting the periodic summaries of the sites.
+package report
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/notify"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/sites"
+	"errors"
+	"fmt"
+	promClient "github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Sender delivers the rendered reports.
+type Sender interface {
+	Send(ctx context.Context, to []string, subject string, body string) error
+}
+
+// Scheduler checks every interval whether a report period of the sites is completed
+// and sends the report of it to the recipients and the channels.
+//
+// The sent periods are kept in memory, the periods completed before the start aren't reported,
+// so a restart never repeats a report. A period is sent again on the next check only if all
+// its targets failed.
+type Scheduler struct {
+	db       database.Database
+	sites    *sites.Registry
+	sender   Sender
+	notifier *notify.Notifier
+	interval time.Duration
+	logger   *zap.Logger
+
+	mutex sync.Mutex
+	// sent are the ends of the last reported periods by the site and the schedule
+	sent map[string]time.Time
+
+	sentTotal *promClient.CounterVec
+}
+
+// NewScheduler returns new Scheduler instance sending the reports of the sites of sitesRegistry.
+//
+// sender may be nil, the email reports fail then.
+func NewScheduler(db database.Database, sitesRegistry *sites.Registry, sender Sender, interval time.Duration) (*Scheduler, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if sitesRegistry == nil {
+		return nil, errors.New("sites.Registry instance is nil")
+	}
+	if interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+
+	s := &Scheduler{
+		db:       db,
+		sites:    sitesRegistry,
+		sender:   sender,
+		notifier: notify.NewNotifier(10 * time.Second),
+		interval: interval,
+		logger:   zap.L().Named("report"),
+		sent:     make(map[string]time.Time),
+		sentTotal: promClient.NewCounterVec(promClient.CounterOpts{
+			Name: "reports_sent_total",
+			Help: "Total number of the reports of the site by the channel and the result",
+		}, []string{"domain", "channel", "result"}),
+	}
+	promClient.MustRegister(s.sentTotal)
+
+	s.markSent(time.Now())
+
+	return s, nil
+}
+
+// Run sends the due reports every interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.SendDue(ctx, time.Now())
+	}
+}
+
+// markSent marks the periods completed at now as reported.
+func (s *Scheduler) markSent(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cfg := s.sites.Config()
+	for i := range cfg.Sites {
+		site := &cfg.Sites[i]
+		for _, r := range site.Reports {
+			_, to := r.Schedule.Period(now, site.Location())
+			s.sent[sentKey(site.Domain, r.Schedule)] = to
+		}
+	}
+}
+
+// SendDue sends the reports of the periods completed at now which aren't sent yet.
+//
+// The reports of the sites added after the start are sent from their next period.
+func (s *Scheduler) SendDue(ctx context.Context, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cfg := s.sites.Config()
+	for i := range cfg.Sites {
+		site := &cfg.Sites[i]
+		for _, r := range site.Reports {
+			from, to := r.Schedule.Period(now, site.Location())
+			key := sentKey(site.Domain, r.Schedule)
+			last, ok := s.sent[key]
+			if !ok {
+				s.sent[key] = to
+				continue
+			}
+			if !last.Before(to) {
+				continue
+			}
+
+			if s.send(ctx, site, r, from, to) {
+				s.sent[key] = to
+			}
+		}
+	}
+}
+
+// send renders and sends the report of the site period to its targets, the failures are logged.
+// It reports whether any target received the report.
+func (s *Scheduler) send(ctx context.Context, site *sites.Site, r sites.Report, from, to time.Time) bool {
+	delivered := false
+	result := func(channel string, err error) {
+		if err != nil {
+			s.sentTotal.WithLabelValues(site.Domain, channel, "error").Inc()
+			s.logger.Error("Cannot send report", zap.String("domain", site.Domain),
+				zap.String("schedule", string(r.Schedule)), zap.String("channel", channel), zap.Error(err))
+			return
+		}
+		s.sentTotal.WithLabelValues(site.Domain, channel, "sent").Inc()
+		delivered = true
+	}
+
+	data, err := summarize(ctx, s.db, site.Key(), site.StatsSettings(), r.Schedule, from, to)
+	if err != nil {
+		s.logger.Error("Cannot render report", zap.String("domain", site.Domain),
+			zap.String("schedule", string(r.Schedule)), zap.Error(err))
+		return false
+	}
+	if len(r.Recipients) > 0 {
+		result("email", s.email(ctx, data, r))
+	}
+	if len(r.Channels) > 0 {
+		m, err := data.message()
+		for _, name := range r.Channels {
+			ch, ok := site.Channel(name)
+			if !ok {
+				continue
+			}
+			if err == nil {
+				err = s.notifier.Send(ctx, ch, m)
+			}
+			result(string(ch.Type), err)
+		}
+	}
+	return delivered
+}
+
+// email sends the rendered report to the recipients.
+func (s *Scheduler) email(ctx context.Context, data *reportData, r sites.Report) error {
+	if s.sender == nil {
+		return errors.New("SMTP server isn't configured")
+	}
+	body, err := data.render()
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("%s %s report, %s", data.Domain, r.Schedule, data.Period)
+	return s.sender.Send(ctx, r.Recipients, subject, body)
+}
+
+// sentKey returns the key of the reports of the site with the schedule.
+func sentKey(domain string, schedule sites.ReportSchedule) string {
+	return domain + "/" + string(schedule)
+}
+
+// Render returns the text of the report of the site stats in [from, to), compared to the preceding period.
+// The stats are calculated with the settings of the site.
+func Render(ctx context.Context, db database.Database, site sites.Key, settings sites.StatsSettings, schedule sites.ReportSchedule, from, to time.Time) (string, error) {
+	data, err := summarize(ctx, db, site, settings, schedule, from, to)
+	if err != nil {
+		return "", err
+	}
+	return data.render()
+}
+
+// summarize returns the report data of the site stats in [from, to) and in the preceding period.
+func summarize(ctx context.Context, db database.Database, site sites.Key, settings sites.StatsSettings, schedule sites.ReportSchedule, from, to time.Time) (*reportData, error) {
+	current, err := prometheus.GetAnalyticsStatsRange(ctx, db, site, settings, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get stats: %w", err)
+	}
+	prevFrom := from.AddDate(0, 0, -7)
+	if schedule == sites.ReportMonthly {
+		prevFrom = from.AddDate(0, -1, 0)
+	}
+	previous, err := prometheus.GetAnalyticsStatsRange(ctx, db, site, settings, prevFrom, from)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get previous stats: %w", err)
+	}
+	return &reportData{
+		Domain:   site.Domain,
+		Schedule: schedule,
+		Period:   periodTitle(schedule, from, to),
+		To:       to,
+		Current:  current,
+		Previous: previous,
+	}, nil
+}
+
+// periodTitle returns the human readable period of the report.
+func periodTitle(schedule sites.ReportSchedule, from, to time.Time) string {
+	if schedule == sites.ReportMonthly {
+		return from.Format("January 2006")
+	}
+	return from.Format("Jan 2") + " – " + to.AddDate(0, 0, -1).Format("Jan 2, 2006")
+}
@@ -0,0 +1,60 @@
+package report
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPConfig holds the SMTP server settings.
+type SMTPConfig struct {
+	// Addr is the host:port of the server
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// SMTPSender sends the reports over SMTP, authenticating with PLAIN if the username is set.
+type SMTPSender struct {
+	cfg SMTPConfig
+}
+
+// NewSMTPSender returns new SMTPSender instance.
+func NewSMTPSender(cfg SMTPConfig) (*SMTPSender, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("SMTP address is missing")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return nil, fmt.Errorf("invalid SMTP address: %w", err)
+	}
+	if cfg.From == "" {
+		return nil, errors.New("sender address is missing")
+	}
+	return &SMTPSender{cfg: cfg}, nil
+}
+
+// Send implements Sender.
+func (s *SMTPSender) Send(_ context.Context, to []string, subject string, body string) error {
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(s.cfg.Addr)
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, host)
+	}
+
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return smtp.SendMail(s.cfg.Addr, auth, s.cfg.From, to, []byte(msg.String()))
+}
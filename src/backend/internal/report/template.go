@@ -0,0 +1,148 @@
+package report
+
+import (
+	"cmp"
+	"diploma/analytics-exporter/internal/notify"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/sites"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// topEntries is the amount of the top pages and sources in the report.
+const topEntries = 5
+
+// reportData is the data of the report template.
+type reportData struct {
+	Domain   string
+	Schedule sites.ReportSchedule
+	Period   string
+	// To is the exclusive end of the period
+	To       time.Time
+	Current  *prometheus.AnalyticsStats
+	Previous *prometheus.AnalyticsStats
+}
+
+// entry is a row of a top list.
+type entry struct {
+	Name  string
+	Count int
+}
+
+// templateFuncs are the functions of the report templates.
+var templateFuncs = template.FuncMap{
+	"change":  change,
+	"top":     top,
+	"percent": percent,
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(templateFuncs).Parse(`Analytics report of {{.Domain}} for {{.Period}}
+
+Unique visitors  {{.Current.UniqueVisitors}} ({{change .Current.UniqueVisitors .Previous.UniqueVisitors}})
+Visits           {{.Current.TotalVisits}} ({{change .Current.TotalVisits .Previous.TotalVisits}})
+Page views       {{.Current.TotalPageViews}} ({{change .Current.TotalPageViews .Previous.TotalPageViews}})
+Bounce rate      {{percent .Current.BounceRate}}
+
+Top pages
+{{- range top .Current.PagesRate}}
+  {{.Name}}  {{.Count}}
+{{- else}}
+  (none)
+{{- end}}
+
+Top sources
+{{- range top .Current.SourcesRate}}
+  {{if .Name}}{{.Name}}{{else}}(direct){{end}}  {{.Count}}
+{{- else}}
+  (none)
+{{- end}}
+`))
+
+// summaryTemplate is the text of the traffic summary posted to the chat channels, the totals are its fields.
+var summaryTemplate = template.Must(template.New("summary").Funcs(templateFuncs).Parse(`*Top pages*
+{{- range top .Current.PagesRate}}
+• ` + "`{{.Name}}`" + `  {{.Count}}
+{{- else}}
+• (none)
+{{- end}}
+
+*Top sources*
+{{- range top .Current.SourcesRate}}
+• {{if .Name}}{{.Name}}{{else}}(direct){{end}}  {{.Count}}
+{{- else}}
+• (none)
+{{- end}}`))
+
+// render returns the text of the email report.
+func (d *reportData) render() (string, error) {
+	buf := &strings.Builder{}
+	if err := reportTemplate.Execute(buf, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// message returns the traffic summary of the report posted to the chat channels.
+func (d *reportData) message() (*notify.Message, error) {
+	buf := &strings.Builder{}
+	if err := summaryTemplate.Execute(buf, d); err != nil {
+		return nil, err
+	}
+	total := func(current, previous int64) string {
+		return fmt.Sprintf("%d (%s)", current, change(current, previous))
+	}
+	return &notify.Message{
+		Title: fmt.Sprintf("%s %s report, %s", d.Domain, d.Schedule, d.Period),
+		Text:  buf.String(),
+		Color: notify.ColorReport,
+		Fields: []notify.Field{
+			{Name: "Unique visitors", Value: total(d.Current.UniqueVisitors, d.Previous.UniqueVisitors)},
+			{Name: "Visits", Value: total(d.Current.TotalVisits, d.Previous.TotalVisits)},
+			{Name: "Page views", Value: total(d.Current.TotalPageViews, d.Previous.TotalPageViews)},
+			{Name: "Bounce rate", Value: percent(d.Current.BounceRate)},
+		},
+		Timestamp: d.To,
+	}, nil
+}
+
+// percent formats the rate as a percentage.
+func percent(v float64) string {
+	return fmt.Sprintf("%.1f%%", v*100)
+}
+
+// change returns the relative change of the value compared to the previous one.
+func change(current, previous int64) string {
+	if previous == 0 {
+		if current == 0 {
+			return "no change"
+		}
+		return "new"
+	}
+	v := float64(current-previous) / float64(previous) * 100
+	if math.Abs(v) < 0.05 {
+		return "no change"
+	}
+	return fmt.Sprintf("%+.1f%% vs previous period", v)
+}
+
+// top returns the most frequent entries of the rating.
+func top(rating map[string]int) []entry {
+	entries := make([]entry, 0, len(rating))
+	for name, count := range rating {
+		entries = append(entries, entry{Name: name, Count: count})
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if len(entries) > topEntries {
+		entries = entries[:topEntries]
+	}
+	return entries
+}
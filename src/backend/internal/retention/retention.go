@@ -0,0 +1,105 @@
+// Package retention implements the job purging the events of the sites older than their retention periods.
+package retention
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Purger periodically deletes the events of the sites with a retention period which are older than it.
+//
+// The sites without a retention period keep their events. The rollups aren't purged,
+// so the aggregated stats of the purged periods are still available.
+type Purger struct {
+	db       database.Database
+	sites    *sites.Registry
+	interval time.Duration
+	logger   *zap.Logger
+
+	purgedTotal *prometheus.CounterVec
+}
+
+// NewPurger returns new Purger instance purging the events of the sites of sitesRegistry.
+func NewPurger(db database.Database, sitesRegistry *sites.Registry, interval time.Duration) (*Purger, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if sitesRegistry == nil {
+		return nil, errors.New("sites.Registry instance is nil")
+	}
+	if interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+
+	p := &Purger{
+		db:       db,
+		sites:    sitesRegistry,
+		interval: interval,
+		logger:   zap.L().Named("retention"),
+		purgedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "purged_events_total",
+			Help: "Total number of the events deleted after the retention period of the site",
+		}, []string{"domain"}),
+	}
+	prometheus.MustRegister(p.purgedTotal)
+
+	return p, nil
+}
+
+// Run purges the events every interval until ctx is done.
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.Purge(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge deletes the events older than the retention periods of the sites at now,
+// returning the numbers of the purged events by the domain. The failures are logged.
+func (p *Purger) Purge(ctx context.Context, now time.Time) map[string]int {
+	purged := make(map[string]int)
+	cfg := p.sites.Config()
+	for i := range cfg.Sites {
+		site := &cfg.Sites[i]
+		if site.Retention <= 0 {
+			continue
+		}
+		cutoff := now.Add(-site.Retention)
+		deleted, err := p.db.DeleteRange(ctx, site.Key(), time.Time{}, cutoff)
+		if err != nil {
+			p.logger.Error("Cannot purge events", zap.String("domain", site.Domain), zap.Error(err))
+			continue
+		}
+		if deleted == 0 {
+			continue
+		}
+		purged[site.Domain] = deleted
+		p.purgedTotal.WithLabelValues(site.Domain).Add(float64(deleted))
+
+		after := fmt.Sprintf(`{"tenant":%q,"to":%q,"deleted":%d}`, site.Tenant(), cutoff.UTC().Format(time.RFC3339), deleted)
+		if err = p.db.AppendAudit(ctx, &database.AuditEntry{
+			Time:   time.Now(),
+			Actor:  "retention",
+			Action: database.AuditDataDelete,
+			Domain: site.Domain,
+			After:  after,
+		}); err != nil {
+			p.logger.Error("Cannot append audit log entry", zap.String("domain", site.Domain), zap.Error(err))
+		}
+		p.logger.Info("Purged events", zap.String("domain", site.Domain), zap.Duration("retention", site.Retention),
+			zap.Int("deleted", deleted))
+	}
+	return purged
+}
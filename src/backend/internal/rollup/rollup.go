@@ -0,0 +1,214 @@
+// Package rollup implements the scheduler pre-aggregating events into hourly and daily rollups.
+package rollup
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"go.uber.org/zap"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TopEntries is an amount of the top pages and sources kept in a rollup.
+const TopEntries = 10
+
+// Scheduler periodically rolls up the events of the sites.
+type Scheduler struct {
+	db       database.Database
+	interval time.Duration
+	logger   *zap.Logger
+
+	mutex sync.Mutex
+	keys  []sites.Key
+	// locations are the timezones of the days of the sites, UTC if missing
+	locations map[sites.Key]*time.Location
+	// settings are the stats settings of the sites
+	settings map[sites.Key]sites.StatsSettings
+
+	// backfilled is set after the first run, which rolls up the whole history
+	backfilled bool
+}
+
+// NewScheduler returns new Scheduler instance rolling up the sites of cfg.
+func NewScheduler(db database.Database, cfg *sites.Config, interval time.Duration) (*Scheduler, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+	s := &Scheduler{
+		db:       db,
+		interval: interval,
+		logger:   zap.L().Named("rollup"),
+	}
+	s.SetSites(cfg)
+	return s, nil
+}
+
+// Run rolls up the events every interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.RollUp(ctx, time.Now()); err != nil {
+			s.logger.Error("cannot roll up events", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetSites replaces the sites rolled up by the following runs with the ones of cfg.
+func (s *Scheduler) SetSites(cfg *sites.Config) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = cfg.Keys()
+	s.locations = cfg.Locations()
+	s.settings = cfg.StatsSettings()
+}
+
+// RollUp recalculates the rollups of the current and the previous day of the sites, including their hours.
+//
+// The first call rolls up all the stored events.
+func (s *Scheduler) RollUp(ctx context.Context, now time.Time) error {
+	s.mutex.Lock()
+	keys, locations, settings := s.keys, s.locations, s.settings
+	s.mutex.Unlock()
+
+	for _, site := range keys {
+		loc := locations[site]
+		if loc == nil {
+			loc = time.UTC
+		}
+		from := sites.StartOfDay(now, loc).AddDate(0, 0, -1)
+		if !s.backfilled {
+			from = time.Time{}
+		}
+
+		events, err := s.db.ListRange(ctx, site, from, now)
+		if err != nil {
+			return err
+		}
+		rollups, err := Calculate(site, loc, settings[site], events.GetEvents())
+		if err != nil {
+			return err
+		}
+		// The hour starting before the previous day in the zones of the half hour offsets is partial
+		rollups = slices.DeleteFunc(rollups, func(r *database.Rollup) bool {
+			return r.Start.Before(from)
+		})
+		if err = s.db.UpsertRollups(ctx, rollups); err != nil {
+			return err
+		}
+		s.logger.Debug("rolled up events", zap.Stringer("site", site), zap.Int("rollups", len(rollups)))
+	}
+	s.backfilled = true
+
+	return nil
+}
+
+// Calculate returns hourly and daily rollups of the site events, the days start at midnight in loc
+// and the hours are the UTC ones. The visits and the pages are the ones of the site settings.
+//
+// Only periods with at least one event are returned.
+func Calculate(site sites.Key, loc *time.Location, settings sites.StatsSettings, events []*analytics.Event) ([]*database.Rollup, error) {
+	type bucket struct {
+		period database.RollupPeriod
+		start  time.Time
+	}
+	buckets := make(map[bucket][]*analytics.Event)
+	for _, e := range events {
+		ts := e.GetTimestamp().AsTime().UTC()
+		hour := bucket{period: database.RollupHourly, start: ts.Truncate(time.Hour)}
+		day := bucket{period: database.RollupDaily, start: sites.StartOfDay(ts, loc)}
+		buckets[hour] = append(buckets[hour], e)
+		buckets[day] = append(buckets[day], e)
+	}
+
+	rollups := make([]*database.Rollup, 0, len(buckets))
+	for b, bucketEvents := range buckets {
+		stats, err := prometheus.CalculateAnalyticsStats(bucketEvents, settings)
+		if err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, &database.Rollup{
+			ID:         database.RollupID(site, b.period, b.start),
+			Tenant:     site.Tenant,
+			Domain:     site.Domain,
+			Period:     b.period,
+			Start:      b.start,
+			Visitors:   stats.UniqueVisitors,
+			Visits:     stats.TotalVisits,
+			Pageviews:  stats.TotalPageViews,
+			TopPages:   top(stats.PagesRate, TopEntries),
+			TopSources: top(stats.SourcesRate, TopEntries),
+		})
+	}
+
+	return rollups, nil
+}
+
+// top returns n entries of the rating with the highest values.
+func top(rating map[string]int, n int) map[string]int {
+	keys := make([]string, 0, len(rating))
+	for k := range rating {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if rating[keys[i]] == rating[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return rating[keys[i]] > rating[keys[j]]
+	})
+
+	res := make(map[string]int, min(n, len(keys)))
+	for _, k := range keys[:min(n, len(keys))] {
+		res[k] = rating[k]
+	}
+	return res
+}
+
+// Merge adds the rollup of the same period to dst.
+//
+// Non-zero totals of src replace the ones of dst, as rollups of a period are imported from
+// several tables, and the top pages and sources are summed up and truncated to TopEntries.
+func Merge(dst *database.Rollup, src *database.Rollup) {
+	if src.Visitors != 0 {
+		dst.Visitors = src.Visitors
+	}
+	if src.Visits != 0 {
+		dst.Visits = src.Visits
+	}
+	if src.Pageviews != 0 {
+		dst.Pageviews = src.Pageviews
+	}
+
+	pages := maps.Clone(dst.TopPages)
+	if pages == nil {
+		pages = make(map[string]int, len(src.TopPages))
+	}
+	for k, v := range src.TopPages {
+		pages[k] += v
+	}
+	dst.TopPages = top(pages, TopEntries)
+
+	sources := maps.Clone(dst.TopSources)
+	if sources == nil {
+		sources = make(map[string]int, len(src.TopSources))
+	}
+	for k, v := range src.TopSources {
+		sources[k] += v
+	}
+	dst.TopSources = top(sources, TopEntries)
+}
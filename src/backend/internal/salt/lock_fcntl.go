@@ -0,0 +1,35 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package salt
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockFile takes the exclusive POSIX record lock of the file at path, waiting until it's released by the others.
+// Unlike flock, the record locks are passed to the server by the NFS clients, so they work on the shared volumes.
+// They are held by the process, so its own callers must be serialized, as they are by the mutex of Salt.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	for {
+		err = syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lock)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return func() {
+		lock.Type = syscall.F_UNLCK
+		_ = syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+		_ = f.Close()
+	}, nil
+}
@@ -0,0 +1,38 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package salt
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// The lock file is polled every lockPollInterval and taken over once it's older than staleLockAge,
+// i.e. it's left by a crashed replica, the salt is written within a fraction of it.
+const (
+	lockPollInterval = 50 * time.Millisecond
+	staleLockAge     = time.Minute
+)
+
+// lockFile takes the lock by creating the file at path exclusively, waiting until it's removed by the others.
+// It's the fallback of the platforms without the POSIX record locks, e.g. Windows.
+func lockFile(path string) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			_ = f.Close()
+			return func() {
+				_ = os.Remove(path)
+			}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			_ = os.Remove(path)
+			continue
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
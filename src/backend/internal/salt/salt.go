@@ -0,0 +1,259 @@
+// Package salt implements the rotated secret salt of the visitor hashes.
+package salt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Default settings of the salt.
+const (
+	DefaultLifetime = time.Hour * 24
+	DefaultSize     = 32
+)
+
+// Config holds the salt settings.
+type Config struct {
+	// Lifetime is the time after which the salt is rotated.
+	Lifetime time.Duration
+	// Size is the amount of the random bytes of the salt.
+	Size int
+	// Path is the file the salt is persisted to, so it survives the restarts.
+	// The salt is kept in memory only if it's empty.
+	Path string
+	// Shared makes the replicas persisting the salt to the same Path, e.g. on a shared volume,
+	// hash the visitors identically. The lock file next to it is locked while the salt is rotated,
+	// so only one of them generates the new salt and the others load it.
+	Shared bool
+	// Grace is the time after the rotation the previous salt is still returned by Previous,
+	// so the visits spanning the rotation aren't split. It's disabled if zero.
+	Grace time.Duration
+	// Elected makes the shared salt rotated by Run of the elected replica only, the others reload it
+	// once it expires and keep using the expired one until it's rotated.
+	Elected bool
+}
+
+// reloadInterval is the time between the reloads of the expired shared salt rotated by the elected replica.
+const reloadInterval = 5 * time.Second
+
+// Salt is the secret salt rotated every lifetime, so the visitor hashes cannot be linked across the periods.
+//
+// It's safe for concurrent use.
+type Salt struct {
+	cfg    Config
+	logger *zap.Logger
+
+	mutex    sync.Mutex
+	value    []byte
+	previous []byte
+	created  time.Time
+	// reloaded is the time the expired salt was last reloaded at
+	reloaded time.Time
+}
+
+// persisted is the file format of the persisted salt.
+type persisted struct {
+	Value    []byte    `json:"value"`
+	Previous []byte    `json:"previous,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// New returns new Salt instance, loading the persisted salt if it's still valid.
+func New(cfg Config) (*Salt, error) {
+	if cfg.Lifetime <= 0 {
+		return nil, errors.New("salt lifetime must be positive")
+	}
+	if cfg.Size < 16 {
+		return nil, errors.New("salt size must be at least 16 bytes")
+	}
+	if cfg.Grace < 0 || cfg.Grace >= cfg.Lifetime {
+		return nil, errors.New("salt grace must be shorter than the lifetime")
+	}
+
+	if cfg.Shared && cfg.Path == "" {
+		return nil, errors.New("shared salt requires the path")
+	}
+	if cfg.Elected && !cfg.Shared {
+		return nil, errors.New("elected salt rotation requires the shared salt")
+	}
+
+	s := &Salt{
+		cfg:    cfg,
+		logger: zap.L().Named("salt"),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load reads the persisted salt, if there's one. The mutex must be held once s is in use.
+func (s *Salt) load() error {
+	if s.cfg.Path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(s.cfg.Path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("cannot read salt: %w", err)
+	default:
+		p := persisted{}
+		if err = json.Unmarshal(b, &p); err != nil {
+			return fmt.Errorf("cannot parse salt: %w", err)
+		}
+		// A salt of another size is rotated right away
+		if len(p.Value) == s.cfg.Size {
+			s.value = p.Value
+			s.previous = p.Previous
+			s.created = p.Created
+		}
+	}
+	return nil
+}
+
+// Get returns the current salt, rotating it if it's expired, unless it's rotated by the elected replica.
+func (s *Salt) Get() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.valid() {
+		return s.value, nil
+	}
+
+	// The elected replica rotates the salt, which is generated here only if there's none yet
+	if s.cfg.Elected && s.value != nil {
+		if time.Since(s.reloaded) >= reloadInterval {
+			s.reloaded = time.Now()
+			if err := s.load(); err != nil {
+				s.logger.Error("Cannot reload the shared salt", zap.Error(err))
+			}
+		}
+		return s.value, nil
+	}
+	return s.rotate()
+}
+
+// Run rotates the salt once it expires until ctx is done, it's the job of the elected replica.
+func (s *Salt) Run(ctx context.Context) {
+	for {
+		s.mutex.Lock()
+		wait := time.Until(s.created.Add(s.cfg.Lifetime))
+		if wait <= 0 {
+			if _, err := s.rotate(); err != nil {
+				s.logger.Error("Cannot rotate the salt", zap.Error(err))
+				wait = reloadInterval
+			} else {
+				wait = time.Until(s.created.Add(s.cfg.Lifetime))
+			}
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// rotate generates the new salt, unless another replica has rotated the shared one already. The mutex must be held.
+func (s *Salt) rotate() ([]byte, error) {
+	// Another replica may have rotated the shared salt already
+	if s.cfg.Shared {
+		unlock, err := s.lock()
+		if err != nil {
+			return nil, fmt.Errorf("cannot lock the salt: %w", err)
+		}
+		defer unlock()
+		if err = s.load(); err != nil {
+			return nil, err
+		}
+		if s.valid() {
+			s.logger.Info("Loaded the shared salt")
+			return s.value, nil
+		}
+	}
+
+	value := make([]byte, s.cfg.Size)
+	if _, err := io.ReadFull(rand.Reader, value); err != nil {
+		return nil, fmt.Errorf("error while creating the salt: %w", err)
+	}
+	// The previous salt is kept unless it has expired longer than the grace period ago, e.g. before a restart
+	var previous []byte
+	if s.value != nil && time.Since(s.created) <= s.cfg.Lifetime+s.cfg.Grace {
+		previous = s.value
+	}
+	created := time.Now()
+	if err := s.persist(value, previous, created); err != nil {
+		return nil, fmt.Errorf("cannot persist the salt: %w", err)
+	}
+
+	s.previous = previous
+	s.value = value
+	s.created = created
+	s.logger.Info("Generated a new salt")
+	return s.value, nil
+}
+
+// Previous returns the salt rotated by the current one during the grace period after the rotation, nil otherwise.
+// It's called after Get, which rotates the salt.
+func (s *Salt) Previous() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.previous == nil || time.Since(s.created) > s.cfg.Grace {
+		return nil
+	}
+	return s.previous
+}
+
+// Grace returns the grace period of the rotation.
+func (s *Salt) Grace() time.Duration {
+	return s.cfg.Grace
+}
+
+// valid reports whether the current salt isn't expired. The mutex must be held.
+func (s *Salt) valid() bool {
+	return s.value != nil && time.Since(s.created) <= s.cfg.Lifetime
+}
+
+// lock takes the exclusive advisory lock of the shared salt, held until the returned function is called.
+func (s *Salt) lock() (func(), error) {
+	return lockFile(s.cfg.Path + ".lock")
+}
+
+// persist atomically writes the salt to the file, readable by the owner only.
+func (s *Salt) persist(value []byte, previous []byte, created time.Time) error {
+	if s.cfg.Path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(persisted{Value: value, Previous: previous, Created: created})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.cfg.Path), filepath.Base(s.cfg.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.cfg.Path)
+}
@@ -0,0 +1,109 @@
+package sites
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+// AlertMetric is the value an alert rule is evaluated on.
+type AlertMetric string
+
+const (
+	// AlertCurrentVisitors is the amount of the visitors with events within the current visitors window of the site.
+	AlertCurrentVisitors AlertMetric = "current_visitors"
+	// AlertVisitors is the amount of the unique visitors in the window.
+	AlertVisitors AlertMetric = "visitors"
+	// AlertPageViews is the amount of the page views in the window.
+	AlertPageViews AlertMetric = "pageviews"
+	// AlertVisitorsAnomaly is the z-score of the visitors of the last hour against the same hours of the previous days,
+	// positive for the spikes and negative for the drops. It requires the hourly rollups.
+	AlertVisitorsAnomaly AlertMetric = "visitors_anomaly"
+)
+
+// DefaultAlertWindow is the window of the alert rules which don't set it.
+const DefaultAlertWindow = time.Hour
+
+// AlertRule fires when the metric of the site compared to the threshold with the operator is true,
+// notifying the targets when it fires and when it's resolved.
+type AlertRule struct {
+	Name   string      `yaml:"name"`
+	Metric AlertMetric `yaml:"metric"`
+	// Window is the period before now the visitors and the page views are counted in, DefaultAlertWindow if zero.
+	Window time.Duration `yaml:"window"`
+	// Operator is one of >, >=, < and <=.
+	Operator  string  `yaml:"operator"`
+	Threshold float64 `yaml:"threshold"`
+
+	// Webhook is the URL the JSON notifications are posted to.
+	Webhook string `yaml:"webhook"`
+	// Slack is the URL of the Slack incoming webhook, a shorthand of a Slack channel of the site.
+	Slack string `yaml:"slack"`
+	// Channels are the names of the channels of the site the notifications are posted to.
+	Channels []string `yaml:"channels"`
+	// Email are the recipients of the notifications, they require an SMTP server.
+	Email []string `yaml:"email"`
+}
+
+// Validate checks the alert rule settings.
+func (r *AlertRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert name is missing")
+	}
+	switch r.Metric {
+	case AlertCurrentVisitors, AlertVisitors, AlertPageViews, AlertVisitorsAnomaly:
+	default:
+		return fmt.Errorf("alert %s: unknown metric %q", r.Name, r.Metric)
+	}
+	if r.Window < 0 {
+		return fmt.Errorf("alert %s: window must not be negative", r.Name)
+	}
+	switch r.Operator {
+	case ">", ">=", "<", "<=":
+	default:
+		return fmt.Errorf("alert %s: unknown operator %q", r.Name, r.Operator)
+	}
+	if r.Webhook == "" && r.Slack == "" && len(r.Channels) == 0 && len(r.Email) == 0 {
+		return fmt.Errorf("alert %s: no notification targets", r.Name)
+	}
+	for _, u := range []string{r.Webhook, r.Slack} {
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("alert %s: invalid URL %q", r.Name, u)
+		}
+	}
+	for _, to := range r.Email {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("alert %s: invalid recipient %q: %w", r.Name, to, err)
+		}
+	}
+	return nil
+}
+
+// Firing reports whether the rule fires with the value.
+func (r *AlertRule) Firing(value float64) bool {
+	switch r.Operator {
+	case ">":
+		return value > r.Threshold
+	case ">=":
+		return value >= r.Threshold
+	case "<":
+		return value < r.Threshold
+	case "<=":
+		return value <= r.Threshold
+	default:
+		return false
+	}
+}
+
+// EvaluationWindow returns the window of the rule, DefaultAlertWindow if it isn't set.
+func (r *AlertRule) EvaluationWindow() time.Duration {
+	if r.Window > 0 {
+		return r.Window
+	}
+	return DefaultAlertWindow
+}
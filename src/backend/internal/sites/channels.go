@@ -0,0 +1,78 @@
+package sites
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// ChannelType is the chat service of a notification channel.
+type ChannelType string
+
+const (
+	// ChannelSlack posts to a Slack incoming webhook.
+	ChannelSlack ChannelType = "slack"
+	// ChannelDiscord posts to a Discord channel webhook.
+	ChannelDiscord ChannelType = "discord"
+)
+
+// Channel is a chat channel the alerts and the reports of the site are posted to, referred by its name.
+type Channel struct {
+	Name string      `yaml:"name"`
+	Type ChannelType `yaml:"type"`
+	// URL is the incoming webhook of the channel.
+	URL string `yaml:"url"`
+}
+
+// Validate checks the channel settings.
+func (c *Channel) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("channel name is missing")
+	}
+	if c.Type != ChannelSlack && c.Type != ChannelDiscord {
+		return fmt.Errorf("channel %s: unknown type %q", c.Name, c.Type)
+	}
+	parsed, err := url.Parse(c.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("channel %s: invalid URL %q", c.Name, c.URL)
+	}
+	return nil
+}
+
+// Channel returns the channel of the site with the name.
+func (s *Site) Channel(name string) (*Channel, bool) {
+	for i := range s.Channels {
+		if s.Channels[i].Name == name {
+			return &s.Channels[i], true
+		}
+	}
+	return nil, false
+}
+
+// validateChannels checks the channels of the site and that the alerts and the reports refer to the defined ones.
+func (s *Site) validateChannels() error {
+	names := make(map[string]bool, len(s.Channels))
+	for i := range s.Channels {
+		if err := s.Channels[i].Validate(); err != nil {
+			return err
+		}
+		if names[s.Channels[i].Name] {
+			return fmt.Errorf("channel %s is defined more than once", s.Channels[i].Name)
+		}
+		names[s.Channels[i].Name] = true
+	}
+	for _, a := range s.Alerts {
+		for _, name := range a.Channels {
+			if !names[name] {
+				return fmt.Errorf("alert %s: unknown channel %q", a.Name, name)
+			}
+		}
+	}
+	for _, r := range s.Reports {
+		for _, name := range r.Channels {
+			if !names[name] {
+				return fmt.Errorf("%s report: unknown channel %q", r.Schedule, name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package sites
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Exclusions are the traffic of the site which isn't stored, e.g. of the office or of the monitoring bots.
+type Exclusions struct {
+	// IPs are the client addresses and the CIDRs, e.g. 203.0.113.0/24.
+	IPs []string `yaml:"ips"`
+	// UserAgents are the substrings of the user agents, matched case-insensitively.
+	UserAgents []string `yaml:"user_agents"`
+	// Visitors are the visitor hashes, which change with the salt rotation.
+	Visitors []string `yaml:"visitors"`
+}
+
+// Validate checks the addresses and the CIDRs.
+func (e *Exclusions) Validate() error {
+	for _, ip := range e.IPs {
+		if _, err := parsePrefix(ip); err != nil {
+			return fmt.Errorf("invalid excluded IP %q", ip)
+		}
+	}
+	for _, ua := range e.UserAgents {
+		if ua == "" {
+			return fmt.Errorf("excluded user agent is empty")
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the exclusions.
+func (e *Exclusions) Clone() Exclusions {
+	return Exclusions{
+		IPs:        slices.Clone(e.IPs),
+		UserAgents: slices.Clone(e.UserAgents),
+		Visitors:   slices.Clone(e.Visitors),
+	}
+}
+
+// Excludes reports whether the events of the client address, the user agent or the visitor hash aren't stored.
+// The visitor is empty if it isn't hashed.
+func (s *Site) Excludes(ip string, userAgent string, visitor string) bool {
+	e := &s.Exclusions
+	if visitor != "" && slices.Contains(e.Visitors, visitor) {
+		return true
+	}
+	if len(e.UserAgents) > 0 {
+		userAgent = strings.ToLower(userAgent)
+		for _, ua := range e.UserAgents {
+			if strings.Contains(userAgent, strings.ToLower(ua)) {
+				return true
+			}
+		}
+	}
+	if len(e.IPs) > 0 {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, excluded := range e.IPs {
+			if prefix, err := parsePrefix(excluded); err == nil && prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parsePrefix parses the CIDR or the single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
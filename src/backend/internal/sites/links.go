@@ -0,0 +1,116 @@
+package sites
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sharedLinkPrefix tells the shared link tokens from the API keys.
+	sharedLinkPrefix = "shl_"
+	// MinLinkSecretLength is the minimal length of the secret the shared links are signed with.
+	MinLinkSecretLength = 16
+	// DefaultSharedLinkTTL is the lifetime of the shared links, unless requested otherwise.
+	DefaultSharedLinkTTL = 7 * 24 * time.Hour
+	// MaxSharedLinkTTL is the maximal lifetime of the shared links.
+	MaxSharedLinkTTL = 90 * 24 * time.Hour
+)
+
+// ErrLinkExpired is returned for the shared links past their expiration, it's ErrUnauthenticated.
+var ErrLinkExpired = fmt.Errorf("shared link is expired: %w", ErrUnauthenticated)
+
+// IsSharedLink reports whether the key is a shared link token rather than an API key.
+func IsSharedLink(key string) bool {
+	return strings.HasPrefix(key, sharedLinkPrefix)
+}
+
+// LinkSigner mints and verifies the shared link tokens, which grant reading the stats of a single domain
+// until they expire. The tokens aren't stored, changing the secret revokes all of them.
+type LinkSigner struct {
+	secret []byte
+}
+
+// NewLinkSigner returns new LinkSigner instance signing the tokens with the secret.
+func NewLinkSigner(secret string) (*LinkSigner, error) {
+	if len(secret) < MinLinkSecretLength {
+		return nil, errors.New("shared link secret is too short")
+	}
+	return &LinkSigner{secret: []byte(secret)}, nil
+}
+
+// Sign returns the shared link token of the domain valid until expires.
+func (s *LinkSigner) Sign(domain string, expires time.Time) string {
+	payload := strconv.FormatInt(expires.Unix(), 10) + "|" + domain
+	return sharedLinkPrefix + base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(s.mac(payload))
+}
+
+// Verify returns the domain of the shared link token, if it's signed by s and isn't expired at now.
+func (s *LinkSigner) Verify(token string, now time.Time) (string, error) {
+	encoded, signature, ok := strings.Cut(strings.TrimPrefix(token, sharedLinkPrefix), ".")
+	if !ok || !IsSharedLink(token) {
+		return "", ErrUnauthenticated
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrUnauthenticated
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.mac(string(payload))) {
+		return "", ErrUnauthenticated
+	}
+	expires, domain, ok := strings.Cut(string(payload), "|")
+	if !ok {
+		return "", ErrUnauthenticated
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", ErrUnauthenticated
+	}
+	if !now.Before(time.Unix(unix, 0)) {
+		return "", ErrLinkExpired
+	}
+	return domain, nil
+}
+
+// mac returns the signature of the payload.
+func (s *LinkSigner) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// SetLinkSigner sets the signer the shared links are verified with, they are rejected if it's nil.
+func (r *Registry) SetLinkSigner(s *LinkSigner) {
+	r.links.Store(s)
+}
+
+// LinkSigner returns the signer of the shared links, or nil. It's safe to call on a nil Registry.
+func (r *Registry) LinkSigner() *LinkSigner {
+	if r == nil {
+		return nil
+	}
+	return r.links.Load()
+}
+
+// authorizeLink checks that the shared link token grants the permission on the domain.
+func (r *Registry) authorizeLink(token string, domain string, permission Permission) error {
+	signer := r.links.Load()
+	if signer == nil {
+		return ErrUnauthenticated
+	}
+	linked, err := signer.Verify(token, time.Now())
+	if err != nil {
+		return err
+	}
+	if permission != PermissionStats || linked != domain {
+		return ErrForbidden
+	}
+	return nil
+}
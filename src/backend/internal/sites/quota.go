@@ -0,0 +1,56 @@
+package sites
+
+import (
+	"fmt"
+)
+
+// OverQuota defines what happens to the events of a tenant over its monthly quota.
+type OverQuota string
+
+const (
+	// OverQuotaReject rejects the events, it's the default.
+	OverQuotaReject OverQuota = "reject"
+	// OverQuotaSample accepts the share of the events defined by the sample rate and drops the rest.
+	OverQuotaSample OverQuota = "sample"
+)
+
+// TenantConfig is the configuration of a tenant, the sites of which are grouped by their owner.
+type TenantConfig struct {
+	Name string `yaml:"name"`
+	// MonthlyQuota is the amount of the events accepted per calendar month in UTC, unlimited if zero.
+	MonthlyQuota int64 `yaml:"monthly_quota"`
+	// OverQuota is the handling of the events over the quota, OverQuotaReject if empty.
+	OverQuota OverQuota `yaml:"over_quota"`
+	// SampleRate is the share of the events over the quota accepted with OverQuotaSample.
+	SampleRate float64 `yaml:"sample_rate"`
+}
+
+// Validate checks the tenant settings.
+func (t *TenantConfig) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("tenant name is missing")
+	}
+	if t.MonthlyQuota < 0 {
+		return fmt.Errorf("tenant %s: monthly quota must not be negative", t.Name)
+	}
+	switch t.OverQuota {
+	case "", OverQuotaReject:
+	case OverQuotaSample:
+		if t.SampleRate <= 0 || t.SampleRate > 1 {
+			return fmt.Errorf("tenant %s: sample rate must be in (0, 1]", t.Name)
+		}
+	default:
+		return fmt.Errorf("tenant %s: unknown over quota handling %q", t.Name, t.OverQuota)
+	}
+	return nil
+}
+
+// Tenant returns the configuration of the tenant, the tenants which aren't configured have no quota.
+func (c *Config) Tenant(name string) TenantConfig {
+	for _, t := range c.Tenants {
+		if t.Name == name {
+			return t
+		}
+	}
+	return TenantConfig{Name: name}
+}
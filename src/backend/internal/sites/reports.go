@@ -0,0 +1,52 @@
+package sites
+
+import (
+	"fmt"
+	"net/mail"
+	"time"
+)
+
+// ReportSchedule is the period summarized by a report.
+type ReportSchedule string
+
+const (
+	// ReportWeekly summarizes the previous week from Monday, sent on Mondays.
+	ReportWeekly ReportSchedule = "weekly"
+	// ReportMonthly summarizes the previous calendar month, sent on the first day of the month.
+	ReportMonthly ReportSchedule = "monthly"
+)
+
+// Report is a report of the site emailed to the recipients and posted to the channels on the schedule.
+type Report struct {
+	Schedule   ReportSchedule `yaml:"schedule"`
+	Recipients []string       `yaml:"recipients"`
+	// Channels are the names of the channels of the site the traffic summary is posted to.
+	Channels []string `yaml:"channels"`
+}
+
+// Validate checks the report settings.
+func (r *Report) Validate() error {
+	if r.Schedule != ReportWeekly && r.Schedule != ReportMonthly {
+		return fmt.Errorf("unknown report schedule %q", r.Schedule)
+	}
+	if len(r.Recipients) == 0 && len(r.Channels) == 0 {
+		return fmt.Errorf("%s report has neither recipients nor channels", r.Schedule)
+	}
+	for _, to := range r.Recipients {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("%s report: invalid recipient %q: %w", r.Schedule, to, err)
+		}
+	}
+	return nil
+}
+
+// Period returns the last period of the schedule completed at now in loc, from is inclusive and to is exclusive.
+func (r ReportSchedule) Period(now time.Time, loc *time.Location) (time.Time, time.Time) {
+	day := StartOfDay(now, loc)
+	if r == ReportMonthly {
+		to := day.AddDate(0, 0, 1-day.Day())
+		return to.AddDate(0, -1, 0), to
+	}
+	to := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	return to.AddDate(0, 0, -7), to
+}
@@ -0,0 +1,65 @@
+package sites
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Role is the set of the permissions granted by a token.
+type Role string
+
+const (
+	// RoleIngest only sends the events of the site, it's granted by the site API keys embedded in the tracker snippets.
+	RoleIngest Role = "ingest"
+	// RoleViewer reads the stats of the sites of the tenant.
+	RoleViewer Role = "viewer"
+	// RoleOwner also sends the events, reads the raw events and imports the data of the sites of the tenant.
+	RoleOwner Role = "owner"
+	// RoleAdmin has all the permissions on the sites of all the tenants.
+	RoleAdmin Role = "admin"
+)
+
+// Permission is an operation on the data of a site.
+type Permission string
+
+const (
+	// PermissionIngest allows sending the events.
+	PermissionIngest Permission = "ingest"
+	// PermissionStats allows reading the aggregated stats and the live visitors.
+	PermissionStats Permission = "stats"
+	// PermissionEvents allows reading the raw events, including their export.
+	PermissionEvents Permission = "events"
+	// PermissionWrite allows importing and deleting the data.
+	PermissionWrite Permission = "write"
+	// PermissionUsage allows reading the usage of the tenant.
+	PermissionUsage Permission = "usage"
+	// PermissionShare allows minting the shared links to the stats.
+	PermissionShare Permission = "share"
+)
+
+// rolePermissions are the permissions granted by the roles.
+var rolePermissions = map[Role][]Permission{
+	RoleIngest: {PermissionIngest},
+	RoleViewer: {PermissionStats, PermissionUsage},
+	RoleOwner:  {PermissionIngest, PermissionStats, PermissionEvents, PermissionWrite, PermissionUsage, PermissionShare},
+	RoleAdmin:  {PermissionIngest, PermissionStats, PermissionEvents, PermissionWrite, PermissionUsage, PermissionShare},
+}
+
+// Can reports whether the role grants the permission.
+func (r Role) Can(p Permission) bool {
+	return slices.Contains(rolePermissions[r], p)
+}
+
+// Validate checks that the role is known.
+func (r Role) Validate() error {
+	if _, ok := rolePermissions[r]; !ok {
+		return fmt.Errorf("unknown role %q", r)
+	}
+	return nil
+}
+
+// Token is an API key of the site granting the role, the API keys of the site grant RoleIngest.
+type Token struct {
+	Key  string `yaml:"key"`
+	Role Role   `yaml:"role"`
+}
@@ -0,0 +1,128 @@
+package sites
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionIssuer is the issuer of the session tokens.
+	sessionIssuer = "analytics-exporter"
+	// sessionHeader is the encoded JOSE header of the session tokens, they are always HS256 signed.
+	sessionHeader = "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9"
+	// MinSessionSecretLength is the minimal length of the secret the sessions are signed with.
+	MinSessionSecretLength = 16
+	// DefaultSessionTTL is the lifetime of the sessions, unless configured otherwise.
+	DefaultSessionTTL = 12 * time.Hour
+)
+
+// ErrSessionExpired is returned for the sessions past their expiration, it's ErrUnauthenticated.
+var ErrSessionExpired = fmt.Errorf("session is expired: %w", ErrUnauthenticated)
+
+// SessionClaims are the claims of the session tokens.
+type SessionClaims struct {
+	Issuer  string `json:"iss"`
+	Subject string `json:"sub"`
+	Email   string `json:"email"`
+	// Admin is granted by the identity provider, in addition to the admin users
+	Admin    bool  `json:"admin,omitempty"`
+	IssuedAt int64 `json:"iat"`
+	Expires  int64 `json:"exp"`
+}
+
+// IsSessionToken reports whether the key is a session token rather than an API key.
+func IsSessionToken(key string) bool {
+	return strings.HasPrefix(key, sessionHeader+".")
+}
+
+// SessionSigner mints and verifies the session tokens of the users, which are JWTs signed with HS256.
+// The sessions aren't stored, changing the secret ends all of them.
+type SessionSigner struct {
+	secret []byte
+}
+
+// NewSessionSigner returns new SessionSigner instance signing the tokens with the secret.
+func NewSessionSigner(secret string) (*SessionSigner, error) {
+	if len(secret) < MinSessionSecretLength {
+		return nil, errors.New("session secret is too short")
+	}
+	return &SessionSigner{secret: []byte(secret)}, nil
+}
+
+// Sign returns the session token of the user valid from now until expires,
+// admin grants the access of the admin users to the session.
+func (s *SessionSigner) Sign(user *User, admin bool, now time.Time, expires time.Time) (string, error) {
+	payload, err := json.Marshal(SessionClaims{
+		Issuer:   sessionIssuer,
+		Subject:  user.ID,
+		Email:    user.Email,
+		Admin:    admin,
+		IssuedAt: now.Unix(),
+		Expires:  expires.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := sessionHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(s.mac(signed)), nil
+}
+
+// Verify returns the claims of the session token, if it's signed by s and isn't expired at now.
+func (s *SessionSigner) Verify(token string, now time.Time) (*SessionClaims, error) {
+	i := strings.LastIndexByte(token, '.')
+	if !IsSessionToken(token) || i < 0 {
+		return nil, ErrUnauthenticated
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(signature, s.mac(token[:i])) {
+		return nil, ErrUnauthenticated
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token[:i], sessionHeader+"."))
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	claims := &SessionClaims{}
+	if err = json.Unmarshal(payload, claims); err != nil || claims.Issuer != sessionIssuer {
+		return nil, ErrUnauthenticated
+	}
+	if !now.Before(time.Unix(claims.Expires, 0)) {
+		return nil, ErrSessionExpired
+	}
+	return claims, nil
+}
+
+// mac returns the signature of the signed part of the token.
+func (s *SessionSigner) mac(signed string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(signed))
+	return h.Sum(nil)
+}
+
+// SetSessionSigner sets the signer the sessions are verified with, they are rejected if it's nil.
+func (r *Registry) SetSessionSigner(s *SessionSigner) {
+	r.sessions.Store(s)
+}
+
+// sessionUser returns the user of the session token, who must still exist, and whether they access as an admin.
+func (r *Registry) sessionUser(token string) (*User, bool, bool) {
+	signer := r.sessions.Load()
+	d := r.users.Load()
+	if signer == nil || d == nil {
+		return nil, false, false
+	}
+	claims, err := signer.Verify(token, time.Now())
+	if err != nil {
+		return nil, false, false
+	}
+	u, ok := d.byID[claims.Subject]
+	if !ok {
+		return nil, false, false
+	}
+	return u, u.Admin || claims.Admin, true
+}
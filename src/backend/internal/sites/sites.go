@@ -0,0 +1,391 @@
+// Package sites implements the per-site configuration file.
+package sites
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the sites configuration file.
+type Config struct {
+	Sites []Site `yaml:"sites"`
+	// Tenants are the settings of the owners of the sites, e.g. their quotas.
+	Tenants []TenantConfig `yaml:"tenants"`
+}
+
+// Site is the configuration of a single tracked domain.
+type Site struct {
+	Domain string `yaml:"domain"`
+	// Timezone is the IANA name of the site timezone, UTC if empty.
+	Timezone string `yaml:"timezone"`
+	// Goals are the conversions tracked for the site.
+	Goals []Goal `yaml:"goals"`
+	// SessionTimeout is the inactivity period ending a visit, the default one is used if zero.
+	SessionTimeout time.Duration `yaml:"session_timeout"`
+	// CurrentVisitorsWindow is the period the visitors with events within are current, the default one is used if zero.
+	CurrentVisitorsWindow time.Duration `yaml:"current_visitors_window"`
+	// DedupWindow is the period the identical events of the same visitor aren't stored again within,
+	// e.g. of the page refreshes or of the double fired tracker calls. The events aren't deduplicated if zero.
+	DedupWindow time.Duration `yaml:"dedup_window"`
+	// URLRules are the normalizations of the page URLs, so the variants of a page are counted as one.
+	URLRules URLRules `yaml:"url_rules"`
+	// Retention is the age after which the site events are archived, or purged when the archive isn't configured.
+	// The global archive threshold is used if zero, the events aren't purged then.
+	Retention time.Duration `yaml:"retention"`
+	// AllowedOrigins are the origins allowed to send the site events, any origin is allowed if empty.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// Exclusions are the traffic of the site which isn't stored.
+	Exclusions Exclusions `yaml:"exclusions"`
+	// Owner is the tenant the site belongs to, the site is its own tenant if empty.
+	Owner string `yaml:"owner"`
+	// APIKeys are the keys accepted for the site events only, as they are embedded in the tracker snippets,
+	// the ingestion of the site is open if empty and there are no tokens.
+	APIKeys []string `yaml:"api_keys"`
+	// Tokens are the API keys granting the roles, e.g. RoleOwner reading the raw events and writing the data.
+	Tokens []Token `yaml:"tokens"`
+	// Channels are the Slack and Discord channels the alerts and the reports of the site can be posted to.
+	Channels []Channel `yaml:"channels"`
+	// Reports are the summaries of the site sent on their schedules.
+	Reports []Report `yaml:"reports"`
+	// Alerts are the rules notifying about the traffic of the site.
+	Alerts []AlertRule `yaml:"alerts"`
+	// Widgets are the public tokens of the numbers of the site embedded into its pages.
+	Widgets []Widget `yaml:"widgets"`
+}
+
+// DefaultSessionTimeout is the inactivity period ending the visits of the sites which don't set it.
+const DefaultSessionTimeout = 30 * time.Minute
+
+// DefaultCurrentVisitorsWindow is the period the visitors with events within are current for the sites which don't set it.
+const DefaultCurrentVisitorsWindow = 5 * time.Minute
+
+// VisitTimeout returns the inactivity period ending the visits of the site.
+func (s *Site) VisitTimeout() time.Duration {
+	if s.SessionTimeout > 0 {
+		return s.SessionTimeout
+	}
+	return DefaultSessionTimeout
+}
+
+// StatsSettings are the settings of the site the stats of its events are calculated with.
+type StatsSettings struct {
+	// VisitTimeout is the inactivity period ending a visit, DefaultSessionTimeout if zero.
+	VisitTimeout time.Duration
+	// URLRules normalize the paths of the pages.
+	URLRules URLRules
+	// CurrentVisitorsWindow is the period the visitors with events within are current, DefaultCurrentVisitorsWindow if zero.
+	CurrentVisitorsWindow time.Duration
+}
+
+// StatsSettings returns the settings the stats of the site are calculated with.
+func (s *Site) StatsSettings() StatsSettings {
+	window := s.CurrentVisitorsWindow
+	if window <= 0 {
+		window = DefaultCurrentVisitorsWindow
+	}
+	return StatsSettings{VisitTimeout: s.VisitTimeout(), URLRules: s.URLRules, CurrentVisitorsWindow: window}
+}
+
+// StatsSettings returns the settings the stats of the domain are calculated with,
+// the default ones for the domains without a site.
+//
+// It's safe to call on a nil Registry, which has no sites.
+func (r *Registry) StatsSettings(domain string) StatsSettings {
+	if r == nil {
+		return StatsSettings{VisitTimeout: DefaultSessionTimeout, CurrentVisitorsWindow: DefaultCurrentVisitorsWindow}
+	}
+	if site, ok := r.Get(domain); ok {
+		return site.StatsSettings()
+	}
+	return StatsSettings{VisitTimeout: DefaultSessionTimeout, CurrentVisitorsWindow: DefaultCurrentVisitorsWindow}
+}
+
+// StatsSettings returns the settings the stats of the sites are calculated with by their keys.
+func (c *Config) StatsSettings() map[Key]StatsSettings {
+	res := make(map[Key]StatsSettings, len(c.Sites))
+	for i := range c.Sites {
+		res[c.Sites[i].Key()] = c.Sites[i].StatsSettings()
+	}
+	return res
+}
+
+// Goal is completed by an event of the type or by a pageview of the path.
+type Goal struct {
+	Name  string `yaml:"name"`
+	Event string `yaml:"event"`
+	Path  string `yaml:"path"`
+	// Webhook receives the completions of the goal, e.g. to trigger the Zapier or Make workflows.
+	Webhook GoalWebhook `yaml:"webhook"`
+}
+
+// GoalWebhook is the HTTP endpoint the goal completions are posted to, disabled if the URL is empty.
+type GoalWebhook struct {
+	URL string `yaml:"url"`
+	// Secret is the key of the HMAC-SHA256 payload signature, the payload is not signed if empty.
+	Secret string `yaml:"secret"`
+}
+
+// Completed reports whether the goal is completed by the event of the type with the URL path.
+func (g *Goal) Completed(eventType string, path string) bool {
+	if g.Event != "" {
+		return g.Event == eventType
+	}
+	return eventType == "pageview" && g.Path == path
+}
+
+// LoadConfig reads and validates the sites configuration file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err = yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse sites config: %w", err)
+	}
+	if len(cfg.Sites) == 0 {
+		return nil, fmt.Errorf("no sites are defined")
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the sites and the tenants, and that their domains, API keys and names are unique.
+func (c *Config) Validate() error {
+	tenants := make(map[string]bool, len(c.Tenants))
+	for i := range c.Tenants {
+		if err := c.Tenants[i].Validate(); err != nil {
+			return err
+		}
+		if tenants[c.Tenants[i].Name] {
+			return fmt.Errorf("tenant %s is defined more than once", c.Tenants[i].Name)
+		}
+		tenants[c.Tenants[i].Name] = true
+	}
+
+	seen := make(map[string]bool, len(c.Sites))
+	keys := make(map[string]string)
+	for i, s := range c.Sites {
+		if s.Domain == "" {
+			return fmt.Errorf("site %d: domain is missing", i)
+		}
+		if seen[s.Domain] {
+			return fmt.Errorf("site %s is defined more than once", s.Domain)
+		}
+		seen[s.Domain] = true
+		if err := s.Validate(); err != nil {
+			return err
+		}
+		for _, k := range s.keys() {
+			if other, ok := keys[k]; ok {
+				return fmt.Errorf("site %s: API key is already used by %s", s.Domain, other)
+			}
+			keys[k] = s.Domain
+		}
+	}
+	// The widget tokens are public, so they must not be API keys too
+	for _, s := range c.Sites {
+		for _, w := range s.Widgets {
+			if other, ok := keys[w.Token]; ok {
+				return fmt.Errorf("site %s: widget token is already used by %s", s.Domain, other)
+			}
+			keys[w.Token] = s.Domain
+		}
+	}
+	return nil
+}
+
+// Validate checks the site settings.
+func (s *Site) Validate() error {
+	if s.Domain == "" {
+		return fmt.Errorf("domain is missing")
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("site %s: invalid timezone: %w", s.Domain, err)
+	}
+	if s.SessionTimeout < 0 || s.Retention < 0 || s.DedupWindow < 0 || s.CurrentVisitorsWindow < 0 {
+		return fmt.Errorf("site %s: session timeout, retention, dedup window and current visitors window must not be negative", s.Domain)
+	}
+	if err := s.Exclusions.Validate(); err != nil {
+		return fmt.Errorf("site %s: %w", s.Domain, err)
+	}
+	if err := s.URLRules.Validate(); err != nil {
+		return fmt.Errorf("site %s: %w", s.Domain, err)
+	}
+	for _, k := range s.keys() {
+		if len(k) < MinAPIKeyLength {
+			return fmt.Errorf("site %s: API keys must be at least %d characters long", s.Domain, MinAPIKeyLength)
+		}
+	}
+	for _, t := range s.Tokens {
+		if err := t.Role.Validate(); err != nil {
+			return fmt.Errorf("site %s: %w", s.Domain, err)
+		}
+	}
+	for _, r := range s.Reports {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("site %s: %w", s.Domain, err)
+		}
+	}
+	alerts := make(map[string]bool, len(s.Alerts))
+	for _, a := range s.Alerts {
+		if err := a.Validate(); err != nil {
+			return fmt.Errorf("site %s: %w", s.Domain, err)
+		}
+		if alerts[a.Name] {
+			return fmt.Errorf("site %s: alert %s is defined more than once", s.Domain, a.Name)
+		}
+		alerts[a.Name] = true
+	}
+	if err := s.validateChannels(); err != nil {
+		return fmt.Errorf("site %s: %w", s.Domain, err)
+	}
+	for i := range s.Widgets {
+		if err := s.Widgets[i].Validate(); err != nil {
+			return fmt.Errorf("site %s: %w", s.Domain, err)
+		}
+	}
+	for _, g := range s.Goals {
+		if g.Name == "" {
+			return fmt.Errorf("site %s: goal name is missing", s.Domain)
+		}
+		if (g.Event == "") == (g.Path == "") {
+			return fmt.Errorf("site %s: goal %s must define either event or path", s.Domain, g.Name)
+		}
+		if g.Webhook.URL != "" {
+			parsed, err := url.Parse(g.Webhook.URL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return fmt.Errorf("site %s: goal %s: invalid webhook URL %q", s.Domain, g.Name, g.Webhook.URL)
+			}
+		}
+	}
+	return nil
+}
+
+// FromDomains returns Config of the domains with the default settings.
+func FromDomains(domains []string) *Config {
+	cfg := &Config{Sites: make([]Site, 0, len(domains))}
+	for _, d := range domains {
+		cfg.Sites = append(cfg.Sites, Site{Domain: d})
+	}
+	return cfg
+}
+
+// Merge returns Config of the base sites followed by the managed ones,
+// the managed sites of the domains defined in base are skipped. The tenants are the ones of base.
+func Merge(base *Config, managed []*Site) *Config {
+	cfg := &Config{Sites: slices.Clone(base.Sites), Tenants: slices.Clone(base.Tenants)}
+	for _, s := range managed {
+		if _, ok := base.Get(s.Domain); !ok {
+			cfg.Sites = append(cfg.Sites, s.Clone())
+		}
+	}
+	return cfg
+}
+
+// Clone returns a deep copy of the site.
+func (s *Site) Clone() Site {
+	c := *s
+	c.Goals = slices.Clone(s.Goals)
+	c.AllowedOrigins = slices.Clone(s.AllowedOrigins)
+	c.Exclusions = s.Exclusions.Clone()
+	c.URLRules = s.URLRules.Clone()
+	c.APIKeys = slices.Clone(s.APIKeys)
+	c.Tokens = slices.Clone(s.Tokens)
+	c.Channels = slices.Clone(s.Channels)
+	c.Reports = slices.Clone(s.Reports)
+	for i := range c.Reports {
+		c.Reports[i].Recipients = slices.Clone(c.Reports[i].Recipients)
+		c.Reports[i].Channels = slices.Clone(c.Reports[i].Channels)
+	}
+	c.Alerts = slices.Clone(s.Alerts)
+	for i := range c.Alerts {
+		c.Alerts[i].Email = slices.Clone(c.Alerts[i].Email)
+		c.Alerts[i].Channels = slices.Clone(c.Alerts[i].Channels)
+	}
+	c.Widgets = slices.Clone(s.Widgets)
+	for i := range c.Widgets {
+		c.Widgets[i].Metrics = slices.Clone(c.Widgets[i].Metrics)
+	}
+	return c
+}
+
+// Domains returns the domains of the sites.
+func (c *Config) Domains() []string {
+	domains := make([]string, 0, len(c.Sites))
+	for _, s := range c.Sites {
+		domains = append(domains, s.Domain)
+	}
+	return domains
+}
+
+// Retention returns the retention overrides of the sites by their keys.
+func (c *Config) Retention() map[Key]time.Duration {
+	res := make(map[Key]time.Duration)
+	for i := range c.Sites {
+		if c.Sites[i].Retention > 0 {
+			res[c.Sites[i].Key()] = c.Sites[i].Retention
+		}
+	}
+	return res
+}
+
+// Get returns the Site of the domain.
+func (c *Config) Get(domain string) (*Site, bool) {
+	for i := range c.Sites {
+		if c.Sites[i].Domain == domain {
+			return &c.Sites[i], true
+		}
+	}
+	return nil, false
+}
+
+// AllowsOrigin reports whether the site accepts the events sent from the origin.
+//
+// Events without an origin, e.g. sent from servers, are always accepted.
+func (s *Site) AllowsOrigin(origin string) bool {
+	return origin == "" || len(s.AllowedOrigins) == 0 || slices.Contains(s.AllowedOrigins, origin)
+}
+
+// Registry holds the current Config, which is replaced on reload.
+//
+// It's safe for concurrent use.
+type Registry struct {
+	cfg   atomic.Pointer[Config]
+	links atomic.Pointer[LinkSigner]
+	// tokens are the personal access tokens by their hashes
+	tokens   atomic.Pointer[map[string]*AccessToken]
+	users    atomic.Pointer[directory]
+	sessions atomic.Pointer[SessionSigner]
+}
+
+// NewRegistry returns new Registry instance holding cfg.
+func NewRegistry(cfg *Config) *Registry {
+	r := &Registry{}
+	r.Store(cfg)
+	return r
+}
+
+// Store replaces the current Config.
+func (r *Registry) Store(cfg *Config) {
+	r.cfg.Store(cfg)
+}
+
+// Config returns the current Config.
+func (r *Registry) Config() *Config {
+	return r.cfg.Load()
+}
+
+// Get returns the Site of the domain.
+func (r *Registry) Get(domain string) (*Site, bool) {
+	return r.cfg.Load().Get(domain)
+}
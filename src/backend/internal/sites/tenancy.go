@@ -0,0 +1,287 @@
+package sites
+
+import (
+	"crypto/subtle"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MinAPIKeyLength is the minimal length of the API keys, so they can't be guessed.
+const MinAPIKeyLength = 16
+
+var (
+	// ErrUnauthenticated is returned if the API key is missing or unknown.
+	ErrUnauthenticated = errors.New("valid API key is required")
+	// ErrForbidden is returned if the API key doesn't grant access to the site.
+	ErrForbidden = errors.New("API key doesn't grant access to the site")
+)
+
+// BearerKey returns the API key of the "Bearer <key>" authorization value, or an empty string.
+func BearerKey(authorization string) string {
+	scheme, key, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(key)
+}
+
+// Tenant returns the tenant the site belongs to.
+func (s *Site) Tenant() string {
+	if s.Owner != "" {
+		return s.Owner
+	}
+	return s.Domain
+}
+
+// Key identifies the data of a site in the database, the domains are only unique within a tenant.
+type Key struct {
+	Tenant string
+	Domain string
+}
+
+// String returns the key as tenant/domain.
+func (k Key) String() string {
+	return k.Tenant + "/" + k.Domain
+}
+
+// Key returns the Key the data of the site is stored under.
+func (s *Site) Key() Key {
+	return Key{Tenant: s.Tenant(), Domain: s.Domain}
+}
+
+// Keys returns the keys of the sites.
+func (c *Config) Keys() []Key {
+	keys := make([]Key, 0, len(c.Sites))
+	for i := range c.Sites {
+		keys = append(keys, c.Sites[i].Key())
+	}
+	return keys
+}
+
+// Key returns the Key of the domain, the domains without a site are their own tenants.
+//
+// It's safe to call on a nil Registry, which has no sites.
+func (r *Registry) Key(domain string) Key {
+	if r == nil {
+		return Key{Tenant: domain, Domain: domain}
+	}
+	if site, ok := r.Get(domain); ok {
+		return site.Key()
+	}
+	return Key{Tenant: domain, Domain: domain}
+}
+
+// keys returns the API keys and the keys of the tokens of the site.
+func (s *Site) keys() []string {
+	keys := slices.Clone(s.APIKeys)
+	for _, t := range s.Tokens {
+		keys = append(keys, t.Key)
+	}
+	return keys
+}
+
+// Role returns the role granted by the key, if it's one of the site API keys or tokens.
+func (s *Site) Role(key string) (Role, bool) {
+	var role Role
+	found := false
+	// Compare all the keys in constant time, so the timing doesn't reveal them
+	for _, k := range s.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			role, found = RoleIngest, true
+		}
+	}
+	for _, t := range s.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Key), []byte(key)) == 1 {
+			role, found = t.Role, true
+		}
+	}
+	return role, found
+}
+
+// MultiTenant reports whether any site requires an API key,
+// in which case the sites are only readable with the keys of their tenants.
+func (c *Config) MultiTenant() bool {
+	for i := range c.Sites {
+		if len(c.Sites[i].keys()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate returns the site the API key belongs to and the role it grants.
+func (c *Config) Authenticate(key string) (*Site, Role, bool) {
+	if key == "" {
+		return nil, "", false
+	}
+	for i := range c.Sites {
+		if role, ok := c.Sites[i].Role(key); ok {
+			return &c.Sites[i], role, true
+		}
+	}
+	return nil, "", false
+}
+
+// principal is the caller authenticated by an API key, a personal access token, a user key or a session token.
+type principal struct {
+	tenant string
+	// admin principals access the sites of all the tenants
+	admin bool
+	can   func(p Permission) bool
+	// user principals aren't bound to a tenant, they access the sites by the roles of their teams
+	user  bool
+	roles map[string][]Role
+}
+
+// allows reports whether the principal has the permission on the site, which is nil if it's unknown.
+func (c *principal) allows(site *Site, p Permission) bool {
+	if c.user && !c.admin {
+		if site == nil {
+			return false
+		}
+		for _, role := range c.roles[site.Domain] {
+			if role.Can(p) {
+				return true
+			}
+		}
+		return false
+	}
+	if !c.can(p) {
+		return false
+	}
+	return c.admin || (site != nil && site.Tenant() == c.tenant)
+}
+
+// authenticate returns the principal of the API key, the personal access token, the user key or the session token.
+func (r *Registry) authenticate(cfg *Config, key string) (principal, bool) {
+	if isUserCredential(key) {
+		u, admin, ok := r.user(key)
+		if !ok {
+			return principal{}, false
+		}
+		return principal{admin: admin, can: RoleAdmin.Can, user: true, roles: r.roles(u.ID)}, true
+	}
+	if IsAccessToken(key) {
+		t, ok := r.accessToken(key, time.Now())
+		if !ok {
+			return principal{}, false
+		}
+		return principal{tenant: t.Tenant, admin: t.Admin(), can: t.Can}, true
+	}
+	site, role, ok := cfg.Authenticate(key)
+	if !ok {
+		return principal{}, false
+	}
+	return principal{tenant: site.Tenant(), admin: role == RoleAdmin, can: role.Can}, true
+}
+
+// multiTenant reports whether the keys are required, either because a site requires them or there are users.
+func (r *Registry) multiTenant(cfg *Config) bool {
+	return cfg.MultiTenant() || r.hasUsers()
+}
+
+// AuthorizeEvent checks the API key sent with an event of the domain.
+//
+// Events of the sites without API keys are accepted without a key,
+// while in the multi-tenant mode the events of unknown domains are rejected.
+// The key must be one of the site keys granting PermissionIngest, a personal access token
+// of the tenant of the site with ScopeEventsWrite, or a user key or a session granting PermissionIngest on the site.
+func (r *Registry) AuthorizeEvent(key string, domain string) error {
+	cfg := r.cfg.Load()
+	site, ok := cfg.Get(domain)
+	if !ok {
+		if r.multiTenant(cfg) {
+			return ErrForbidden
+		}
+		return nil
+	}
+	if len(site.keys()) == 0 {
+		return nil
+	}
+	if key == "" {
+		return ErrUnauthenticated
+	}
+	if IsAccessToken(key) || isUserCredential(key) {
+		caller, ok := r.authenticate(cfg, key)
+		if !ok {
+			return ErrUnauthenticated
+		}
+		if !caller.allows(site, PermissionIngest) {
+			return ErrForbidden
+		}
+		return nil
+	}
+	role, ok := site.Role(key)
+	if !ok || !role.Can(PermissionIngest) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Authorize checks that the API key grants the permission on the data of the domain.
+//
+// The keys and the personal access tokens are valid for the sites of their tenant, except the ones
+// granting RoleAdmin or ScopeAdmin, which are valid for all the sites. The users, by their keys or sessions,
+// access the sites of their teams, or all the sites if they are admins. The shared links only grant PermissionStats
+// on their domain. Everything is allowed without a key unless in the multi-tenant mode.
+func (r *Registry) Authorize(key string, domain string, permission Permission) error {
+	cfg := r.cfg.Load()
+	if !r.multiTenant(cfg) {
+		return nil
+	}
+	if IsSharedLink(key) {
+		return r.authorizeLink(key, domain, permission)
+	}
+	caller, ok := r.authenticate(cfg, key)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	site, _ := cfg.Get(domain)
+	if !caller.allows(site, permission) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// AuthorizeTenant checks that the API key grants the permission on the data of all the sites of the tenant.
+//
+// The shared links, which are scoped to a single site, aren't accepted.
+func (r *Registry) AuthorizeTenant(key string, tenant string, permission Permission) error {
+	cfg := r.cfg.Load()
+	if !r.multiTenant(cfg) {
+		return nil
+	}
+	if IsSharedLink(key) {
+		return ErrForbidden
+	}
+	caller, ok := r.authenticate(cfg, key)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !caller.user {
+		if !caller.can(permission) || (!caller.admin && caller.tenant != tenant) {
+			return ErrForbidden
+		}
+		return nil
+	}
+	if caller.admin {
+		return nil
+	}
+	// The users need the permission on every site of the tenant
+	found := false
+	for i := range cfg.Sites {
+		if cfg.Sites[i].Tenant() != tenant {
+			continue
+		}
+		if !caller.allows(&cfg.Sites[i], permission) {
+			return ErrForbidden
+		}
+		found = true
+	}
+	if !found {
+		return ErrForbidden
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package sites
+
+import (
+	"fmt"
+	"time"
+)
+
+// Location returns the timezone of the site, UTC if it's unset or invalid.
+func (s *Site) Location() *time.Location {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Location returns the timezone of the site of the domain, UTC for the domains without a site.
+//
+// It's safe to call on a nil Registry, which has no sites.
+func (r *Registry) Location(domain string) *time.Location {
+	if r == nil {
+		return time.UTC
+	}
+	if site, ok := r.Get(domain); ok {
+		return site.Location()
+	}
+	return time.UTC
+}
+
+// Locations returns the timezones of the sites by their keys.
+func (c *Config) Locations() map[Key]*time.Location {
+	res := make(map[Key]*time.Location, len(c.Sites))
+	for i := range c.Sites {
+		res[c.Sites[i].Key()] = c.Sites[i].Location()
+	}
+	return res
+}
+
+// StartOfDay returns the start of the day of t in loc.
+func StartOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// The named periods of the stats, their days start at midnight in the site timezone.
+const (
+	PeriodToday     = "today"
+	PeriodYesterday = "yesterday"
+	// Period7Days and Period30Days are the days before today, without it.
+	Period7Days  = "7d"
+	Period30Days = "30d"
+	// PeriodMonth is the current month until now.
+	PeriodMonth     = "month"
+	PeriodLastMonth = "last_month"
+	// PeriodYear is the current year until now.
+	PeriodYear = "year"
+)
+
+// PeriodRange returns the named period at now in loc, from is inclusive and to is exclusive.
+func PeriodRange(period string, now time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	day := StartOfDay(now, loc)
+	switch period {
+	case PeriodToday:
+		return day, now, nil
+	case PeriodYesterday:
+		return day.AddDate(0, 0, -1), day, nil
+	case Period7Days:
+		return day.AddDate(0, 0, -7), day, nil
+	case Period30Days:
+		return day.AddDate(0, 0, -30), day, nil
+	case PeriodMonth:
+		return day.AddDate(0, 0, 1-day.Day()), now, nil
+	case PeriodLastMonth:
+		month := day.AddDate(0, 0, 1-day.Day())
+		return month.AddDate(0, -1, 0), month, nil
+	case PeriodYear:
+		return time.Date(day.Year(), time.January, 1, 0, 0, 0, 0, loc), now, nil
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown period %q", period)
+	}
+}
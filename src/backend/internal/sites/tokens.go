@@ -0,0 +1,129 @@
+package sites
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// accessTokenPrefix tells the personal access tokens from the API keys of the sites.
+const accessTokenPrefix = "pat_"
+
+// Scope is a set of the permissions granted by a personal access token.
+type Scope string
+
+const (
+	// ScopeEventsWrite allows sending the events.
+	ScopeEventsWrite Scope = "events:write"
+	// ScopeEventsRead allows reading the raw events, including their export.
+	ScopeEventsRead Scope = "events:read"
+	// ScopeStatsRead allows reading the stats, the live visitors and the usage.
+	ScopeStatsRead Scope = "stats:read"
+	// ScopeDataWrite allows importing the data, managing the annotations and minting the shared links.
+	ScopeDataWrite Scope = "data:write"
+	// ScopeAdmin grants all the permissions on the sites of all the tenants and the admin service.
+	ScopeAdmin Scope = "admin"
+)
+
+// scopePermissions are the permissions granted by the scopes.
+var scopePermissions = map[Scope][]Permission{
+	ScopeEventsWrite: {PermissionIngest},
+	ScopeEventsRead:  {PermissionEvents},
+	ScopeStatsRead:   {PermissionStats, PermissionUsage},
+	ScopeDataWrite:   {PermissionWrite, PermissionShare},
+	ScopeAdmin:       {PermissionIngest, PermissionStats, PermissionEvents, PermissionWrite, PermissionUsage, PermissionShare},
+}
+
+// Validate checks that the scope is known.
+func (s Scope) Validate() error {
+	if _, ok := scopePermissions[s]; !ok {
+		return fmt.Errorf("unknown scope %q", s)
+	}
+	return nil
+}
+
+// AccessToken is a personal access token of a tenant, only the hash of its key is stored.
+type AccessToken struct {
+	ID     string
+	Name   string
+	Tenant string
+	Scopes []Scope
+	// Hash is the HashAccessToken of the key
+	Hash    string
+	Created time.Time
+	// Expires is the expiration time, the token doesn't expire if it's zero
+	Expires time.Time
+}
+
+// IsAccessToken reports whether the key is a personal access token rather than an API key.
+func IsAccessToken(key string) bool {
+	return strings.HasPrefix(key, accessTokenPrefix)
+}
+
+// NewAccessTokenKey returns the key of a personal access token of the random bytes.
+func NewAccessTokenKey(random []byte) string {
+	return accessTokenPrefix + hex.EncodeToString(random)
+}
+
+// HashAccessToken returns the hash the personal access token is stored by.
+func HashAccessToken(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// Can reports whether the scopes of the token grant the permission.
+func (t *AccessToken) Can(p Permission) bool {
+	for _, s := range t.Scopes {
+		if slices.Contains(scopePermissions[s], p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Admin reports whether the token has ScopeAdmin.
+func (t *AccessToken) Admin() bool {
+	return slices.Contains(t.Scopes, ScopeAdmin)
+}
+
+// Expired reports whether the token is expired at now.
+func (t *AccessToken) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// SetAccessTokens replaces the personal access tokens accepted by the registry.
+func (r *Registry) SetAccessTokens(tokens []*AccessToken) {
+	byHash := make(map[string]*AccessToken, len(tokens))
+	for _, t := range tokens {
+		byHash[t.Hash] = t
+	}
+	r.tokens.Store(&byHash)
+}
+
+// accessToken returns the valid personal access token of the key.
+func (r *Registry) accessToken(key string, now time.Time) (*AccessToken, bool) {
+	tokens := r.tokens.Load()
+	if tokens == nil {
+		return nil, false
+	}
+	t, ok := (*tokens)[HashAccessToken(key)]
+	if !ok || t.Expired(now) {
+		return nil, false
+	}
+	return t, true
+}
+
+// AdminAccessToken returns the ID of the personal access token of the key, if it's valid and has ScopeAdmin.
+func (r *Registry) AdminAccessToken(key string) (string, bool) {
+	if !IsAccessToken(key) {
+		return "", false
+	}
+	t, ok := r.accessToken(key, time.Now())
+	if !ok || !t.Admin() {
+		return "", false
+	}
+	return t.ID, true
+}
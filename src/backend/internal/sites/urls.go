@@ -0,0 +1,124 @@
+package sites
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// URLRules are the normalizations of the page URLs of the site, applied to the URLs at the ingestion
+// and to the paths in the stats, so the events stored before the rules are counted the same way.
+type URLRules struct {
+	// CollapseTrailingSlash removes the trailing slashes of the paths, e.g. /pricing/ is counted as /pricing.
+	CollapseTrailingSlash bool `yaml:"collapse_trailing_slash"`
+	// Lowercase lowercases the paths.
+	Lowercase bool `yaml:"lowercase"`
+	// FoldIndex removes the index pages from the paths, e.g. /docs/index.html is counted as /docs/.
+	FoldIndex bool `yaml:"fold_index"`
+	// StripQuery are the query parameters removed from the URLs, the names ending with * match by the prefix,
+	// e.g. fbclid or mc_*. The names are case-insensitive.
+	StripQuery []string `yaml:"strip_query"`
+}
+
+// indexPages are the file names of the index pages folded by URLRules.FoldIndex,
+// "index" is the one of index.html once the stats remove the .html.
+var indexPages = []string{"index.html", "index.htm", "index"}
+
+// Validate checks the stripped query parameters.
+func (u *URLRules) Validate() error {
+	for _, name := range u.StripQuery {
+		if strings.TrimSpace(strings.TrimSuffix(name, "*")) == "" {
+			return fmt.Errorf("stripped query parameter %q is empty", name)
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the rules.
+func (u *URLRules) Clone() URLRules {
+	c := *u
+	c.StripQuery = slices.Clone(u.StripQuery)
+	return c
+}
+
+// NormalizePath returns the path of a page with the rules applied.
+func (u *URLRules) NormalizePath(path string) string {
+	if u.Lowercase {
+		path = strings.ToLower(path)
+	}
+	if u.FoldIndex {
+		for _, index := range indexPages {
+			if strings.HasSuffix(path, "/"+index) {
+				path = strings.TrimSuffix(path, index)
+				break
+			}
+		}
+	}
+	if u.CollapseTrailingSlash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+	return path
+}
+
+// Normalize returns the URL with the rules applied to its path and with the stripped query parameters removed,
+// the scheme, the host, the rest of the query and the fragment are kept as is.
+func (u *URLRules) Normalize(rawURL string) string {
+	if !u.CollapseTrailingSlash && !u.Lowercase && !u.FoldIndex && len(u.StripQuery) == 0 {
+		return rawURL
+	}
+	rest, fragment, hasFragment := strings.Cut(rawURL, "#")
+	base, query, hasQuery := strings.Cut(rest, "?")
+
+	// The path starts at the first slash after the host, the links without a scheme start with the host
+	hostEnd := 0
+	if i := strings.Index(base, "://"); i >= 0 {
+		hostEnd = i + len("://")
+	}
+	if i := strings.IndexByte(base[hostEnd:], '/'); i >= 0 {
+		hostEnd += i
+	} else {
+		hostEnd = len(base)
+	}
+	res := base[:hostEnd]
+	if path := base[hostEnd:]; path != "" {
+		res += u.NormalizePath(path)
+	}
+
+	if hasQuery {
+		kept := make([]string, 0)
+		for _, pair := range strings.Split(query, "&") {
+			name, _, _ := strings.Cut(pair, "=")
+			if name, err := url.QueryUnescape(name); err == nil && u.strips(name) {
+				continue
+			}
+			kept = append(kept, pair)
+		}
+		if len(kept) > 0 {
+			res += "?" + strings.Join(kept, "&")
+		}
+	}
+	if hasFragment {
+		res += "#" + fragment
+	}
+	return res
+}
+
+// strips reports whether the query parameter is removed.
+func (u *URLRules) strips(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range u.StripQuery {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package sites
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+)
+
+// userKeyPrefix tells the API keys of the users from the API keys of the sites.
+const userKeyPrefix = "usr_"
+
+// User is a person accessing the sites of the teams they are a member of, only the hash of their key is stored.
+type User struct {
+	ID    string
+	Email string
+	Name  string
+	// Admin users access all the sites and the admin service
+	Admin bool
+	// Hash is the HashAccessToken of the user API key
+	Hash    string
+	Created time.Time
+}
+
+// Team grants its members their roles on the sites of the team.
+type Team struct {
+	ID   string
+	Name string
+	// Sites are the domains of the sites of the team
+	Sites   []string
+	Members []Member
+	Created time.Time
+}
+
+// Member is a user of a team with the role granted on the team sites.
+type Member struct {
+	UserID string
+	Role   Role
+}
+
+// IsUserKey reports whether the key is an API key of a user rather than of a site.
+func IsUserKey(key string) bool {
+	return strings.HasPrefix(key, userKeyPrefix)
+}
+
+// NewUserKey returns the API key of a user of the random bytes.
+func NewUserKey(random []byte) string {
+	return userKeyPrefix + hex.EncodeToString(random)
+}
+
+// Validate checks the user settings.
+func (u *User) Validate() error {
+	if _, err := mail.ParseAddress(u.Email); err != nil {
+		return fmt.Errorf("invalid email %q: %w", u.Email, err)
+	}
+	return nil
+}
+
+// Validate checks the team settings, the roles of the members are RoleViewer or RoleOwner.
+func (t *Team) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("team name is missing")
+	}
+	for _, domain := range t.Sites {
+		if domain == "" {
+			return fmt.Errorf("team %s: site domain is missing", t.Name)
+		}
+	}
+	seen := make(map[string]bool, len(t.Members))
+	for _, m := range t.Members {
+		if m.UserID == "" {
+			return fmt.Errorf("team %s: member user is missing", t.Name)
+		}
+		if seen[m.UserID] {
+			return fmt.Errorf("team %s: user %s is a member more than once", t.Name, m.UserID)
+		}
+		seen[m.UserID] = true
+		if m.Role != RoleViewer && m.Role != RoleOwner {
+			return fmt.Errorf("team %s: member role must be %s or %s", t.Name, RoleViewer, RoleOwner)
+		}
+	}
+	return nil
+}
+
+// directory is the snapshot of the users and the roles granted to them by the teams.
+type directory struct {
+	// users are the users by the hashes of their keys
+	users map[string]*User
+	byID  map[string]*User
+	// roles are the roles of the users on the sites by the user ID and the domain
+	roles map[string]map[string][]Role
+}
+
+// SetUsers replaces the users and the teams accepted by the registry.
+//
+// The users are accepted even without any sites, so the APIs require a key as soon as there is a user.
+func (r *Registry) SetUsers(users []*User, teams []*Team) {
+	d := &directory{
+		users: make(map[string]*User, len(users)),
+		byID:  make(map[string]*User, len(users)),
+		roles: make(map[string]map[string][]Role),
+	}
+	for _, u := range users {
+		d.users[u.Hash] = u
+		d.byID[u.ID] = u
+	}
+	for _, t := range teams {
+		for _, m := range t.Members {
+			if d.roles[m.UserID] == nil {
+				d.roles[m.UserID] = make(map[string][]Role)
+			}
+			for _, domain := range t.Sites {
+				if !slices.Contains(d.roles[m.UserID][domain], m.Role) {
+					d.roles[m.UserID][domain] = append(d.roles[m.UserID][domain], m.Role)
+				}
+			}
+		}
+	}
+	r.users.Store(d)
+}
+
+// isUserCredential reports whether the key is a user key or a session token of a user.
+func isUserCredential(key string) bool {
+	return IsUserKey(key) || IsSessionToken(key)
+}
+
+// user returns the user of the user key or the session token, and whether they access as an admin.
+func (r *Registry) user(key string) (*User, bool, bool) {
+	if IsSessionToken(key) {
+		return r.sessionUser(key)
+	}
+	d := r.users.Load()
+	if d == nil {
+		return nil, false, false
+	}
+	u, ok := d.users[HashAccessToken(key)]
+	if !ok {
+		return nil, false, false
+	}
+	return u, u.Admin, true
+}
+
+// roles returns the roles of the user by the domain.
+func (r *Registry) roles(userID string) map[string][]Role {
+	d := r.users.Load()
+	if d == nil {
+		return nil
+	}
+	return d.roles[userID]
+}
+
+// UserByEmail returns the user of the email, which is compared case-insensitively.
+func (r *Registry) UserByEmail(email string) (*User, bool) {
+	d := r.users.Load()
+	if d == nil {
+		return nil, false
+	}
+	for _, u := range d.byID {
+		if strings.EqualFold(u.Email, email) {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// hasUsers reports whether there is any user, in which case the APIs require a key.
+func (r *Registry) hasUsers() bool {
+	d := r.users.Load()
+	return d != nil && len(d.users) > 0
+}
+
+// AdminUser returns the email of the user of the user key or the session token, if they access as an admin.
+func (r *Registry) AdminUser(key string) (string, bool) {
+	if !isUserCredential(key) {
+		return "", false
+	}
+	u, admin, ok := r.user(key)
+	if !ok || !admin {
+		return "", false
+	}
+	return u.Email, true
+}
@@ -0,0 +1,69 @@
+package sites
+
+import (
+	"fmt"
+	"slices"
+)
+
+// WidgetMetric is a number of the site exposed by the public widgets.
+type WidgetMetric string
+
+const (
+	// WidgetCurrentVisitors is the amount of the visitors with events within the current visitors window of the site.
+	WidgetCurrentVisitors WidgetMetric = "current_visitors"
+	// WidgetVisitorsToday is the amount of the unique visitors since the start of the day in the site timezone.
+	WidgetVisitorsToday WidgetMetric = "visitors_today"
+	// WidgetVisitorsMonth is the amount of the unique visitors since the start of the month in the site timezone.
+	WidgetVisitorsMonth WidgetMetric = "visitors_month"
+	// WidgetPageViewsMonth is the amount of the page views since the start of the month in the site timezone.
+	WidgetPageViewsMonth WidgetMetric = "pageviews_month"
+)
+
+// WidgetMetrics are all the metrics of the widgets.
+var WidgetMetrics = []WidgetMetric{WidgetCurrentVisitors, WidgetVisitorsToday, WidgetVisitorsMonth, WidgetPageViewsMonth}
+
+// Widget grants reading the selected numbers of the site without an API key, so they can be embedded
+// into its pages. Its token is public, so it never grants anything else.
+type Widget struct {
+	Token string `yaml:"token"`
+	// Metrics are the numbers exposed by the widget, all of WidgetMetrics if empty.
+	Metrics []WidgetMetric `yaml:"metrics"`
+}
+
+// Validate checks the widget settings.
+func (w *Widget) Validate() error {
+	if len(w.Token) < MinAPIKeyLength {
+		return fmt.Errorf("widget tokens must be at least %d characters long", MinAPIKeyLength)
+	}
+	for _, m := range w.Metrics {
+		if !slices.Contains(WidgetMetrics, m) {
+			return fmt.Errorf("widget: unknown metric %q", m)
+		}
+	}
+	return nil
+}
+
+// Exposes reports whether the widget exposes the metric.
+func (w *Widget) Exposes(m WidgetMetric) bool {
+	if len(w.Metrics) == 0 {
+		return slices.Contains(WidgetMetrics, m)
+	}
+	return slices.Contains(w.Metrics, m)
+}
+
+// Widget returns the site and the widget of the token.
+func (r *Registry) Widget(token string) (*Site, *Widget, bool) {
+	if token == "" {
+		return nil, nil, false
+	}
+	cfg := r.cfg.Load()
+	for i := range cfg.Sites {
+		s := &cfg.Sites[i]
+		for j := range s.Widgets {
+			if s.Widgets[j].Token == token {
+				return s, &s.Widgets[j], true
+			}
+		}
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,95 @@
+package tracker
+
+import (
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AMPPath is the gateway path the amp-analytics requests are sent to, e.g. with the config
+//
+//	"requests": {"pageview": "https://<host>/api/amp?d=<domain>&u=${canonicalUrl}&r=${documentReferrer}"}
+//
+// Both the GET and the POST (beacon) requests are accepted, the variables are always read from the query.
+const AMPPath = "/api/amp"
+
+// ampCacheSuffixes are the host suffixes of the origins of the AMP caches serving the pages,
+// see https://cdn.ampproject.org/caches.json.
+var ampCacheSuffixes = []string{".cdn.ampproject.org", ".bing-amp.com"}
+
+// NewAMPHandler returns runtime.HandlerFunc recording an event of the amp-analytics request from the query
+// parameters (d - domain, u - url, r - referrer, t - type, pageview if empty) and responding with
+// a transparent GIF, so the image transport works too.
+//
+// The source origin of the page sent by the runtime as __amp_source_origin is used as the origin of the event,
+// if the request comes from an AMP cache or from the source origin itself. The AMP CORS headers are set
+// only once the event is created, i.e. the origin is checked against the AllowedOrigins of the site.
+func NewAMPHandler(create EventCreator) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		q := r.URL.Query()
+		w.Header().Add("Vary", "Origin")
+		requestOrigin := r.Header.Get("Origin")
+		source := q.Get("__amp_source_origin")
+		if source != "" {
+			if !trustedAMPSource(r, source) {
+				http.Error(w, "source origin is not allowed", http.StatusForbidden)
+				return
+			}
+			r.Header.Set("Origin", source)
+		}
+
+		e := &analytics.Event{
+			Type:     q.Get("t"),
+			Domain:   q.Get("d"),
+			URL:      q.Get("u"),
+			Referrer: q.Get("r"),
+		}
+		if e.Type == "" {
+			e.Type = "pageview"
+		}
+		if err := create(r, e); err != nil {
+			zap.L().Named("tracker").Debug("cannot record AMP event", zap.Error(err))
+			http.Error(w, status.Convert(err).Message(), runtime.HTTPStatusFromCode(status.Code(err)))
+			return
+		}
+
+		if requestOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", requestOrigin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if source != "" {
+			w.Header().Set("AMP-Access-Control-Allow-Source-Origin", source)
+			w.Header().Set("Access-Control-Expose-Headers", "AMP-Access-Control-Allow-Source-Origin")
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		_, _ = w.Write(transparentGIF)
+	}
+}
+
+// trustedAMPSource reports whether the source origin of the request can be trusted: the request is sent
+// from an AMP cache or from the source origin, which marks the same-origin requests by AMP-Same-Origin
+// instead of Origin.
+func trustedAMPSource(r *http.Request, source string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return r.Header.Get("AMP-Same-Origin") == "true"
+	}
+	if origin == source {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	for _, suffix := range ampCacheSuffixes {
+		if strings.HasSuffix(u.Hostname(), suffix) {
+			return true
+		}
+	}
+	return false
+}
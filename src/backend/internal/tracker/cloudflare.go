@@ -0,0 +1,152 @@
+package tracker
+
+import (
+	"bufio"
+	"compress/gzip"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// CloudflarePath is the gateway path the Cloudflare Logpush HTTP destination and the Workers trackers
+// of the domain send the request records to, e.g. with the Logpush destination
+//
+//	https://<host>/api/cloudflare/<domain>?header_Authorization=Bearer%20<key>
+const CloudflarePath = "/api/cloudflare/{domain}"
+
+// maxCloudflarePayload is the maximal size of the uncompressed batch of the records.
+const maxCloudflarePayload = 16 << 20
+
+// cloudflareRecord holds the fields of the Logpush http_requests dataset mapped into the pageview,
+// the Workers trackers send the records with the same names.
+type cloudflareRecord struct {
+	ClientIP                string `json:"ClientIP"`
+	ClientCountry           string `json:"ClientCountry"`
+	ClientRequestScheme     string `json:"ClientRequestScheme"`
+	ClientRequestHost       string `json:"ClientRequestHost"`
+	ClientRequestMethod     string `json:"ClientRequestMethod"`
+	ClientRequestURI        string `json:"ClientRequestURI"`
+	ClientRequestReferer    string `json:"ClientRequestReferer"`
+	ClientRequestUserAgent  string `json:"ClientRequestUserAgent"`
+	EdgeResponseStatus      int    `json:"EdgeResponseStatus"`
+	EdgeResponseContentType string `json:"EdgeResponseContentType"`
+}
+
+// NewCloudflareHandler returns runtime.HandlerFunc recording the pageviews of the Cloudflare request records
+// sent to the domain as the newline delimited JSON, optionally gzipped, or as a JSON array.
+//
+// Only the successful GET requests of the HTML pages of the domain and its subdomains are recorded,
+// the records of the assets, the errors and the other hosts of the zone, as well as the Logpush
+// validation record, are skipped. The visitors are identified by the client fields of the records.
+func NewCloudflareHandler(create EventCreator) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		body := io.Reader(r.Body)
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "invalid gzip payload", http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		records, err := parseCloudflarePayload(io.LimitReader(body, maxCloudflarePayload))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, rec := range records {
+			e := rec.pageview(params["domain"])
+			if e == nil {
+				continue
+			}
+			if err := createRelayed(create, r, e, rec.ClientIP, rec.ClientRequestUserAgent, rec.ClientCountry); err != nil {
+				zap.L().Named("tracker").Debug("cannot record Cloudflare pageview", zap.Error(err))
+				http.Error(w, status.Convert(err).Message(), runtime.HTTPStatusFromCode(status.Code(err)))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// parseCloudflarePayload returns the records of the newline delimited JSON or of the JSON array.
+func parseCloudflarePayload(body io.Reader) ([]*cloudflareRecord, error) {
+	br := bufio.NewReader(body)
+	for {
+		b, err := br.Peek(1)
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read payload: %w", err)
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		_, _ = br.ReadByte()
+	}
+
+	dec := json.NewDecoder(br)
+	if b, _ := br.Peek(1); b[0] == '[' {
+		var records []*cloudflareRecord
+		if err := dec.Decode(&records); err != nil {
+			return nil, fmt.Errorf("invalid payload: %w", err)
+		}
+		return records, nil
+	}
+	var records []*cloudflareRecord
+	for {
+		rec := &cloudflareRecord{}
+		err := dec.Decode(rec)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload: %w", err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// pageview returns the pageview of the record, or nil if it isn't a pageview of the domain.
+func (rec *cloudflareRecord) pageview(domain string) *analytics.Event {
+	if rec == nil || rec.ClientRequestHost == "" || rec.ClientRequestURI == "" {
+		return nil
+	}
+	if rec.ClientRequestMethod != "" && rec.ClientRequestMethod != http.MethodGet {
+		return nil
+	}
+	if rec.EdgeResponseStatus != 0 && (rec.EdgeResponseStatus < 200 || rec.EdgeResponseStatus >= 300) {
+		return nil
+	}
+	if rec.EdgeResponseContentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(rec.EdgeResponseContentType); err != nil || mediaType != "text/html" {
+			return nil
+		}
+	}
+	host := strings.ToLower(rec.ClientRequestHost)
+	if host != domain && !strings.HasSuffix(host, "."+domain) {
+		return nil
+	}
+
+	scheme := rec.ClientRequestScheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	return &analytics.Event{
+		Type:     "pageview",
+		Domain:   domain,
+		URL:      scheme + "://" + host + rec.ClientRequestURI,
+		Referrer: rec.ClientRequestReferer,
+	}
+}
@@ -0,0 +1,66 @@
+package tracker
+
+import (
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+// PixelPath is the gateway path the tracking pixel is served on.
+const PixelPath = "/pixel.gif"
+
+// transparentGIF is a 1x1 transparent GIF image.
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// EventCreator stores the event on behalf of the incoming HTTP request r.
+type EventCreator func(r *http.Request, e *analytics.Event) error
+
+// createRelayed stores the event of the visitor relayed by a third party, e.g. Segment, on behalf of a copy
+// of the request r with the client address, the user agent and the country of the visitor.
+// The empty user agent is left as is, while the empty address and country are removed, as they are the relay's.
+func createRelayed(create EventCreator, r *http.Request, e *analytics.Event, ip string, userAgent string, country string) error {
+	r = r.Clone(r.Context())
+	if userAgent != "" {
+		r.Header.Set("User-Agent", userAgent)
+	}
+	r.Header.Del("X-Forwarded-For")
+	if ip != "" {
+		r.Header.Set("X-Forwarded-For", ip)
+	}
+	for _, h := range []string{"CF-IPCountry", "CloudFront-Viewer-Country", "X-Country-Code", "CloudFront-Viewer-Country-Region", "X-Region-Code"} {
+		r.Header.Del(h)
+	}
+	if country != "" {
+		r.Header.Set("X-Country-Code", country)
+	}
+	return create(r, e)
+}
+
+// NewPixelHandler returns runtime.HandlerFunc recording a pageview from the query parameters
+// (d - domain, u - url, r - referrer) and responding with a transparent GIF.
+func NewPixelHandler(create EventCreator) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		q := r.URL.Query()
+		e := &analytics.Event{
+			Type:     "pageview",
+			Domain:   q.Get("d"),
+			URL:      q.Get("u"),
+			Referrer: q.Get("r"),
+		}
+		if err := create(r, e); err != nil {
+			zap.L().Named("tracker").Debug("cannot record pixel pageview", zap.Error(err))
+			http.Error(w, status.Convert(err).Message(), runtime.HTTPStatusFromCode(status.Code(err)))
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		_, _ = w.Write(transparentGIF)
+	}
+}
@@ -0,0 +1,161 @@
+package tracker
+
+import (
+	"bytes"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/json"
+	"fmt"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// SegmentPath is the gateway path the Segment webhook destination of the domain sends the events to.
+// The API key of the keyed sites is set as the "Authorization: Bearer <key>" header of the destination.
+const SegmentPath = "/api/segment/{domain}"
+
+// maxSegmentPayload is the maximal size of the webhook payload.
+const maxSegmentPayload = 1 << 20
+
+// segmentMessage is the part of the Segment message mapped into the event.
+type segmentMessage struct {
+	Type       string         `json:"type"`
+	Event      string         `json:"event"`
+	Properties map[string]any `json:"properties"`
+	Context    struct {
+		IP        string `json:"ip"`
+		UserAgent string `json:"userAgent"`
+		Page      struct {
+			URL      string `json:"url"`
+			Path     string `json:"path"`
+			Referrer string `json:"referrer"`
+		} `json:"page"`
+	} `json:"context"`
+}
+
+// NewSegmentHandler returns runtime.HandlerFunc recording the events of the Segment "page" and "track" messages
+// sent to the domain, the other message types (identify, group, alias, screen) are ignored.
+//
+// The message is accepted as is, in a JSON array or in the "batch" field. The pages are recorded as
+// the pageviews and the tracks as the events of their name with the scalar properties as the props.
+// The visitors are identified by the context.ip and the context.userAgent of the messages rather than
+// by the request, which comes from Segment.
+func NewSegmentHandler(create EventCreator) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSegmentPayload+1))
+		if err != nil {
+			http.Error(w, "cannot read payload", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxSegmentPayload {
+			http.Error(w, "payload is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		messages, err := parseSegmentPayload(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, m := range messages {
+			e := m.event(params["domain"])
+			if e == nil {
+				continue
+			}
+			if err := createRelayed(create, r, e, m.Context.IP, m.Context.UserAgent, ""); err != nil {
+				zap.L().Named("tracker").Debug("cannot record Segment event", zap.Error(err))
+				http.Error(w, status.Convert(err).Message(), runtime.HTTPStatusFromCode(status.Code(err)))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// parseSegmentPayload returns the messages of the single message, the array or the batch payload.
+func parseSegmentPayload(body []byte) ([]*segmentMessage, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var messages []*segmentMessage
+		if err := json.Unmarshal(body, &messages); err != nil {
+			return nil, fmt.Errorf("invalid payload: %w", err)
+		}
+		return messages, nil
+	}
+
+	var payload struct {
+		segmentMessage
+		Batch []*segmentMessage `json:"batch"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	if payload.Batch != nil {
+		return payload.Batch, nil
+	}
+	return []*segmentMessage{&payload.segmentMessage}, nil
+}
+
+// event returns the event of the message, or nil if the message type isn't recorded.
+func (m *segmentMessage) event(domain string) *analytics.Event {
+	if m == nil {
+		return nil
+	}
+	e := &analytics.Event{
+		Domain:   domain,
+		URL:      m.property("url", m.Context.Page.URL),
+		Referrer: m.property("referrer", m.Context.Page.Referrer),
+	}
+	switch m.Type {
+	case "page":
+		e.Type = "pageview"
+	case "track":
+		if m.Event == "" {
+			return nil
+		}
+		e.Type = m.Event
+		e.Props = m.props()
+	default:
+		return nil
+	}
+	// The server side messages have no page, they are recorded for the path or the root of the domain
+	if e.URL == "" {
+		path := m.property("path", m.Context.Page.Path)
+		if path == "" {
+			path = "/"
+		}
+		e.URL = (&url.URL{Scheme: "https", Host: domain, Path: path}).String()
+	}
+	return e
+}
+
+// property returns the string property of the message, or fallback if it's missing.
+func (m *segmentMessage) property(name string, fallback string) string {
+	if v, ok := m.Properties[name].(string); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+// props returns the scalar properties of the message as strings, the nested objects and arrays are dropped.
+func (m *segmentMessage) props() map[string]string {
+	if len(m.Properties) == 0 {
+		return nil
+	}
+	props := make(map[string]string, len(m.Properties))
+	for k, v := range m.Properties {
+		switch v := v.(type) {
+		case string:
+			props[k] = v
+		case float64:
+			props[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			props[k] = strconv.FormatBool(v)
+		}
+	}
+	return props
+}
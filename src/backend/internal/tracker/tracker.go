@@ -0,0 +1,70 @@
+// Package tracker serves the JavaScript tracking snippet.
+package tracker
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"text/template"
+)
+
+// ScriptPath is the gateway path the tracker script is served on.
+const ScriptPath = "/js/script.js"
+
+// EventPath is the ingestion endpoint the tracker script sends events to.
+const EventPath = "/api/event"
+
+//go:embed script.js.tmpl
+var scriptSource string
+
+var scriptTemplate = template.Must(template.New("script.js").Parse(scriptSource))
+
+// scriptParams holds JSON encoded values rendered into the script.
+type scriptParams struct {
+	Endpoint string
+	Domain   string
+}
+
+// ScriptHandler renders the tracker script for the requesting site.
+//
+// The ingestion endpoint is derived from the request host, so the script always points
+// at the instance it was loaded from. The tracked domain is taken from the "domain"
+// query parameter, falling back to the "data-domain" script attribute or the page hostname.
+//
+// The script tracks the pageviews, including the history API navigation, the clicks of the outbound links
+// and of the downloads, and the custom events sent by window.analytics("event", name, props).
+func ScriptHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	endpoint, err := json.Marshal(scheme + "://" + r.Host + EventPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	domain, err := json.Marshal(r.URL.Query().Get("domain"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err = scriptTemplate.Execute(&buf, scriptParams{
+		Endpoint: string(endpoint),
+		Domain:   string(domain),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,115 @@
+// Package usage meters the events accepted per tenant and enforces their monthly quotas.
+package usage
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/sites"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned for the events of a tenant over its monthly quota.
+var ErrQuotaExceeded = errors.New("monthly quota is exceeded")
+
+// Month returns the calendar month of t in UTC, which the usage is counted by.
+func Month(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// Meter counts the accepted events of the tenants in the database, enforcing the quotas of the tenants
+// configured in the sites registry.
+//
+// It's safe for concurrent use.
+type Meter struct {
+	db    database.Database
+	sites *sites.Registry
+
+	// mutex serializes the admission, so the quotas aren't exceeded by the concurrent events
+	mutex sync.Mutex
+	rnd   *rand.Rand
+
+	usageEvents    *prometheus.GaugeVec
+	quotaEvents    *prometheus.GaugeVec
+	overQuotaTotal *prometheus.CounterVec
+}
+
+// NewMeter returns new Meter instance.
+func NewMeter(db database.Database, sitesRegistry *sites.Registry) (*Meter, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if sitesRegistry == nil {
+		return nil, errors.New("sites.Registry instance is nil")
+	}
+
+	m := &Meter{
+		db:    db,
+		sites: sitesRegistry,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		usageEvents: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_usage_events",
+			Help: "Number of the events of the tenant accepted in the current month",
+		}, []string{"tenant"}),
+		quotaEvents: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_quota_events",
+			Help: "Monthly quota of the events of the tenant, 0 if unlimited",
+		}, []string{"tenant"}),
+		overQuotaTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tenant_over_quota_events_total",
+			Help: "Total number of the events of the tenant over its quota by the action taken",
+		}, []string{"tenant", "action"}),
+	}
+	prometheus.MustRegister(m.usageEvents, m.quotaEvents, m.overQuotaTotal)
+
+	return m, nil
+}
+
+// Admit counts the event of the tenant received at now, reporting whether it's accepted.
+//
+// ErrQuotaExceeded is returned if the tenant is over its quota and its events are rejected,
+// with OverQuotaSample the events not sampled are dropped without an error.
+func (m *Meter) Admit(ctx context.Context, tenant string, now time.Time) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	month := Month(now)
+	cfg := m.sites.Config().Tenant(tenant)
+	m.quotaEvents.WithLabelValues(tenant).Set(float64(cfg.MonthlyQuota))
+	if cfg.MonthlyQuota > 0 {
+		used, err := m.db.GetUsage(ctx, tenant, month)
+		if err != nil {
+			return false, err
+		}
+		if used >= cfg.MonthlyQuota {
+			if cfg.OverQuota != sites.OverQuotaSample {
+				m.overQuotaTotal.WithLabelValues(tenant, "rejected").Inc()
+				return false, ErrQuotaExceeded
+			}
+			if m.rnd.Float64() >= cfg.SampleRate {
+				m.overQuotaTotal.WithLabelValues(tenant, "dropped").Inc()
+				return false, nil
+			}
+			m.overQuotaTotal.WithLabelValues(tenant, "sampled").Inc()
+		}
+	}
+
+	total, err := m.db.AddUsage(ctx, tenant, month, 1)
+	if err != nil {
+		return false, err
+	}
+	m.usageEvents.WithLabelValues(tenant).Set(float64(total))
+	return true, nil
+}
+
+// Usage returns the amount of the events of the tenant accepted in the month and its quota.
+func (m *Meter) Usage(ctx context.Context, tenant string, month string) (int64, int64, error) {
+	used, err := m.db.GetUsage(ctx, tenant, month)
+	if err != nil {
+		return 0, 0, err
+	}
+	return used, m.sites.Config().Tenant(tenant).MonthlyQuota, nil
+}
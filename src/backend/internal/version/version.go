@@ -0,0 +1,69 @@
+// Package version holds the build metadata of the binary.
+//
+// The values are set at build time with
+//
+//	-ldflags "-X diploma/analytics-exporter/internal/version.Version=... -X ...Commit=... -X ...Date=..."
+//
+// and fall back to the VCS details embedded by the Go toolchain, the version defaults to "dev".
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	// Version is the release version.
+	Version = ""
+	// Commit is the VCS revision.
+	Commit = ""
+	// Date is the build date in RFC 3339.
+	Date = ""
+)
+
+// GoVersion is the version of the Go toolchain the binary was built with.
+var GoVersion = runtime.Version()
+
+func init() {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if Version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && Commit == "":
+				Commit = s.Value
+			case s.Key == "vcs.time" && Date == "":
+				Date = s.Value
+			}
+		}
+	}
+	if Version == "" {
+		Version = "dev"
+	}
+}
+
+// String returns the human-readable build metadata.
+func String() string {
+	return fmt.Sprintf("version: %s\ncommit: %s\nbuild date: %s\ngo version: %s\n",
+		Version, orUnknown(Commit), orUnknown(Date), GoVersion)
+}
+
+// Labels returns the build metadata as the labels of the build info metric.
+func Labels() map[string]string {
+	return map[string]string{
+		"version":   Version,
+		"commit":    orUnknown(Commit),
+		"date":      orUnknown(Date),
+		"goversion": GoVersion,
+	}
+}
+
+// orUnknown returns v or "unknown" if it's empty.
+func orUnknown(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	return v
+}
@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+)
+
+// Config is the webhooks configuration file.
+type Config struct {
+	Webhooks []Target `yaml:"webhooks"`
+}
+
+// Target is an HTTP endpoint receiving the events of a single domain.
+type Target struct {
+	Domain string `yaml:"domain"`
+	URL    string `yaml:"url"`
+	// Secret is the key of the HMAC-SHA256 payload signature, the payload is not signed if empty.
+	Secret string `yaml:"secret"`
+	// Events are the event types delivered to the target, no events are delivered if empty.
+	Events []string `yaml:"events"`
+	// Goals are delivered to the target on every completion.
+	Goals []Goal `yaml:"goals"`
+}
+
+// Goal is completed by an event of the type or by a pageview of the path.
+type Goal struct {
+	Name  string `yaml:"name"`
+	Event string `yaml:"event"`
+	Path  string `yaml:"path"`
+}
+
+// LoadConfig reads and validates the webhooks configuration file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err = yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse webhooks config: %w", err)
+	}
+	for i, t := range cfg.Webhooks {
+		if t.Domain == "" {
+			return nil, fmt.Errorf("webhook %d: domain is missing", i)
+		}
+		if t.URL == "" {
+			return nil, fmt.Errorf("webhook %d: url is missing", i)
+		}
+		for _, g := range t.Goals {
+			if g.Name == "" {
+				return nil, fmt.Errorf("webhook %d: goal name is missing", i)
+			}
+			if (g.Event == "") == (g.Path == "") {
+				return nil, fmt.Errorf("webhook %d: goal %s must define either event or path", i, g.Name)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// matches reports whether the goal is completed by the event of the type with the URL path.
+func (g Goal) matches(eventType string, path string) bool {
+	if g.Event != "" {
+		return g.Event == eventType
+	}
+	return eventType == "pageview" && g.Path == path
+}
@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"time"
+)
+
+// GoalCompletion is the JSON body sent to the webhooks of the site goals.
+//
+// It's a flat object of the event and the visitor context, so the automation tools like Zapier and Make
+// map its fields without parsing the nested event.
+type GoalCompletion struct {
+	Kind    string `json:"kind"`
+	Goal    string `json:"goal"`
+	Domain  string `json:"domain"`
+	EventID string `json:"event_id"`
+	// Event is the type of the event completing the goal
+	Event    string `json:"event"`
+	URL      string `json:"url"`
+	Path     string `json:"path"`
+	Referrer string `json:"referrer"`
+	// Source is the referrer domain, "Direct/None" without a referrer and empty for the internal ones
+	Source string `json:"source"`
+	// Visitor is the visit hash, empty if the event isn't hashed
+	Visitor   string            `json:"visitor"`
+	Browser   string            `json:"browser"`
+	OS        string            `json:"os"`
+	Device    string            `json:"device"`
+	Props     map[string]string `json:"props"`
+	TraceID   string            `json:"trace_id,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// publishGoals queues deliveries of the completions of the site goals with webhooks.
+func (d *Dispatcher) publishGoals(e *analytics.Event, path string) {
+	if d.sites == nil {
+		return
+	}
+	site, ok := d.sites.Get(e.GetDomain())
+	if !ok {
+		return
+	}
+
+	var completion *GoalCompletion
+	for i := range site.Goals {
+		g := &site.Goals[i]
+		if g.Webhook.URL == "" || !g.Completed(e.GetType(), path) {
+			continue
+		}
+		if completion == nil {
+			completion = newGoalCompletion(e, path)
+		}
+		completion.Goal = g.Name
+		d.enqueueKind(&Target{Domain: site.Domain, URL: g.Webhook.URL, Secret: g.Webhook.Secret}, KindGoal, completion)
+	}
+}
+
+// newGoalCompletion returns the completion payload of the event, without the goal.
+func newGoalCompletion(e *analytics.Event, path string) *GoalCompletion {
+	source, _ := prometheus.EventSource(e)
+	props := e.GetProps()
+	if props == nil {
+		props = map[string]string{}
+	}
+	return &GoalCompletion{
+		Kind:      KindGoal,
+		Domain:    e.GetDomain(),
+		EventID:   e.GetID(),
+		Event:     e.GetType(),
+		URL:       e.GetURL(),
+		Path:      path,
+		Referrer:  e.GetReferrer(),
+		Source:    source,
+		Visitor:   e.GetHashedVisit(),
+		Browser:   prometheus.EventBrowser(e),
+		OS:        prometheus.EventOS(e),
+		Device:    prometheus.EventDevice(e),
+		Props:     props,
+		TraceID:   e.GetTraceID(),
+		Timestamp: e.GetTimestamp().AsTime(),
+	}
+}
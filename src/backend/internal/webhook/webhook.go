@@ -0,0 +1,242 @@
+// Package webhook delivers accepted events and goal completions to the configured HTTP targets
+// and to the webhooks of the site goals.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"diploma/analytics-exporter/internal/sites"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Payload kinds
+const (
+	KindEvent = "event"
+	KindGoal  = "goal"
+)
+
+// SignatureHeader holds the hex encoded HMAC-SHA256 of the "<timestamp>.<body>" string.
+const SignatureHeader = "X-Analytics-Signature"
+
+// TimestampHeader holds the unix time the payload was signed at.
+const TimestampHeader = "X-Analytics-Timestamp"
+
+const (
+	// queueSize is an amount of deliveries waiting to be sent before new ones are dropped.
+	queueSize = 1024
+	// workers is an amount of concurrent deliveries.
+	workers = 4
+	// maxAttempts is an amount of delivery attempts, including the first one.
+	maxAttempts = 5
+	// initialBackoff is the delay before the first retry, doubled after every attempt.
+	initialBackoff = time.Second
+)
+
+// Payload is the JSON body sent to the targets.
+type Payload struct {
+	Kind  string          `json:"kind"`
+	Goal  string          `json:"goal,omitempty"`
+	Event json.RawMessage `json:"event"`
+}
+
+// delivery is a payload waiting to be sent to the target.
+type delivery struct {
+	target *Target
+	kind   string
+	body   []byte
+}
+
+// Dispatcher delivers the events to the webhook targets of their domains,
+// and the goal completions to the webhooks of the goals of the sites.
+type Dispatcher struct {
+	targets map[string][]*Target
+	sites   *sites.Registry
+	client  *http.Client
+	queue   chan delivery
+	wg      sync.WaitGroup
+	logger  *zap.Logger
+
+	deliveriesTotal  *prometheus.CounterVec
+	deliveryDuration prometheus.Histogram
+}
+
+// NewDispatcher returns new Dispatcher instance and starts its workers.
+//
+// sitesRegistry may be nil, the goals of the sites aren't delivered then.
+func NewDispatcher(cfg *Config, sitesRegistry *sites.Registry) (*Dispatcher, error) {
+	if cfg == nil {
+		return nil, errors.New("webhooks config is nil")
+	}
+
+	d := &Dispatcher{
+		targets: make(map[string][]*Target),
+		sites:   sitesRegistry,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan delivery, queueSize),
+		logger:  zap.L().Named("webhook"),
+		deliveriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_deliveries_total",
+			Help: "Total number of webhook deliveries by result",
+		}, []string{"domain", "kind", "result"}),
+		deliveryDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "webhook_delivery_duration_seconds",
+			Help:    "Duration of a single webhook delivery attempt",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	prometheus.MustRegister(d.deliveriesTotal, d.deliveryDuration)
+
+	for i := range cfg.Webhooks {
+		t := &cfg.Webhooks[i]
+		d.targets[t.Domain] = append(d.targets[t.Domain], t)
+	}
+
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+
+	return d, nil
+}
+
+// Publish queues deliveries of the event and of the goals it completes.
+func (d *Dispatcher) Publish(e *analytics.Event) {
+	var path string
+	if u, err := url.Parse(e.GetURL()); err == nil {
+		path = u.Path
+	}
+	d.publishGoals(e, path)
+
+	targets := d.targets[e.GetDomain()]
+	if len(targets) == 0 {
+		return
+	}
+
+	event, err := protojson.Marshal(e)
+	if err != nil {
+		d.logger.Error("cannot encode event", zap.String("id", e.GetID()), zap.Error(err))
+		return
+	}
+
+	for _, t := range targets {
+		if slices.Contains(t.Events, e.GetType()) {
+			d.enqueue(t, Payload{Kind: KindEvent, Event: event})
+		}
+		for _, g := range t.Goals {
+			if g.matches(e.GetType(), path) {
+				d.enqueue(t, Payload{Kind: KindGoal, Goal: g.Name, Event: event})
+			}
+		}
+	}
+}
+
+// Shutdown stops accepting deliveries and waits until the queued ones are sent or ctx is done.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.logger.Info("Shutting down webhook dispatcher...")
+	close(d.queue)
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueue queues the payload delivery, dropping it if the queue is full.
+func (d *Dispatcher) enqueue(t *Target, p Payload) {
+	d.enqueueKind(t, p.Kind, p)
+}
+
+// enqueueKind queues the delivery of the payload of the kind, dropping it if the queue is full.
+func (d *Dispatcher) enqueueKind(t *Target, kind string, payload any) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		d.logger.Error("cannot encode payload", zap.Error(err))
+		return
+	}
+
+	select {
+	case d.queue <- delivery{target: t, kind: kind, body: body}:
+	default:
+		d.deliveriesTotal.WithLabelValues(t.Domain, kind, "dropped").Inc()
+	}
+}
+
+// work sends the queued deliveries, retrying the failed ones with exponential backoff.
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for dl := range d.queue {
+		backoff := initialBackoff
+		result := "failed"
+		for attempt := 1; attempt <= maxAttempts; attempt++ {
+			err := d.send(dl)
+			if err == nil {
+				result = "delivered"
+				break
+			}
+			d.logger.Debug("webhook delivery failed",
+				zap.String("url", dl.target.URL), zap.Int("attempt", attempt), zap.Error(err))
+			if attempt < maxAttempts {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+		d.deliveriesTotal.WithLabelValues(dl.target.Domain, dl.kind, result).Inc()
+	}
+}
+
+// send makes a single delivery attempt.
+func (d *Dispatcher) send(dl delivery) error {
+	req, err := http.NewRequest(http.MethodPost, dl.target.URL, bytes.NewReader(dl.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if dl.target.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, "sha256="+Sign(dl.target.Secret, timestamp, dl.body))
+	}
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	d.deliveryDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the "<timestamp>.<body>" string.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
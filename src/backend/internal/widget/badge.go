@@ -0,0 +1,67 @@
+package widget
+
+import (
+	"bytes"
+	"diploma/analytics-exporter/internal/sites"
+	"text/template"
+	"unicode/utf8"
+)
+
+// badgeLabels are the default labels of the badges of the metrics.
+var badgeLabels = map[sites.WidgetMetric]string{
+	sites.WidgetCurrentVisitors: "online now",
+	sites.WidgetVisitorsToday:   "visitors today",
+	sites.WidgetVisitorsMonth:   "visitors this month",
+	sites.WidgetPageViewsMonth:  "page views this month",
+}
+
+const (
+	// charWidth is the approximate width of a character of the badge font.
+	charWidth = 7
+	// padding is the horizontal padding of the badge parts.
+	padding = 10
+	// maxLabel is the amount of the label characters shown.
+	maxLabel = 40
+)
+
+// badgeData is the data of the badge template.
+type badgeData struct {
+	Label, Value           string
+	LabelWidth, ValueWidth int
+	Width, LabelX, ValueX  int
+}
+
+// badgeTemplate is the flat two-part badge the way the README badges look.
+var badgeTemplate = template.Must(template.New("badge").Funcs(template.FuncMap{
+	"xml": template.HTMLEscapeString,
+}).Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="20" role="img" aria-label="{{xml .Label}}: {{xml .Value}}">
+<title>{{xml .Label}}: {{xml .Value}}</title>
+<rect width="{{.LabelWidth}}" height="20" fill="#555"/>
+<rect x="{{.LabelWidth}}" width="{{.ValueWidth}}" height="20" fill="#0969da"/>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="{{.LabelX}}" y="14">{{xml .Label}}</text>
+<text x="{{.ValueX}}" y="14">{{xml .Value}}</text>
+</g>
+</svg>
+`))
+
+// badge returns the SVG badge of the label and the value.
+func badge(label string, value string) []byte {
+	if utf8.RuneCountInString(label) > maxLabel {
+		label = string([]rune(label)[:maxLabel])
+	}
+	d := badgeData{
+		Label:      label,
+		Value:      value,
+		LabelWidth: utf8.RuneCountInString(label)*charWidth + 2*padding,
+		ValueWidth: utf8.RuneCountInString(value)*charWidth + 2*padding,
+	}
+	d.Width = d.LabelWidth + d.ValueWidth
+	d.LabelX = d.LabelWidth / 2
+	d.ValueX = d.LabelWidth + d.ValueWidth/2
+
+	buf := &bytes.Buffer{}
+	// The template only fails on the writes, which don't fail for bytes.Buffer
+	_ = badgeTemplate.Execute(buf, d)
+	return buf.Bytes()
+}
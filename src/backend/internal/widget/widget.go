@@ -0,0 +1,189 @@
+// Package widget implements the public endpoints of the numbers of the sites embedded into their pages.
+package widget
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/database"
+	"diploma/analytics-exporter/internal/prometheus"
+	"diploma/analytics-exporter/internal/sites"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Path is the gateway path the JSON numbers of the widget token are served on.
+	Path = "/api/widget/{token}"
+	// BadgePath is the gateway path the SVG badge of a number of the widget token is served on.
+	BadgePath = "/api/widget/{token}/badge"
+)
+
+// cacheTTL is the period the numbers of a site are reused for, as the widgets are requested on every page view.
+const cacheTTL = time.Minute
+
+// numbers are the computed metrics of a site.
+type numbers struct {
+	values  map[sites.WidgetMetric]int64
+	expires time.Time
+}
+
+// Handler serves the widgets of the sites, they are authorized by the tokens in their paths.
+type Handler struct {
+	db    database.Database
+	sites *sites.Registry
+
+	mutex sync.Mutex
+	// cache are the numbers by the site and the exposed metrics
+	cache map[string]*numbers
+}
+
+// NewHandler returns new Handler instance serving the widgets of the sites of sitesRegistry.
+func NewHandler(db database.Database, sitesRegistry *sites.Registry) (*Handler, error) {
+	if db == nil {
+		return nil, errors.New("database.Database instance is nil")
+	}
+	if sitesRegistry == nil {
+		return nil, errors.New("sites.Registry instance is nil")
+	}
+	return &Handler{db: db, sites: sitesRegistry, cache: make(map[string]*numbers)}, nil
+}
+
+// JSON responds with the exposed numbers of the widget token, e.g. {"domain":"example.com","visitors_month":1234}.
+func (h *Handler) JSON(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	site, widget, ok := h.sites.Widget(params["token"])
+	if !ok {
+		http.Error(w, "widget not found", http.StatusNotFound)
+		return
+	}
+	values, err := h.numbers(r.Context(), site, widget)
+	if err != nil {
+		http.Error(w, "cannot get stats", http.StatusInternalServerError)
+		return
+	}
+
+	res := map[string]any{"domain": site.Domain}
+	for m, v := range values {
+		res[string(m)] = v
+	}
+	setHeaders(w, "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// Badge responds with the SVG badge of the "metric" query parameter of the widget token,
+// labelled with the "label" query parameter or the metric name.
+func (h *Handler) Badge(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	site, widget, ok := h.sites.Widget(params["token"])
+	if !ok {
+		http.Error(w, "widget not found", http.StatusNotFound)
+		return
+	}
+	metric := sites.WidgetMetric(r.URL.Query().Get("metric"))
+	if !widget.Exposes(metric) {
+		http.Error(w, fmt.Sprintf("metric %q isn't exposed by the widget", metric), http.StatusNotFound)
+		return
+	}
+	values, err := h.numbers(r.Context(), site, widget)
+	if err != nil {
+		http.Error(w, "cannot get stats", http.StatusInternalServerError)
+		return
+	}
+
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		label = badgeLabels[metric]
+	}
+	setHeaders(w, "image/svg+xml")
+	_, _ = w.Write(badge(label, strconv.FormatInt(values[metric], 10)))
+}
+
+// setHeaders sets the content type and lets any page embed the cached response.
+func setHeaders(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(cacheTTL.Seconds())))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+}
+
+// numbers returns the metrics exposed by the widget of the site, cached for cacheTTL.
+func (h *Handler) numbers(ctx context.Context, site *sites.Site, widget *sites.Widget) (map[sites.WidgetMetric]int64, error) {
+	metrics := widget.Metrics
+	if len(metrics) == 0 {
+		metrics = sites.WidgetMetrics
+	}
+	key := site.Domain + fmt.Sprint(metrics)
+	now := time.Now()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if n, ok := h.cache[key]; ok && now.Before(n.expires) {
+		return n.values, nil
+	}
+	// The expired entries are dropped, so the removed sites and widgets don't stay in the cache
+	for k, n := range h.cache {
+		if !now.Before(n.expires) {
+			delete(h.cache, k)
+		}
+	}
+
+	values, err := h.compute(ctx, site, metrics, now)
+	if err != nil {
+		return nil, err
+	}
+	h.cache[key] = &numbers{values: values, expires: now.Add(cacheTTL)}
+	return values, nil
+}
+
+// compute returns the metrics of the site at now.
+func (h *Handler) compute(ctx context.Context, site *sites.Site, metrics []sites.WidgetMetric, now time.Time) (map[sites.WidgetMetric]int64, error) {
+	local := now.In(site.Location())
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	month := today.AddDate(0, 0, 1-today.Day())
+
+	// The ranges are shared by the metrics of the same period
+	ranges := make(map[time.Time]*prometheus.AnalyticsStats)
+	stats := func(from time.Time) (*prometheus.AnalyticsStats, error) {
+		if s, ok := ranges[from]; ok {
+			return s, nil
+		}
+		s, err := prometheus.GetAnalyticsStatsRange(ctx, h.db, site.Key(), site.StatsSettings(), from, now)
+		if err != nil {
+			return nil, err
+		}
+		ranges[from] = s
+		return s, nil
+	}
+
+	values := make(map[sites.WidgetMetric]int64, len(metrics))
+	for _, m := range metrics {
+		var from time.Time
+		switch m {
+		case sites.WidgetCurrentVisitors:
+			visitors, err := prometheus.GetCurrentVisitors(ctx, h.db, site.Key(), site.StatsSettings(), now)
+			if err != nil {
+				return nil, err
+			}
+			values[m] = visitors
+			continue
+		case sites.WidgetVisitorsToday:
+			from = today
+		case sites.WidgetVisitorsMonth, sites.WidgetPageViewsMonth:
+			from = month
+		default:
+			continue
+		}
+		s, err := stats(from)
+		if err != nil {
+			return nil, err
+		}
+		switch m {
+		case sites.WidgetVisitorsToday, sites.WidgetVisitorsMonth:
+			values[m] = s.UniqueVisitors
+		case sites.WidgetPageViewsMonth:
+			values[m] = s.TotalPageViews
+		}
+	}
+	return values, nil
+}
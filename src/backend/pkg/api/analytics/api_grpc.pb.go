@@ -21,8 +21,20 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	Analytics_CreateEvent_FullMethodName = "/api.Analytics/CreateEvent"
-	Analytics_ListEvents_FullMethodName  = "/api.Analytics/ListEvents"
+	Analytics_CreateEvent_FullMethodName      = "/api.Analytics/CreateEvent"
+	Analytics_ListEvents_FullMethodName       = "/api.Analytics/ListEvents"
+	Analytics_SubscribeEvents_FullMethodName  = "/api.Analytics/SubscribeEvents"
+	Analytics_ExportEvents_FullMethodName     = "/api.Analytics/ExportEvents"
+	Analytics_Import_FullMethodName           = "/api.Analytics/Import"
+	Analytics_GetStats_FullMethodName         = "/api.Analytics/GetStats"
+	Analytics_SubscribeStats_FullMethodName   = "/api.Analytics/SubscribeStats"
+	Analytics_GetUsage_FullMethodName         = "/api.Analytics/GetUsage"
+	Analytics_CreateSharedLink_FullMethodName = "/api.Analytics/CreateSharedLink"
+	Analytics_CreateAnnotation_FullMethodName = "/api.Analytics/CreateAnnotation"
+	Analytics_ListAnnotations_FullMethodName  = "/api.Analytics/ListAnnotations"
+	Analytics_DeleteAnnotation_FullMethodName = "/api.Analytics/DeleteAnnotation"
+	Analytics_ExportVisitor_FullMethodName    = "/api.Analytics/ExportVisitor"
+	Analytics_DeleteVisitor_FullMethodName    = "/api.Analytics/DeleteVisitor"
 )
 
 // AnalyticsClient is the client API for Analytics service.
@@ -31,6 +43,22 @@ const (
 type AnalyticsClient interface {
 	CreateEvent(ctx context.Context, in *Event, opts ...grpc.CallOption) (*emptypb.Empty, error)
 	ListEvents(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*Events, error)
+	SubscribeEvents(ctx context.Context, in *SubscribeEventsRequest, opts ...grpc.CallOption) (Analytics_SubscribeEventsClient, error)
+	ExportEvents(ctx context.Context, in *ExportEventsRequest, opts ...grpc.CallOption) (Analytics_ExportEventsClient, error)
+	Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportResponse, error)
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error)
+	SubscribeStats(ctx context.Context, in *SubscribeStatsRequest, opts ...grpc.CallOption) (Analytics_SubscribeStatsClient, error)
+	GetUsage(ctx context.Context, in *GetUsageRequest, opts ...grpc.CallOption) (*Usage, error)
+	// CreateSharedLink mints a read-only token of the stats of the domain, which is passed as the API key
+	CreateSharedLink(ctx context.Context, in *CreateSharedLinkRequest, opts ...grpc.CallOption) (*SharedLink, error)
+	// Annotations are the markers of the deployments, the campaigns and the like, returned with the stats
+	CreateAnnotation(ctx context.Context, in *Annotation, opts ...grpc.CallOption) (*Annotation, error)
+	ListAnnotations(ctx context.Context, in *ListAnnotationsRequest, opts ...grpc.CallOption) (*Annotations, error)
+	DeleteAnnotation(ctx context.Context, in *DeleteAnnotationRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// ExportVisitor returns all the stored events of the pseudonymous visitor of the domain, for the data subject access requests
+	ExportVisitor(ctx context.Context, in *ExportVisitorRequest, opts ...grpc.CallOption) (*Events, error)
+	// DeleteVisitor deletes all the stored events of the pseudonymous visitor of the domain, for the data subject erasure requests
+	DeleteVisitor(ctx context.Context, in *DeleteVisitorRequest, opts ...grpc.CallOption) (*DeleteVisitorResponse, error)
 }
 
 type analyticsClient struct {
@@ -59,12 +87,205 @@ func (c *analyticsClient) ListEvents(ctx context.Context, in *wrapperspb.StringV
 	return out, nil
 }
 
+func (c *analyticsClient) SubscribeEvents(ctx context.Context, in *SubscribeEventsRequest, opts ...grpc.CallOption) (Analytics_SubscribeEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Analytics_ServiceDesc.Streams[0], Analytics_SubscribeEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &analyticsSubscribeEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Analytics_SubscribeEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type analyticsSubscribeEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *analyticsSubscribeEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *analyticsClient) ExportEvents(ctx context.Context, in *ExportEventsRequest, opts ...grpc.CallOption) (Analytics_ExportEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Analytics_ServiceDesc.Streams[1], Analytics_ExportEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &analyticsExportEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Analytics_ExportEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type analyticsExportEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *analyticsExportEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *analyticsClient) Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportResponse, error) {
+	out := new(ImportResponse)
+	err := c.cc.Invoke(ctx, Analytics_Import_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error) {
+	out := new(Stats)
+	err := c.cc.Invoke(ctx, Analytics_GetStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) SubscribeStats(ctx context.Context, in *SubscribeStatsRequest, opts ...grpc.CallOption) (Analytics_SubscribeStatsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Analytics_ServiceDesc.Streams[2], Analytics_SubscribeStats_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &analyticsSubscribeStatsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Analytics_SubscribeStatsClient interface {
+	Recv() (*Stats, error)
+	grpc.ClientStream
+}
+
+type analyticsSubscribeStatsClient struct {
+	grpc.ClientStream
+}
+
+func (x *analyticsSubscribeStatsClient) Recv() (*Stats, error) {
+	m := new(Stats)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *analyticsClient) GetUsage(ctx context.Context, in *GetUsageRequest, opts ...grpc.CallOption) (*Usage, error) {
+	out := new(Usage)
+	err := c.cc.Invoke(ctx, Analytics_GetUsage_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) CreateSharedLink(ctx context.Context, in *CreateSharedLinkRequest, opts ...grpc.CallOption) (*SharedLink, error) {
+	out := new(SharedLink)
+	err := c.cc.Invoke(ctx, Analytics_CreateSharedLink_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) CreateAnnotation(ctx context.Context, in *Annotation, opts ...grpc.CallOption) (*Annotation, error) {
+	out := new(Annotation)
+	err := c.cc.Invoke(ctx, Analytics_CreateAnnotation_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) ListAnnotations(ctx context.Context, in *ListAnnotationsRequest, opts ...grpc.CallOption) (*Annotations, error) {
+	out := new(Annotations)
+	err := c.cc.Invoke(ctx, Analytics_ListAnnotations_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) DeleteAnnotation(ctx context.Context, in *DeleteAnnotationRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Analytics_DeleteAnnotation_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) ExportVisitor(ctx context.Context, in *ExportVisitorRequest, opts ...grpc.CallOption) (*Events, error) {
+	out := new(Events)
+	err := c.cc.Invoke(ctx, Analytics_ExportVisitor_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) DeleteVisitor(ctx context.Context, in *DeleteVisitorRequest, opts ...grpc.CallOption) (*DeleteVisitorResponse, error) {
+	out := new(DeleteVisitorResponse)
+	err := c.cc.Invoke(ctx, Analytics_DeleteVisitor_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // AnalyticsServer is the server API for Analytics service.
 // All implementations must embed UnimplementedAnalyticsServer
 // for forward compatibility
 type AnalyticsServer interface {
 	CreateEvent(context.Context, *Event) (*emptypb.Empty, error)
 	ListEvents(context.Context, *wrapperspb.StringValue) (*Events, error)
+	SubscribeEvents(*SubscribeEventsRequest, Analytics_SubscribeEventsServer) error
+	ExportEvents(*ExportEventsRequest, Analytics_ExportEventsServer) error
+	Import(context.Context, *ImportRequest) (*ImportResponse, error)
+	GetStats(context.Context, *GetStatsRequest) (*Stats, error)
+	SubscribeStats(*SubscribeStatsRequest, Analytics_SubscribeStatsServer) error
+	GetUsage(context.Context, *GetUsageRequest) (*Usage, error)
+	// CreateSharedLink mints a read-only token of the stats of the domain, which is passed as the API key
+	CreateSharedLink(context.Context, *CreateSharedLinkRequest) (*SharedLink, error)
+	// Annotations are the markers of the deployments, the campaigns and the like, returned with the stats
+	CreateAnnotation(context.Context, *Annotation) (*Annotation, error)
+	ListAnnotations(context.Context, *ListAnnotationsRequest) (*Annotations, error)
+	DeleteAnnotation(context.Context, *DeleteAnnotationRequest) (*emptypb.Empty, error)
+	// ExportVisitor returns all the stored events of the pseudonymous visitor of the domain, for the data subject access requests
+	ExportVisitor(context.Context, *ExportVisitorRequest) (*Events, error)
+	// DeleteVisitor deletes all the stored events of the pseudonymous visitor of the domain, for the data subject erasure requests
+	DeleteVisitor(context.Context, *DeleteVisitorRequest) (*DeleteVisitorResponse, error)
 	mustEmbedUnimplementedAnalyticsServer()
 }
 
@@ -78,6 +299,42 @@ func (UnimplementedAnalyticsServer) CreateEvent(context.Context, *Event) (*empty
 func (UnimplementedAnalyticsServer) ListEvents(context.Context, *wrapperspb.StringValue) (*Events, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListEvents not implemented")
 }
+func (UnimplementedAnalyticsServer) SubscribeEvents(*SubscribeEventsRequest, Analytics_SubscribeEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeEvents not implemented")
+}
+func (UnimplementedAnalyticsServer) ExportEvents(*ExportEventsRequest, Analytics_ExportEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExportEvents not implemented")
+}
+func (UnimplementedAnalyticsServer) Import(context.Context, *ImportRequest) (*ImportResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Import not implemented")
+}
+func (UnimplementedAnalyticsServer) GetStats(context.Context, *GetStatsRequest) (*Stats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedAnalyticsServer) SubscribeStats(*SubscribeStatsRequest, Analytics_SubscribeStatsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeStats not implemented")
+}
+func (UnimplementedAnalyticsServer) GetUsage(context.Context, *GetUsageRequest) (*Usage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsage not implemented")
+}
+func (UnimplementedAnalyticsServer) CreateSharedLink(context.Context, *CreateSharedLinkRequest) (*SharedLink, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateSharedLink not implemented")
+}
+func (UnimplementedAnalyticsServer) CreateAnnotation(context.Context, *Annotation) (*Annotation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateAnnotation not implemented")
+}
+func (UnimplementedAnalyticsServer) ListAnnotations(context.Context, *ListAnnotationsRequest) (*Annotations, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAnnotations not implemented")
+}
+func (UnimplementedAnalyticsServer) DeleteAnnotation(context.Context, *DeleteAnnotationRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteAnnotation not implemented")
+}
+func (UnimplementedAnalyticsServer) ExportVisitor(context.Context, *ExportVisitorRequest) (*Events, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExportVisitor not implemented")
+}
+func (UnimplementedAnalyticsServer) DeleteVisitor(context.Context, *DeleteVisitorRequest) (*DeleteVisitorResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteVisitor not implemented")
+}
 func (UnimplementedAnalyticsServer) mustEmbedUnimplementedAnalyticsServer() {}
 
 // UnsafeAnalyticsServer may be embedded to opt out of forward compatibility for this service.
@@ -127,6 +384,231 @@ func _Analytics_ListEvents_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Analytics_SubscribeEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AnalyticsServer).SubscribeEvents(m, &analyticsSubscribeEventsServer{stream})
+}
+
+type Analytics_SubscribeEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type analyticsSubscribeEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *analyticsSubscribeEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Analytics_ExportEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AnalyticsServer).ExportEvents(m, &analyticsExportEventsServer{stream})
+}
+
+type Analytics_ExportEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type analyticsExportEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *analyticsExportEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Analytics_Import_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ImportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).Import(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Analytics_Import_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).Import(ctx, req.(*ImportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Analytics_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_SubscribeStats_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeStatsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AnalyticsServer).SubscribeStats(m, &analyticsSubscribeStatsServer{stream})
+}
+
+type Analytics_SubscribeStatsServer interface {
+	Send(*Stats) error
+	grpc.ServerStream
+}
+
+type analyticsSubscribeStatsServer struct {
+	grpc.ServerStream
+}
+
+func (x *analyticsSubscribeStatsServer) Send(m *Stats) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Analytics_GetUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).GetUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Analytics_GetUsage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).GetUsage(ctx, req.(*GetUsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_CreateSharedLink_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateSharedLinkRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).CreateSharedLink(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Analytics_CreateSharedLink_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).CreateSharedLink(ctx, req.(*CreateSharedLinkRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_CreateAnnotation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Annotation)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).CreateAnnotation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Analytics_CreateAnnotation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).CreateAnnotation(ctx, req.(*Annotation))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_ListAnnotations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAnnotationsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).ListAnnotations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Analytics_ListAnnotations_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).ListAnnotations(ctx, req.(*ListAnnotationsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_DeleteAnnotation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteAnnotationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).DeleteAnnotation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Analytics_DeleteAnnotation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).DeleteAnnotation(ctx, req.(*DeleteAnnotationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_ExportVisitor_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportVisitorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).ExportVisitor(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Analytics_ExportVisitor_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).ExportVisitor(ctx, req.(*ExportVisitorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_DeleteVisitor_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteVisitorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).DeleteVisitor(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Analytics_DeleteVisitor_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).DeleteVisitor(ctx, req.(*DeleteVisitorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Analytics_ServiceDesc is the grpc.ServiceDesc for Analytics service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -142,7 +624,59 @@ var Analytics_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ListEvents",
 			Handler:    _Analytics_ListEvents_Handler,
 		},
+		{
+			MethodName: "Import",
+			Handler:    _Analytics_Import_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _Analytics_GetStats_Handler,
+		},
+		{
+			MethodName: "GetUsage",
+			Handler:    _Analytics_GetUsage_Handler,
+		},
+		{
+			MethodName: "CreateSharedLink",
+			Handler:    _Analytics_CreateSharedLink_Handler,
+		},
+		{
+			MethodName: "CreateAnnotation",
+			Handler:    _Analytics_CreateAnnotation_Handler,
+		},
+		{
+			MethodName: "ListAnnotations",
+			Handler:    _Analytics_ListAnnotations_Handler,
+		},
+		{
+			MethodName: "DeleteAnnotation",
+			Handler:    _Analytics_DeleteAnnotation_Handler,
+		},
+		{
+			MethodName: "ExportVisitor",
+			Handler:    _Analytics_ExportVisitor_Handler,
+		},
+		{
+			MethodName: "DeleteVisitor",
+			Handler:    _Analytics_DeleteVisitor_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubscribeEvents",
+			Handler:       _Analytics_SubscribeEvents_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ExportEvents",
+			Handler:       _Analytics_ExportEvents_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SubscribeStats",
+			Handler:       _Analytics_SubscribeStats_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "api/analytics/api.proto",
 }
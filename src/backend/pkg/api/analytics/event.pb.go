@@ -10,6 +10,7 @@ import (
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
 	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	wrapperspb "google.golang.org/protobuf/types/known/wrapperspb"
 	reflect "reflect"
 	sync "sync"
 )
@@ -21,24 +22,35 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
-// TODO: remove the ID and the Timestamp from the message or change them so they cannot be set externally
 type Event struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	ID          string                 `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
-	Type        string                 `protobuf:"bytes,2,opt,name=Type,json=type,proto3" json:"Type,omitempty"`
-	URL         string                 `protobuf:"bytes,3,opt,name=URL,json=url,proto3" json:"URL,omitempty"`
-	Domain      string                 `protobuf:"bytes,4,opt,name=Domain,json=domain,proto3" json:"Domain,omitempty"`
-	Referrer    string                 `protobuf:"bytes,5,opt,name=Referrer,json=referrer,proto3" json:"Referrer,omitempty"`
-	Browser     string                 `protobuf:"bytes,6,opt,name=Browser,proto3" json:"Browser,omitempty"`
-	OS          string                 `protobuf:"bytes,7,opt,name=OS,proto3" json:"OS,omitempty"`
-	Device      *Device                `protobuf:"bytes,8,opt,name=Device,proto3" json:"Device,omitempty"`
-	HashedVisit string                 `protobuf:"bytes,10,opt,name=HashedVisit,proto3" json:"HashedVisit,omitempty"`
-	Meta        map[string]string      `protobuf:"bytes,20,rep,name=Meta,json=meta,proto3" json:"Meta,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
-	Props       map[string]string      `protobuf:"bytes,21,rep,name=Props,json=props,proto3" json:"Props,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
-	Timestamp   *timestamppb.Timestamp `protobuf:"bytes,22,opt,name=Timestamp,proto3" json:"Timestamp,omitempty"`
+	// ID is the UUID of the event, it's generated by the service unless the client sends one,
+	// so the events retried by the clients are stored once
+	ID          string            `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	Type        string            `protobuf:"bytes,2,opt,name=Type,json=type,proto3" json:"Type,omitempty"`
+	URL         string            `protobuf:"bytes,3,opt,name=URL,json=url,proto3" json:"URL,omitempty"`
+	Domain      string            `protobuf:"bytes,4,opt,name=Domain,json=domain,proto3" json:"Domain,omitempty"`
+	Referrer    string            `protobuf:"bytes,5,opt,name=Referrer,json=referrer,proto3" json:"Referrer,omitempty"`
+	Browser     string            `protobuf:"bytes,6,opt,name=Browser,proto3" json:"Browser,omitempty"`
+	OS          string            `protobuf:"bytes,7,opt,name=OS,proto3" json:"OS,omitempty"`
+	Device      *Device           `protobuf:"bytes,8,opt,name=Device,proto3" json:"Device,omitempty"`
+	HashedVisit string            `protobuf:"bytes,10,opt,name=HashedVisit,proto3" json:"HashedVisit,omitempty"`
+	Meta        map[string]string `protobuf:"bytes,20,rep,name=Meta,json=meta,proto3" json:"Meta,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Props       map[string]string `protobuf:"bytes,21,rep,name=Props,json=props,proto3" json:"Props,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// Timestamp is the time the event happened at, the server time unless the client sends an accepted one
+	Timestamp *timestamppb.Timestamp `protobuf:"bytes,22,opt,name=Timestamp,proto3" json:"Timestamp,omitempty"`
+	// Tenant is the tenant of the site the event is stored for, it's set by the service
+	Tenant string `protobuf:"bytes,23,opt,name=Tenant,json=tenant,proto3" json:"Tenant,omitempty"`
+	// Consent is whether the visitor consented to the tracking, assumed if unset. The events without it
+	// are counted in the aggregates only, they are stored without the visitor hash and the props
+	Consent *wrapperspb.BoolValue `protobuf:"bytes,24,opt,name=Consent,json=consent,proto3" json:"Consent,omitempty"`
+	// TraceID is the hex encoded W3C trace ID of the traceparent the event was sent with, it's set by the service
+	TraceID string `protobuf:"bytes,25,opt,name=TraceID,json=trace_id,proto3" json:"TraceID,omitempty"`
+	// ClientTimestamp is whether the Timestamp is the one sent by the client, it's set by the service
+	ClientTimestamp bool `protobuf:"varint,26,opt,name=ClientTimestamp,json=client_timestamp,proto3" json:"ClientTimestamp,omitempty"`
 }
 
 func (x *Event) Reset() {
@@ -157,6 +169,34 @@ func (x *Event) GetTimestamp() *timestamppb.Timestamp {
 	return nil
 }
 
+func (x *Event) GetTenant() string {
+	if x != nil {
+		return x.Tenant
+	}
+	return ""
+}
+
+func (x *Event) GetConsent() *wrapperspb.BoolValue {
+	if x != nil {
+		return x.Consent
+	}
+	return nil
+}
+
+func (x *Event) GetTraceID() string {
+	if x != nil {
+		return x.TraceID
+	}
+	return ""
+}
+
+func (x *Event) GetClientTimestamp() bool {
+	if x != nil {
+		return x.ClientTimestamp
+	}
+	return false
+}
+
 type Device struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -168,6 +208,7 @@ type Device struct {
 	//	*Device_Mobile
 	//	*Device_Desktop
 	//	*Device_Bot
+	//	*Device_Unknown
 	Device isDevice_Device `protobuf_oneof:"Device"`
 }
 
@@ -238,6 +279,13 @@ func (x *Device) GetBot() bool {
 	return false
 }
 
+func (x *Device) GetUnknown() bool {
+	if x, ok := x.GetDevice().(*Device_Unknown); ok {
+		return x.Unknown
+	}
+	return false
+}
+
 type isDevice_Device interface {
 	isDevice_Device()
 }
@@ -258,6 +306,11 @@ type Device_Bot struct {
 	Bot bool `protobuf:"varint,4,opt,name=Bot,proto3,oneof"`
 }
 
+type Device_Unknown struct {
+	// Unknown is set for the events whose device can't be classified, so they're never left without one
+	Unknown bool `protobuf:"varint,5,opt,name=Unknown,proto3,oneof"`
+}
+
 func (*Device_Tablet) isDevice_Device() {}
 
 func (*Device_Mobile) isDevice_Device() {}
@@ -266,6 +319,8 @@ func (*Device_Desktop) isDevice_Device() {}
 
 func (*Device_Bot) isDevice_Device() {}
 
+func (*Device_Unknown) isDevice_Device() {}
+
 type Events struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -320,7 +375,9 @@ var file_api_analytics_event_proto_rawDesc = []byte{
 	0x65, 0x76, 0x65, 0x6e, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x03, 0x61, 0x70, 0x69,
 	0x1a, 0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75,
 	0x66, 0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x22, 0xe6, 0x03, 0x0a, 0x05, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x49,
+	0x6f, 0x1a, 0x1e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2f, 0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x22, 0xfa, 0x04, 0x0a, 0x05, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x49,
 	0x44, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x49, 0x44, 0x12, 0x12, 0x0a, 0x04, 0x54,
 	0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12,
 	0x10, 0x0a, 0x03, 0x55, 0x52, 0x4c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x75, 0x72,
@@ -343,28 +400,39 @@ var file_api_analytics_event_proto_rawDesc = []byte{
 	0x09, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x16, 0x20, 0x01, 0x28, 0x0b,
 	0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
 	0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x09, 0x54, 0x69,
-	0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x1a, 0x37, 0x0a, 0x09, 0x4d, 0x65, 0x74, 0x61, 0x45,
-	0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18,
-	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01,
-	0x1a, 0x38, 0x0a, 0x0a, 0x50, 0x72, 0x6f, 0x70, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10,
-	0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79,
-	0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x76, 0x0a, 0x06, 0x44, 0x65,
-	0x76, 0x69, 0x63, 0x65, 0x12, 0x18, 0x0a, 0x06, 0x54, 0x61, 0x62, 0x6c, 0x65, 0x74, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x08, 0x48, 0x00, 0x52, 0x06, 0x54, 0x61, 0x62, 0x6c, 0x65, 0x74, 0x12, 0x18,
-	0x0a, 0x06, 0x4d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x48, 0x00,
-	0x52, 0x06, 0x4d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x12, 0x1a, 0x0a, 0x07, 0x44, 0x65, 0x73, 0x6b,
-	0x74, 0x6f, 0x70, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x48, 0x00, 0x52, 0x07, 0x44, 0x65, 0x73,
-	0x6b, 0x74, 0x6f, 0x70, 0x12, 0x12, 0x0a, 0x03, 0x42, 0x6f, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28,
-	0x08, 0x48, 0x00, 0x52, 0x03, 0x42, 0x6f, 0x74, 0x42, 0x08, 0x0a, 0x06, 0x44, 0x65, 0x76, 0x69,
-	0x63, 0x65, 0x22, 0x2c, 0x0a, 0x06, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x22, 0x0a, 0x06,
-	0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0a, 0x2e, 0x61,
-	0x70, 0x69, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x52, 0x06, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73,
-	0x42, 0x2e, 0x5a, 0x2c, 0x64, 0x69, 0x70, 0x6c, 0x6f, 0x6d, 0x61, 0x2f, 0x61, 0x6e, 0x61, 0x6c,
-	0x79, 0x74, 0x69, 0x63, 0x73, 0x2d, 0x65, 0x78, 0x70, 0x6f, 0x72, 0x74, 0x65, 0x72, 0x2f, 0x70,
-	0x6b, 0x67, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x61, 0x6e, 0x61, 0x6c, 0x79, 0x74, 0x69, 0x63, 0x73,
-	0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x16, 0x0a, 0x06, 0x54, 0x65, 0x6e, 0x61, 0x6e,
+	0x74, 0x18, 0x17, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x74, 0x65, 0x6e, 0x61, 0x6e, 0x74, 0x12,
+	0x34, 0x0a, 0x07, 0x43, 0x6f, 0x6e, 0x73, 0x65, 0x6e, 0x74, 0x18, 0x18, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2e, 0x42, 0x6f, 0x6f, 0x6c, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x52, 0x07, 0x63, 0x6f,
+	0x6e, 0x73, 0x65, 0x6e, 0x74, 0x12, 0x19, 0x0a, 0x07, 0x54, 0x72, 0x61, 0x63, 0x65, 0x49, 0x44,
+	0x18, 0x19, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x74, 0x72, 0x61, 0x63, 0x65, 0x5f, 0x69, 0x64,
+	0x12, 0x29, 0x0a, 0x0f, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74,
+	0x61, 0x6d, 0x70, 0x18, 0x1a, 0x20, 0x01, 0x28, 0x08, 0x52, 0x10, 0x63, 0x6c, 0x69, 0x65, 0x6e,
+	0x74, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x1a, 0x37, 0x0a, 0x09, 0x4d,
+	0x65, 0x74, 0x61, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61,
+	0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65,
+	0x3a, 0x02, 0x38, 0x01, 0x1a, 0x38, 0x0a, 0x0a, 0x50, 0x72, 0x6f, 0x70, 0x73, 0x45, 0x6e, 0x74,
+	0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x92,
+	0x01, 0x0a, 0x06, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x12, 0x18, 0x0a, 0x06, 0x54, 0x61, 0x62,
+	0x6c, 0x65, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x08, 0x48, 0x00, 0x52, 0x06, 0x54, 0x61, 0x62,
+	0x6c, 0x65, 0x74, 0x12, 0x18, 0x0a, 0x06, 0x4d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x08, 0x48, 0x00, 0x52, 0x06, 0x4d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x12, 0x1a, 0x0a,
+	0x07, 0x44, 0x65, 0x73, 0x6b, 0x74, 0x6f, 0x70, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x48, 0x00,
+	0x52, 0x07, 0x44, 0x65, 0x73, 0x6b, 0x74, 0x6f, 0x70, 0x12, 0x12, 0x0a, 0x03, 0x42, 0x6f, 0x74,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x48, 0x00, 0x52, 0x03, 0x42, 0x6f, 0x74, 0x12, 0x1a, 0x0a,
+	0x07, 0x55, 0x6e, 0x6b, 0x6e, 0x6f, 0x77, 0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x48, 0x00,
+	0x52, 0x07, 0x55, 0x6e, 0x6b, 0x6e, 0x6f, 0x77, 0x6e, 0x42, 0x08, 0x0a, 0x06, 0x44, 0x65, 0x76,
+	0x69, 0x63, 0x65, 0x22, 0x2c, 0x0a, 0x06, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x22, 0x0a,
+	0x06, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0a, 0x2e,
+	0x61, 0x70, 0x69, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x52, 0x06, 0x45, 0x76, 0x65, 0x6e, 0x74,
+	0x73, 0x42, 0x2e, 0x5a, 0x2c, 0x64, 0x69, 0x70, 0x6c, 0x6f, 0x6d, 0x61, 0x2f, 0x61, 0x6e, 0x61,
+	0x6c, 0x79, 0x74, 0x69, 0x63, 0x73, 0x2d, 0x65, 0x78, 0x70, 0x6f, 0x72, 0x74, 0x65, 0x72, 0x2f,
+	0x70, 0x6b, 0x67, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x61, 0x6e, 0x61, 0x6c, 0x79, 0x74, 0x69, 0x63,
+	0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -387,18 +455,20 @@ var file_api_analytics_event_proto_goTypes = []interface{}{
 	nil,                           // 3: api.Event.MetaEntry
 	nil,                           // 4: api.Event.PropsEntry
 	(*timestamppb.Timestamp)(nil), // 5: google.protobuf.Timestamp
+	(*wrapperspb.BoolValue)(nil),  // 6: google.protobuf.BoolValue
 }
 var file_api_analytics_event_proto_depIdxs = []int32{
 	1, // 0: api.Event.Device:type_name -> api.Device
 	3, // 1: api.Event.Meta:type_name -> api.Event.MetaEntry
 	4, // 2: api.Event.Props:type_name -> api.Event.PropsEntry
 	5, // 3: api.Event.Timestamp:type_name -> google.protobuf.Timestamp
-	0, // 4: api.Events.Events:type_name -> api.Event
-	5, // [5:5] is the sub-list for method output_type
-	5, // [5:5] is the sub-list for method input_type
-	5, // [5:5] is the sub-list for extension type_name
-	5, // [5:5] is the sub-list for extension extendee
-	0, // [0:5] is the sub-list for field type_name
+	6, // 4: api.Event.Consent:type_name -> google.protobuf.BoolValue
+	0, // 5: api.Events.Events:type_name -> api.Event
+	6, // [6:6] is the sub-list for method output_type
+	6, // [6:6] is the sub-list for method input_type
+	6, // [6:6] is the sub-list for extension type_name
+	6, // [6:6] is the sub-list for extension extendee
+	0, // [0:6] is the sub-list for field type_name
 }
 
 func init() { file_api_analytics_event_proto_init() }
@@ -449,6 +519,7 @@ func file_api_analytics_event_proto_init() {
 		(*Device_Mobile)(nil),
 		(*Device_Desktop)(nil),
 		(*Device_Bot)(nil),
+		(*Device_Unknown)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
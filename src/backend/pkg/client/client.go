@@ -0,0 +1,273 @@
+// Package client is the Go client of the event service, reporting the server-side events over gRPC.
+//
+// The events are sent right away by TrackPageview and TrackEvent, or queued by Enqueue and sent
+// in batches from the background, which never blocks the caller.
+package client
+
+import (
+	"context"
+	"diploma/analytics-exporter/internal/grpcwrap"
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"errors"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"time"
+)
+
+// Default settings of the client.
+const (
+	DefaultBatchSize     = 100
+	DefaultFlushInterval = 5 * time.Second
+	DefaultQueueSize     = 10000
+	// DefaultUserAgent is sent for the visitors without the user agent, the service requires one.
+	DefaultUserAgent = "analytics-exporter-go-client"
+)
+
+var (
+	// ErrQueueFull is returned by Enqueue when the queue is full, the event is dropped.
+	ErrQueueFull = errors.New("event queue is full")
+	// ErrClosed is returned by the calls after Close.
+	ErrClosed = errors.New("client is closed")
+)
+
+// Options are the settings of the client, the zero values are replaced by the defaults.
+type Options struct {
+	// TLS enables the transport security of the connection.
+	TLS bool
+	// APIKey is sent as the bearer token with every call, nothing is sent if it's empty.
+	APIKey string
+	// BatchSize is the number of the queued events sending of which is started right away.
+	BatchSize int
+	// FlushInterval is the time after which the queued events are sent.
+	FlushInterval time.Duration
+	// QueueSize is the maximal number of the queued events.
+	QueueSize int
+	// OnError receives the errors of sending the queued events, they are dropped if it's nil.
+	OnError func(e *analytics.Event, err error)
+}
+
+// Visitor is the visitor the event is reported on behalf of, taken from the original request
+// of the visitor, so the service hashes the visitors the same way as for the events of the tracker script.
+type Visitor struct {
+	// IP is the client address of the visitor.
+	IP string
+	// UserAgent is the user agent of the visitor, DefaultUserAgent is sent if it's empty.
+	UserAgent string
+	// TraceParent is the W3C traceparent of the request, the service stores its trace ID with the event.
+	TraceParent string
+}
+
+// queued is an event waiting in the queue.
+type queued struct {
+	event   *analytics.Event
+	visitor Visitor
+}
+
+// Client reports the events to the event service.
+//
+// It's safe for concurrent use.
+type Client struct {
+	conn *grpc.ClientConn
+	api  analytics.AnalyticsClient
+	opts Options
+
+	queue  chan queued
+	batch  chan struct{}
+	flush  chan chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// New returns new Client instance connected to the gRPC address of the service.
+func New(addr string, opts Options) (*Client, error) {
+	if addr == "" {
+		return nil, errors.New("address is missing")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+
+	conn, err := grpcwrap.NewClientConn(addr, opts.TLS, grpcwrap.WithAPIKey(opts.APIKey))
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:  conn,
+		api:   analytics.NewAnalyticsClient(conn),
+		opts:  opts,
+		queue: make(chan queued, opts.QueueSize),
+		batch: make(chan struct{}, 1),
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.run()
+	return c, nil
+}
+
+// TrackPageview sends the pageview of the URL of the domain.
+func (c *Client) TrackPageview(ctx context.Context, domain string, url string, referrer string, v Visitor) error {
+	return c.TrackEvent(ctx, &analytics.Event{
+		Type:     "pageview",
+		Domain:   domain,
+		URL:      url,
+		Referrer: referrer,
+	}, v)
+}
+
+// TrackEvent sends the event, its timestamp is set by the service. Its ID is generated unless it's set,
+// so the retries of the event are stored once.
+func (c *Client) TrackEvent(ctx context.Context, e *analytics.Event, v Visitor) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	return c.send(ctx, e, v)
+}
+
+// Enqueue queues the event to be sent from the background, it's stored with the time it's sent at.
+// It returns ErrQueueFull without blocking if the queue is full.
+func (c *Client) Enqueue(e *analytics.Event, v Visitor) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	select {
+	case c.queue <- queued{event: e, visitor: v}:
+	default:
+		return ErrQueueFull
+	}
+	if len(c.queue) >= c.opts.BatchSize {
+		select {
+		case c.batch <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush sends the queued events, waiting until they are sent or ctx is done.
+func (c *Client) Flush(ctx context.Context) error {
+	c.mutex.RLock()
+	if c.closed {
+		c.mutex.RUnlock()
+		return ErrClosed
+	}
+	sent := make(chan struct{})
+	select {
+	case c.flush <- sent:
+	case <-ctx.Done():
+		c.mutex.RUnlock()
+		return ctx.Err()
+	}
+	c.mutex.RUnlock()
+
+	select {
+	case <-sent:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends the queued events and closes the connection, the events still queued when ctx is done are dropped.
+func (c *Client) Close(ctx context.Context) error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mutex.Unlock()
+
+	close(c.done)
+	stopped := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(stopped)
+	}()
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// run sends the queued events every flush interval, when a batch is queued, on Flush and on Close.
+func (c *Client) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			c.drain()
+			return
+		case sent := <-c.flush:
+			c.drain()
+			close(sent)
+		case <-c.batch:
+			c.drain()
+		case <-ticker.C:
+			c.drain()
+		}
+	}
+}
+
+// drain sends the events queued at the moment.
+func (c *Client) drain() {
+	for n := len(c.queue); n > 0; n-- {
+		c.sendQueued(<-c.queue)
+	}
+}
+
+// sendQueued sends the queued event, reporting the failure to OnError.
+func (c *Client) sendQueued(q queued) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.FlushInterval)
+	defer cancel()
+	if err := c.send(ctx, q.event, q.visitor); err != nil && c.opts.OnError != nil {
+		c.opts.OnError(q.event, err)
+	}
+}
+
+// send sends the event with the visitor details in the metadata, the way the gateway passes them.
+func (c *Client) send(ctx context.Context, e *analytics.Event, v Visitor) error {
+	userAgent := v.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "grpcgateway-user-agent", userAgent)
+	if v.IP != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", v.IP)
+	}
+	if v.TraceParent != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "traceparent", v.TraceParent)
+	}
+	if e.GetID() == "" {
+		e = proto.Clone(e).(*analytics.Event)
+		e.ID = uuid.New().String()
+	}
+	_, err := c.api.CreateEvent(ctx, e)
+	return err
+}
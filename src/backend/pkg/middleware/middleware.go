@@ -0,0 +1,139 @@
+// Package middleware reports the pageviews of the Go web applications to the event service,
+// queueing them with the client of pkg/client, so the requests aren't slowed down.
+package middleware
+
+import (
+	"diploma/analytics-exporter/pkg/api/analytics"
+	"diploma/analytics-exporter/pkg/client"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Config holds the middleware settings.
+type Config struct {
+	// Domain is the domain of the site the pageviews are reported for.
+	Domain string
+	// SampleRate is the share of the reported pageviews between 0 and 1, all of them are reported if it's zero.
+	SampleRate float64
+	// ExcludePaths are the path prefixes which aren't reported, e.g. /healthz or /static/.
+	ExcludePaths []string
+	// ExcludeUserAgents are the substrings of the user agents which aren't reported, matched case-insensitively.
+	ExcludeUserAgents []string
+	// Exclude is the custom rule, the requests it returns true for aren't reported.
+	Exclude func(r *http.Request) bool
+	// TrustProxy takes the client address and the scheme from the X-Forwarded-For and the X-Forwarded-Proto
+	// headers, it must be set only behind a proxy setting them.
+	TrustProxy bool
+}
+
+// New returns the middleware reporting the pageviews of the successful GET requests with the client.
+func New(c *client.Client, cfg Config) (func(http.Handler) http.Handler, error) {
+	if c == nil {
+		return nil, errors.New("client.Client instance is nil")
+	}
+	if cfg.Domain == "" {
+		return nil, errors.New("domain is missing")
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, errors.New("sample rate must be between 0 and 1")
+	}
+	userAgents := make([]string, len(cfg.ExcludeUserAgents))
+	for i, ua := range cfg.ExcludeUserAgents {
+		userAgents[i] = strings.ToLower(ua)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !cfg.tracks(r, userAgents) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			if rec.status >= http.StatusBadRequest {
+				return
+			}
+			// The failures are reported to the OnError of the client
+			_ = c.Enqueue(&analytics.Event{
+				Type:     "pageview",
+				Domain:   cfg.Domain,
+				URL:      cfg.url(r),
+				Referrer: r.Referer(),
+			}, client.Visitor{IP: cfg.clientIP(r), UserAgent: r.UserAgent(), TraceParent: r.Header.Get("Traceparent")})
+		})
+	}, nil
+}
+
+// tracks reports whether the pageview of the request is reported, before it's served.
+func (cfg *Config) tracks(r *http.Request, userAgents []string) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	for _, prefix := range cfg.ExcludePaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+	if len(userAgents) > 0 {
+		ua := strings.ToLower(r.UserAgent())
+		for _, excluded := range userAgents {
+			if strings.Contains(ua, excluded) {
+				return false
+			}
+		}
+	}
+	if cfg.Exclude != nil && cfg.Exclude(r) {
+		return false
+	}
+	return cfg.SampleRate == 0 || rand.Float64() < cfg.SampleRate
+}
+
+// url returns the full URL of the request.
+func (cfg *Config) url(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); cfg.TrustProxy && (proto == "http" || proto == "https") {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// clientIP returns the address of the client of the request.
+func (cfg *Config) clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); cfg.TrustProxy && forwarded != "" {
+		ip, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(ip)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder is http.ResponseWriter recording the status of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the underlying http.ResponseWriter, so http.ResponseController reaches it.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}